@@ -0,0 +1,163 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+var staffActivityRe = regexp.MustCompile(`^/staff/([^/]+)/activity$`)
+
+// activitySummary counts what one staff member did over a period. Voids,
+// refunds and payments are read from the order snapshots on each change, so
+// they are counted whichever endpoint made the change. Discounts counts
+// audited actions named for a discount.
+type activitySummary struct {
+	StaffID       string         `json:"staff_id"`
+	Name          string         `json:"name"`
+	Role          string         `json:"role"`
+	From          string         `json:"from"`
+	To            string         `json:"to"`
+	Actions       int            `json:"actions"`
+	OrdersCreated int            `json:"orders_created"`
+	OrdersUpdated int            `json:"orders_updated"`
+	Payments      countAmount    `json:"payments"`
+	Voids         countAmount    `json:"voids"`
+	Refunds       countAmount    `json:"refunds"`
+	Discounts     int            `json:"discounts"`
+	ByAction      map[string]int `json:"by_action"`
+	Recent        []auditEntry   `json:"recent"`
+	FirstActionAt *time.Time     `json:"first_action_at,omitempty"`
+	LastActionAt  *time.Time     `json:"last_action_at,omitempty"`
+	DevicesUsed   []string       `json:"devices_used"`
+	OrdersTouched int            `json:"orders_touched"`
+	VoidRate      float64        `json:"void_rate"`
+}
+
+const activityRecent = 50
+
+type activityHandler struct {
+	audit    *auditLog
+	staff    *staffStore
+	sessions *sessionStore
+}
+
+func (h *activityHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("content-type", "application/json")
+	sess, ok := h.sessions.fromRequest(r)
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("unauthorized"))
+		return
+	}
+	switch {
+	case r.Method == http.MethodGet && staffActivityRe.MatchString(r.URL.Path):
+		h.Activity(w, r, sess)
+		return
+	default:
+		notFound(w, r)
+		return
+	}
+}
+
+// Activity summarises a staff member's audited actions between ?from= and
+// ?to= (inclusive dates, default today). Staff may see their own activity;
+// managers may see anyone's.
+func (h *activityHandler) Activity(w http.ResponseWriter, r *http.Request, sess session) {
+	id := staffActivityRe.FindStringSubmatch(r.URL.Path)[1]
+	if id != sess.StaffID && !sess.hasScope("orders:manage") {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("forbidden"))
+		return
+	}
+	h.staff.RLock()
+	member, ok := h.staff.m[id]
+	h.staff.RUnlock()
+	if !ok {
+		notFound(w, r)
+		return
+	}
+	from, to, err := parseDateRange(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	sum := activitySummary{
+		StaffID:     member.ID,
+		Name:        member.Name,
+		Role:        member.Role,
+		From:        from.Format(dateLayout),
+		To:          to.AddDate(0, 0, -1).Format(dateLayout),
+		ByAction:    map[string]int{},
+		Recent:      []auditEntry{},
+		DevicesUsed: []string{},
+	}
+	devices := map[string]bool{}
+	orders := map[string]bool{}
+	for _, e := range h.audit.list() {
+		if e.StaffID != id || e.Time.Before(from) || !e.Time.Before(to) {
+			continue
+		}
+		e := e
+		sum.Actions++
+		sum.ByAction[e.Action]++
+		if sum.FirstActionAt == nil {
+			sum.FirstActionAt = &e.Time
+		}
+		sum.LastActionAt = &e.Time
+		if e.DeviceID != "" && !devices[e.DeviceID] {
+			devices[e.DeviceID] = true
+			sum.DevicesUsed = append(sum.DevicesUsed, e.DeviceID)
+		}
+		if e.OrderID != "" {
+			orders[e.OrderID] = true
+		}
+		if strings.Contains(e.Action, "discount") {
+			sum.Discounts++
+		}
+		if e.HasDiff {
+			sum.classify(e)
+		}
+		sum.Recent = append(sum.Recent, e)
+	}
+	sum.OrdersTouched = len(orders)
+	if sum.OrdersTouched > 0 {
+		sum.VoidRate = float64(sum.Voids.Count) / float64(sum.OrdersTouched)
+	}
+	sort.Strings(sum.DevicesUsed)
+	if len(sum.Recent) > activityRecent {
+		sum.Recent = sum.Recent[len(sum.Recent)-activityRecent:]
+	}
+	for i, j := 0, len(sum.Recent)-1; i < j; i, j = i+1, j-1 {
+		sum.Recent[i], sum.Recent[j] = sum.Recent[j], sum.Recent[i]
+	}
+	writeJSON(w, r, http.StatusOK, sum)
+}
+
+// classify counts an order change by the state transition its snapshots show.
+func (s *activitySummary) classify(e auditEntry) {
+	before, after, ok := e.orders()
+	if !ok {
+		return
+	}
+	if before.ID == "" {
+		s.OrdersCreated++
+	} else {
+		s.OrdersUpdated++
+	}
+	switch {
+	case isVoided(after) && !isVoided(before):
+		s.Voids.Count++
+		s.Voids.Amount += after.Total
+	case isRefunded(after) && !isRefunded(before):
+		s.Refunds.Count++
+		s.Refunds.Amount += after.Total
+	case isPaid(after) && !isPaid(before):
+		s.Payments.Count++
+		s.Payments.Amount += after.Total
+	}
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	listAuditRe = regexp.MustCompile(`^/admin/audit/?$`)
+	auditDiffRe = regexp.MustCompile(`^/admin/audit/([0-9]+)/diff$`)
+)
+
+type auditEntry struct {
+	ID       string    `json:"id"`
+	Time     time.Time `json:"time"`
+	Action   string    `json:"action"`
+	OrderID  string    `json:"order_id,omitempty"`
+	Ref      string    `json:"ref,omitempty"`
+	StaffID  string    `json:"staff_id,omitempty"`
+	DeviceID string    `json:"device_id,omitempty"`
+	// HasDiff is set on order changes recorded with before/after snapshots.
+	HasDiff bool `json:"has_diff,omitempty"`
+	before  []byte
+	after   []byte
+}
+
+// maxAuditEntries bounds how many entries the audit log keeps. Once it is
+// reached the oldest quarter is dropped, as the change feed does.
+const maxAuditEntries = 100000
+
+// auditLog is an append-only record of mutations.
+type auditLog struct {
+	entries []auditEntry
+	// dropped is how many of the oldest entries have been dropped; entry IDs
+	// count them, so they stay the same.
+	dropped int
+	*sync.RWMutex
+}
+
+func newAuditLog() *auditLog {
+	return &auditLog{RWMutex: &sync.RWMutex{}}
+}
+
+func (l *auditLog) record(e auditEntry) auditEntry {
+	l.Lock()
+	defer l.Unlock()
+	e.ID = strconv.Itoa(l.dropped + len(l.entries) + 1)
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+	if len(l.entries) >= maxAuditEntries {
+		l.entries = append([]auditEntry(nil), l.entries[maxAuditEntries/4:]...)
+		l.dropped += maxAuditEntries / 4
+	}
+	l.entries = append(l.entries, e)
+	return e
+}
+
+// orders decodes the order snapshots of a change. before is the zero order
+// when the change created the order.
+func (e auditEntry) orders() (before, after order, ok bool) {
+	if !e.HasDiff {
+		return order{}, order{}, false
+	}
+	if len(e.before) > 0 && json.Unmarshal(e.before, &before) != nil {
+		return order{}, order{}, false
+	}
+	if json.Unmarshal(e.after, &after) != nil {
+		return order{}, order{}, false
+	}
+	return before, after, true
+}
+
+func (l *auditLog) get(id string) (auditEntry, bool) {
+	n, err := strconv.Atoi(id)
+	l.RLock()
+	defer l.RUnlock()
+	n -= l.dropped
+	if err != nil || n < 1 || n > len(l.entries) {
+		return auditEntry{}, false
+	}
+	return l.entries[n-1], true
+}
+
+// page returns limit entries from offset, all the rest when limit is -1,
+// and how many entries there are.
+func (l *auditLog) page(offset, limit int) ([]auditEntry, int) {
+	l.RLock()
+	defer l.RUnlock()
+	start := minInt(offset, len(l.entries))
+	end := len(l.entries)
+	if limit >= 0 {
+		end = minInt(start+limit, end)
+	}
+	return append([]auditEntry{}, l.entries[start:end]...), len(l.entries)
+}
+
+func (l *auditLog) list() []auditEntry {
+	l.RLock()
+	defer l.RUnlock()
+	out := make([]auditEntry, len(l.entries))
+	copy(out, l.entries)
+	return out
+}
+
+// actor identifies who made a request: the staff session and the device it
+// came from, either of which may be unknown.
+type actor struct {
+	StaffID  string
+	DeviceID string
+}
+
+func identifyActor(r *http.Request, sessions *sessionStore, devices *deviceStore) actor {
+	var a actor
+	if sess, ok := sessions.fromRequest(r); ok {
+		a.StaffID = sess.StaffID
+	}
+	if id, ok := devices.identify(r); ok {
+		a.DeviceID = id
+	}
+	return a
+}
+
+type auditHandler struct {
+	audit    *auditLog
+	sessions *sessionStore
+	paging   pagingConfig
+}
+
+func (h *auditHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("content-type", "application/json")
+	switch {
+	case r.Method == http.MethodGet && listAuditRe.MatchString(r.URL.Path):
+		h.List(w, r)
+		return
+	case r.Method == http.MethodGet && auditDiffRe.MatchString(r.URL.Path):
+		h.Diff(w, r)
+		return
+	default:
+		notFound(w, r)
+		return
+	}
+}
+
+// List returns the audit log oldest first, paged with ?offset= and ?limit=
+// within the caller's page limits, and reports its size in X-Total-Count.
+func (h *auditHandler) List(w http.ResponseWriter, r *http.Request) {
+	if _, ok := h.sessions.requireScope(w, r, "orders:manage"); !ok {
+		return
+	}
+	offset, limit, err := parsePage(r.URL.Query(), h.paging.limits(r, h.sessions))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	entries, total := h.audit.page(offset, limit)
+	w.Header().Set(totalCountHeader, strconv.Itoa(total))
+	writeJSON(w, r, http.StatusOK, entries)
+}
+
+// fieldChange is one leaf field that differs between two snapshots. Nested
+// fields are named by dotted path, list elements by index.
+type fieldChange struct {
+	Field  string      `json:"field"`
+	Before interface{} `json:"before"`
+	After  interface{} `json:"after"`
+}
+
+// Diff shows field by field what an order change altered.
+func (h *auditHandler) Diff(w http.ResponseWriter, r *http.Request) {
+	if _, ok := h.sessions.requireScope(w, r, "orders:manage"); !ok {
+		return
+	}
+	e, ok := h.audit.get(auditDiffRe.FindStringSubmatch(r.URL.Path)[1])
+	if !ok {
+		notFound(w, r)
+		return
+	}
+	if !e.HasDiff {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		w.Write([]byte("entry has no snapshots"))
+		return
+	}
+	before, after := map[string]interface{}{}, map[string]interface{}{}
+	if err := flattenJSON(e.before, before); err != nil {
+		internalServerError(w, r)
+		return
+	}
+	if err := flattenJSON(e.after, after); err != nil {
+		internalServerError(w, r)
+		return
+	}
+	writeJSON(w, r, http.StatusOK, struct {
+		Entry   auditEntry    `json:"entry"`
+		Changes []fieldChange `json:"changes"`
+	}{e, diffFields(before, after)})
+}
+
+func flattenJSON(doc []byte, out map[string]interface{}) error {
+	if len(doc) == 0 {
+		return nil
+	}
+	var v interface{}
+	if err := json.Unmarshal(doc, &v); err != nil {
+		return err
+	}
+	flatten("", v, out)
+	return nil
+}
+
+func flatten(prefix string, v interface{}, out map[string]interface{}) {
+	join := func(k string) string {
+		if prefix == "" {
+			return k
+		}
+		return prefix + "." + k
+	}
+	switch t := v.(type) {
+	case map[string]interface{}:
+		for k, child := range t {
+			flatten(join(k), child, out)
+		}
+	case []interface{}:
+		for i, child := range t {
+			flatten(join(strconv.Itoa(i)), child, out)
+		}
+	default:
+		out[prefix] = v
+	}
+}
+
+func diffFields(before, after map[string]interface{}) []fieldChange {
+	changes := []fieldChange{}
+	for k, b := range before {
+		if a, ok := after[k]; !ok || !reflect.DeepEqual(a, b) {
+			changes = append(changes, fieldChange{Field: k, Before: b, After: after[k]})
+		}
+	}
+	for k, a := range after {
+		if _, ok := before[k]; !ok {
+			changes = append(changes, fieldChange{Field: k, After: a})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Field < changes[j].Field })
+	return changes
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"testing"
+)
+
+// TestAuditLog checks that the audit list is paged and that the log keeps
+// entry IDs stable once it drops its oldest entries.
+func TestAuditLog(t *testing.T) {
+	s := newTestServer(t)
+	for i := 0; i < 3; i++ {
+		s.orders.audit.record(auditEntry{Action: "test"})
+	}
+	w := do(s, http.MethodGet, "/admin/audit?offset=1&limit=1", "")
+	var page []auditEntry
+	if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil || len(page) != 1 || page[0].ID != "2" {
+		t.Fatalf("page: %d %s", w.Code, w.Body)
+	}
+	if total := w.Header().Get(totalCountHeader); total != "3" {
+		t.Errorf("total %q, want 3", total)
+	}
+	if w := do(s, http.MethodGet, "/admin/audit?limit=-1", ""); w.Code != http.StatusBadRequest {
+		t.Errorf("negative limit: %d, want 400", w.Code)
+	}
+
+	l := newAuditLog()
+	for i := 0; i <= maxAuditEntries; i++ {
+		l.record(auditEntry{Action: "test"})
+	}
+	if len(l.entries) > maxAuditEntries {
+		t.Errorf("log holds %d entries, want at most %d", len(l.entries), maxAuditEntries)
+	}
+	if _, ok := l.get("1"); ok {
+		t.Error("dropped entry 1 still found")
+	}
+	last := strconv.Itoa(maxAuditEntries + 1)
+	if e, ok := l.get(last); !ok || e.ID != last {
+		t.Errorf("entry %s: %+v, %v", last, e, ok)
+	}
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// apiKeyHeader carries a static API key. Keys are also accepted as bearer
+// tokens.
+const apiKeyHeader = "X-API-Key"
+
+// jwtMinSecret is the shortest HS256 secret accepted, in bytes.
+const jwtMinSecret = 32
+
+// apiKey lets an integration, such as a POS terminal or a partner system,
+// call the API with the scopes of Role, for LocationID if it is set.
+type apiKey struct {
+	Name       string `json:"name"`
+	Role       string `json:"role"`
+	Key        string `json:"key"`
+	LocationID string `json:"location_id,omitempty"`
+	// FieldNaming is the key naming the key's requests get unless they ask
+	// with X-Field-Naming: snake or camel.
+	FieldNaming string `json:"field_naming,omitempty"`
+	// The key's default_page_size and max_page_size, if set, take the place
+	// of its role's.
+	pageLimits
+}
+
+// staffAccount is a staff member who logs in with a PIN at /auth/pin, at
+// LocationID if they work at one location.
+type staffAccount struct {
+	ID         string `json:"id"`
+	Name       string `json:"name"`
+	Role       string `json:"role"`
+	PIN        string `json:"pin"`
+	LocationID string `json:"location_id,omitempty"`
+}
+
+// routeRule requires Scope on requests whose path is Prefix or below it, for
+// Method or, when Method is empty, any method. A * segment in Prefix matches
+// any one path segment. The first matching rule applies.
+type routeRule struct {
+	Method string `json:"method,omitempty"`
+	Prefix string `json:"prefix"`
+	Scope  string `json:"scope"`
+}
+
+func (rule routeRule) matches(r *http.Request) bool {
+	if rule.Method != "" && rule.Method != r.Method {
+		return false
+	}
+	want := strings.Split(strings.Trim(rule.Prefix, "/"), "/")
+	got := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(got) < len(want) {
+		return false
+	}
+	for i, seg := range want {
+		if seg != "*" && seg != got[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// defaultRouteRules guard the order routes, whose handlers do not check
+// sessions themselves. Other handlers enforce their own scopes. The kitchen
+// moves orders along their workflow, so that route only needs a session;
+// SetStatus checks the scope for each status.
+var defaultRouteRules = []routeRule{
+	{Method: http.MethodPost, Prefix: "/orders/*/status", Scope: "orders:read"},
+	{Method: http.MethodGet, Prefix: "/orders", Scope: "orders:read"},
+	{Prefix: "/orders", Scope: "orders:write"},
+	{Method: http.MethodGet, Prefix: "/order", Scope: "orders:read"},
+	{Prefix: "/order", Scope: "orders:write"},
+}
+
+// authConfig is who may call the API: staff, who log in with their PIN,
+// static API keys, and HS256 JWTs issued elsewhere, whose "role" claim picks
+// the scopes and "sub" names the caller. Routes are the scopes the auth
+// middleware enforces.
+type authConfig struct {
+	Staff     []staffAccount `json:"staff"`
+	APIKeys   []apiKey       `json:"api_keys"`
+	JWTSecret string         `json:"jwt_secret"`
+	Routes    []routeRule    `json:"routes"`
+	// keys indexes APIKeys by the SHA-256 of the key, so looking one up
+	// does not compare secrets byte by byte.
+	keys map[string]apiKey
+}
+
+// loadAuthConfig starts from base, the config file's auth section, reads the
+// JSON file named by AUTH_CONFIG over it, if any, then adds staff from STAFF
+// (comma-separated id:role:pin), keys from API_KEYS (comma-separated
+// name:role:key) and takes JWT_SECRET over the files' secret. Without routes
+// in either file, defaultRouteRules apply.
+func loadAuthConfig(base authConfig) (*authConfig, error) {
+	c := &base
+	if path := os.Getenv("AUTH_CONFIG"); path != "" {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(b, c); err != nil {
+			return nil, fmt.Errorf("parse %s: %w", path, err)
+		}
+	}
+	for _, spec := range splitList(os.Getenv("STAFF"), nil) {
+		parts := strings.SplitN(spec, ":", 3)
+		if len(parts) != 3 {
+			return nil, fmt.Errorf("STAFF entries must be id:role:pin")
+		}
+		c.Staff = append(c.Staff, staffAccount{ID: parts[0], Name: parts[0], Role: parts[1], PIN: parts[2]})
+	}
+	for _, spec := range splitList(os.Getenv("API_KEYS"), nil) {
+		parts := strings.SplitN(spec, ":", 3)
+		if len(parts) != 3 {
+			return nil, fmt.Errorf("API_KEYS entries must be name:role:key")
+		}
+		c.APIKeys = append(c.APIKeys, apiKey{Name: parts[0], Role: parts[1], Key: parts[2]})
+	}
+	if v := os.Getenv("JWT_SECRET"); v != "" {
+		c.JWTSecret = v
+	}
+	if c.Routes == nil {
+		c.Routes = defaultRouteRules
+	}
+	return c, c.compile()
+}
+
+func (c *authConfig) compile() error {
+	if c.JWTSecret != "" && len(c.JWTSecret) < jwtMinSecret {
+		return fmt.Errorf("JWT secret must be at least %d bytes", jwtMinSecret)
+	}
+	ids := map[string]bool{}
+	for _, m := range c.Staff {
+		switch {
+		case m.ID == "":
+			return fmt.Errorf("staff need an id")
+		case ids[m.ID]:
+			return fmt.Errorf("staff id %s is used twice", m.ID)
+		case !pinRe.MatchString(m.PIN):
+			return fmt.Errorf("staff %s: pin must be 4 to 6 digits", m.ID)
+		}
+		if _, ok := roleScopes[m.Role]; !ok {
+			return fmt.Errorf("staff %s has unknown role %q", m.ID, m.Role)
+		}
+		ids[m.ID] = true
+	}
+	c.keys = map[string]apiKey{}
+	for _, k := range c.APIKeys {
+		if k.Name == "" || k.Key == "" {
+			return fmt.Errorf("API keys need a name and a key")
+		}
+		if _, ok := roleScopes[k.Role]; !ok {
+			return fmt.Errorf("API key %s has unknown role %q", k.Name, k.Role)
+		}
+		if k.FieldNaming != "" {
+			if err := validFieldNaming(k.FieldNaming); err != nil {
+				return fmt.Errorf("API key %s: %w", k.Name, err)
+			}
+		}
+		if err := k.pageLimits.validate(); err != nil {
+			return fmt.Errorf("API key %s: %w", k.Name, err)
+		}
+		c.keys[hashKey(k.Key)] = k
+	}
+	for _, rule := range c.Routes {
+		if rule.Prefix == "" || rule.Scope == "" {
+			return fmt.Errorf("route rules need a prefix and a scope")
+		}
+	}
+	return nil
+}
+
+func hashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// rule returns the first route rule r falls under.
+func (c *authConfig) rule(r *http.Request) (routeRule, bool) {
+	for _, rule := range c.Routes {
+		if rule.matches(r) {
+			return rule, true
+		}
+	}
+	return routeRule{}, false
+}
+
+// apiKeySession resolves a static API key to a session for its role.
+func (c *authConfig) apiKeySession(key string) (session, bool) {
+	k, ok := c.keys[hashKey(key)]
+	if !ok {
+		return session{}, false
+	}
+	return session{StaffID: "key:" + k.Name, Role: k.Role, Scopes: roleScopes[k.Role], LocationID: k.LocationID,
+		FieldNaming: k.FieldNaming, PageLimits: k.pageLimits}, true
+}
+
+// jwtSession verifies an HS256 token and resolves it to a session. Tokens
+// must carry an expiry and a known role; a "location_id" claim binds the
+// session to a location.
+func (c *authConfig) jwtSession(token string, now time.Time) (session, bool) {
+	parts := strings.Split(token, ".")
+	if c.JWTSecret == "" || len(parts) != 3 {
+		return session{}, false
+	}
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if !decodeJWTPart(parts[0], &header) || header.Alg != "HS256" {
+		return session{}, false
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return session{}, false
+	}
+	mac := hmac.New(sha256.New, []byte(c.JWTSecret))
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		return session{}, false
+	}
+	var claims struct {
+		Sub        string `json:"sub"`
+		Role       string `json:"role"`
+		LocationID string `json:"location_id"`
+		Exp        int64  `json:"exp"`
+		Nbf        int64  `json:"nbf"`
+	}
+	if !decodeJWTPart(parts[1], &claims) || claims.Sub == "" || claims.Exp == 0 {
+		return session{}, false
+	}
+	expires := time.Unix(claims.Exp, 0)
+	if !now.Before(expires) || (claims.Nbf != 0 && now.Before(time.Unix(claims.Nbf, 0))) {
+		return session{}, false
+	}
+	scopes, ok := roleScopes[claims.Role]
+	if !ok {
+		return session{}, false
+	}
+	return session{StaffID: claims.Sub, Role: claims.Role, Scopes: scopes, LocationID: claims.LocationID, ExpiresAt: expires}, true
+}
+
+func decodeJWTPart(part string, v interface{}) bool {
+	b, err := base64.RawURLEncoding.DecodeString(part)
+	return err == nil && json.Unmarshal(b, v) == nil
+}
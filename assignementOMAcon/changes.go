@@ -0,0 +1,130 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+const kindOrders = "orders"
+
+// maxFeedHistory bounds how many changes the feed keeps for export. Once it
+// is reached the oldest quarter is dropped, so that a server without exports,
+// or whose exports keep failing, does not grow without end.
+const maxFeedHistory = 100000
+
+// change records that an object of some kind was written or deleted at seq.
+type change struct {
+	Seq     int64     `json:"seq"`
+	Kind    string    `json:"kind"`
+	ID      string    `json:"id"`
+	Deleted bool      `json:"deleted,omitempty"`
+	At      time.Time `json:"at"`
+}
+
+// changeFeed keeps the latest change per object under a monotonically
+// increasing sequence number, which clients use as a sync cursor.
+type changeFeed struct {
+	seq    int64
+	latest map[string]change
+	// history is the changes not yet pruned, in order, for export.
+	history []change
+	// pruned is when the oldest change still in history was made, once
+	// older ones have been dropped.
+	pruned time.Time
+	// changed wakes streams waiting for the next change.
+	changed *broadcast
+	*sync.RWMutex
+}
+
+func newChangeFeed() *changeFeed {
+	return &changeFeed{latest: map[string]change{}, changed: newBroadcast(), RWMutex: &sync.RWMutex{}}
+}
+
+func (f *changeFeed) publish(kind, id string, deleted bool) int64 {
+	f.Lock()
+	defer f.Unlock()
+	f.seq++
+	c := change{Seq: f.seq, Kind: kind, ID: id, Deleted: deleted, At: time.Now().UTC()}
+	f.latest[kind+"/"+id] = c
+	if len(f.history) >= maxFeedHistory {
+		f.history = append([]change(nil), f.history[maxFeedHistory/4:]...)
+		f.pruned = f.history[0].At
+	}
+	f.history = append(f.history, c)
+	f.changed.notify()
+	return f.seq
+}
+
+func (f *changeFeed) head() int64 {
+	f.RLock()
+	defer f.RUnlock()
+	return f.seq
+}
+
+// since returns the changes after seq in sequence order, together with the
+// current head.
+func (f *changeFeed) since(seq int64) ([]change, int64) {
+	f.RLock()
+	out := make([]change, 0)
+	for _, c := range f.latest {
+		if c.Seq > seq {
+			out = append(out, c)
+		}
+	}
+	head := f.seq
+	f.RUnlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].Seq < out[j].Seq })
+	return out, head
+}
+
+// between returns every change made in [from, to), in sequence order.
+func (f *changeFeed) between(from, to time.Time) []change {
+	f.RLock()
+	defer f.RUnlock()
+	i := sort.Search(len(f.history), func(i int) bool { return !f.history[i].At.Before(from) })
+	j := sort.Search(len(f.history), func(i int) bool { return !f.history[i].At.Before(to) })
+	return append([]change(nil), f.history[i:j]...)
+}
+
+// prune drops the changes made before t, once they have been exported.
+func (f *changeFeed) prune(t time.Time) {
+	f.Lock()
+	defer f.Unlock()
+	i := sort.Search(len(f.history), func(i int) bool { return !f.history[i].At.Before(t) })
+	if i > 0 {
+		f.history = append([]change(nil), f.history[i:]...)
+		f.pruned = t
+	}
+}
+
+// keeps reports whether the feed still has every change made since t.
+func (f *changeFeed) keeps(t time.Time) bool {
+	f.RLock()
+	defer f.RUnlock()
+	return !t.Before(f.pruned)
+}
+
+// broadcast lets any number of goroutines wait for the next notify.
+type broadcast struct {
+	ch chan struct{}
+	*sync.Mutex
+}
+
+func newBroadcast() *broadcast {
+	return &broadcast{ch: make(chan struct{}), Mutex: &sync.Mutex{}}
+}
+
+// wait returns a channel that is closed at the next notify.
+func (b *broadcast) wait() <-chan struct{} {
+	b.Lock()
+	defer b.Unlock()
+	return b.ch
+}
+
+func (b *broadcast) notify() {
+	b.Lock()
+	close(b.ch)
+	b.ch = make(chan struct{})
+	b.Unlock()
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+	"sort"
+)
+
+var channelReportRe = regexp.MustCompile(`^/reports/channels$`)
+
+const (
+	channelWalkIn      = "walk-in"
+	channelPhone       = "phone"
+	channelWebsite     = "website"
+	channelDeliveryApp = "delivery-app"
+)
+
+var channels = map[string]bool{
+	channelWalkIn:      true,
+	channelPhone:       true,
+	channelWebsite:     true,
+	channelDeliveryApp: true,
+}
+
+// defaultChannel fills in the channel for orders created without one.
+func defaultChannel(o *order) {
+	if o.Channel == "" {
+		o.Channel = channelWalkIn
+	}
+}
+
+func validateChannel(o order) []fieldError {
+	if o.Channel != "" && !channels[o.Channel] {
+		return []fieldError{{Field: "channel", Message: "must be walk-in, phone, website or delivery-app"}}
+	}
+	return nil
+}
+
+type channelRevenue struct {
+	Channel string `json:"channel"`
+	Orders  int    `json:"orders"`
+	Paid    int    `json:"paid"`
+	Revenue int64  `json:"revenue"`
+}
+
+// Channels reports orders and paid revenue per channel for orders last
+// touched within ?from=&to=.
+func (h *reportHandler) Channels(w http.ResponseWriter, r *http.Request) {
+	from, to, err := parseDateRange(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	by := map[string]*channelRevenue{}
+	for c := range channels {
+		by[c] = &channelRevenue{Channel: c}
+	}
+	h.store.RLock()
+	for _, o := range h.store.m {
+		if o.UpdatedAt == nil || o.UpdatedAt.Before(from) || !o.UpdatedAt.Before(to) {
+			continue
+		}
+		c := o.Channel
+		if c == "" {
+			c = channelWalkIn
+		}
+		cr := by[c]
+		if cr == nil {
+			cr = &channelRevenue{Channel: c}
+			by[c] = cr
+		}
+		cr.Orders++
+		if isPaid(o) {
+			cr.Paid++
+			cr.Revenue += o.Total
+		}
+	}
+	h.store.RUnlock()
+	out := make([]channelRevenue, 0, len(by))
+	for _, cr := range by {
+		out = append(out, *cr)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Channel < out[j].Channel })
+	writeJSON(w, r, http.StatusOK, out)
+}
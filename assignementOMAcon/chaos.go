@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"time"
+)
+
+const (
+	faultLatency = "latency"
+	faultError   = "error"
+	faultDrop    = "drop"
+)
+
+const chaosHeader = "X-Chaos-Fault"
+
+// chaosConfig injects faults into a share of requests so clients' retry and
+// timeout handling can be tried against a real server. It is off unless
+// Percent is set.
+type chaosConfig struct {
+	// Percent of requests that get a fault, from 0 to 100.
+	Percent float64 `json:"percent"`
+	// Latency bounds the delay added by a latency fault.
+	Latency duration `json:"latency"`
+	// Faults lists the faults to choose from, at random.
+	Faults []string `json:"faults"`
+}
+
+func (c chaosConfig) enabled() bool {
+	return c.Percent > 0
+}
+
+func (c chaosConfig) validate() error {
+	if c.Percent < 0 || c.Percent > 100 {
+		return fmt.Errorf("percent must be from 0 to 100")
+	}
+	if c.Latency <= 0 {
+		return fmt.Errorf("latency must be a positive duration")
+	}
+	if len(c.Faults) == 0 {
+		return fmt.Errorf("faults lists no faults")
+	}
+	for _, f := range c.Faults {
+		if f != faultLatency && f != faultError && f != faultDrop {
+			return fmt.Errorf("unknown fault %q", f)
+		}
+	}
+	return nil
+}
+
+// chaosMiddleware applies one of the configured faults to cfg.Percent of
+// requests. A latency fault delays the request and then serves it; an error
+// fault answers 500 without reaching the handler; a drop closes the
+// connection with no response.
+func chaosMiddleware(cfg chaosConfig) middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if rand.Float64()*100 >= cfg.Percent {
+				next.ServeHTTP(w, r)
+				return
+			}
+			fault := cfg.Faults[rand.Intn(len(cfg.Faults))]
+			slog.InfoContext(r.Context(), "chaos", slog.String("fault", fault), slog.String("method", r.Method), slog.String("path", r.URL.Path))
+			switch fault {
+			case faultLatency:
+				delay := time.Duration(rand.Int63n(int64(cfg.Latency))) + 1
+				select {
+				case <-time.After(delay):
+				case <-r.Context().Done():
+					return
+				}
+				w.Header().Set(chaosHeader, faultLatency)
+				next.ServeHTTP(w, r)
+			case faultError:
+				w.Header().Set(chaosHeader, faultError)
+				writeError(w, r, http.StatusInternalServerError, "", "fault injected by chaos mode", nil)
+			case faultDrop:
+				panic(http.ErrAbortHandler)
+			}
+		})
+	}
+}
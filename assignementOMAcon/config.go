@@ -0,0 +1,520 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// duration is a time.Duration written in config files as a string such as
+// "10s".
+type duration time.Duration
+
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("durations must be strings such as \"10s\"")
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = duration(v)
+	return nil
+}
+
+func (d duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// storeConfig picks where orders are kept.
+type storeConfig struct {
+	Driver string `json:"driver"`
+	DSN    string `json:"dsn"`
+}
+
+// orderNumberConfig is where the order number counter is kept, if anywhere,
+// and whether it starts again each day (reset daily) or never.
+type orderNumberConfig struct {
+	File  string `json:"file"`
+	Reset string `json:"reset"`
+}
+
+// webhookConfig is the generic delivery platform webhook: the secret its
+// requests are signed with and where status changes are sent back. Without
+// a secret the webhook is off.
+type webhookConfig struct {
+	Secret    string `json:"secret"`
+	StatusURL string `json:"status_url"`
+}
+
+// config is the server's configuration. It is read from the file named by
+// CONFIG_FILE, if any, in JSON or, for a .yaml or .yml file, YAML, and the
+// environment variables below override the file:
+//
+//	LISTEN_ADDR                  listen_addr                (default localhost:8081)
+//	GRPC_ADDR                    grpc_addr                  (default localhost:8082)
+//	SHUTDOWN_TIMEOUT             shutdown_timeout           (default 10s)
+//	HTTP_READ_TIMEOUT            read_timeout               (default none)
+//	HTTP_HEADER_TIMEOUT          read_header_timeout        (default 10s)
+//	HTTP_WRITE_TIMEOUT           write_timeout              (default none)
+//	HTTP_IDLE_TIMEOUT            idle_timeout               (default 2m)
+//	LOG_LEVEL                    log_level                  (default info)
+//	LOG_FORMAT                   log_format                 (default text)
+//	STORE_DRIVER                 store.driver               (default memory)
+//	STORE_DSN                    store.dsn                  (default orders.db for sqlite)
+//	SEED                         seed                       (default false)
+//	PATH_MODE                    path_mode                  (default lenient)
+//	PAGE_SIZE_DEFAULT            paging.default_page_size   (default none)
+//	PAGE_SIZE_MAX                paging.max_page_size       (default none)
+//	ORDER_IDS                    order_ids                  (number or ulid, default number)
+//	ORDER_NUMBER_FILE            order_numbers.file         (default none, in memory)
+//	ORDER_NUMBER_RESET           order_numbers.reset        (never or daily, default never)
+//	ORDER_DELETE_MODE            order_delete_mode          (hard or soft, default hard)
+//	TABLE_NUMBER_MAX             table_number_max           (default 9999)
+//	MENU_CHECK                   menu_check                 (on or off, default on)
+//	VALIDATION_RULES             validation_rules           (default none)
+//	DUPLICATE_WINDOW             duplicates.window          (default 30s, 0 turns it off)
+//	DUPLICATE_ACTION             duplicates.action          (flag or block, default flag)
+//	IDEMPOTENCY_TTL              idempotency_ttl            (default 24h)
+//	STUCK_PREPARING              stuck.preparing            (default 30m)
+//	STUCK_AWAITING_PAYMENT       stuck.awaiting_payment     (default 1h)
+//	DELIVERY_WEBHOOK_SECRET      delivery_webhook.secret    (default none)
+//	DELIVERY_WEBHOOK_STATUS_URL  delivery_webhook.status_url
+//	RESPONSE_ENVELOPE            response_envelope          (default negotiate)
+//	FIELD_NAMING                 field_naming               (snake or camel, default snake)
+//	CORS_ORIGINS                 cors_origins               (comma-separated, default none)
+//	MIDDLEWARE                   middleware                 (comma-separated, default all in order)
+//	RATE_LIMIT                   rate_limit.rate            (requests a second, default none)
+//	RATE_LIMIT_BURST             rate_limit.burst           (default the rate, rounded up)
+//	QUOTA_MAX_OPEN_ORDERS        quotas.max_open_orders     (per location, default none)
+//	QUOTA_REQUESTS_PER_MINUTE    quotas.requests_per_minute (per location, default none)
+//	CHAOS_PERCENT                chaos.percent              (default 0, off)
+//	CHAOS_LATENCY                chaos.latency              (default 2s)
+//	CHAOS_FAULTS                 chaos.faults               (default latency,error,drop)
+//	LOCK_TRACE                   lock_trace                 (on or off, default off)
+//	EXPORT_BUCKET                exports.bucket             (default none, no exports)
+//	EXPORT_ENDPOINT              exports.endpoint
+//	EXPORT_REGION                exports.region             (default us-east-1)
+//	EXPORT_ACCESS_KEY            exports.access_key
+//	EXPORT_SECRET_KEY            exports.secret_key
+//	EXPORT_PREFIX                exports.prefix             (default exports/)
+//	EXPORT_AT                    exports.at                 (default 01:00 UTC)
+//	IMAGE_STORE                  images.store               (disk or s3, default disk)
+//	IMAGE_DIR                    images.dir                 (default images)
+//	IMAGE_BUCKET                 images.bucket, and IMAGE_ENDPOINT and so on as for exports
+//	SMTP_ADDR                    smtp.addr                  (host:port, default none)
+//	SMTP_USERNAME                smtp.username
+//	SMTP_PASSWORD                smtp.password
+//	SMTP_FROM                    smtp.from
+//	LINK_SIGNING_KEY             link_signing_key           (default a random key)
+//
+// paging.roles overrides the page sizes for a role's sessions, and an API
+// key's own default_page_size and max_page_size override those.
+//
+// The file's auth section has the shape of an AUTH_CONFIG file, and
+// AUTH_CONFIG, STAFF, API_KEYS and JWT_SECRET are applied over it. Seed adds
+// demo staff with well-known PINs, so it is for trying the server out only;
+// real staff are listed in the auth section's staff. A write timeout
+// also cuts off event streams and WebSockets, so it is best left unset. An
+// empty grpc_addr in the file turns the gRPC server off.
+// Plugins read their own settings.
+type config struct {
+	ListenAddr        string      `json:"listen_addr"`
+	GRPCAddr          string      `json:"grpc_addr"`
+	ShutdownTimeout   duration    `json:"shutdown_timeout"`
+	ReadTimeout       duration    `json:"read_timeout"`
+	ReadHeaderTimeout duration    `json:"read_header_timeout"`
+	WriteTimeout      duration    `json:"write_timeout"`
+	IdleTimeout       duration    `json:"idle_timeout"`
+	LogLevel          string      `json:"log_level"`
+	LogFormat         string      `json:"log_format"`
+	Store             storeConfig `json:"store"`
+	Auth              authConfig  `json:"auth"`
+	// Paging bounds the pages of lists; see pagingConfig.
+	Paging pagingConfig `json:"paging"`
+	// PathMode is lenient or strict; see pathMiddleware.
+	PathMode string `json:"path_mode"`
+	// Seed loads the demo staff, orders, menu and stock. The demo staff's
+	// PINs are public, so it is off by default.
+	Seed bool `json:"seed"`
+
+	// OrderIDs is what orders created without an ID get: their order
+	// number, or a ULID, which sorts by creation time.
+	OrderIDs     string            `json:"order_ids"`
+	OrderNumbers orderNumberConfig `json:"order_numbers"`
+	DeleteMode   string            `json:"order_delete_mode"`
+	// TableNumberMax is the highest table number orders may give.
+	TableNumberMax int `json:"table_number_max"`
+	// MenuCheck off accepts order lines for items not on the menu, as when
+	// importing history from a POS whose dishes are gone.
+	MenuCheck bool `json:"menu_check"`
+	// ValidationRules names a file of extra order constraints.
+	ValidationRules string          `json:"validation_rules"`
+	Duplicates      duplicateConfig `json:"duplicates"`
+	IdempotencyTTL  duration        `json:"idempotency_ttl"`
+	Stuck           stuckThresholds `json:"stuck"`
+	DeliveryWebhook webhookConfig   `json:"delivery_webhook"`
+
+	ResponseEnvelope string   `json:"response_envelope"`
+	FieldNaming      string   `json:"field_naming"`
+	CORSOrigins      []string `json:"cors_origins"`
+	// Middleware lists the middleware to run, in order.
+	Middleware []string        `json:"middleware"`
+	RateLimit  rateLimitConfig `json:"rate_limit"`
+	// Quotas are the global quotas each location gets unless an admin sets
+	// its own; see quotaStore.
+	Quotas quotaConfig `json:"quotas"`
+	Chaos  chaosConfig `json:"chaos"`
+	// LockTrace records how long the order store's lock is waited for and
+	// held, for /admin/contention. It costs a stack lookup on every lock,
+	// so it is meant to be turned on while measuring.
+	LockTrace bool `json:"lock_trace"`
+
+	Exports        exportConfig `json:"exports"`
+	Images         imageConfig  `json:"images"`
+	SMTP           smtpConfig   `json:"smtp"`
+	LinkSigningKey string       `json:"link_signing_key"`
+}
+
+func defaultConfig() config {
+	return config{
+		ListenAddr:        "localhost:8081",
+		GRPCAddr:          "localhost:8082",
+		ShutdownTimeout:   duration(10 * time.Second),
+		ReadHeaderTimeout: duration(10 * time.Second),
+		IdleTimeout:       duration(2 * time.Minute),
+		Store:             storeConfig{Driver: storeMemory},
+		PathMode:          pathsLenient,
+		OrderIDs:          orderIDsNumber,
+		DeleteMode:        deleteHard,
+		TableNumberMax:    9999,
+		MenuCheck:         true,
+		Duplicates:        duplicateConfig{Window: duration(30 * time.Second), Action: duplicateFlag},
+		IdempotencyTTL:    duration(defaultIdempotencyKeepFor),
+		Stuck:             stuckThresholds{Preparing: duration(30 * time.Minute), AwaitingPayment: duration(time.Hour)},
+		ResponseEnvelope:  envelopeNegotiate,
+		FieldNaming:       namingSnake,
+		Middleware:        defaultMiddlewareOrder,
+		Chaos:             chaosConfig{Latency: duration(2 * time.Second), Faults: []string{faultLatency, faultError, faultDrop}},
+		Exports:           exportConfig{Prefix: "exports/", At: "01:00"},
+		Images:            imageConfig{Store: imageStoreDisk, Dir: "images"},
+	}
+}
+
+// loadConfig reads the config file and environment and validates the result.
+func loadConfig() (config, error) {
+	c := defaultConfig()
+	if path := os.Getenv("CONFIG_FILE"); path != "" {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return config{}, err
+		}
+		if ext := filepath.Ext(path); ext == ".yaml" || ext == ".yml" {
+			if b, err = yamlToJSON(b); err != nil {
+				return config{}, fmt.Errorf("parse %s: %w", path, err)
+			}
+		}
+		if err := decodeConfig(bytes.NewReader(b), &c); err != nil {
+			return config{}, fmt.Errorf("parse %s: %w", path, err)
+		}
+	}
+	for _, v := range []struct {
+		env string
+		to  *string
+	}{
+		{"LISTEN_ADDR", &c.ListenAddr},
+		{"GRPC_ADDR", &c.GRPCAddr},
+		{"LOG_LEVEL", &c.LogLevel},
+		{"LOG_FORMAT", &c.LogFormat},
+		{"STORE_DRIVER", &c.Store.Driver},
+		{"STORE_DSN", &c.Store.DSN},
+		{"PATH_MODE", &c.PathMode},
+		{"ORDER_IDS", &c.OrderIDs},
+		{"ORDER_NUMBER_FILE", &c.OrderNumbers.File},
+		{"ORDER_NUMBER_RESET", &c.OrderNumbers.Reset},
+		{"ORDER_DELETE_MODE", &c.DeleteMode},
+		{"VALIDATION_RULES", &c.ValidationRules},
+		{"DUPLICATE_ACTION", &c.Duplicates.Action},
+		{"DELIVERY_WEBHOOK_SECRET", &c.DeliveryWebhook.Secret},
+		{"DELIVERY_WEBHOOK_STATUS_URL", &c.DeliveryWebhook.StatusURL},
+		{"RESPONSE_ENVELOPE", &c.ResponseEnvelope},
+		{"FIELD_NAMING", &c.FieldNaming},
+		{"EXPORT_BUCKET", &c.Exports.Bucket},
+		{"EXPORT_ENDPOINT", &c.Exports.Endpoint},
+		{"EXPORT_REGION", &c.Exports.Region},
+		{"EXPORT_ACCESS_KEY", &c.Exports.AccessKey},
+		{"EXPORT_SECRET_KEY", &c.Exports.SecretKey},
+		{"EXPORT_AT", &c.Exports.At},
+		{"IMAGE_STORE", &c.Images.Store},
+		{"IMAGE_DIR", &c.Images.Dir},
+		{"IMAGE_BUCKET", &c.Images.Bucket},
+		{"IMAGE_ENDPOINT", &c.Images.Endpoint},
+		{"IMAGE_REGION", &c.Images.Region},
+		{"IMAGE_ACCESS_KEY", &c.Images.AccessKey},
+		{"IMAGE_SECRET_KEY", &c.Images.SecretKey},
+		{"SMTP_ADDR", &c.SMTP.Addr},
+		{"SMTP_USERNAME", &c.SMTP.Username},
+		{"SMTP_PASSWORD", &c.SMTP.Password},
+		{"SMTP_FROM", &c.SMTP.From},
+		{"LINK_SIGNING_KEY", &c.LinkSigningKey},
+	} {
+		if s := os.Getenv(v.env); s != "" {
+			*v.to = s
+		}
+	}
+	// An empty EXPORT_PREFIX puts exports at the top of the bucket.
+	if s, ok := os.LookupEnv("EXPORT_PREFIX"); ok {
+		c.Exports.Prefix = s
+	}
+	for _, v := range []struct {
+		env string
+		to  *duration
+	}{
+		{"SHUTDOWN_TIMEOUT", &c.ShutdownTimeout},
+		{"HTTP_READ_TIMEOUT", &c.ReadTimeout},
+		{"HTTP_HEADER_TIMEOUT", &c.ReadHeaderTimeout},
+		{"HTTP_WRITE_TIMEOUT", &c.WriteTimeout},
+		{"HTTP_IDLE_TIMEOUT", &c.IdleTimeout},
+		{"DUPLICATE_WINDOW", &c.Duplicates.Window},
+		{"IDEMPOTENCY_TTL", &c.IdempotencyTTL},
+		{"STUCK_PREPARING", &c.Stuck.Preparing},
+		{"STUCK_AWAITING_PAYMENT", &c.Stuck.AwaitingPayment},
+		{"CHAOS_LATENCY", &c.Chaos.Latency},
+	} {
+		if s := os.Getenv(v.env); s != "" {
+			d, err := time.ParseDuration(s)
+			if err != nil {
+				return config{}, fmt.Errorf("%s must be a duration, got %q", v.env, s)
+			}
+			*v.to = duration(d)
+		}
+	}
+	for _, v := range []struct {
+		env string
+		to  *int
+	}{
+		{"PAGE_SIZE_DEFAULT", &c.Paging.Default},
+		{"PAGE_SIZE_MAX", &c.Paging.Max},
+		{"TABLE_NUMBER_MAX", &c.TableNumberMax},
+		{"RATE_LIMIT_BURST", &c.RateLimit.Burst},
+		{"QUOTA_MAX_OPEN_ORDERS", &c.Quotas.MaxOpenOrders},
+		{"QUOTA_REQUESTS_PER_MINUTE", &c.Quotas.RequestsPerMinute},
+	} {
+		if s := os.Getenv(v.env); s != "" {
+			n, err := strconv.Atoi(s)
+			if err != nil || n < 0 {
+				return config{}, fmt.Errorf("%s must be a non-negative integer, got %q", v.env, s)
+			}
+			*v.to = n
+		}
+	}
+	for _, v := range []struct {
+		env string
+		to  *float64
+	}{
+		{"RATE_LIMIT", &c.RateLimit.Rate},
+		{"CHAOS_PERCENT", &c.Chaos.Percent},
+	} {
+		if s := os.Getenv(v.env); s != "" {
+			f, err := strconv.ParseFloat(s, 64)
+			if err != nil {
+				return config{}, fmt.Errorf("%s must be a number, got %q", v.env, s)
+			}
+			*v.to = f
+		}
+	}
+	for _, v := range []struct {
+		env string
+		to  *[]string
+	}{
+		{"CORS_ORIGINS", &c.CORSOrigins},
+		{"MIDDLEWARE", &c.Middleware},
+		{"CHAOS_FAULTS", &c.Chaos.Faults},
+	} {
+		if s := os.Getenv(v.env); s != "" {
+			*v.to = splitList(s, nil)
+		}
+	}
+	for _, v := range []struct {
+		env, on, off string
+		to           *bool
+	}{
+		{"MENU_CHECK", "on", "off", &c.MenuCheck},
+		{"LOCK_TRACE", "on", "off", &c.LockTrace},
+	} {
+		switch s := os.Getenv(v.env); s {
+		case "":
+		case v.on:
+			*v.to = true
+		case v.off:
+			*v.to = false
+		default:
+			return config{}, fmt.Errorf("%s must be %s or %s, got %q", v.env, v.on, v.off, s)
+		}
+	}
+	if s := os.Getenv("SEED"); s != "" {
+		on, err := strconv.ParseBool(s)
+		if err != nil {
+			return config{}, fmt.Errorf("SEED must be true or false, got %q", s)
+		}
+		c.Seed = on
+	}
+	if c.Store.Driver == "" {
+		c.Store.Driver = storeMemory
+	}
+	if c.Store.DSN == "" && c.Store.Driver == storeSQLite {
+		c.Store.DSN = "orders.db"
+	}
+	if c.RateLimit.Burst == 0 && c.RateLimit.Rate > 0 {
+		c.RateLimit.Burst = int(math.Ceil(c.RateLimit.Rate))
+	}
+	auth, err := loadAuthConfig(c.Auth)
+	if err != nil {
+		return config{}, err
+	}
+	c.Auth = *auth
+	return c, c.validate()
+}
+
+// decodeConfig reads a config file, rejecting keys the config does not have
+// so that typos are not silently ignored.
+func decodeConfig(r io.Reader, c *config) error {
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	return dec.Decode(c)
+}
+
+func (c config) validate() error {
+	if c.ListenAddr == "" {
+		return fmt.Errorf("listen_addr is required")
+	}
+	if c.GRPCAddr == c.ListenAddr {
+		return fmt.Errorf("grpc_addr must differ from listen_addr")
+	}
+	if c.ShutdownTimeout <= 0 {
+		return fmt.Errorf("shutdown_timeout must be a positive duration")
+	}
+	for name, d := range map[string]duration{
+		"read_timeout": c.ReadTimeout, "read_header_timeout": c.ReadHeaderTimeout,
+		"write_timeout": c.WriteTimeout, "idle_timeout": c.IdleTimeout,
+	} {
+		if d < 0 {
+			return fmt.Errorf("%s must not be negative", name)
+		}
+	}
+	switch c.Store.Driver {
+	case storeMemory, storeSQLite, storePostgres:
+	default:
+		return fmt.Errorf("store driver must be memory, sqlite or postgres, got %q", c.Store.Driver)
+	}
+	if c.Store.Driver == storePostgres && c.Store.DSN == "" {
+		return fmt.Errorf("store dsn is required for postgres")
+	}
+	if err := validPathMode(c.PathMode); err != nil {
+		return err
+	}
+	if err := c.Paging.validate(); err != nil {
+		return fmt.Errorf("paging: %w", err)
+	}
+	if _, err := newLogger(io.Discard, c.LogLevel, c.LogFormat); err != nil {
+		return err
+	}
+	if c.OrderIDs != orderIDsNumber && c.OrderIDs != orderIDsULID {
+		return fmt.Errorf("order_ids must be number or ulid, got %q", c.OrderIDs)
+	}
+	switch c.OrderNumbers.Reset {
+	case "", "never", "daily":
+	default:
+		return fmt.Errorf("order_numbers.reset must be never or daily, got %q", c.OrderNumbers.Reset)
+	}
+	if c.DeleteMode != deleteHard && c.DeleteMode != deleteSoft {
+		return fmt.Errorf("order_delete_mode must be hard or soft, got %q", c.DeleteMode)
+	}
+	if c.TableNumberMax < 1 {
+		return fmt.Errorf("table_number_max must be a positive whole number")
+	}
+	if c.ValidationRules != "" {
+		if err := registerConstraints(newValidatorRegistry(), c.ValidationRules); err != nil {
+			return fmt.Errorf("validation_rules: %w", err)
+		}
+	}
+	if err := c.Duplicates.validate(); err != nil {
+		return fmt.Errorf("duplicates: %w", err)
+	}
+	if c.IdempotencyTTL <= 0 {
+		return fmt.Errorf("idempotency_ttl must be a positive duration")
+	}
+	if err := c.Stuck.validate(); err != nil {
+		return fmt.Errorf("stuck: %w", err)
+	}
+	if c.DeliveryWebhook.StatusURL != "" {
+		if u, err := url.Parse(c.DeliveryWebhook.StatusURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("delivery_webhook.status_url must be an http or https URL, got %q", c.DeliveryWebhook.StatusURL)
+		}
+	}
+	if err := validEnvelopeMode(c.ResponseEnvelope); err != nil {
+		return err
+	}
+	if err := validFieldNaming(c.FieldNaming); err != nil {
+		return err
+	}
+	known := map[string]bool{"chaos": true, "locktrace": true}
+	for _, name := range defaultMiddlewareOrder {
+		known[name] = true
+	}
+	hasAuth := false
+	for _, name := range c.Middleware {
+		if !known[name] {
+			return fmt.Errorf("middleware: unknown middleware %q", name)
+		}
+		hasAuth = hasAuth || name == "auth"
+	}
+	// The order handlers leave authentication to the auth middleware's
+	// route rules, so without it anyone could use them.
+	if !hasAuth {
+		return fmt.Errorf("middleware: auth is required")
+	}
+	if err := c.RateLimit.validate(); err != nil {
+		return fmt.Errorf("rate_limit: %w", err)
+	}
+	if err := c.Quotas.validate(); err != nil {
+		return fmt.Errorf("quotas: %w", err)
+	}
+	if err := c.Chaos.validate(); err != nil {
+		return fmt.Errorf("chaos: %w", err)
+	}
+	if err := c.Exports.validate(); err != nil {
+		return fmt.Errorf("exports: %w", err)
+	}
+	if _, err := newImageStore(c.Images); err != nil {
+		return fmt.Errorf("images: %w", err)
+	}
+	if _, err := newMailConfig(c.SMTP); err != nil {
+		return fmt.Errorf("smtp: %w", err)
+	}
+	if _, err := newLinkSigner(c.LinkSigningKey); err != nil {
+		return err
+	}
+	return nil
+}
+
+// newHTTPServer is the HTTP server for cfg, serving h.
+func newHTTPServer(cfg config, h http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              cfg.ListenAddr,
+		Handler:           h,
+		ReadTimeout:       time.Duration(cfg.ReadTimeout),
+		ReadHeaderTimeout: time.Duration(cfg.ReadHeaderTimeout),
+		WriteTimeout:      time.Duration(cfg.WriteTimeout),
+		IdleTimeout:       time.Duration(cfg.IdleTimeout),
+	}
+}
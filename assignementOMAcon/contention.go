@@ -0,0 +1,412 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var contentionRe = regexp.MustCompile(`^/admin/contention/?$`)
+
+// recentLockTraces is how many traced requests /admin/contention keeps.
+const recentLockTraces = 200
+
+const (
+	lockRead  = "read"
+	lockWrite = "write"
+)
+
+// lockSpan is one hold of a lock: how long it took to get and how long it
+// was kept. Site is the function that took it.
+type lockSpan struct {
+	Lock  string        `json:"lock"`
+	Mode  string        `json:"mode"`
+	Site  string        `json:"site"`
+	Start time.Time     `json:"start"`
+	Wait  time.Duration `json:"wait_ns"`
+	Held  time.Duration `json:"held_ns"`
+}
+
+// lockTrace is the locks one request took.
+type lockTrace struct {
+	RequestID string        `json:"request_id"`
+	Method    string        `json:"method"`
+	Path      string        `json:"path"`
+	Start     time.Time     `json:"start"`
+	Duration  time.Duration `json:"duration_ns"`
+	Wait      time.Duration `json:"wait_ns"`
+	Held      time.Duration `json:"held_ns"`
+	Spans     []lockSpan    `json:"spans"`
+}
+
+// lockSiteStats sums the holds of one lock in one mode from one site.
+type lockSiteStats struct {
+	Lock         string        `json:"lock"`
+	Mode         string        `json:"mode"`
+	Site         string        `json:"site"`
+	Acquisitions int64         `json:"acquisitions"`
+	Contended    int64         `json:"contended"`
+	WaitTotal    time.Duration `json:"wait_total_ns"`
+	WaitMax      time.Duration `json:"wait_max_ns"`
+	HeldTotal    time.Duration `json:"held_total_ns"`
+	HeldMax      time.Duration `json:"held_max_ns"`
+}
+
+// contentionTracker collects lock waits and holds, in total by site and per
+// request. Locks do not see the request they are taken for, so requests are
+// matched to the goroutine serving them; locks taken on other goroutines
+// count toward the totals only.
+type contentionTracker struct {
+	since   time.Time
+	sites   map[string]*lockSiteStats
+	active  map[uint64]*lockTrace
+	recent  []lockTrace
+	next    int
+	enabled bool
+	*sync.Mutex
+}
+
+func newContentionTracker(enabled bool) *contentionTracker {
+	return &contentionTracker{
+		since:   time.Now().UTC(),
+		sites:   map[string]*lockSiteStats{},
+		active:  map[uint64]*lockTrace{},
+		enabled: enabled,
+		Mutex:   &sync.Mutex{},
+	}
+}
+
+// goroutineID reads the current goroutine's ID from the head of its stack,
+// "goroutine 123 [running]:".
+func goroutineID() uint64 {
+	var buf [64]byte
+	n := runtime.Stack(buf[:], false)
+	f := bytes.Fields(bytes.TrimPrefix(buf[:n], []byte("goroutine ")))
+	if len(f) == 0 {
+		return 0
+	}
+	id, _ := strconv.ParseUint(string(f[0]), 10, 64)
+	return id
+}
+
+// callerSite names the function skip frames above the caller, without the
+// package path.
+func callerSite(skip int) string {
+	pc, _, _, ok := runtime.Caller(skip + 1)
+	if !ok {
+		return "unknown"
+	}
+	name := runtime.FuncForPC(pc).Name()
+	if i := strings.LastIndex(name, "/"); i >= 0 {
+		name = name[i+1:]
+	}
+	return strings.TrimPrefix(name, "main.")
+}
+
+func (t *contentionTracker) begin(gid uint64, r *http.Request) {
+	t.Lock()
+	defer t.Unlock()
+	t.active[gid] = &lockTrace{
+		RequestID: requestID(r.Context()), Method: r.Method, Path: r.URL.Path,
+		Start: time.Now().UTC(), Spans: []lockSpan{},
+	}
+}
+
+// end closes a request's trace, keeping it if it took any locks.
+func (t *contentionTracker) end(gid uint64) lockTrace {
+	t.Lock()
+	defer t.Unlock()
+	tr := t.active[gid]
+	delete(t.active, gid)
+	if tr == nil {
+		return lockTrace{}
+	}
+	tr.Duration = time.Since(tr.Start)
+	if len(tr.Spans) > 0 {
+		if len(t.recent) < recentLockTraces {
+			t.recent = append(t.recent, *tr)
+		} else {
+			t.recent[t.next] = *tr
+		}
+		t.next = (t.next + 1) % recentLockTraces
+	}
+	return *tr
+}
+
+// acquired notes that a lock was got after waiting, returning where the span
+// is in the request's trace, or -1 outside a traced request.
+func (t *contentionTracker) acquired(gid uint64, span lockSpan) int {
+	t.Lock()
+	defer t.Unlock()
+	key := span.Lock + " " + span.Mode + " " + span.Site
+	st, ok := t.sites[key]
+	if !ok {
+		st = &lockSiteStats{Lock: span.Lock, Mode: span.Mode, Site: span.Site}
+		t.sites[key] = st
+	}
+	st.Acquisitions++
+	st.WaitTotal += span.Wait
+	if span.Wait > time.Millisecond {
+		st.Contended++
+	}
+	if span.Wait > st.WaitMax {
+		st.WaitMax = span.Wait
+	}
+	tr := t.active[gid]
+	if tr == nil {
+		return -1
+	}
+	tr.Wait += span.Wait
+	tr.Spans = append(tr.Spans, span)
+	return len(tr.Spans) - 1
+}
+
+// released notes how long a lock taken on goroutine gid was held.
+func (t *contentionTracker) released(gid uint64, span lockSpan, idx int) {
+	t.Lock()
+	defer t.Unlock()
+	if st, ok := t.sites[span.Lock+" "+span.Mode+" "+span.Site]; ok {
+		st.HeldTotal += span.Held
+		if span.Held > st.HeldMax {
+			st.HeldMax = span.Held
+		}
+	}
+	if tr := t.active[gid]; tr != nil && idx >= 0 && idx < len(tr.Spans) {
+		tr.Spans[idx].Held = span.Held
+		tr.Held += span.Held
+	}
+}
+
+// serverTiming is a Server-Timing header value for the locks a request has
+// taken so far.
+func (t *contentionTracker) serverTiming(gid uint64) string {
+	t.Lock()
+	defer t.Unlock()
+	tr := t.active[gid]
+	if tr == nil || len(tr.Spans) == 0 {
+		return ""
+	}
+	return fmt.Sprintf("lock-wait;dur=%.3f, lock-held;dur=%.3f, locks;desc=%q",
+		float64(tr.Wait)/float64(time.Millisecond), float64(tr.Held)/float64(time.Millisecond), strconv.Itoa(len(tr.Spans)))
+}
+
+// contentionReport is the /admin/contention summary.
+type contentionReport struct {
+	Enabled bool            `json:"enabled"`
+	Since   time.Time       `json:"since"`
+	Sites   []lockSiteStats `json:"sites"`
+	Slowest []lockTrace     `json:"slowest_requests"`
+}
+
+// report lists sites by total wait, and the recent requests that waited
+// longest.
+func (t *contentionTracker) report(limit int) contentionReport {
+	t.Lock()
+	defer t.Unlock()
+	rep := contentionReport{Enabled: t.enabled, Since: t.since, Sites: []lockSiteStats{}, Slowest: []lockTrace{}}
+	for _, st := range t.sites {
+		rep.Sites = append(rep.Sites, *st)
+	}
+	sort.Slice(rep.Sites, func(i, j int) bool {
+		if rep.Sites[i].WaitTotal != rep.Sites[j].WaitTotal {
+			return rep.Sites[i].WaitTotal > rep.Sites[j].WaitTotal
+		}
+		return rep.Sites[i].Lock+rep.Sites[i].Mode+rep.Sites[i].Site < rep.Sites[j].Lock+rep.Sites[j].Mode+rep.Sites[j].Site
+	})
+	rep.Slowest = append(rep.Slowest, t.recent...)
+	sort.SliceStable(rep.Slowest, func(i, j int) bool { return rep.Slowest[i].Wait > rep.Slowest[j].Wait })
+	if len(rep.Slowest) > limit {
+		rep.Slowest = rep.Slowest[:limit]
+	}
+	return rep
+}
+
+func (t *contentionTracker) reset() {
+	t.Lock()
+	defer t.Unlock()
+	t.since = time.Now().UTC()
+	t.sites = map[string]*lockSiteStats{}
+	t.recent, t.next = nil, 0
+}
+
+// heldLock is a hold in progress, for working out its length on release.
+type heldLock struct {
+	span lockSpan
+	gid  uint64
+	idx  int
+}
+
+// tracedRWMutex is a sync.RWMutex that reports its waits and holds to a
+// contentionTracker. Without one, or with tracing off, it is a plain
+// RWMutex.
+type tracedRWMutex struct {
+	name    string
+	mu      sync.RWMutex
+	tracker *contentionTracker
+	writer  heldLock
+	readers map[uint64][]heldLock
+	held    sync.Mutex
+}
+
+func newTracedRWMutex(name string, tracker *contentionTracker) *tracedRWMutex {
+	return &tracedRWMutex{name: name, tracker: tracker, readers: map[uint64][]heldLock{}}
+}
+
+func (m *tracedRWMutex) tracing() bool {
+	return m.tracker != nil && m.tracker.enabled
+}
+
+func (m *tracedRWMutex) Lock() {
+	if !m.tracing() {
+		m.mu.Lock()
+		return
+	}
+	gid, site, start := goroutineID(), callerSite(1), time.Now()
+	m.mu.Lock()
+	span := lockSpan{Lock: m.name, Mode: lockWrite, Site: site, Start: start.UTC(), Wait: time.Since(start)}
+	m.writer = heldLock{span: span, gid: gid, idx: m.tracker.acquired(gid, span)}
+}
+
+func (m *tracedRWMutex) Unlock() {
+	if !m.tracing() {
+		m.mu.Unlock()
+		return
+	}
+	h := m.writer
+	h.span.Held = time.Since(h.span.Start) - h.span.Wait
+	m.mu.Unlock()
+	m.tracker.released(h.gid, h.span, h.idx)
+}
+
+func (m *tracedRWMutex) RLock() {
+	if !m.tracing() {
+		m.mu.RLock()
+		return
+	}
+	gid, site, start := goroutineID(), callerSite(1), time.Now()
+	m.mu.RLock()
+	span := lockSpan{Lock: m.name, Mode: lockRead, Site: site, Start: start.UTC(), Wait: time.Since(start)}
+	h := heldLock{span: span, gid: gid, idx: m.tracker.acquired(gid, span)}
+	m.held.Lock()
+	m.readers[gid] = append(m.readers[gid], h)
+	m.held.Unlock()
+}
+
+func (m *tracedRWMutex) RUnlock() {
+	if !m.tracing() {
+		m.mu.RUnlock()
+		return
+	}
+	gid := goroutineID()
+	m.held.Lock()
+	holds := m.readers[gid]
+	var h heldLock
+	ok := len(holds) > 0
+	if ok {
+		h = holds[len(holds)-1]
+		if len(holds) == 1 {
+			delete(m.readers, gid)
+		} else {
+			m.readers[gid] = holds[:len(holds)-1]
+		}
+	}
+	m.held.Unlock()
+	m.mu.RUnlock()
+	if ok {
+		h.span.Held = time.Since(h.span.Start) - h.span.Wait
+		m.tracker.released(gid, h.span, h.idx)
+	}
+}
+
+// lockTraceWriter sets the Server-Timing header for the locks taken before
+// the response is written.
+type lockTraceWriter struct {
+	*statusRecorder
+	tracker *contentionTracker
+	gid     uint64
+	wrote   bool
+}
+
+func (w *lockTraceWriter) WriteHeader(code int) {
+	if !w.wrote {
+		w.wrote = true
+		if v := w.tracker.serverTiming(w.gid); v != "" {
+			w.Header().Set("Server-Timing", v)
+		}
+	}
+	w.statusRecorder.WriteHeader(code)
+}
+
+func (w *lockTraceWriter) Write(b []byte) (int, error) {
+	if !w.wrote {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.statusRecorder.Write(b)
+}
+
+// lockTraceMiddleware traces the locks each request takes. The totals go out
+// in a Server-Timing header and a debug log line, and the whole trace to
+// /admin/contention.
+func lockTraceMiddleware(tracker *contentionTracker) middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			gid := goroutineID()
+			tracker.begin(gid, r)
+			next.ServeHTTP(&lockTraceWriter{statusRecorder: &statusRecorder{ResponseWriter: w}, tracker: tracker, gid: gid}, r)
+			tr := tracker.end(gid)
+			if len(tr.Spans) > 0 {
+				slog.DebugContext(r.Context(), "locks",
+					slog.Int("count", len(tr.Spans)),
+					slog.Duration("wait", tr.Wait),
+					slog.Duration("held", tr.Held),
+				)
+			}
+		})
+	}
+}
+
+// contentionHandler serves /admin/contention: GET for the summary, the
+// ?limit= (default 20) slowest recent requests included, and DELETE to start
+// counting afresh.
+type contentionHandler struct {
+	tracker  *contentionTracker
+	sessions *sessionStore
+}
+
+func (h *contentionHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("content-type", "application/json")
+	if _, ok := h.sessions.requireScope(w, r, "orders:manage"); !ok {
+		return
+	}
+	if !contentionRe.MatchString(r.URL.Path) {
+		notFound(w, r)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		limit := 20
+		if v := r.URL.Query().Get("limit"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte("limit must be a non-negative integer"))
+				return
+			}
+			limit = n
+		}
+		writeJSON(w, r, http.StatusOK, h.tracker.report(limit))
+	case http.MethodDelete:
+		h.tracker.reset()
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		notFound(w, r)
+	}
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	listCouriersRe       = regexp.MustCompile(`^/couriers/?$`)
+	getCourierRe         = regexp.MustCompile(`^/couriers/([0-9]+)$`)
+	courierStatusRe      = regexp.MustCompile(`^/couriers/([0-9]+)/status$`)
+	courierLocationRe    = regexp.MustCompile(`^/couriers/([0-9]+)/location$`)
+	assignCourierRe      = regexp.MustCompile(`^/couriers/([0-9]+)/assignments$`)
+	unassignCourierRe    = regexp.MustCompile(`^/couriers/([0-9]+)/assignments/([^/]+)$`)
+	deliveredRe          = regexp.MustCompile(`^/couriers/([0-9]+)/assignments/([^/]+)/delivered$`)
+	courierAssignmentsRe = regexp.MustCompile(`^/couriers/assignments$`)
+)
+
+const (
+	courierAvailable  = "available"
+	courierOnDelivery = "on_delivery"
+	courierOffline    = "offline"
+)
+
+// courierLocation is where a courier's device last said it was.
+type courierLocation struct {
+	Lat float64   `json:"lat"`
+	Lng float64   `json:"lng"`
+	At  time.Time `json:"at"`
+}
+
+// courier is a driver delivering our own orders. Status moves to on_delivery
+// when they are given an order and back to available when their last one is
+// delivered; couriers set offline and available themselves.
+type courier struct {
+	ID       string           `json:"id"`
+	Name     string           `json:"name"`
+	Phone    string           `json:"phone,omitempty"`
+	Status   string           `json:"status"`
+	Location *courierLocation `json:"location,omitempty"`
+	Orders   []string         `json:"orders"`
+}
+
+// courierAssignment gives one order to a courier.
+type courierAssignment struct {
+	OrderID     string           `json:"order_id"`
+	CourierID   string           `json:"courier_id"`
+	CourierName string           `json:"courier_name"`
+	AssignedBy  string           `json:"assigned_by,omitempty"`
+	AssignedAt  time.Time        `json:"assigned_at"`
+	DeliveredAt *time.Time       `json:"delivered_at,omitempty"`
+	Location    *courierLocation `json:"location,omitempty"`
+}
+
+type courierStore struct {
+	couriers map[string]courier
+	// active holds the undelivered assignment for each order.
+	active map[string]courierAssignment
+	*sync.RWMutex
+}
+
+func newCourierStore() *courierStore {
+	return &courierStore{
+		couriers: map[string]courier{},
+		active:   map[string]courierAssignment{},
+		RWMutex:  &sync.RWMutex{},
+	}
+}
+
+type courierHandler struct {
+	couriers *courierStore
+	store    *datastore
+	sessions *sessionStore
+	audit    *auditLog
+}
+
+func (h *courierHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("content-type", "application/json")
+	sess, ok := h.sessions.requireScope(w, r, "orders:write")
+	if !ok {
+		return
+	}
+	switch {
+	case r.Method == http.MethodGet && listCouriersRe.MatchString(r.URL.Path):
+		h.List(w, r)
+		return
+	case r.Method == http.MethodPost && listCouriersRe.MatchString(r.URL.Path):
+		h.Create(w, r, sess)
+		return
+	case r.Method == http.MethodGet && courierAssignmentsRe.MatchString(r.URL.Path):
+		h.Assignments(w, r)
+		return
+	case r.Method == http.MethodGet && getCourierRe.MatchString(r.URL.Path):
+		h.couriers.RLock()
+		c, ok := h.couriers.couriers[getCourierRe.FindStringSubmatch(r.URL.Path)[1]]
+		h.couriers.RUnlock()
+		if !ok {
+			notFound(w, r)
+			return
+		}
+		writeJSON(w, r, http.StatusOK, c)
+		return
+	case r.Method == http.MethodPut && courierStatusRe.MatchString(r.URL.Path):
+		h.SetStatus(w, r)
+		return
+	case r.Method == http.MethodPost && courierLocationRe.MatchString(r.URL.Path):
+		h.Ping(w, r)
+		return
+	case r.Method == http.MethodPost && assignCourierRe.MatchString(r.URL.Path):
+		h.Assign(w, r, sess)
+		return
+	case r.Method == http.MethodDelete && unassignCourierRe.MatchString(r.URL.Path):
+		m := unassignCourierRe.FindStringSubmatch(r.URL.Path)
+		h.release(w, r, sess, m[1], m[2], false)
+		return
+	case r.Method == http.MethodPost && deliveredRe.MatchString(r.URL.Path):
+		m := deliveredRe.FindStringSubmatch(r.URL.Path)
+		h.release(w, r, sess, m[1], m[2], true)
+		return
+	default:
+		notFound(w, r)
+		return
+	}
+}
+
+// List returns the couriers, e.g. ?status=available for who is free.
+func (h *courierHandler) List(w http.ResponseWriter, r *http.Request) {
+	status := r.URL.Query().Get("status")
+	h.couriers.RLock()
+	out := make([]courier, 0, len(h.couriers.couriers))
+	for _, c := range h.couriers.couriers {
+		if status == "" || c.Status == status {
+			out = append(out, c)
+		}
+	}
+	h.couriers.RUnlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	writeJSON(w, r, http.StatusOK, out)
+}
+
+// Create adds a courier. Only managers take on couriers.
+func (h *courierHandler) Create(w http.ResponseWriter, r *http.Request, sess session) {
+	if !sess.hasScope("orders:manage") {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("forbidden"))
+		return
+	}
+	var c courier
+	if err := json.NewDecoder(r.Body).Decode(&c); err != nil || strings.TrimSpace(c.Name) == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("name is required"))
+		return
+	}
+	c.Name = strings.TrimSpace(c.Name)
+	c.Status, c.Location, c.Orders = courierOffline, nil, []string{}
+	h.couriers.Lock()
+	c.ID = strconv.Itoa(len(h.couriers.couriers) + 1)
+	h.couriers.couriers[c.ID] = c
+	h.couriers.Unlock()
+	h.audit.record(auditEntry{Action: "courier.create", Ref: c.ID, StaffID: sess.StaffID})
+	writeJSON(w, r, http.StatusCreated, c)
+}
+
+// SetStatus lets a courier come on or go off shift. Couriers with orders
+// still to deliver cannot do either.
+func (h *courierHandler) SetStatus(w http.ResponseWriter, r *http.Request) {
+	id := courierStatusRe.FindStringSubmatch(r.URL.Path)[1]
+	var req struct {
+		Status string `json:"status"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil ||
+		(req.Status != courierAvailable && req.Status != courierOffline) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("status must be available or offline"))
+		return
+	}
+	h.couriers.Lock()
+	c, ok := h.couriers.couriers[id]
+	if !ok {
+		h.couriers.Unlock()
+		notFound(w, r)
+		return
+	}
+	if len(c.Orders) > 0 {
+		h.couriers.Unlock()
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte("courier still has orders to deliver"))
+		return
+	}
+	c.Status = req.Status
+	h.couriers.couriers[id] = c
+	h.couriers.Unlock()
+	writeJSON(w, r, http.StatusOK, c)
+}
+
+// Ping records a courier's current position.
+func (h *courierHandler) Ping(w http.ResponseWriter, r *http.Request) {
+	id := courierLocationRe.FindStringSubmatch(r.URL.Path)[1]
+	var loc courierLocation
+	if err := json.NewDecoder(r.Body).Decode(&loc); err != nil ||
+		loc.Lat < -90 || loc.Lat > 90 || loc.Lng < -180 || loc.Lng > 180 {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("lat and lng must be valid coordinates"))
+		return
+	}
+	loc.At = time.Now().UTC()
+	h.couriers.Lock()
+	c, ok := h.couriers.couriers[id]
+	if ok {
+		c.Location = &loc
+		h.couriers.couriers[id] = c
+	}
+	h.couriers.Unlock()
+	if !ok {
+		notFound(w, r)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Assign gives an order to a courier who is on shift. An order goes to one
+// courier at a time; unassign it first to hand it to someone else.
+func (h *courierHandler) Assign(w http.ResponseWriter, r *http.Request, sess session) {
+	id := assignCourierRe.FindStringSubmatch(r.URL.Path)[1]
+	var req struct {
+		OrderID string `json:"order_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.OrderID == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("order_id is required"))
+		return
+	}
+	h.store.RLock()
+	o, ok := h.store.m[req.OrderID]
+	h.store.RUnlock()
+	if !ok {
+		notFound(w, r)
+		return
+	}
+	if o.Channel == channelWalkIn || isVoided(o) || isRefunded(o) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("order is not for delivery"))
+		return
+	}
+	h.couriers.Lock()
+	c, ok := h.couriers.couriers[id]
+	if !ok {
+		h.couriers.Unlock()
+		notFound(w, r)
+		return
+	}
+	conflict := ""
+	if c.Status == courierOffline {
+		conflict = "courier is offline"
+	} else if a, taken := h.couriers.active[o.ID]; taken {
+		conflict = "order is already assigned to " + a.CourierName
+	}
+	if conflict != "" {
+		h.couriers.Unlock()
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte(conflict))
+		return
+	}
+	a := courierAssignment{
+		OrderID:     o.ID,
+		CourierID:   c.ID,
+		CourierName: c.Name,
+		AssignedBy:  sess.StaffID,
+		AssignedAt:  time.Now().UTC(),
+	}
+	h.couriers.active[o.ID] = a
+	c.Orders = append(append([]string{}, c.Orders...), o.ID)
+	c.Status = courierOnDelivery
+	h.couriers.couriers[c.ID] = c
+	h.couriers.Unlock()
+	h.audit.record(auditEntry{Action: "courier.assign", OrderID: o.ID, Ref: c.ID, StaffID: sess.StaffID})
+	writeJSON(w, r, http.StatusCreated, a)
+}
+
+// release takes an order off a courier, either because it was delivered or
+// to reassign it. A courier with nothing left to deliver is available again.
+func (h *courierHandler) release(w http.ResponseWriter, r *http.Request, sess session, courierID, orderID string, delivered bool) {
+	h.couriers.Lock()
+	a, ok := h.couriers.active[orderID]
+	if !ok || a.CourierID != courierID {
+		h.couriers.Unlock()
+		notFound(w, r)
+		return
+	}
+	delete(h.couriers.active, orderID)
+	c := h.couriers.couriers[courierID]
+	orders := make([]string, 0, len(c.Orders))
+	for _, id := range c.Orders {
+		if id != orderID {
+			orders = append(orders, id)
+		}
+	}
+	c.Orders = orders
+	if len(orders) == 0 {
+		c.Status = courierAvailable
+	}
+	h.couriers.couriers[courierID] = c
+	h.couriers.Unlock()
+	action := "courier.unassign"
+	if delivered {
+		now := time.Now().UTC()
+		a.DeliveredAt = &now
+		action = "courier.delivered"
+	}
+	h.audit.record(auditEntry{Action: action, OrderID: orderID, Ref: courierID, StaffID: sess.StaffID})
+	writeJSON(w, r, http.StatusOK, a)
+}
+
+// Assignments lists the orders out for delivery with where their courier
+// last was, oldest first.
+func (h *courierHandler) Assignments(w http.ResponseWriter, r *http.Request) {
+	h.couriers.RLock()
+	out := make([]courierAssignment, 0, len(h.couriers.active))
+	for _, a := range h.couriers.active {
+		a.Location = h.couriers.couriers[a.CourierID].Location
+		out = append(out, a)
+	}
+	h.couriers.RUnlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].AssignedAt.Before(out[j].AssignedAt) })
+	writeJSON(w, r, http.StatusOK, out)
+}
@@ -0,0 +1,372 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	listCustomersRe     = regexp.MustCompile(`^/customers/?$`)
+	createCustomerRe    = regexp.MustCompile(`^/customers/?$`)
+	getCustomerRe       = regexp.MustCompile(`^/customers/([^/]+)$`)
+	issueCreditRe       = regexp.MustCompile(`^/customers/([^/]+)/credit$`)
+	houseAccountRe      = regexp.MustCompile(`^/customers/([^/]+)/house-account$`)
+	settleAccountRe     = regexp.MustCompile(`^/customers/([^/]+)/settle$`)
+	customerStatementRe = regexp.MustCompile(`^/customers/([^/]+)/statement$`)
+)
+
+const monthLayout = "2006-01"
+
+const (
+	txnCreditIssue  = "credit_issue"
+	txnCreditRedeem = "credit_redeem"
+	txnCreditRefund = "credit_refund"
+	txnCharge       = "charge"
+	txnChargeRefund = "charge_refund"
+	txnSettlement   = "settlement"
+)
+
+// houseAccount lets a customer charge orders and settle up monthly. Balance is
+// what the customer owes.
+type houseAccount struct {
+	Limit   int64 `json:"limit"`
+	Balance int64 `json:"balance"`
+}
+
+type customer struct {
+	ID           string        `json:"id"`
+	Name         string        `json:"name"`
+	Phone        string        `json:"phone,omitempty"`
+	Email        string        `json:"email,omitempty"`
+	StoreCredit  int64         `json:"store_credit"`
+	HouseAccount *houseAccount `json:"house_account,omitempty"`
+}
+
+// customerTxn is one entry on a customer's ledger, in minor currency units.
+type customerTxn struct {
+	ID         string    `json:"id"`
+	CustomerID string    `json:"customer_id"`
+	Type       string    `json:"type"`
+	Amount     int64     `json:"amount"`
+	OrderID    string    `json:"order_id,omitempty"`
+	Method     string    `json:"method,omitempty"`
+	StaffID    string    `json:"staff_id,omitempty"`
+	At         time.Time `json:"at"`
+}
+
+type customerStore struct {
+	m      map[string]customer
+	ledger []customerTxn
+	nextID int
+	*sync.RWMutex
+}
+
+func newCustomerStore() *customerStore {
+	return &customerStore{m: map[string]customer{}, RWMutex: &sync.RWMutex{}}
+}
+
+// post records a ledger entry. Callers hold the lock.
+func (s *customerStore) post(t customerTxn) {
+	t.ID = strconv.Itoa(len(s.ledger) + 1)
+	s.ledger = append(s.ledger, t)
+}
+
+// move applies a ledger entry to the customer's balances after checking it is
+// allowed, all under one lock.
+func (s *customerStore) move(t customerTxn) (customer, error) {
+	s.Lock()
+	defer s.Unlock()
+	c, ok := s.m[t.CustomerID]
+	if !ok {
+		return customer{}, errAccountNotFound
+	}
+	switch t.Type {
+	case txnCreditIssue, txnCreditRefund:
+		c.StoreCredit += t.Amount
+	case txnCreditRedeem:
+		if c.StoreCredit < t.Amount {
+			return customer{}, errInsufficientFunds
+		}
+		c.StoreCredit -= t.Amount
+	case txnCharge, txnChargeRefund, txnSettlement:
+		if c.HouseAccount == nil {
+			return customer{}, errAccountNotFound
+		}
+		acct := *c.HouseAccount
+		switch t.Type {
+		case txnCharge:
+			if acct.Balance+t.Amount > acct.Limit {
+				return customer{}, errInsufficientFunds
+			}
+			acct.Balance += t.Amount
+		default:
+			acct.Balance -= t.Amount
+		}
+		c.HouseAccount = &acct
+	}
+	s.m[c.ID] = c
+	s.post(t)
+	return c, nil
+}
+
+// storeCreditTender lets payment legs spend a customer's store credit.
+type storeCreditTender struct {
+	customers *customerStore
+}
+
+func (t storeCreditTender) debit(ref string, amount int64, orderID, staffID string, now time.Time) (string, error) {
+	_, err := t.customers.move(customerTxn{CustomerID: ref, Type: txnCreditRedeem, Amount: amount, OrderID: orderID, StaffID: staffID, At: now})
+	return ref, err
+}
+
+func (t storeCreditTender) refund(ref string, amount int64, orderID, staffID string, now time.Time) {
+	t.customers.move(customerTxn{CustomerID: ref, Type: txnCreditRefund, Amount: amount, OrderID: orderID, StaffID: staffID, At: now})
+}
+
+// houseAccountTender charges payment legs to a customer's house account.
+type houseAccountTender struct {
+	customers *customerStore
+}
+
+func (t houseAccountTender) debit(ref string, amount int64, orderID, staffID string, now time.Time) (string, error) {
+	_, err := t.customers.move(customerTxn{CustomerID: ref, Type: txnCharge, Amount: amount, OrderID: orderID, StaffID: staffID, At: now})
+	return ref, err
+}
+
+func (t houseAccountTender) refund(ref string, amount int64, orderID, staffID string, now time.Time) {
+	t.customers.move(customerTxn{CustomerID: ref, Type: txnChargeRefund, Amount: amount, OrderID: orderID, StaffID: staffID, At: now})
+}
+
+// statement covers one calendar month of a customer's ledger. House account
+// balances are what the customer owes at the start and end of the month.
+type statement struct {
+	CustomerID     string        `json:"customer_id"`
+	Name           string        `json:"name"`
+	Month          string        `json:"month"`
+	OpeningBalance int64         `json:"opening_balance"`
+	Charges        int64         `json:"charges"`
+	Payments       int64         `json:"payments"`
+	ClosingBalance int64         `json:"closing_balance"`
+	StoreCredit    int64         `json:"store_credit"`
+	Transactions   []customerTxn `json:"transactions"`
+}
+
+type customerHandler struct {
+	customers *customerStore
+	sessions  *sessionStore
+	audit     *auditLog
+	jsonAPI   *jsonAPI
+}
+
+func (h *customerHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("content-type", "application/json")
+	scope := "orders:write"
+	if issueCreditRe.MatchString(r.URL.Path) || houseAccountRe.MatchString(r.URL.Path) || settleAccountRe.MatchString(r.URL.Path) {
+		scope = "orders:manage"
+	}
+	sess, ok := h.sessions.requireScope(w, r, scope)
+	if !ok {
+		return
+	}
+	switch {
+	case r.Method == http.MethodGet && listCustomersRe.MatchString(r.URL.Path):
+		h.List(w, r)
+		return
+	case r.Method == http.MethodPost && createCustomerRe.MatchString(r.URL.Path):
+		h.Create(w, r)
+		return
+	case r.Method == http.MethodGet && getCustomerRe.MatchString(r.URL.Path):
+		h.Get(w, r)
+		return
+	case r.Method == http.MethodPost && issueCreditRe.MatchString(r.URL.Path):
+		h.IssueCredit(w, r, sess)
+		return
+	case r.Method == http.MethodPut && houseAccountRe.MatchString(r.URL.Path):
+		h.PutHouseAccount(w, r, sess)
+		return
+	case r.Method == http.MethodPost && settleAccountRe.MatchString(r.URL.Path):
+		h.Settle(w, r, sess)
+		return
+	case r.Method == http.MethodGet && customerStatementRe.MatchString(r.URL.Path):
+		h.Statement(w, r)
+		return
+	default:
+		notFound(w, r)
+		return
+	}
+}
+
+func (h *customerHandler) List(w http.ResponseWriter, r *http.Request) {
+	h.customers.RLock()
+	out := make([]customer, 0, len(h.customers.m))
+	for _, c := range h.customers.m {
+		out = append(out, c)
+	}
+	h.customers.RUnlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	if wantsJSONAPI(r) {
+		res := make([]jsonAPIResource, 0, len(out))
+		for _, c := range out {
+			res = append(res, h.jsonAPI.customerResource(c))
+		}
+		h.jsonAPI.writeMany(w, r, http.StatusOK, res)
+		return
+	}
+	writeJSON(w, r, http.StatusOK, out)
+}
+
+func (h *customerHandler) Create(w http.ResponseWriter, r *http.Request) {
+	var c customer
+	if err := json.NewDecoder(r.Body).Decode(&c); err != nil || c.Name == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("name is required"))
+		return
+	}
+	c.StoreCredit, c.HouseAccount = 0, nil
+	h.customers.Lock()
+	h.customers.nextID++
+	c.ID = "c" + strconv.Itoa(h.customers.nextID)
+	h.customers.m[c.ID] = c
+	h.customers.Unlock()
+	writeJSON(w, r, http.StatusCreated, c)
+}
+
+func (h *customerHandler) Get(w http.ResponseWriter, r *http.Request) {
+	matches := getCustomerRe.FindStringSubmatch(r.URL.Path)
+	h.customers.RLock()
+	c, ok := h.customers.m[matches[1]]
+	h.customers.RUnlock()
+	if !ok {
+		notFound(w, r)
+		return
+	}
+	if wantsJSONAPI(r) {
+		h.jsonAPI.writeOne(w, r, http.StatusOK, h.jsonAPI.customerResource(c))
+		return
+	}
+	writeJSON(w, r, http.StatusOK, c)
+}
+
+func (h *customerHandler) IssueCredit(w http.ResponseWriter, r *http.Request, sess session) {
+	matches := issueCreditRe.FindStringSubmatch(r.URL.Path)
+	var req struct {
+		Amount int64 `json:"amount"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Amount <= 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("a positive amount is required"))
+		return
+	}
+	c, err := h.customers.move(customerTxn{CustomerID: matches[1], Type: txnCreditIssue, Amount: req.Amount, StaffID: sess.StaffID, At: time.Now().UTC()})
+	if err != nil {
+		accountFailed(w, r, err)
+		return
+	}
+	h.audit.record(auditEntry{Action: "customer.credit", Ref: c.ID, StaffID: sess.StaffID})
+	writeJSON(w, r, http.StatusOK, c)
+}
+
+// PutHouseAccount opens a house account or changes its credit limit.
+func (h *customerHandler) PutHouseAccount(w http.ResponseWriter, r *http.Request, sess session) {
+	matches := houseAccountRe.FindStringSubmatch(r.URL.Path)
+	var req struct {
+		Limit int64 `json:"limit"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Limit < 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("a non-negative limit is required"))
+		return
+	}
+	h.customers.Lock()
+	c, ok := h.customers.m[matches[1]]
+	if !ok {
+		h.customers.Unlock()
+		notFound(w, r)
+		return
+	}
+	acct := houseAccount{Limit: req.Limit}
+	if c.HouseAccount != nil {
+		acct.Balance = c.HouseAccount.Balance
+	}
+	c.HouseAccount = &acct
+	h.customers.m[c.ID] = c
+	h.customers.Unlock()
+	h.audit.record(auditEntry{Action: "customer.house_account", Ref: c.ID, StaffID: sess.StaffID})
+	writeJSON(w, r, http.StatusOK, c)
+}
+
+// Settle records a payment against the house account balance.
+func (h *customerHandler) Settle(w http.ResponseWriter, r *http.Request, sess session) {
+	matches := settleAccountRe.FindStringSubmatch(r.URL.Path)
+	var req struct {
+		Amount int64  `json:"amount"`
+		Method string `json:"method"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Amount <= 0 || (req.Method != tenderCash && req.Method != tenderCard) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("a positive amount and method (cash or card) are required"))
+		return
+	}
+	c, err := h.customers.move(customerTxn{CustomerID: matches[1], Type: txnSettlement, Amount: req.Amount, Method: req.Method, StaffID: sess.StaffID, At: time.Now().UTC()})
+	if err != nil {
+		accountFailed(w, r, err)
+		return
+	}
+	h.audit.record(auditEntry{Action: "customer.settle", Ref: c.ID, StaffID: sess.StaffID})
+	writeJSON(w, r, http.StatusOK, c)
+}
+
+// Statement reports a customer's ledger for ?month=YYYY-MM (default this
+// month).
+func (h *customerHandler) Statement(w http.ResponseWriter, r *http.Request) {
+	matches := customerStatementRe.FindStringSubmatch(r.URL.Path)
+	month := r.URL.Query().Get("month")
+	if month == "" {
+		month = time.Now().UTC().Format(monthLayout)
+	}
+	start, err := time.Parse(monthLayout, month)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("month must be YYYY-MM"))
+		return
+	}
+	end := start.AddDate(0, 1, 0)
+
+	h.customers.RLock()
+	defer h.customers.RUnlock()
+	c, ok := h.customers.m[matches[1]]
+	if !ok {
+		notFound(w, r)
+		return
+	}
+	st := statement{CustomerID: c.ID, Name: c.Name, Month: month, StoreCredit: c.StoreCredit, Transactions: []customerTxn{}}
+	for _, t := range h.customers.ledger {
+		if t.CustomerID != c.ID || !t.At.Before(end) {
+			continue
+		}
+		var owed int64
+		switch t.Type {
+		case txnCharge:
+			owed = t.Amount
+		case txnChargeRefund, txnSettlement:
+			owed = -t.Amount
+		}
+		if t.At.Before(start) {
+			st.OpeningBalance += owed
+			continue
+		}
+		if owed > 0 {
+			st.Charges += owed
+		} else {
+			st.Payments -= owed
+		}
+		st.Transactions = append(st.Transactions, t)
+	}
+	st.ClosingBalance = st.OpeningBalance + st.Charges - st.Payments
+	writeJSON(w, r, http.StatusOK, st)
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"regexp"
+	"sync"
+	"time"
+)
+
+var deliveryWebhookRe = regexp.MustCompile(`^/integrations/([a-z0-9-]+)/orders$`)
+
+const (
+	deliveryAccepted  = "accepted"
+	deliveryCompleted = "completed"
+	deliveryCancelled = "cancelled"
+)
+
+const (
+	deliverySignatureHeader = "X-Delivery-Signature"
+	maxDeliveryPayloadBytes = 1 << 20
+)
+
+var errBadDeliveryPayload = errors.New("malformed delivery order")
+
+// externalOrder is a delivery platform's order translated into our terms.
+// ExternalID is the platform's own reference, used for de-duplication and for
+// status updates sent back.
+type externalOrder struct {
+	ExternalID string
+	Order      order
+}
+
+// deliveryAdapter connects one delivery platform. Adapters authenticate and
+// decode the platform's order webhooks and push our status changes back.
+// pushStatus reports the platform's response code, or zero and no error when
+// the platform takes no status updates.
+type deliveryAdapter interface {
+	name() string
+	verify(r *http.Request, body []byte) bool
+	parseOrder(body []byte) (externalOrder, error)
+	pushStatus(ctx context.Context, externalID, status string) (int, error)
+}
+
+// deliveryLink ties a stored order to the platform order it came from.
+type deliveryLink struct {
+	Platform   string `json:"platform"`
+	ExternalID string `json:"external_id"`
+	OrderID    string `json:"order_id"`
+}
+
+type deliveryStore struct {
+	adapters map[string]deliveryAdapter
+	byOrder  map[string]deliveryLink
+	webhooks *webhookLog
+	*sync.RWMutex
+}
+
+func newDeliveryStore() *deliveryStore {
+	return &deliveryStore{
+		adapters: map[string]deliveryAdapter{},
+		byOrder:  map[string]deliveryLink{},
+		webhooks: newWebhookLog(),
+		RWMutex:  &sync.RWMutex{},
+	}
+}
+
+func (s *deliveryStore) register(a deliveryAdapter) {
+	s.Lock()
+	s.adapters[a.name()] = a
+	s.Unlock()
+}
+
+func (s *deliveryStore) adapter(name string) (deliveryAdapter, bool) {
+	s.RLock()
+	defer s.RUnlock()
+	a, ok := s.adapters[name]
+	return a, ok
+}
+
+func deliveryOrderID(platform, externalID string) string {
+	return platform + "-" + externalID
+}
+
+// push sends a status update to the platform an order came from, if any, in
+// the background. Failed updates are retried a few times and then kept for
+// redelivery by hand.
+func (s *deliveryStore) push(orderID, status string) {
+	s.RLock()
+	link, ok := s.byOrder[orderID]
+	a := s.adapters[link.Platform]
+	s.RUnlock()
+	if !ok || a == nil {
+		return
+	}
+	go s.webhooks.deliver(a, webhookDelivery{
+		Platform:   link.Platform,
+		OrderID:    orderID,
+		ExternalID: link.ExternalID,
+		Event:      status,
+	})
+}
+
+// statusChanged is installed as an after-status-change hook so platforms hear
+// when their orders are settled or voided.
+func (s *deliveryStore) statusChanged(ctx context.Context, prev, next order) {
+	switch {
+	case isVoided(next) && !isVoided(prev):
+		s.push(next.ID, deliveryCancelled)
+	case isPaid(next) && !isPaid(prev):
+		s.push(next.ID, deliveryCompleted)
+	}
+}
+
+type deliveryHandler struct {
+	delivery *deliveryStore
+	orders   *orderHandler
+}
+
+func (h *deliveryHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("content-type", "application/json")
+	switch {
+	case r.Method == http.MethodPost && deliveryWebhookRe.MatchString(r.URL.Path):
+		h.Ingest(w, r)
+		return
+	default:
+		notFound(w, r)
+		return
+	}
+}
+
+// Ingest accepts an order webhook from a delivery platform. The request is
+// authenticated by the platform's adapter rather than a staff session. A
+// webhook redelivered for an order we already hold returns that order.
+func (h *deliveryHandler) Ingest(w http.ResponseWriter, r *http.Request) {
+	matches := deliveryWebhookRe.FindStringSubmatch(r.URL.Path)
+	a, ok := h.delivery.adapter(matches[1])
+	if !ok {
+		notFound(w, r)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxDeliveryPayloadBytes)
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		bodyReadFailed(w, r, err)
+		return
+	}
+	if !a.verify(r, body) {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("invalid signature"))
+		return
+	}
+	ext, err := a.parseOrder(body)
+	if err != nil || ext.ExternalID == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(errBadDeliveryPayload.Error()))
+		return
+	}
+
+	u := ext.Order
+	u.ID = deliveryOrderID(a.name(), ext.ExternalID)
+	u.Channel = channelDeliveryApp
+	h.orders.store.RLock()
+	existing, dup := h.orders.store.m[u.ID]
+	h.orders.store.RUnlock()
+	if dup {
+		writeJSON(w, r, http.StatusOK, existing)
+		return
+	}
+	unavailable := h.orders.menu.price(order{}, &u)
+	tallyItems(&u)
+	if errs := append(unavailable, h.orders.validators.validate(u)...); len(errs) > 0 {
+		validationFailed(w, r, errs)
+		return
+	}
+	u, err = h.orders.create(r, u)
+	if err != nil {
+		mutateFailed(w, r, err)
+		return
+	}
+	h.delivery.Lock()
+	h.delivery.byOrder[u.ID] = deliveryLink{Platform: a.name(), ExternalID: ext.ExternalID, OrderID: u.ID}
+	h.delivery.Unlock()
+	h.delivery.push(u.ID, deliveryAccepted)
+	writeJSON(w, r, http.StatusCreated, u)
+}
+
+// webhookAdapter is the reference adapter. It speaks a plain JSON format
+// signed with a shared secret (hex HMAC-SHA256 of the body) and posts status
+// updates, signed the same way, to a callback URL.
+type webhookAdapter struct {
+	platform  string
+	secret    []byte
+	statusURL string
+	client    *http.Client
+}
+
+type webhookItem struct {
+	Name     string `json:"name"`
+	Quantity int    `json:"quantity"`
+}
+
+type webhookOrder struct {
+	ID       string        `json:"id"`
+	Customer string        `json:"customer"`
+	Items    []webhookItem `json:"items"`
+	Total    int64         `json:"total"`
+	Paid     bool          `json:"paid"`
+}
+
+func newWebhookAdapter(platform, secret, statusURL string) *webhookAdapter {
+	return &webhookAdapter{
+		platform:  platform,
+		secret:    []byte(secret),
+		statusURL: statusURL,
+		client:    &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (a *webhookAdapter) name() string {
+	return a.platform
+}
+
+func (a *webhookAdapter) sign(body []byte) string {
+	mac := hmac.New(sha256.New, a.secret)
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (a *webhookAdapter) verify(r *http.Request, body []byte) bool {
+	sig := r.Header.Get(deliverySignatureHeader)
+	return sig != "" && hmac.Equal([]byte(sig), []byte(a.sign(body)))
+}
+
+func (a *webhookAdapter) parseOrder(body []byte) (externalOrder, error) {
+	var in webhookOrder
+	if err := json.Unmarshal(body, &in); err != nil {
+		return externalOrder{}, err
+	}
+	if len(in.Items) == 0 || in.Total < 0 {
+		return externalOrder{}, errBadDeliveryPayload
+	}
+	var items orderItems
+	for _, it := range in.Items {
+		if it.Name == "" || it.Quantity < 1 {
+			return externalOrder{}, errBadDeliveryPayload
+		}
+		items = append(items, orderItem{Name: it.Name, Quantity: it.Quantity})
+	}
+	o := order{
+		Name:       in.Customer,
+		OrderItems: items,
+		Total:      in.Total,
+		Payment:    paymentPending,
+	}
+	if in.Paid {
+		o.Payment = paymentPaid
+		o.PaymentMethod = a.platform
+	}
+	return externalOrder{ExternalID: in.ID, Order: o}, nil
+}
+
+func (a *webhookAdapter) pushStatus(ctx context.Context, externalID, status string) (int, error) {
+	if a.statusURL == "" {
+		return 0, nil
+	}
+	body, err := json.Marshal(map[string]string{"id": externalID, "status": status})
+	if err != nil {
+		return 0, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.statusURL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("content-type", "application/json")
+	req.Header.Set(deliverySignatureHeader, a.sign(body))
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return resp.StatusCode, errors.New("status callback returned " + resp.Status)
+	}
+	return resp.StatusCode, nil
+}
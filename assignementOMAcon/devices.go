@@ -0,0 +1,212 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	listDevicesRe    = regexp.MustCompile(`^/devices/?$`)
+	getDeviceRe      = regexp.MustCompile(`^/devices/([^/]+)$`)
+	registerDeviceRe = regexp.MustCompile(`^/devices/?$`)
+	revokeDeviceRe   = regexp.MustCompile(`^/devices/([^/]+)/revoke$`)
+)
+
+const deviceTokenHeader = "X-Device-Token"
+
+const (
+	deviceTerminal       = "terminal"
+	deviceKitchenDisplay = "kitchen_display"
+)
+
+type device struct {
+	ID           string     `json:"id"`
+	Name         string     `json:"name"`
+	Kind         string     `json:"kind"`
+	RegisteredAt time.Time  `json:"registered_at"`
+	LastSeenAt   *time.Time `json:"last_seen_at,omitempty"`
+	LastSeenIP   string     `json:"last_seen_ip,omitempty"`
+	RevokedAt    *time.Time `json:"revoked_at,omitempty"`
+	// Credential is only populated in the registration response.
+	Credential string `json:"credential,omitempty"`
+	credHash   string
+}
+
+type deviceStore struct {
+	m      map[string]device
+	byCred map[string]string
+	*sync.RWMutex
+}
+
+func newDeviceStore() *deviceStore {
+	return &deviceStore{
+		m:       map[string]device{},
+		byCred:  map[string]string{},
+		RWMutex: &sync.RWMutex{},
+	}
+}
+
+func hashCredential(cred string) string {
+	sum := sha256.Sum256([]byte(cred))
+	return hex.EncodeToString(sum[:])
+}
+
+func (s *deviceStore) register(name, kind string, now time.Time) (device, error) {
+	id, err := randomToken(10)
+	if err != nil {
+		return device{}, err
+	}
+	cred, err := randomToken(40)
+	if err != nil {
+		return device{}, err
+	}
+	d := device{
+		ID:           id,
+		Name:         name,
+		Kind:         kind,
+		RegisteredAt: now,
+		credHash:     hashCredential(cred),
+	}
+	s.Lock()
+	s.m[d.ID] = d
+	s.byCred[d.credHash] = d.ID
+	s.Unlock()
+	d.Credential = cred
+	return d, nil
+}
+
+func (s *deviceStore) revoke(id string, now time.Time) (device, bool) {
+	s.Lock()
+	defer s.Unlock()
+	d, ok := s.m[id]
+	if !ok {
+		return device{}, false
+	}
+	if d.RevokedAt == nil {
+		d.RevokedAt = &now
+		delete(s.byCred, d.credHash)
+		s.m[id] = d
+	}
+	return d, true
+}
+
+// identify resolves the device credential on a request and records it as seen.
+// Unknown or revoked credentials yield no device.
+func (s *deviceStore) identify(r *http.Request) (string, bool) {
+	cred := r.Header.Get(deviceTokenHeader)
+	if cred == "" {
+		return "", false
+	}
+	now := time.Now().UTC()
+	s.Lock()
+	defer s.Unlock()
+	id, ok := s.byCred[hashCredential(cred)]
+	if !ok {
+		return "", false
+	}
+	d := s.m[id]
+	d.LastSeenAt = &now
+	d.LastSeenIP = r.RemoteAddr
+	s.m[id] = d
+	return id, true
+}
+
+func (s *deviceStore) list() []device {
+	s.RLock()
+	out := make([]device, 0, len(s.m))
+	for _, d := range s.m {
+		out = append(out, d)
+	}
+	s.RUnlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].RegisteredAt.Before(out[j].RegisteredAt) })
+	return out
+}
+
+func (s *deviceStore) get(id string) (device, bool) {
+	s.RLock()
+	defer s.RUnlock()
+	d, ok := s.m[id]
+	return d, ok
+}
+
+type deviceHandler struct {
+	devices  *deviceStore
+	sessions *sessionStore
+	audit    *auditLog
+}
+
+func (h *deviceHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("content-type", "application/json")
+	sess, ok := h.sessions.requireScope(w, r, "orders:manage")
+	if !ok {
+		return
+	}
+	switch {
+	case r.Method == http.MethodGet && listDevicesRe.MatchString(r.URL.Path):
+		h.List(w, r)
+		return
+	case r.Method == http.MethodGet && getDeviceRe.MatchString(r.URL.Path):
+		h.Get(w, r)
+		return
+	case r.Method == http.MethodPost && registerDeviceRe.MatchString(r.URL.Path):
+		h.Register(w, r, sess)
+		return
+	case r.Method == http.MethodPost && revokeDeviceRe.MatchString(r.URL.Path):
+		h.Revoke(w, r, sess)
+		return
+	default:
+		notFound(w, r)
+		return
+	}
+}
+
+func (h *deviceHandler) List(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, r, http.StatusOK, h.devices.list())
+}
+
+func (h *deviceHandler) Get(w http.ResponseWriter, r *http.Request) {
+	matches := getDeviceRe.FindStringSubmatch(r.URL.Path)
+	d, ok := h.devices.get(matches[1])
+	if !ok {
+		notFound(w, r)
+		return
+	}
+	writeJSON(w, r, http.StatusOK, d)
+}
+
+func (h *deviceHandler) Register(w http.ResponseWriter, r *http.Request, sess session) {
+	var req struct {
+		Name string `json:"name"`
+		Kind string `json:"kind"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Name == "" ||
+		(req.Kind != deviceTerminal && req.Kind != deviceKitchenDisplay) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("name and kind (terminal or kitchen_display) are required"))
+		return
+	}
+	d, err := h.devices.register(req.Name, req.Kind, time.Now().UTC())
+	if err != nil {
+		internalServerError(w, r)
+		return
+	}
+	h.audit.record(auditEntry{Action: "device.register", StaffID: sess.StaffID, DeviceID: d.ID})
+	writeJSON(w, r, http.StatusCreated, d)
+}
+
+func (h *deviceHandler) Revoke(w http.ResponseWriter, r *http.Request, sess session) {
+	matches := revokeDeviceRe.FindStringSubmatch(r.URL.Path)
+	d, ok := h.devices.revoke(matches[1], time.Now().UTC())
+	if !ok {
+		notFound(w, r)
+		return
+	}
+	h.audit.record(auditEntry{Action: "device.revoke", StaffID: sess.StaffID, DeviceID: d.ID})
+	writeJSON(w, r, http.StatusOK, d)
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	listDrawersRe      = regexp.MustCompile(`^/drawers/?$`)
+	openDrawerRe       = regexp.MustCompile(`^/drawers/([a-z0-9_-]+)/open$`)
+	closeDrawerRe      = regexp.MustCompile(`^/drawers/([a-z0-9_-]+)/close$`)
+	getDrawerSessionRe = regexp.MustCompile(`^/drawers/sessions/([0-9]+)$`)
+	reconcileDrawerRe  = regexp.MustCompile(`^/drawers/sessions/([0-9]+)/reconciliation$`)
+)
+
+// drawerCash is cash a payment left in the drawer: what the guest handed
+// over less their change.
+type drawerCash struct {
+	OrderID string    `json:"order_id"`
+	LegID   string    `json:"leg_id"`
+	Amount  int64     `json:"amount"`
+	At      time.Time `json:"at"`
+}
+
+// drawerSession is one cash drawer from opening, with its starting float,
+// to the count at close. Amounts are in minor currency units.
+type drawerSession struct {
+	ID            string       `json:"id"`
+	Drawer        string       `json:"drawer"`
+	StartingFloat int64        `json:"starting_float"`
+	OpenedBy      string       `json:"opened_by"`
+	OpenedAt      time.Time    `json:"opened_at"`
+	Cash          []drawerCash `json:"cash"`
+	ClosedBy      string       `json:"closed_by,omitempty"`
+	ClosedAt      *time.Time   `json:"closed_at,omitempty"`
+	Counted       *int64       `json:"counted,omitempty"`
+}
+
+func (s drawerSession) open() bool {
+	return s.ClosedAt == nil
+}
+
+// drawerReconciliation compares the cash that should be in a drawer with what
+// was counted. Variance is counted minus expected: negative means short.
+type drawerReconciliation struct {
+	SessionID     string `json:"session_id"`
+	Drawer        string `json:"drawer"`
+	StartingFloat int64  `json:"starting_float"`
+	CashPayments  int    `json:"cash_payments"`
+	CashTaken     int64  `json:"cash_taken"`
+	Expected      int64  `json:"expected"`
+	Counted       *int64 `json:"counted"`
+	Variance      *int64 `json:"variance"`
+	Closed        bool   `json:"closed"`
+}
+
+func (s drawerSession) reconcile() drawerReconciliation {
+	rec := drawerReconciliation{
+		SessionID:     s.ID,
+		Drawer:        s.Drawer,
+		StartingFloat: s.StartingFloat,
+		CashPayments:  len(s.Cash),
+		Counted:       s.Counted,
+		Closed:        !s.open(),
+	}
+	for _, c := range s.Cash {
+		rec.CashTaken += c.Amount
+	}
+	rec.Expected = s.StartingFloat + rec.CashTaken
+	if s.Counted != nil {
+		v := *s.Counted - rec.Expected
+		rec.Variance = &v
+	}
+	return rec
+}
+
+type drawerStore struct {
+	sessions []drawerSession
+	// current maps each drawer to the index of its open session.
+	current map[string]int
+	*sync.RWMutex
+}
+
+func newDrawerStore() *drawerStore {
+	return &drawerStore{current: map[string]int{}, RWMutex: &sync.RWMutex{}}
+}
+
+func (s *drawerStore) get(id string) (drawerSession, bool) {
+	n, err := strconv.Atoi(id)
+	s.RLock()
+	defer s.RUnlock()
+	if err != nil || n < 1 || n > len(s.sessions) {
+		return drawerSession{}, false
+	}
+	return s.sessions[n-1], true
+}
+
+// forCash picks the session a cash payment goes into: the named drawer's,
+// or, when none is named, the only drawer open. ok is false if the named
+// drawer is not open or it is ambiguous which is meant; with no drawers open
+// at all cash is taken without one.
+func (s *drawerStore) forCash(drawer string) (id string, ok bool) {
+	s.RLock()
+	defer s.RUnlock()
+	if drawer != "" {
+		i, open := s.current[drawer]
+		if !open {
+			return "", false
+		}
+		return s.sessions[i].ID, true
+	}
+	switch len(s.current) {
+	case 0:
+		return "", true
+	case 1:
+		for _, i := range s.current {
+			return s.sessions[i].ID, true
+		}
+	}
+	return "", false
+}
+
+// record adds cash to a session. Cash counts even if the drawer was closed
+// while the payment was going through, so the variance shows it.
+func (s *drawerStore) record(sessionID string, c drawerCash) {
+	n, _ := strconv.Atoi(sessionID)
+	s.Lock()
+	defer s.Unlock()
+	if n >= 1 && n <= len(s.sessions) {
+		s.sessions[n-1].Cash = append(s.sessions[n-1].Cash, c)
+	}
+}
+
+type drawerHandler struct {
+	drawers  *drawerStore
+	sessions *sessionStore
+	audit    *auditLog
+}
+
+func (h *drawerHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("content-type", "application/json")
+	sess, ok := h.sessions.requireScope(w, r, "orders:write")
+	if !ok {
+		return
+	}
+	switch {
+	case r.Method == http.MethodGet && listDrawersRe.MatchString(r.URL.Path):
+		h.drawers.RLock()
+		out := make([]drawerSession, 0, len(h.drawers.current))
+		for _, i := range h.drawers.current {
+			out = append(out, h.drawers.sessions[i])
+		}
+		h.drawers.RUnlock()
+		writeJSON(w, r, http.StatusOK, out)
+		return
+	case r.Method == http.MethodPost && openDrawerRe.MatchString(r.URL.Path):
+		h.Open(w, r, sess)
+		return
+	case r.Method == http.MethodPost && closeDrawerRe.MatchString(r.URL.Path):
+		h.Close(w, r, sess)
+		return
+	case r.Method == http.MethodGet && getDrawerSessionRe.MatchString(r.URL.Path):
+		ds, ok := h.drawers.get(getDrawerSessionRe.FindStringSubmatch(r.URL.Path)[1])
+		if !ok {
+			notFound(w, r)
+			return
+		}
+		writeJSON(w, r, http.StatusOK, ds)
+		return
+	case r.Method == http.MethodGet && reconcileDrawerRe.MatchString(r.URL.Path):
+		ds, ok := h.drawers.get(reconcileDrawerRe.FindStringSubmatch(r.URL.Path)[1])
+		if !ok {
+			notFound(w, r)
+			return
+		}
+		writeJSON(w, r, http.StatusOK, ds.reconcile())
+		return
+	default:
+		notFound(w, r)
+		return
+	}
+}
+
+// Open starts a session on a drawer with the float counted into it.
+func (h *drawerHandler) Open(w http.ResponseWriter, r *http.Request, sess session) {
+	drawer := openDrawerRe.FindStringSubmatch(r.URL.Path)[1]
+	var req struct {
+		StartingFloat int64 `json:"starting_float"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.StartingFloat < 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("starting_float must be a non-negative amount"))
+		return
+	}
+	h.drawers.Lock()
+	if _, open := h.drawers.current[drawer]; open {
+		h.drawers.Unlock()
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte("drawer is already open"))
+		return
+	}
+	ds := drawerSession{
+		ID:            strconv.Itoa(len(h.drawers.sessions) + 1),
+		Drawer:        drawer,
+		StartingFloat: req.StartingFloat,
+		OpenedBy:      sess.StaffID,
+		OpenedAt:      time.Now().UTC(),
+		Cash:          []drawerCash{},
+	}
+	h.drawers.current[drawer] = len(h.drawers.sessions)
+	h.drawers.sessions = append(h.drawers.sessions, ds)
+	h.drawers.Unlock()
+	h.audit.record(auditEntry{Action: "drawer.open", Ref: ds.ID, StaffID: sess.StaffID})
+	writeJSON(w, r, http.StatusCreated, ds)
+}
+
+// Close ends a drawer's session with the cash counted out of it and returns
+// the reconciliation.
+func (h *drawerHandler) Close(w http.ResponseWriter, r *http.Request, sess session) {
+	drawer := closeDrawerRe.FindStringSubmatch(r.URL.Path)[1]
+	var req struct {
+		Counted *int64 `json:"counted"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Counted == nil || *req.Counted < 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("counted must be a non-negative amount"))
+		return
+	}
+	now := time.Now().UTC()
+	h.drawers.Lock()
+	i, open := h.drawers.current[drawer]
+	if !open {
+		h.drawers.Unlock()
+		notFound(w, r)
+		return
+	}
+	ds := &h.drawers.sessions[i]
+	ds.ClosedBy, ds.ClosedAt, ds.Counted = sess.StaffID, &now, req.Counted
+	delete(h.drawers.current, drawer)
+	rec := ds.reconcile()
+	h.drawers.Unlock()
+	h.audit.record(auditEntry{Action: "drawer.close", Ref: rec.SessionID, StaffID: sess.StaffID})
+	writeJSON(w, r, http.StatusOK, rec)
+}
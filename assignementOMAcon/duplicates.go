@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	duplicateFlag  = "flag"
+	duplicateBlock = "block"
+)
+
+// duplicateCheck catches an order submitted twice, as happens when a guest
+// double-taps the button on a QR ordering page: a second order for the same
+// table with the same items within window of the first. In flag mode the
+// second order is taken and marked with DuplicateOf; in block mode it is
+// refused unless the client resubmits with ?allow_duplicate=true.
+type duplicateCheck struct {
+	window time.Duration
+	mode   string
+}
+
+// duplicateConfig sets up the duplicate check: Window (0 turns it off) and
+// Action, flag or block.
+type duplicateConfig struct {
+	Window duration `json:"window"`
+	Action string   `json:"action"`
+}
+
+func (c duplicateConfig) validate() error {
+	if c.Window < 0 {
+		return fmt.Errorf("window must not be negative")
+	}
+	if c.Action != duplicateFlag && c.Action != duplicateBlock {
+		return fmt.Errorf("action must be flag or block, got %q", c.Action)
+	}
+	return nil
+}
+
+func newDuplicateCheck(c duplicateConfig) duplicateCheck {
+	return duplicateCheck{window: time.Duration(c.Window), mode: c.Action}
+}
+
+// itemsKey describes an order's items regardless of line order or case, so
+// two orders for the same things have the same key.
+func itemsKey(items orderItems) string {
+	counts := map[string]int{}
+	for _, it := range items {
+		counts[strings.ToLower(strings.TrimSpace(it.Name))] += it.Quantity
+	}
+	lines := make([]string, 0, len(counts))
+	for name, n := range counts {
+		lines = append(lines, name+"\x00"+strconv.Itoa(n))
+	}
+	sort.Strings(lines)
+	return strings.Join(lines, "\x00")
+}
+
+// find returns the open order u looks like a repeat of, if any. Orders
+// without a table or without items are never treated as duplicates.
+func (c duplicateCheck) find(store *datastore, u order, now time.Time) (order, bool) {
+	if c.window <= 0 || u.TableNumber == "" || len(u.OrderItems) == 0 {
+		return order{}, false
+	}
+	key := itemsKey(u.OrderItems)
+	store.RLock()
+	defer store.RUnlock()
+	var found order
+	for _, o := range store.m {
+		if o.ID == u.ID || o.TableNumber != u.TableNumber || isFinal(o) || o.CreatedAt == nil ||
+			now.Sub(*o.CreatedAt) > c.window || itemsKey(o.OrderItems) != key {
+			continue
+		}
+		if found.CreatedAt == nil || o.CreatedAt.After(*found.CreatedAt) {
+			found = o
+		}
+	}
+	return found, found.CreatedAt != nil
+}
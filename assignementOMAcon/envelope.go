@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const envelopeHeader = "X-Envelope"
+
+const eventStreamMediaType = "text/event-stream"
+
+const (
+	envelopeNegotiate = "negotiate"
+	envelopeAlways    = "always"
+	envelopeNever     = "never"
+)
+
+// envelope is the response shape some clients expect instead of the bare
+// resource: the resource in data, paging and status in meta, and any failure
+// in errors.
+type envelope struct {
+	Data   json.RawMessage `json:"data"`
+	Meta   envelopeMeta    `json:"meta"`
+	Errors []envelopeError `json:"errors"`
+}
+
+type envelopeMeta struct {
+	Status     int                 `json:"status"`
+	Pagination *envelopePagination `json:"pagination,omitempty"`
+	// RequestID is set on failures, for quoting when reporting them.
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// envelopePagination describes the page of a collection in data. Collections
+// are paged with ?offset= and ?limit= when the envelope is in use.
+type envelopePagination struct {
+	Total  int `json:"total"`
+	Count  int `json:"count"`
+	Offset int `json:"offset"`
+	Limit  int `json:"limit"`
+}
+
+type envelopeError struct {
+	Status int    `json:"status"`
+	Title  string `json:"title"`
+	Detail string `json:"detail,omitempty"`
+	Field  string `json:"field,omitempty"`
+}
+
+// wantsEnvelope reports whether the response to r should be wrapped. In
+// negotiate mode the client asks with an X-Envelope: true header.
+func wantsEnvelope(mode string, r *http.Request) bool {
+	switch mode {
+	case envelopeAlways:
+		return true
+	case envelopeNever:
+		return false
+	}
+	on, _ := strconv.ParseBool(r.Header.Get(envelopeHeader))
+	return on
+}
+
+// envelopeRecorder holds back the handler's response so it can be wrapped.
+type envelopeRecorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (rec *envelopeRecorder) Header() http.Header {
+	return rec.header
+}
+
+func (rec *envelopeRecorder) WriteHeader(code int) {
+	if rec.status == 0 {
+		rec.status = code
+	}
+}
+
+func (rec *envelopeRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	return rec.body.Write(b)
+}
+
+// envelopeMiddleware wraps responses in an envelope according to mode
+// (negotiate, always or never; RESPONSE_ENVELOPE). Successful responses that
+// are not JSON, such as receipts and calendars, and JSON:API documents, which
+// have their own top level, pass through unchanged, and event streams and
+// WebSockets are never held back. Collections are paged within the caller's
+// page limits from paging.
+func envelopeMiddleware(mode string, paging pagingConfig, sessions *sessionStore) middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == http.MethodOptions || r.Header.Get("Accept") == eventStreamMediaType || isWebSocketUpgrade(r) ||
+				!wantsEnvelope(mode, r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			rec := &envelopeRecorder{header: w.Header()}
+			next.ServeHTTP(rec, r)
+			if rec.status == 0 {
+				rec.status = http.StatusOK
+			}
+			env, ok := wrapResponse(r, rec.status, rec.header, rec.body.Bytes(), paging.limits(r, sessions))
+			if !ok || strings.HasPrefix(rec.header.Get("content-type"), jsonAPIMediaType) {
+				w.WriteHeader(rec.status)
+				w.Write(rec.body.Bytes())
+				return
+			}
+			jsonBytes, err := json.Marshal(env)
+			if err != nil {
+				internalServerError(w, r)
+				return
+			}
+			w.Header().Set("content-type", "application/json")
+			w.Header().Del("Content-Length")
+			w.WriteHeader(rec.status)
+			w.Write(jsonBytes)
+		})
+	}
+}
+
+// wrapResponse builds the envelope for a response, or reports false when a
+// successful body is not JSON. A collection the handler paged itself, as its
+// X-Total-Count header says, is passed through with that page described.
+func wrapResponse(r *http.Request, status int, header http.Header, body []byte, limits pageLimits) (envelope, bool) {
+	env := envelope{Data: json.RawMessage("null"), Meta: envelopeMeta{Status: status}, Errors: []envelopeError{}}
+	if status >= http.StatusBadRequest {
+		env.Errors = responseErrors(status, body)
+		env.Meta.RequestID = requestID(r.Context())
+		return env, true
+	}
+	body = bytes.TrimSpace(body)
+	if len(body) == 0 {
+		return env, true
+	}
+	if !json.Valid(body) {
+		return envelope{}, false
+	}
+	env.Data = body
+	var items []json.RawMessage
+	if body[0] == '[' && json.Unmarshal(body, &items) == nil {
+		if total, err := strconv.Atoi(header.Get(totalCountHeader)); err == nil {
+			env.Meta.Pagination = handlerPage(r, total, len(items), limits)
+			return env, true
+		}
+		page, p := paginate(r, items, limits)
+		if data, err := json.Marshal(page); err == nil {
+			env.Data = data
+			env.Meta.Pagination = &p
+		}
+	}
+	return env, true
+}
+
+// paginate applies ?offset= and ?limit= to a collection, within limits.
+// Invalid values are ignored; the default is the default page size, or the
+// whole collection without one.
+func paginate(r *http.Request, items []json.RawMessage, limits pageLimits) ([]json.RawMessage, envelopePagination) {
+	p := envelopePagination{Total: len(items), Limit: pageLimit(r, limits, len(items))}
+	if n, err := strconv.Atoi(r.URL.Query().Get("offset")); err == nil && n > 0 {
+		p.Offset = minInt(n, len(items))
+	}
+	page := items[p.Offset:minInt(p.Offset+p.Limit, len(items))]
+	if page == nil {
+		page = []json.RawMessage{}
+	}
+	p.Count = len(page)
+	return page, p
+}
+
+// handlerPage describes a page of count items the handler cut from total
+// with ?offset= and ?limit=, within limits.
+func handlerPage(r *http.Request, total, count int, limits pageLimits) *envelopePagination {
+	p := envelopePagination{Total: total, Count: count, Limit: pageLimit(r, limits, total)}
+	if n, err := strconv.Atoi(r.URL.Query().Get("offset")); err == nil && n > 0 {
+		p.Offset = minInt(n, total)
+	}
+	return &p
+}
+
+// pageLimit is the page size r gets within limits, or total for the whole
+// collection.
+func pageLimit(r *http.Request, limits pageLimits, total int) int {
+	n, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil || n < 0 {
+		n = -1
+	}
+	if n = limits.clamp(n); n < 0 {
+		return total
+	}
+	return n
+}
+
+// responseErrors reads the errors out of a failed response: one per field
+// for an apiError with field details, otherwise one with the message or text.
+func responseErrors(status int, body []byte) []envelopeError {
+	title := http.StatusText(status)
+	var e struct {
+		Code    string          `json:"code"`
+		Message string          `json:"message"`
+		Details json.RawMessage `json:"details"`
+	}
+	if json.Unmarshal(body, &e) != nil || e.Code == "" {
+		return []envelopeError{{Status: status, Title: title, Detail: strings.TrimSpace(string(body))}}
+	}
+	var fields []fieldError
+	if json.Unmarshal(e.Details, &fields) == nil && len(fields) > 0 {
+		out := make([]envelopeError, 0, len(fields))
+		for _, f := range fields {
+			out = append(out, envelopeError{Status: status, Title: title, Detail: f.Message, Field: f.Field})
+		}
+		return out
+	}
+	return []envelopeError{{Status: status, Title: title, Detail: e.Message}}
+}
+
+func validEnvelopeMode(mode string) error {
+	switch mode {
+	case envelopeNegotiate, envelopeAlways, envelopeNever:
+		return nil
+	}
+	return fmt.Errorf("response envelope must be negotiate, always or never, got %q", mode)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// apiError is the body of every error response. Code is a stable machine
+// name for the failure, such as not_found or validation_failed; Message is
+// for people; Details carries what the code calls for, such as the fields
+// that failed validation.
+type apiError struct {
+	Code      string      `json:"code"`
+	Message   string      `json:"message"`
+	Details   interface{} `json:"details,omitempty"`
+	RequestID string      `json:"request_id,omitempty"`
+}
+
+var errorCodeReplacer = strings.NewReplacer(" ", "_", "-", "_", "'", "")
+
+// errorCode is the code for a failure with nothing more specific to say than
+// its status: not_found, conflict, internal_server_error and so on.
+func errorCode(status int) string {
+	if text := http.StatusText(status); text != "" {
+		return errorCodeReplacer.Replace(strings.ToLower(text))
+	}
+	return "error"
+}
+
+// writeError writes an error response. An empty code is taken from status.
+func writeError(w http.ResponseWriter, r *http.Request, status int, code, message string, details interface{}) {
+	if code == "" {
+		code = errorCode(status)
+	}
+	jsonBytes, err := json.Marshal(apiError{Code: code, Message: message, Details: details, RequestID: requestID(r.Context())})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("content-type", "application/json")
+	w.Header().Del("Content-Length")
+	w.WriteHeader(status)
+	w.Write(jsonBytes)
+}
+
+// bodyReadFailed reports a request body that could not be read: too large,
+// or cut off by the client. Neither is the server's fault.
+func bodyReadFailed(w http.ResponseWriter, r *http.Request, err error) {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		writeError(w, r, http.StatusRequestEntityTooLarge, "", "request body is too large", nil)
+		return
+	}
+	writeError(w, r, http.StatusBadRequest, "", "could not read request body", nil)
+}
+
+// errorWriter holds back error responses so errorMiddleware can rewrite them;
+// other responses go straight through.
+type errorWriter struct {
+	http.ResponseWriter
+	status  int
+	wrote   bool
+	capture bool
+	body    bytes.Buffer
+}
+
+func (w *errorWriter) WriteHeader(code int) {
+	if w.wrote {
+		return
+	}
+	w.wrote, w.status = true, code
+	if code >= http.StatusBadRequest {
+		w.capture = true
+		return
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *errorWriter) Write(b []byte) (int, error) {
+	if !w.wrote {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.capture {
+		return w.body.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *errorWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok && !w.capture {
+		f.Flush()
+	}
+}
+
+// errorMiddleware gives error responses written as plain text, as most
+// handlers write them, the apiError shape, with the code taken from the
+// status and the text as the message. Errors that are JSON already pass
+// through unchanged. Event streams and WebSockets are never held back.
+func errorMiddleware() middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Accept") == eventStreamMediaType || isWebSocketUpgrade(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			ew := &errorWriter{ResponseWriter: w}
+			next.ServeHTTP(ew, r)
+			if !ew.capture {
+				return
+			}
+			body := bytes.TrimSpace(ew.body.Bytes())
+			if len(body) > 0 && json.Valid(body) {
+				w.WriteHeader(ew.status)
+				w.Write(ew.body.Bytes())
+				return
+			}
+			message := string(body)
+			if message == "" {
+				message = strings.ToLower(http.StatusText(ew.status))
+			}
+			writeError(w, r, ew.status, "", message, nil)
+		})
+	}
+}
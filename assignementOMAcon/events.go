@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"sync"
+	"time"
+)
+
+var orderStreamRe = regexp.MustCompile(`^/ws/orders$`)
+
+const (
+	eventOrderCreated = "order.created"
+	eventOrderUpdated = "order.updated"
+	eventOrderDeleted = "order.deleted"
+)
+
+// eventBufferSize is how many events a subscriber may fall behind by before
+// it is dropped.
+const eventBufferSize = 64
+
+// wsKeepAlive is how often idle order streams are pinged.
+const wsKeepAlive = 30 * time.Second
+
+// orderEvent is a committed change to an order. Order is the order as stored
+// afterwards, and is left out when it was deleted.
+type orderEvent struct {
+	Type    string    `json:"type"`
+	OrderID string    `json:"order_id"`
+	Order   *order    `json:"order,omitempty"`
+	At      time.Time `json:"at"`
+}
+
+// eventBus fans order events out to subscribers, such as the order streams of
+// kitchen displays. Publishing never blocks: a subscriber that falls
+// eventBufferSize events behind has its channel closed and must start over.
+type eventBus struct {
+	subs map[int]chan orderEvent
+	next int
+	*sync.Mutex
+}
+
+func newEventBus() *eventBus {
+	return &eventBus{subs: map[int]chan orderEvent{}, Mutex: &sync.Mutex{}}
+}
+
+// subscribe returns a channel of events published from now on, and a func
+// that ends the subscription.
+func (b *eventBus) subscribe() (<-chan orderEvent, func()) {
+	b.Lock()
+	defer b.Unlock()
+	id, ch := b.next, make(chan orderEvent, eventBufferSize)
+	b.next++
+	b.subs[id] = ch
+	return ch, func() {
+		b.Lock()
+		defer b.Unlock()
+		if _, ok := b.subs[id]; ok {
+			delete(b.subs, id)
+			close(ch)
+		}
+	}
+}
+
+func (b *eventBus) publish(e orderEvent) {
+	if e.At.IsZero() {
+		e.At = time.Now().UTC()
+	}
+	b.Lock()
+	defer b.Unlock()
+	for id, ch := range b.subs {
+		select {
+		case ch <- e:
+		default:
+			delete(b.subs, id)
+			close(ch)
+		}
+	}
+}
+
+func (b *eventBus) created(o order) {
+	b.publish(orderEvent{Type: eventOrderCreated, OrderID: o.ID, Order: &o})
+}
+
+func (b *eventBus) updated(o order) {
+	b.publish(orderEvent{Type: eventOrderUpdated, OrderID: o.ID, Order: &o})
+}
+
+func (b *eventBus) deleted(id string) {
+	b.publish(orderEvent{Type: eventOrderDeleted, OrderID: id})
+}
+
+type orderStreamHandler struct {
+	events   *eventBus
+	sessions *sessionStore
+}
+
+func (h *orderStreamHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.Method == http.MethodGet && orderStreamRe.MatchString(r.URL.Path):
+		h.Stream(w, r)
+		return
+	default:
+		notFound(w, r)
+		return
+	}
+}
+
+// Stream upgrades to a WebSocket and sends each order event as a JSON text
+// message until the client goes away. ?location= limits the stream to one
+// location's orders; deletions are always sent, as a deleted order's location
+// is no longer known. Browsers cannot set headers on a WebSocket, so the
+// session token may also be passed as ?token=.
+func (h *orderStreamHandler) Stream(w http.ResponseWriter, r *http.Request) {
+	if token := r.URL.Query().Get("token"); token != "" && r.Header.Get("Authorization") == "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	if _, ok := h.sessions.requireScope(w, r, "orders:read"); !ok {
+		return
+	}
+	location := r.URL.Query().Get("location")
+	conn, ok := upgradeWebSocket(w, r)
+	if !ok {
+		return
+	}
+	events, unsubscribe := h.events.subscribe()
+	defer unsubscribe()
+	gone := make(chan struct{})
+	go func() {
+		conn.readLoop()
+		close(gone)
+	}()
+	keepAlive := time.NewTicker(wsKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-gone:
+			conn.conn.Close()
+			return
+		case <-keepAlive.C:
+			if conn.writeFrame(wsPing, nil) != nil {
+				conn.conn.Close()
+				return
+			}
+		case e, ok := <-events:
+			if !ok {
+				conn.close(wsCloseTryLater)
+				return
+			}
+			if location != "" && e.Order != nil && e.Order.LocationID != location {
+				continue
+			}
+			b, err := json.Marshal(e)
+			if err != nil || conn.writeText(b) != nil {
+				conn.conn.Close()
+				return
+			}
+		}
+	}
+}
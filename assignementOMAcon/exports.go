@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"sync"
+	"time"
+)
+
+var exportsRe = regexp.MustCompile(`^/admin/exports/?$`)
+
+// exportConfig names the bucket the previous UTC day is exported to at At,
+// a time of day (default 01:00), under Prefix (default exports/). Without a
+// bucket nothing is exported.
+type exportConfig struct {
+	objectStoreConfig
+	Prefix string `json:"prefix"`
+	At     string `json:"at"`
+}
+
+// offset is At as time since midnight.
+func (c exportConfig) offset() (time.Duration, error) {
+	t, err := time.Parse("15:04", c.At)
+	if err != nil {
+		return 0, fmt.Errorf("at must be a time of day such as 01:00, got %q", c.At)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+func (c exportConfig) validate() error {
+	if _, err := c.offset(); err != nil {
+		return err
+	}
+	if c.Bucket == "" {
+		return nil
+	}
+	_, err := newS3Store(c.objectStoreConfig)
+	return err
+}
+
+// exportObject is one file written by an export.
+type exportObject struct {
+	Key     string `json:"key"`
+	Records int    `json:"records"`
+	Bytes   int    `json:"bytes"`
+}
+
+// exportRun is one export of a day's audit log and change events.
+type exportRun struct {
+	Date    string         `json:"date"`
+	At      time.Time      `json:"at"`
+	Trigger string         `json:"trigger"`
+	Objects []exportObject `json:"objects"`
+	Error   string         `json:"error,omitempty"`
+}
+
+// exporter ships each UTC day's audit entries and change events to object
+// storage as gzipped NDJSON, one object per stream and day:
+//
+//	<prefix>audit/2024-05-01.ndjson.gz
+//	<prefix>events/2024-05-01.ndjson.gz
+//
+// Exporting a day again overwrites its objects. Change events are dropped
+// from memory once the schedule has exported the following day, so exporting
+// an older day again rewrites only its audit entries.
+type exporter struct {
+	audit  *auditLog
+	feed   *changeFeed
+	dest   objectStore
+	prefix string
+	runs   []exportRun
+	*sync.Mutex
+}
+
+func newExporter(audit *auditLog, feed *changeFeed, dest objectStore, prefix string) *exporter {
+	return &exporter{audit: audit, feed: feed, dest: dest, prefix: prefix, Mutex: &sync.Mutex{}}
+}
+
+// run exports the previous day at the given time of day, every day until ctx
+// is done.
+func (e *exporter) run(ctx context.Context, at time.Duration) {
+	for {
+		now := time.Now().UTC()
+		next := now.Truncate(24 * time.Hour).Add(at)
+		if !next.After(now) {
+			next = next.AddDate(0, 0, 1)
+		}
+		t := time.NewTimer(next.Sub(now))
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return
+		case <-t.C:
+		}
+		day := next.Truncate(24*time.Hour).AddDate(0, 0, -1)
+		if run := e.export(ctx, day, "schedule"); run.Error != "" {
+			log.Printf("export %s: %s", run.Date, run.Error)
+		}
+	}
+}
+
+// export writes the UTC day starting at day and records the run.
+func (e *exporter) export(ctx context.Context, day time.Time, trigger string) exportRun {
+	run := exportRun{Date: day.Format(dateLayout), At: time.Now().UTC(), Trigger: trigger, Objects: []exportObject{}}
+	audit, events := dayRecords(e.audit, e.feed, day)
+	for _, stream := range []struct {
+		name    string
+		records []interface{}
+	}{{"audit", audit}, {"events", events}} {
+		if stream.name == "events" && !e.feed.keeps(day) {
+			continue
+		}
+		obj, err := e.write(ctx, e.prefix+stream.name+"/"+run.Date+".ndjson.gz", stream.records)
+		if err != nil {
+			run.Error = err.Error()
+			break
+		}
+		run.Objects = append(run.Objects, obj)
+	}
+	e.Lock()
+	e.runs = append(e.runs, run)
+	e.Unlock()
+	// Scheduled runs export each day in turn, so the change events of the
+	// days before this one are in storage and need not be kept. This day's
+	// are kept for a while in case it is exported again.
+	if trigger == "schedule" && run.Error == "" {
+		e.feed.prune(day)
+	}
+	return run
+}
+
+func (e *exporter) write(ctx context.Context, key string, records []interface{}) (exportObject, error) {
+	body, err := encodeNDJSON(records)
+	if err != nil {
+		return exportObject{}, err
+	}
+	if err := e.dest.put(ctx, key, object{body: body, contentType: "application/x-ndjson", contentEncoding: "gzip"}); err != nil {
+		return exportObject{}, err
+	}
+	return exportObject{Key: key, Records: len(records), Bytes: len(body)}, nil
+}
+
+// dayRecords returns the audit entries and change events of the UTC day
+// starting at day, as exported.
+func dayRecords(audit *auditLog, feed *changeFeed, day time.Time) ([]interface{}, []interface{}) {
+	from, to := day, day.AddDate(0, 0, 1)
+	var entries []interface{}
+	for _, a := range audit.list() {
+		if !a.Time.Before(from) && a.Time.Before(to) {
+			entries = append(entries, a)
+		}
+	}
+	var events []interface{}
+	for _, c := range feed.between(from, to) {
+		events = append(events, c)
+	}
+	return entries, events
+}
+
+// encodeNDJSON writes records one JSON object per line, gzipped.
+func encodeNDJSON(records []interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	enc := json.NewEncoder(zw)
+	for _, rec := range records {
+		if err := enc.Encode(rec); err != nil {
+			return nil, err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (e *exporter) history() []exportRun {
+	e.Lock()
+	defer e.Unlock()
+	return append([]exportRun{}, e.runs...)
+}
+
+type exportHandler struct {
+	exporter *exporter
+	sessions *sessionStore
+	audit    *auditLog
+}
+
+func (h *exportHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("content-type", "application/json")
+	sess, ok := h.sessions.requireScope(w, r, "orders:manage")
+	if !ok {
+		return
+	}
+	if !exportsRe.MatchString(r.URL.Path) {
+		notFound(w, r)
+		return
+	}
+	if h.exporter == nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("export storage is not configured"))
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, r, http.StatusOK, h.exporter.history())
+	case http.MethodPost:
+		h.Run(w, r, sess)
+	default:
+		notFound(w, r)
+	}
+}
+
+// Run exports one day now, ?date=YYYY-MM-DD or by default yesterday, for
+// days the schedule missed or that changed after they were exported.
+func (h *exportHandler) Run(w http.ResponseWriter, r *http.Request, sess session) {
+	day := time.Now().UTC().Truncate(24*time.Hour).AddDate(0, 0, -1)
+	if v := r.URL.Query().Get("date"); v != "" {
+		d, err := time.Parse(dateLayout, v)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("date must be YYYY-MM-DD"))
+			return
+		}
+		day = d
+	}
+	run := h.exporter.export(r.Context(), day, "manual")
+	h.audit.record(auditEntry{Action: "export.run", Ref: run.Date, StaffID: sess.StaffID})
+	if run.Error != "" {
+		writeJSON(w, r, http.StatusBadGateway, run)
+		return
+	}
+	writeJSON(w, r, http.StatusOK, run)
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+var (
+	feedbackRe       = regexp.MustCompile(`^/r/([0-9A-Za-z]+)/feedback$`)
+	feedbackReportRe = regexp.MustCompile(`^/reports/feedback$`)
+)
+
+const (
+	feedbackMaxComment = 1000
+	// Each receipt link may be used feedbackMaxPerWindow times per
+	// feedbackWindow; a later submission replaces the earlier one.
+	feedbackMaxPerWindow = 3
+	feedbackWindow       = time.Hour
+)
+
+// feedback is a guest's rating of a paid order, left through the link on
+// their receipt. Items and Waiter are taken from the order when it is left.
+type feedback struct {
+	OrderID string    `json:"order_id"`
+	Rating  int       `json:"rating"`
+	Comment string    `json:"comment,omitempty"`
+	Items   []string  `json:"items"`
+	Waiter  string    `json:"waiter,omitempty"`
+	At      time.Time `json:"at"`
+}
+
+type feedbackStore struct {
+	byOrder  map[string]feedback
+	attempts map[string][]time.Time
+	*sync.RWMutex
+}
+
+func newFeedbackStore() *feedbackStore {
+	return &feedbackStore{
+		byOrder:  map[string]feedback{},
+		attempts: map[string][]time.Time{},
+		RWMutex:  &sync.RWMutex{},
+	}
+}
+
+// allow counts a submission against token, reporting how long to wait when
+// it is over the limit.
+func (s *feedbackStore) allow(token string, now time.Time) (time.Duration, bool) {
+	s.Lock()
+	defer s.Unlock()
+	recent := s.attempts[token][:0]
+	for _, t := range s.attempts[token] {
+		if now.Sub(t) < feedbackWindow {
+			recent = append(recent, t)
+		}
+	}
+	if len(recent) >= feedbackMaxPerWindow {
+		s.attempts[token] = recent
+		return feedbackWindow - now.Sub(recent[0]), false
+	}
+	s.attempts[token] = append(recent, now)
+	return 0, true
+}
+
+func (s *feedbackStore) put(f feedback) {
+	s.Lock()
+	s.byOrder[f.OrderID] = f
+	s.Unlock()
+}
+
+// between returns the feedback left in [from, to).
+func (s *feedbackStore) between(from, to time.Time) []feedback {
+	s.RLock()
+	defer s.RUnlock()
+	var out []feedback
+	for _, f := range s.byOrder {
+		if !f.At.Before(from) && f.At.Before(to) {
+			out = append(out, f)
+		}
+	}
+	return out
+}
+
+// orderCreator is the staff member who took the order, from the audit log.
+func orderCreator(audit *auditLog, orderID string) string {
+	for _, e := range audit.list() {
+		if e.OrderID == orderID && (e.Action == "order.create" || e.Action == "order.sync.create") {
+			return e.StaffID
+		}
+	}
+	return ""
+}
+
+// Feedback records a guest's rating of the order behind a receipt link. No
+// session is needed: the link is the guest's proof they had the order.
+func (h *receiptHandler) Feedback(w http.ResponseWriter, r *http.Request, token string) {
+	w.Header().Set("content-type", "application/json")
+	orderID, ok := h.receipts.lookup(token)
+	if !ok {
+		notFound(w, r)
+		return
+	}
+	var req struct {
+		Rating  int    `json:"rating"`
+		Comment string `json:"comment"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Rating < 1 || req.Rating > 5 {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("rating must be from 1 to 5"))
+		return
+	}
+	req.Comment = strings.TrimSpace(req.Comment)
+	if utf8.RuneCountInString(req.Comment) > feedbackMaxComment {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("comment must be at most " + strconv.Itoa(feedbackMaxComment) + " characters"))
+		return
+	}
+	h.store.RLock()
+	o, ok := h.store.m[orderID]
+	h.store.RUnlock()
+	if !ok {
+		notFound(w, r)
+		return
+	}
+	now := time.Now().UTC()
+	if wait, ok := h.feedback.allow(token, now); !ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+		w.WriteHeader(http.StatusTooManyRequests)
+		w.Write([]byte("too many submissions"))
+		return
+	}
+	f := feedback{
+		OrderID: o.ID,
+		Rating:  req.Rating,
+		Comment: req.Comment,
+		Items:   []string{},
+		Waiter:  orderCreator(h.audit, o.ID),
+		At:      now,
+	}
+	for _, it := range o.OrderItems {
+		f.Items = append(f.Items, it.Name)
+	}
+	h.feedback.put(f)
+	writeJSON(w, r, http.StatusCreated, f)
+}
+
+type ratingTotal struct {
+	Key     string  `json:"key"`
+	Count   int     `json:"count"`
+	Average float64 `json:"average"`
+	sum     int
+}
+
+func (t *ratingTotal) add(rating int) {
+	t.Count++
+	t.sum += rating
+	t.Average = float64(t.sum) / float64(t.Count)
+}
+
+type feedbackReport struct {
+	From     string        `json:"from"`
+	To       string        `json:"to"`
+	Overall  ratingTotal   `json:"overall"`
+	ByDay    []ratingTotal `json:"by_day"`
+	ByItem   []ratingTotal `json:"by_item"`
+	ByWaiter []ratingTotal `json:"by_waiter"`
+	Comments []feedback    `json:"comments"`
+}
+
+// Feedback reports guest ratings between ?from= and ?to= (inclusive dates,
+// default today) per day, item and waiter, with the comments left.
+func (h *reportHandler) Feedback(w http.ResponseWriter, r *http.Request) {
+	from, to, err := parseDateRange(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	rep := feedbackReport{
+		From:     from.Format(dateLayout),
+		To:       to.AddDate(0, 0, -1).Format(dateLayout),
+		Overall:  ratingTotal{Key: "all"},
+		Comments: []feedback{},
+	}
+	byDay, byItem, byWaiter := map[string]*ratingTotal{}, map[string]*ratingTotal{}, map[string]*ratingTotal{}
+	addTo := func(m map[string]*ratingTotal, key string, rating int) {
+		if m[key] == nil {
+			m[key] = &ratingTotal{Key: key}
+		}
+		m[key].add(rating)
+	}
+	for _, f := range h.feedback.between(from, to) {
+		rep.Overall.add(f.Rating)
+		addTo(byDay, f.At.Format(dateLayout), f.Rating)
+		seen := map[string]bool{}
+		for _, item := range f.Items {
+			if item = strings.ToLower(item); !seen[item] {
+				seen[item] = true
+				addTo(byItem, item, f.Rating)
+			}
+		}
+		if f.Waiter != "" {
+			addTo(byWaiter, f.Waiter, f.Rating)
+		}
+		if f.Comment != "" {
+			rep.Comments = append(rep.Comments, f)
+		}
+	}
+	rep.ByDay = sortedRatings(byDay)
+	sort.Slice(rep.ByDay, func(i, j int) bool { return rep.ByDay[i].Key < rep.ByDay[j].Key })
+	rep.ByItem, rep.ByWaiter = sortedRatings(byItem), sortedRatings(byWaiter)
+	sort.Slice(rep.Comments, func(i, j int) bool { return rep.Comments[i].At.Before(rep.Comments[j].At) })
+	writeJSON(w, r, http.StatusOK, rep)
+}
+
+// sortedRatings lists totals lowest average first, so what guests liked
+// least comes first.
+func sortedRatings(m map[string]*ratingTotal) []ratingTotal {
+	out := make([]ratingTotal, 0, len(m))
+	for _, t := range m {
+		out = append(out, *t)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Average != out[j].Average {
+			return out[i].Average < out[j].Average
+		}
+		return out[i].Key < out[j].Key
+	})
+	return out
+}
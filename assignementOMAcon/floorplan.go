@@ -0,0 +1,305 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	floorPlanRe     = regexp.MustCompile(`^/floorplan/?$`)
+	floorPlanLiveRe = regexp.MustCompile(`^/floorplan/live$`)
+)
+
+var tableShapes = map[string]bool{"round": true, "square": true, "rect": true}
+
+const kindTables = "tables"
+
+// upcomingWindow is how far ahead a reservation marks its table as reserved on
+// the live view.
+const upcomingWindow = time.Hour
+
+// floorTable places a table on the map. Coordinates and sizes are in the
+// plan's own units; clients scale them to the screen.
+type floorTable struct {
+	Number   string  `json:"number"`
+	Shape    string  `json:"shape"`
+	X        float64 `json:"x"`
+	Y        float64 `json:"y"`
+	Width    float64 `json:"width"`
+	Height   float64 `json:"height"`
+	Rotation float64 `json:"rotation,omitempty"`
+	Seats    int     `json:"seats"`
+}
+
+type section struct {
+	ID     string       `json:"id"`
+	Name   string       `json:"name"`
+	Tables []floorTable `json:"tables"`
+}
+
+type floorPlan struct {
+	LocationID string     `json:"location_id"`
+	Width      float64    `json:"width"`
+	Height     float64    `json:"height"`
+	Sections   []section  `json:"sections"`
+	UpdatedAt  *time.Time `json:"updated_at,omitempty"`
+}
+
+func (p floorPlan) validate() error {
+	seen := map[string]bool{}
+	for _, s := range p.Sections {
+		if s.ID == "" {
+			return fmt.Errorf("every section needs an id")
+		}
+		for _, t := range s.Tables {
+			if t.Number == "" || !tableShapes[t.Shape] || t.Width <= 0 || t.Height <= 0 || t.Seats <= 0 {
+				return fmt.Errorf("table %q needs a shape (round, square, rect), positive size and seats", t.Number)
+			}
+			if seen[t.Number] {
+				return fmt.Errorf("table %q appears twice", t.Number)
+			}
+			seen[t.Number] = true
+		}
+	}
+	return nil
+}
+
+type floorPlanStore struct {
+	m    map[string]floorPlan
+	feed *changeFeed
+	*sync.RWMutex
+}
+
+func newFloorPlanStore(feed *changeFeed) *floorPlanStore {
+	return &floorPlanStore{m: map[string]floorPlan{}, feed: feed, RWMutex: &sync.RWMutex{}}
+}
+
+// syncTable is a table as delta sync sends it: where it is and which section
+// it is in. Its sync ID is the location and table number, as location/number.
+type syncTable struct {
+	LocationID string `json:"location_id"`
+	SectionID  string `json:"section_id"`
+	floorTable
+}
+
+func syncTableID(location, number string) string {
+	return location + "/" + number
+}
+
+// tablesOf lists the tables on p by sync ID.
+func tablesOf(p floorPlan) map[string]syncTable {
+	out := map[string]syncTable{}
+	for _, s := range p.Sections {
+		for _, t := range s.Tables {
+			out[syncTableID(p.LocationID, t.Number)] = syncTable{LocationID: p.LocationID, SectionID: s.ID, floorTable: t}
+		}
+	}
+	return out
+}
+
+// publish records on the change feed the tables that differ between a
+// location's plan before and after a change.
+func (s *floorPlanStore) publish(before, after floorPlan) {
+	old, now := tablesOf(before), tablesOf(after)
+	ids := make([]string, 0, len(old)+len(now))
+	for id := range old {
+		ids = append(ids, id)
+	}
+	for id := range now {
+		if _, ok := old[id]; !ok {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		t, ok := now[id]
+		switch {
+		case !ok:
+			s.feed.publish(kindTables, id, true)
+		case t != old[id]:
+			s.feed.publish(kindTables, id, false)
+		}
+	}
+}
+
+// set replaces a location's plan.
+func (s *floorPlanStore) set(p floorPlan) {
+	s.Lock()
+	before := s.m[p.LocationID]
+	s.m[p.LocationID] = p
+	s.Unlock()
+	s.publish(before, p)
+}
+
+// syncSource exposes every table on every plan to delta sync.
+func (s *floorPlanStore) syncSource() syncSource {
+	return syncSource{
+		get: func(id string) (interface{}, bool) {
+			s.RLock()
+			defer s.RUnlock()
+			for _, p := range s.m {
+				if t, ok := tablesOf(p)[id]; ok {
+					return t, true
+				}
+			}
+			return nil, false
+		},
+		all: func() []interface{} {
+			s.RLock()
+			defer s.RUnlock()
+			out := []interface{}{}
+			for _, p := range s.m {
+				for _, t := range tablesOf(p) {
+					out = append(out, t)
+				}
+			}
+			return out
+		},
+	}
+}
+
+func (s *floorPlanStore) get(location string) floorPlan {
+	s.RLock()
+	defer s.RUnlock()
+	p, ok := s.m[location]
+	if !ok {
+		return floorPlan{LocationID: location, Sections: []section{}}
+	}
+	return p
+}
+
+// tableOverlay is the live state of one table.
+type tableOverlay struct {
+	floorTable
+	SectionID   string       `json:"section_id"`
+	Status      string       `json:"status"`
+	OpenOrders  []string     `json:"open_orders"`
+	OpenTotal   int64        `json:"open_total"`
+	BalanceDue  int64        `json:"balance_due"`
+	Reservation *reservation `json:"reservation,omitempty"`
+}
+
+const (
+	tableFree     = "free"
+	tableOccupied = "occupied"
+	tableReserved = "reserved"
+)
+
+type floorPlanHandler struct {
+	plans        *floorPlanStore
+	store        *datastore
+	reservations *reservationStore
+	sessions     *sessionStore
+}
+
+func (h *floorPlanHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("content-type", "application/json")
+	scope := "orders:read"
+	if r.Method != http.MethodGet {
+		scope = "orders:manage"
+	}
+	if _, ok := h.sessions.requireScope(w, r, scope); !ok {
+		return
+	}
+	location := r.URL.Query().Get("location")
+	if location == "" {
+		location = defaultLocation
+	}
+	switch {
+	case r.Method == http.MethodGet && floorPlanLiveRe.MatchString(r.URL.Path):
+		h.Live(w, r, location)
+		return
+	case r.Method == http.MethodGet && floorPlanRe.MatchString(r.URL.Path):
+		writeJSON(w, r, http.StatusOK, h.plans.get(location))
+		return
+	case r.Method == http.MethodPut && floorPlanRe.MatchString(r.URL.Path):
+		h.Put(w, r, location)
+		return
+	default:
+		notFound(w, r)
+		return
+	}
+}
+
+func (h *floorPlanHandler) Put(w http.ResponseWriter, r *http.Request, location string) {
+	var p floorPlan
+	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("invalid floor plan"))
+		return
+	}
+	if err := p.validate(); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	now := time.Now().UTC()
+	p.LocationID = location
+	p.UpdatedAt = &now
+	h.plans.set(p)
+	writeJSON(w, r, http.StatusOK, p)
+}
+
+// Live overlays each table with its open orders (matched by table number) and
+// any reservation starting within the next hour.
+func (h *floorPlanHandler) Live(w http.ResponseWriter, r *http.Request, location string) {
+	plan := h.plans.get(location)
+	now := time.Now().UTC()
+	tables := liveTables(plan, h.store, h.reservations, now)
+	writeJSON(w, r, http.StatusOK, struct {
+		LocationID string         `json:"location_id"`
+		Width      float64        `json:"width"`
+		Height     float64        `json:"height"`
+		Sections   []section      `json:"sections"`
+		Tables     []tableOverlay `json:"tables"`
+		AsOf       time.Time      `json:"as_of"`
+	}{plan.LocationID, plan.Width, plan.Height, plan.Sections, tables, now})
+}
+
+func liveTables(plan floorPlan, store *datastore, reservations *reservationStore, now time.Time) []tableOverlay {
+	open := map[string][]order{}
+	store.RLock()
+	for _, o := range store.m {
+		if o.TableNumber != "" && !o.Locked && !isFinal(o) {
+			open[o.TableNumber] = append(open[o.TableNumber], o)
+		}
+	}
+	store.RUnlock()
+
+	upcoming := map[string]reservation{}
+	for _, res := range reservations.forLocation(plan.LocationID) {
+		if res.Cancelled || res.TableNumber == "" || res.end().Before(now) || res.Start.After(now.Add(upcomingWindow)) {
+			continue
+		}
+		if _, taken := upcoming[res.TableNumber]; !taken {
+			upcoming[res.TableNumber] = res
+		}
+	}
+
+	tables := make([]tableOverlay, 0)
+	for _, s := range plan.Sections {
+		for _, t := range s.Tables {
+			ov := tableOverlay{floorTable: t, SectionID: s.ID, Status: tableFree, OpenOrders: []string{}}
+			for _, o := range open[t.Number] {
+				ov.OpenOrders = append(ov.OpenOrders, o.ID)
+				ov.OpenTotal += o.Total
+				ov.BalanceDue += balanceDue(o)
+			}
+			if res, ok := upcoming[t.Number]; ok {
+				res := res
+				ov.Reservation = &res
+				ov.Status = tableReserved
+			}
+			if len(ov.OpenOrders) > 0 {
+				ov.Status = tableOccupied
+			}
+			tables = append(tables, ov)
+		}
+	}
+	return tables
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	forecastRe        = regexp.MustCompile(`^/reports/forecast$`)
+	forecastHorizonRe = regexp.MustCompile(`^([0-9]+)d$`)
+)
+
+const (
+	defaultForecastWeeks = 4
+	maxForecastDays      = 28
+	maxForecastWeeks     = 12
+)
+
+const (
+	methodWeekly        = "weekly"
+	methodMovingAverage = "moving_average"
+)
+
+// dayDemand is what was ordered, or is expected to be, on one day.
+type dayDemand struct {
+	orders  float64
+	revenue float64
+	items   map[string]float64
+}
+
+type forecastDay struct {
+	Date    string  `json:"date"`
+	Weekday string  `json:"weekday"`
+	Orders  float64 `json:"orders"`
+	Revenue int64   `json:"revenue"`
+	// Method is weekly when the day is the average of the same weekday in
+	// the history, or moving_average when no such weekday was seen.
+	Method string `json:"method"`
+}
+
+type forecastItem struct {
+	Name     string  `json:"name"`
+	Quantity float64 `json:"quantity"`
+}
+
+type forecast struct {
+	From        string         `json:"from"`
+	Days        int            `json:"days"`
+	HistoryFrom string         `json:"history_from"`
+	HistoryDays int            `json:"history_days"`
+	Orders      float64        `json:"orders"`
+	Revenue     int64          `json:"revenue"`
+	Forecast    []forecastDay  `json:"forecast"`
+	Items       []forecastItem `json:"items"`
+}
+
+// Forecast predicts orders, revenue and item demand for the next ?horizon=
+// days (e.g. 7d, default 7d, at most 28d) starting tomorrow. Each day is the
+// average of the same weekday over the last ?weeks= weeks (default 4), so a
+// busy Friday predicts a busy Friday; weekdays with no history use the
+// average of the last seven days. History comes from order changes in the
+// audit log and starts on the first day one was recorded.
+func (h *reportHandler) Forecast(w http.ResponseWriter, r *http.Request) {
+	days := 7
+	if v := r.URL.Query().Get("horizon"); v != "" {
+		m := forecastHorizonRe.FindStringSubmatch(v)
+		if m == nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("horizon must be a number of days, e.g. 7d"))
+			return
+		}
+		days, _ = strconv.Atoi(m[1])
+		if days < 1 || days > maxForecastDays {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("horizon must be between 1d and " + strconv.Itoa(maxForecastDays) + "d"))
+			return
+		}
+	}
+	weeks := defaultForecastWeeks
+	if v := r.URL.Query().Get("weeks"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxForecastWeeks {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("weeks must be between 1 and " + strconv.Itoa(maxForecastWeeks)))
+			return
+		}
+		weeks = n
+	}
+
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	start := today.AddDate(0, 0, 1-7*weeks)
+	history := h.dailyDemand(start, today.AddDate(0, 0, 1))
+	fc := forecast{From: today.AddDate(0, 0, 1).Format(dateLayout), Days: days, Forecast: []forecastDay{}, Items: []forecastItem{}}
+	// Days before the first recorded change are not known to be quiet, so
+	// they are left out rather than averaged in as zero.
+	var known []time.Time
+	for d := start; !d.After(today); d = d.AddDate(0, 0, 1) {
+		if len(known) > 0 || history[d] != nil {
+			known = append(known, d)
+		}
+	}
+	if len(known) > 0 {
+		fc.HistoryFrom = known[0].Format(dateLayout)
+		fc.HistoryDays = len(known)
+	}
+
+	items := map[string]float64{}
+	for i := 1; i <= days; i++ {
+		day := today.AddDate(0, 0, i)
+		var samples []time.Time
+		for _, d := range known {
+			if d.Weekday() == day.Weekday() {
+				samples = append(samples, d)
+			}
+		}
+		method := methodWeekly
+		if len(samples) == 0 {
+			method = methodMovingAverage
+			samples = known[len(known)-minInt(7, len(known)):]
+		}
+		avg := averageDemand(history, samples)
+		fc.Forecast = append(fc.Forecast, forecastDay{
+			Date:    day.Format(dateLayout),
+			Weekday: day.Weekday().String(),
+			Orders:  round1(avg.orders),
+			Revenue: int64(math.Round(avg.revenue)),
+			Method:  method,
+		})
+		fc.Orders += avg.orders
+		fc.Revenue += int64(math.Round(avg.revenue))
+		for name, q := range avg.items {
+			items[name] += q
+		}
+	}
+	fc.Orders = round1(fc.Orders)
+	for name, q := range items {
+		fc.Items = append(fc.Items, forecastItem{Name: name, Quantity: round1(q)})
+	}
+	sort.Slice(fc.Items, func(i, j int) bool {
+		if fc.Items[i].Quantity != fc.Items[j].Quantity {
+			return fc.Items[i].Quantity > fc.Items[j].Quantity
+		}
+		return fc.Items[i].Name < fc.Items[j].Name
+	})
+	writeJSON(w, r, http.StatusOK, fc)
+}
+
+// dailyDemand totals order changes in [from, to) per UTC day: orders and
+// items by creation day, revenue by the day the order was paid.
+func (h *reportHandler) dailyDemand(from, to time.Time) map[time.Time]*dayDemand {
+	out := map[time.Time]*dayDemand{}
+	for _, e := range h.audit.list() {
+		if e.Time.Before(from) || !e.Time.Before(to) {
+			continue
+		}
+		before, after, ok := e.orders()
+		if !ok {
+			continue
+		}
+		day := e.Time.UTC().Truncate(24 * time.Hour)
+		d := out[day]
+		if d == nil {
+			d = &dayDemand{items: map[string]float64{}}
+			out[day] = d
+		}
+		if before.ID == "" {
+			d.orders++
+			for _, name := range orderItemNames(after) {
+				d.items[strings.ToLower(name)]++
+			}
+		}
+		if isPaid(after) && !isPaid(before) {
+			d.revenue += float64(after.Total)
+		}
+	}
+	return out
+}
+
+// averageDemand averages the given days; days without orders count as zero.
+func averageDemand(history map[time.Time]*dayDemand, days []time.Time) dayDemand {
+	avg := dayDemand{items: map[string]float64{}}
+	if len(days) == 0 {
+		return avg
+	}
+	n := float64(len(days))
+	for _, day := range days {
+		d := history[day]
+		if d == nil {
+			continue
+		}
+		avg.orders += d.orders / n
+		avg.revenue += d.revenue / n
+		for name, q := range d.items {
+			avg.items[name] += q / n
+		}
+	}
+	return avg
+}
+
+func round1(v float64) float64 {
+	return math.Round(v*10) / 10
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"math"
+	"strings"
+	"unicode"
+)
+
+// fuzzyWords splits text into lowercase words on anything that is not a
+// letter, digit or combining mark (so Devanagari vowel signs stay in their
+// word).
+func fuzzyWords(s string) []string {
+	return strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && !unicode.IsMark(r)
+	})
+}
+
+// typoBudget is how many edits a query word of n letters may be off by.
+// Short words must match exactly, or nearly every word would match them.
+func typoBudget(n int) int {
+	switch {
+	case n <= 3:
+		return 0
+	case n <= 6:
+		return 1
+	default:
+		return 2
+	}
+}
+
+// editDistance is the optimal string alignment distance between a and b:
+// insertions, deletions, substitutions and swaps of adjacent letters each
+// cost one. It gives up early, returning max+1, once the distance is known
+// to exceed max.
+func editDistance(a, b string, max int) int {
+	ra, rb := []rune(a), []rune(b)
+	if d := len(ra) - len(rb); d > max || -d > max {
+		return max + 1
+	}
+	prev2 := make([]int, len(rb)+1)
+	prev := make([]int, len(rb)+1)
+	cur := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		cur[0] = i
+		rowMin := cur[0]
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = minInt(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+			if i > 1 && j > 1 && ra[i-1] == rb[j-2] && ra[i-2] == rb[j-1] {
+				cur[j] = minInt(cur[j], prev2[j-2]+1)
+			}
+			if cur[j] < rowMin {
+				rowMin = cur[j]
+			}
+		}
+		if rowMin > max {
+			return max + 1
+		}
+		prev2, prev, cur = prev, cur, prev2
+	}
+	return prev[len(rb)]
+}
+
+func minInt(first int, rest ...int) int {
+	m := first
+	for _, v := range rest {
+		if v < m {
+			m = v
+		}
+	}
+	return m
+}
+
+// wordScore rates how well one query word matches one word of the text: 1 for
+// an exact match, a little less for a prefix (the user is still typing), and
+// less again per typo. Zero means no match.
+func wordScore(q, w string) float64 {
+	switch {
+	case q == w:
+		return 1
+	case strings.HasPrefix(w, q) && len([]rune(q)) >= 2:
+		return 0.9
+	}
+	budget := typoBudget(len([]rune(q)))
+	if budget == 0 {
+		return 0
+	}
+	best := 0.0
+	if d := editDistance(q, w, budget); d <= budget {
+		best = 0.8 - 0.2*float64(d)
+	}
+	// Also forgive typos in a prefix so "birya" still finds "biryani".
+	if wr := []rune(w); len(wr) > len([]rune(q)) {
+		if d := editDistance(q, string(wr[:len([]rune(q))]), budget); d <= budget && 0.7-0.2*float64(d) > best {
+			best = 0.7 - 0.2*float64(d)
+		}
+	}
+	return best
+}
+
+// fuzzyScore rates how well text matches query. Every query word must match
+// some word of the text; the score is the mean of each query word's best
+// match, so 1 means every word was found exactly and 0 means no match.
+func fuzzyScore(query, text string) float64 {
+	qs := fuzzyWords(query)
+	ws := fuzzyWords(text)
+	if len(qs) == 0 || len(ws) == 0 {
+		return 0
+	}
+	total := 0.0
+	for _, q := range qs {
+		best := 0.0
+		for _, w := range ws {
+			if s := wordScore(q, w); s > best {
+				best = s
+			}
+		}
+		if best == 0 {
+			return 0
+		}
+		total += best
+	}
+	return math.Round(total/float64(len(qs))*100) / 100
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	issueGiftCardRe  = regexp.MustCompile(`^/giftcards/?$`)
+	getGiftCardRe    = regexp.MustCompile(`^/giftcards/([0-9A-Za-z]+)$`)
+	redeemGiftCardRe = regexp.MustCompile(`^/giftcards/([0-9A-Za-z]+)/redeem$`)
+)
+
+const (
+	giftCardIssue  = "issue"
+	giftCardRedeem = "redeem"
+	giftCardRefund = "refund"
+)
+
+// giftCardTxn is one movement on a card's balance, in minor currency units.
+type giftCardTxn struct {
+	ID      string    `json:"id"`
+	Type    string    `json:"type"`
+	Amount  int64     `json:"amount"`
+	OrderID string    `json:"order_id,omitempty"`
+	StaffID string    `json:"staff_id,omitempty"`
+	At      time.Time `json:"at"`
+}
+
+type giftCard struct {
+	Code         string        `json:"code"`
+	Balance      int64         `json:"balance"`
+	IssuedAt     time.Time     `json:"issued_at"`
+	Transactions []giftCardTxn `json:"transactions,omitempty"`
+}
+
+type giftCardStore struct {
+	m map[string]giftCard
+	*sync.RWMutex
+}
+
+func newGiftCardStore() *giftCardStore {
+	return &giftCardStore{m: map[string]giftCard{}, RWMutex: &sync.RWMutex{}}
+}
+
+func normalizeGiftCardCode(code string) string {
+	return strings.ToUpper(code)
+}
+
+func (s *giftCardStore) issue(amount int64, staffID string, now time.Time) (giftCard, error) {
+	s.Lock()
+	defer s.Unlock()
+	for {
+		code, err := randomToken(16)
+		if err != nil {
+			return giftCard{}, err
+		}
+		code = normalizeGiftCardCode(code)
+		if _, taken := s.m[code]; taken {
+			continue
+		}
+		gc := giftCard{Code: code, Balance: amount, IssuedAt: now}
+		gc.Transactions = []giftCardTxn{{ID: "1", Type: giftCardIssue, Amount: amount, StaffID: staffID, At: now}}
+		s.m[code] = gc
+		return gc, nil
+	}
+}
+
+func (s *giftCardStore) get(code string) (giftCard, bool) {
+	s.RLock()
+	defer s.RUnlock()
+	gc, ok := s.m[normalizeGiftCardCode(code)]
+	return gc, ok
+}
+
+// apply moves amount on the card: redemptions decrement and must not overdraw,
+// refunds credit it back. The check and update happen under one lock.
+func (s *giftCardStore) apply(code, kind string, amount int64, orderID, staffID string, now time.Time) (giftCard, error) {
+	s.Lock()
+	defer s.Unlock()
+	code = normalizeGiftCardCode(code)
+	gc, ok := s.m[code]
+	if !ok {
+		return giftCard{}, errAccountNotFound
+	}
+	switch kind {
+	case giftCardRedeem:
+		if gc.Balance < amount {
+			return giftCard{}, errInsufficientFunds
+		}
+		gc.Balance -= amount
+	case giftCardRefund:
+		gc.Balance += amount
+	}
+	gc.Transactions = append(append([]giftCardTxn{}, gc.Transactions...), giftCardTxn{
+		ID:      strconv.Itoa(len(gc.Transactions) + 1),
+		Type:    kind,
+		Amount:  amount,
+		OrderID: orderID,
+		StaffID: staffID,
+		At:      now,
+	})
+	s.m[code] = gc
+	return gc, nil
+}
+
+func (s *giftCardStore) debit(code string, amount int64, orderID, staffID string, now time.Time) (string, error) {
+	gc, err := s.apply(code, giftCardRedeem, amount, orderID, staffID, now)
+	return gc.Code, err
+}
+
+func (s *giftCardStore) refund(code string, amount int64, orderID, staffID string, now time.Time) {
+	s.apply(code, giftCardRefund, amount, orderID, staffID, now)
+}
+
+type giftCardHandler struct {
+	cards    *giftCardStore
+	sessions *sessionStore
+	audit    *auditLog
+}
+
+func (h *giftCardHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("content-type", "application/json")
+	switch {
+	case r.Method == http.MethodPost && issueGiftCardRe.MatchString(r.URL.Path):
+		h.Issue(w, r)
+		return
+	case r.Method == http.MethodGet && getGiftCardRe.MatchString(r.URL.Path):
+		h.Get(w, r)
+		return
+	case r.Method == http.MethodPost && redeemGiftCardRe.MatchString(r.URL.Path):
+		h.Redeem(w, r)
+		return
+	default:
+		notFound(w, r)
+		return
+	}
+}
+
+func (h *giftCardHandler) Issue(w http.ResponseWriter, r *http.Request) {
+	sess, ok := h.sessions.requireScope(w, r, "orders:manage")
+	if !ok {
+		return
+	}
+	var req struct {
+		Amount int64 `json:"amount"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Amount <= 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("a positive amount is required"))
+		return
+	}
+	gc, err := h.cards.issue(req.Amount, sess.StaffID, time.Now().UTC())
+	if err != nil {
+		internalServerError(w, r)
+		return
+	}
+	h.audit.record(auditEntry{Action: "giftcard.issue", Ref: gc.Code, StaffID: sess.StaffID})
+	writeJSON(w, r, http.StatusCreated, gc)
+}
+
+// Get reports a card's balance. Staff with manage scope also see its
+// transaction history.
+func (h *giftCardHandler) Get(w http.ResponseWriter, r *http.Request) {
+	matches := getGiftCardRe.FindStringSubmatch(r.URL.Path)
+	gc, ok := h.cards.get(matches[1])
+	if !ok {
+		notFound(w, r)
+		return
+	}
+	if sess, ok := h.sessions.fromRequest(r); !ok || !sess.hasScope("orders:manage") {
+		gc.Transactions = nil
+	}
+	writeJSON(w, r, http.StatusOK, gc)
+}
+
+func (h *giftCardHandler) Redeem(w http.ResponseWriter, r *http.Request) {
+	sess, ok := h.sessions.requireScope(w, r, "orders:write")
+	if !ok {
+		return
+	}
+	matches := redeemGiftCardRe.FindStringSubmatch(r.URL.Path)
+	var req struct {
+		Amount  int64  `json:"amount"`
+		OrderID string `json:"order_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Amount <= 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("a positive amount is required"))
+		return
+	}
+	gc, err := h.cards.apply(matches[1], giftCardRedeem, req.Amount, req.OrderID, sess.StaffID, time.Now().UTC())
+	if err != nil {
+		accountFailed(w, r, err)
+		return
+	}
+	h.audit.record(auditEntry{Action: "giftcard.redeem", Ref: gc.Code, OrderID: req.OrderID, StaffID: sess.StaffID})
+	writeJSON(w, r, http.StatusOK, gc)
+}
@@ -0,0 +1,428 @@
+package main
+
+//go:generate protoc -I proto --go_out=. --go_opt=module=github.com/mayurkhairnar2525/assignementOMAcon --go-grpc_out=. --go-grpc_opt=module=github.com/mayurkhairnar2525/assignementOMAcon orders.proto
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	ordersv1 "github.com/mayurkhairnar2525/assignementOMAcon/proto/ordersv1"
+)
+
+// grpcOrders serves proto/orders.proto's OrderService for internal callers.
+// Calls go to the order handler's logic directly, so orders are validated,
+// stored, audited and published exactly as over HTTP. Callers authenticate
+// with the same authorization or x-api-key metadata as HTTP headers, are held
+// to the same route scopes, and count against the quota of the location
+// their credentials are bound to.
+type grpcOrders struct {
+	ordersv1.UnimplementedOrderServiceServer
+	// ctx ends watches when the server shuts down.
+	ctx      context.Context
+	orders   *orderHandler
+	sessions *sessionStore
+	quotas   *quotaStore
+	events   *eventBus
+}
+
+func newGRPCServer(ctx context.Context, orders *orderHandler, sessions *sessionStore, quotas *quotaStore, events *eventBus) *grpc.Server {
+	srv := grpc.NewServer(
+		grpc.ChainUnaryInterceptor(recoverUnary(orders.hooks)),
+		grpc.ChainStreamInterceptor(recoverStream(orders.hooks)),
+	)
+	ordersv1.RegisterOrderServiceServer(srv, &grpcOrders{
+		ctx:      ctx,
+		orders:   orders,
+		sessions: sessions,
+		quotas:   quotas,
+		events:   events,
+	})
+	return srv
+}
+
+func (g *grpcOrders) CreateOrder(ctx context.Context, req *ordersv1.CreateOrderRequest) (*ordersv1.Order, error) {
+	r, err := g.authorize(ctx, http.MethodPost, "/orders")
+	if err != nil {
+		return nil, err
+	}
+	o, err := g.orders.place(r, orderFromProto(req.GetOrder()), false)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return orderToProto(o), nil
+}
+
+func (g *grpcOrders) GetOrder(ctx context.Context, req *ordersv1.GetOrderRequest) (*ordersv1.Order, error) {
+	if req.GetId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "id is required")
+	}
+	if _, err := g.authorize(ctx, http.MethodGet, "/orders/"+url.PathEscape(req.GetId())); err != nil {
+		return nil, err
+	}
+	g.orders.store.RLock()
+	o, ok := g.orders.store.m[req.GetId()]
+	g.orders.store.RUnlock()
+	if !ok {
+		return nil, grpcError(errOrderNotFound)
+	}
+	return orderToProto(o), nil
+}
+
+func (g *grpcOrders) ListOrders(ctx context.Context, req *ordersv1.ListOrdersRequest) (*ordersv1.ListOrdersResponse, error) {
+	q := url.Values{}
+	for name, v := range map[string]string{"payment": req.GetPayment(), "status": req.GetStatus(), "table": req.GetTable(), "sort": req.GetSort()} {
+		if v != "" {
+			q.Set(name, v)
+		}
+	}
+	if req.GetOffset() != 0 {
+		q.Set("offset", strconv.Itoa(int(req.GetOffset())))
+	}
+	if req.GetLimit() != 0 {
+		q.Set("limit", strconv.Itoa(int(req.GetLimit())))
+	}
+	r, err := g.authorize(ctx, http.MethodGet, "/orders")
+	if err != nil {
+		return nil, err
+	}
+	listing, err := parseOrderListing(q, g.orders.paging.limits(r, g.sessions))
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	orders := g.orders.listOrders(nil, req.GetChannel(), req.GetQ(), listing)
+	resp := &ordersv1.ListOrdersResponse{Total: int32(len(orders))}
+	for _, o := range listing.page(orders) {
+		resp.Orders = append(resp.Orders, orderToProto(o))
+	}
+	return resp, nil
+}
+
+func (g *grpcOrders) UpdateOrder(ctx context.Context, req *ordersv1.UpdateOrderRequest) (*ordersv1.Order, error) {
+	if req.GetOrder().GetId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "order.id is required")
+	}
+	r, err := g.authorize(ctx, http.MethodPut, "/orders/"+url.PathEscape(req.GetOrder().GetId()))
+	if err != nil {
+		return nil, err
+	}
+	o, err := g.orders.replace(r, orderFromProto(req.GetOrder()))
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return orderToProto(o), nil
+}
+
+func (g *grpcOrders) DeleteOrder(ctx context.Context, req *ordersv1.DeleteOrderRequest) (*ordersv1.DeleteOrderResponse, error) {
+	if req.GetId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "id is required")
+	}
+	r, err := g.authorize(ctx, http.MethodDelete, "/orders/"+url.PathEscape(req.GetId()))
+	if err != nil {
+		return nil, err
+	}
+	if sess, _ := sessionFromContext(r.Context()); !sess.hasScope("orders:manage") {
+		return nil, status.Error(codes.PermissionDenied, "forbidden")
+	}
+	if err := g.orders.cancel(r, req.GetId()); err != nil {
+		return nil, grpcError(err)
+	}
+	return &ordersv1.DeleteOrderResponse{}, nil
+}
+
+// WatchOrders streams order events until the caller goes away or the server
+// shuts down. A caller that falls too far behind is cut off with
+// ResourceExhausted and must watch again, as on /ws/orders.
+func (g *grpcOrders) WatchOrders(req *ordersv1.WatchOrdersRequest, stream ordersv1.OrderService_WatchOrdersServer) error {
+	r, err := g.authorize(stream.Context(), http.MethodGet, "/ws/orders")
+	if err != nil {
+		return err
+	}
+	if sess, ok := sessionFromContext(r.Context()); !ok {
+		return status.Error(codes.Unauthenticated, "unauthorized")
+	} else if !sess.hasScope("orders:read") {
+		return status.Error(codes.PermissionDenied, "forbidden")
+	}
+	events, unsubscribe := g.events.subscribe()
+	defer unsubscribe()
+	// Headers go out at once, so the caller knows it is subscribed before
+	// the first event.
+	if err := stream.SendHeader(nil); err != nil {
+		return err
+	}
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case <-g.ctx.Done():
+			return status.Error(codes.Unavailable, "shutting down")
+		case e, ok := <-events:
+			if !ok {
+				return status.Error(codes.ResourceExhausted, "fell too far behind; watch again")
+			}
+			if loc := req.GetLocationId(); loc != "" && e.Order != nil && e.Order.LocationID != loc {
+				continue
+			}
+			ev := &ordersv1.OrderEvent{Type: e.Type, OrderId: e.OrderID, At: timestamppb.New(e.At)}
+			if e.Order != nil {
+				ev.Order = orderToProto(*e.Order)
+			}
+			if err := stream.Send(ev); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// authorize checks the caller may make the call that stands for method and
+// path over HTTP, as the auth and quota middleware do, and counts it against
+// its location's quota. The request it returns is never served: it carries
+// the caller's metadata as headers and its session in the context, which is
+// how the order logic tells who is acting.
+func (g *grpcOrders) authorize(ctx context.Context, method, path string) (*http.Request, error) {
+	r, err := http.NewRequestWithContext(ctx, method, path, http.NoBody)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	for k, vs := range md {
+		if strings.HasPrefix(k, ":") || strings.HasPrefix(k, "grpc-") {
+			continue
+		}
+		for _, v := range vs {
+			r.Header.Add(k, v)
+		}
+	}
+	sess, ok := g.sessions.fromRequest(r)
+	if rule, found := g.sessions.auth.rule(r); found {
+		if !ok {
+			return nil, status.Error(codes.Unauthenticated, "unauthorized")
+		}
+		if !sess.hasScope(rule.Scope) {
+			return nil, status.Error(codes.PermissionDenied, "forbidden")
+		}
+	}
+	if !ok {
+		return r, nil
+	}
+	if _, allowed := g.quotas.allow(sessionLocation(sess), time.Now()); !allowed {
+		return nil, status.Error(codes.ResourceExhausted, sessionLocation(sess)+" has used its requests for this minute")
+	}
+	return r.WithContext(context.WithValue(ctx, sessionCtxKey, sess)), nil
+}
+
+// grpcError maps an error from the order logic to a status, as mutateFailed
+// maps it to a response.
+func grpcError(err error) error {
+	var bad *badRequestError
+	var forbidden *forbiddenError
+	var closed *closedError
+	var transition *transitionError
+	var quota *quotaError
+	var invalid *validationError
+	var version *versionError
+	var dup *duplicateError
+	var rule *ruleError
+	switch {
+	case errors.Is(err, errOrderNotFound):
+		return status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, errOrderExists):
+		return status.Error(codes.AlreadyExists, err.Error())
+	case errors.Is(err, errOrderConflict), errors.As(err, &version):
+		return status.Error(codes.Aborted, err.Error())
+	case errors.Is(err, errOrderLocked), errors.Is(err, errOrderPaid), errors.As(err, &transition),
+		errors.As(err, &dup), errors.As(err, &closed):
+		return status.Error(codes.FailedPrecondition, err.Error())
+	case errors.As(err, &invalid), errors.As(err, &bad), errors.As(err, &rule):
+		return status.Error(codes.InvalidArgument, err.Error())
+	case errors.As(err, &forbidden):
+		return status.Error(codes.PermissionDenied, err.Error())
+	case errors.As(err, &quota):
+		return status.Error(codes.ResourceExhausted, err.Error())
+	}
+	slog.Error("grpc call failed", slog.String("error", err.Error()))
+	return status.Error(codes.Internal, "an unexpected error occurred")
+}
+
+// recoverUnary turns a panic in a call into a logged stack trace, a call to
+// the registered error hooks and an Internal status, as recoveryMiddleware
+// does for HTTP.
+func recoverUnary(hooks *hookRegistry) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp interface{}, err error) {
+		defer func() {
+			if rv := recover(); rv != nil {
+				err = grpcPanic(ctx, hooks, info.FullMethod, rv)
+			}
+		}()
+		return handler(ctx, req)
+	}
+}
+
+// recoverStream is recoverUnary for streams.
+func recoverStream(hooks *hookRegistry) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) (err error) {
+		defer func() {
+			if rv := recover(); rv != nil {
+				err = grpcPanic(ss.Context(), hooks, info.FullMethod, rv)
+			}
+		}()
+		return handler(srv, ss)
+	}
+}
+
+func grpcPanic(ctx context.Context, hooks *hookRegistry, method string, rv interface{}) error {
+	stack := debug.Stack()
+	err, ok := rv.(error)
+	if !ok {
+		err = fmt.Errorf("%v", rv)
+	}
+	slog.ErrorContext(ctx, "panic",
+		slog.String("method", method),
+		slog.String("error", err.Error()),
+		slog.String("stack", string(stack)),
+	)
+	hooks.runError(ctx, err, stack)
+	return status.Error(codes.Internal, "an unexpected error occurred")
+}
+
+func protoTime(t *time.Time) *timestamppb.Timestamp {
+	if t == nil {
+		return nil
+	}
+	return timestamppb.New(*t)
+}
+
+func timeFromProto(ts *timestamppb.Timestamp) *time.Time {
+	if ts == nil {
+		return nil
+	}
+	t := ts.AsTime()
+	return &t
+}
+
+func orderToProto(o order) *ordersv1.Order {
+	p := &ordersv1.Order{
+		Id:            o.ID,
+		Number:        o.Number,
+		Reference:     o.Reference,
+		Name:          o.Name,
+		TotalItems:    int32(o.TotalItems),
+		Subtotal:      o.Subtotal,
+		Discount:      o.Discount,
+		Payment:       string(o.Payment),
+		Status:        string(o.Status),
+		TableNumber:   o.TableNumber,
+		PartySize:     int32(o.PartySize),
+		Channel:       o.Channel,
+		LocationId:    o.LocationID,
+		Total:         o.Total,
+		Tax:           o.Tax,
+		Tip:           o.Tip,
+		PaymentMethod: o.PaymentMethod,
+		ScheduledFor:  protoTime(o.ScheduledFor),
+		Locked:        o.Locked,
+		ReceiptUrl:    o.ReceiptURL,
+		TrackingUrl:   o.TrackingURL,
+		DuplicateOf:   o.DuplicateOf,
+		Version:       o.Version,
+		CreatedAt:     protoTime(o.CreatedAt),
+		UpdatedAt:     protoTime(o.UpdatedAt),
+	}
+	for _, it := range o.OrderItems {
+		p.OrderItems = append(p.OrderItems, &ordersv1.OrderItem{
+			Name: it.Name, MenuItemId: it.MenuItemID, Quantity: int32(it.Quantity), UnitPrice: it.UnitPrice, Notes: it.Notes,
+		})
+	}
+	for _, c := range o.Courses {
+		p.Courses = append(p.Courses, &ordersv1.Course{Course: int32(c.Number), Name: c.Name, Items: c.Items, Hold: c.Hold})
+	}
+	for _, d := range o.Discounts {
+		p.Discounts = append(p.Discounts, &ordersv1.AppliedPromotion{PromotionId: d.PromotionID, Name: d.Name, Amount: d.Amount})
+	}
+	for _, s := range o.StatusHistory {
+		p.StatusHistory = append(p.StatusHistory, &ordersv1.StatusChange{Status: string(s.Status), At: timestamppb.New(s.At), StaffId: s.StaffID})
+	}
+	if sc := o.ServiceCharge; sc != nil {
+		p.ServiceCharge = &ordersv1.ServiceCharge{
+			Rule: sc.Rule, Percent: sc.Percent, Amount: sc.Amount,
+			RemovedBy: sc.RemovedBy, RemovedReason: sc.RemovedReason, RemovedAt: protoTime(sc.RemovedAt),
+		}
+	}
+	for _, l := range o.Payments {
+		p.Payments = append(p.Payments, &ordersv1.PaymentLeg{
+			Id: l.ID, Method: l.Method, Amount: l.Amount, Change: l.Change, Reference: l.Reference,
+			Drawer: l.Drawer, DrawerSession: l.DrawerSession, At: timestamppb.New(l.At),
+		})
+	}
+	return p
+}
+
+func orderFromProto(p *ordersv1.Order) order {
+	o := order{
+		ID:            p.GetId(),
+		Number:        p.GetNumber(),
+		Reference:     p.GetReference(),
+		Name:          p.GetName(),
+		TotalItems:    itemCount(p.GetTotalItems()),
+		Subtotal:      p.GetSubtotal(),
+		Discount:      p.GetDiscount(),
+		Payment:       paymentStatus(p.GetPayment()),
+		Status:        orderStatus(p.GetStatus()),
+		TableNumber:   p.GetTableNumber(),
+		PartySize:     int(p.GetPartySize()),
+		Channel:       p.GetChannel(),
+		LocationID:    p.GetLocationId(),
+		Total:         p.GetTotal(),
+		Tax:           p.GetTax(),
+		Tip:           p.GetTip(),
+		PaymentMethod: p.GetPaymentMethod(),
+		ScheduledFor:  timeFromProto(p.GetScheduledFor()),
+		Locked:        p.GetLocked(),
+		ReceiptURL:    p.GetReceiptUrl(),
+		TrackingURL:   p.GetTrackingUrl(),
+		DuplicateOf:   p.GetDuplicateOf(),
+		Version:       p.GetVersion(),
+		CreatedAt:     timeFromProto(p.GetCreatedAt()),
+		UpdatedAt:     timeFromProto(p.GetUpdatedAt()),
+	}
+	for _, it := range p.GetOrderItems() {
+		o.OrderItems = append(o.OrderItems, orderItem{
+			Name: it.GetName(), MenuItemID: it.GetMenuItemId(), Quantity: int(it.GetQuantity()), UnitPrice: it.GetUnitPrice(), Notes: it.GetNotes(),
+		})
+	}
+	for _, c := range p.GetCourses() {
+		o.Courses = append(o.Courses, course{Number: int(c.GetCourse()), Name: c.GetName(), Items: c.GetItems(), Hold: c.GetHold()})
+	}
+	for _, d := range p.GetDiscounts() {
+		o.Discounts = append(o.Discounts, appliedPromotion{PromotionID: d.GetPromotionId(), Name: d.GetName(), Amount: d.GetAmount()})
+	}
+	for _, s := range p.GetStatusHistory() {
+		o.StatusHistory = append(o.StatusHistory, statusChange{Status: orderStatus(s.GetStatus()), At: s.GetAt().AsTime(), StaffID: s.GetStaffId()})
+	}
+	if sc := p.GetServiceCharge(); sc != nil {
+		o.ServiceCharge = &serviceCharge{
+			Rule: sc.GetRule(), Percent: sc.GetPercent(), Amount: sc.GetAmount(),
+			RemovedBy: sc.GetRemovedBy(), RemovedReason: sc.GetRemovedReason(), RemovedAt: timeFromProto(sc.GetRemovedAt()),
+		}
+	}
+	for _, l := range p.GetPayments() {
+		o.Payments = append(o.Payments, paymentLeg{
+			ID: l.GetId(), Method: l.GetMethod(), Amount: l.GetAmount(), Change: l.GetChange(), Reference: l.GetReference(),
+			Drawer: l.GetDrawer(), DrawerSession: l.GetDrawerSession(), At: l.GetAt().AsTime(),
+		})
+	}
+	return o
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	ordersv1 "github.com/mayurkhairnar2525/assignementOMAcon/proto/ordersv1"
+)
+
+// newTestGRPCClient serves s's order service over an in-memory listener.
+func newTestGRPCClient(t *testing.T, s *server) ordersv1.OrderServiceClient {
+	t.Helper()
+	lis := bufconn.Listen(1 << 20)
+	go s.grpc.Serve(lis)
+	t.Cleanup(s.grpc.Stop)
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return ordersv1.NewOrderServiceClient(conn)
+}
+
+func TestGRPCOrders(t *testing.T) {
+	s := newTestServer(t)
+	client := newTestGRPCClient(t, s)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if _, err := client.GetOrder(ctx, &ordersv1.GetOrderRequest{Id: "1"}); status.Code(err) != codes.Unauthenticated {
+		t.Fatalf("GetOrder without a key: %v, want Unauthenticated", err)
+	}
+	ctx = metadata.AppendToOutgoingContext(ctx, "x-api-key", testAPIKey)
+
+	watch, err := client.WatchOrders(ctx, &ordersv1.WatchOrdersRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := watch.Header(); err != nil {
+		t.Fatal(err)
+	}
+
+	created, err := client.CreateOrder(ctx, &ordersv1.CreateOrderRequest{Order: &ordersv1.Order{
+		Name: "grpc", TableNumber: "9", OrderItems: []*ordersv1.OrderItem{{Name: "roti", Quantity: 2}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created.Id == "" || created.Version != 1 || created.Status != string(statusReceived) {
+		t.Fatalf("created %+v", created)
+	}
+	ev, err := watch.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ev.Type != eventOrderCreated || ev.OrderId != created.Id || ev.Order.GetName() != "grpc" {
+		t.Errorf("watched %+v, want the created order", ev)
+	}
+
+	got, err := client.GetOrder(ctx, &ordersv1.GetOrderRequest{Id: created.Id})
+	if err != nil || got.Name != "grpc" || got.OrderItems[0].Quantity != 2 {
+		t.Fatalf("GetOrder: %+v, %v", got, err)
+	}
+	if _, err := client.CreateOrder(ctx, &ordersv1.CreateOrderRequest{Order: got}); status.Code(err) != codes.AlreadyExists {
+		t.Errorf("CreateOrder with a taken ID: %v, want AlreadyExists", err)
+	}
+
+	got.OrderItems[0].Quantity = 3
+	updated, err := client.UpdateOrder(ctx, &ordersv1.UpdateOrderRequest{Order: got})
+	if err != nil || updated.Version != 2 || updated.OrderItems[0].Quantity != 3 {
+		t.Fatalf("UpdateOrder: %+v, %v", updated, err)
+	}
+	// got is still at version 1.
+	if _, err := client.UpdateOrder(ctx, &ordersv1.UpdateOrderRequest{Order: got}); status.Code(err) != codes.Aborted {
+		t.Errorf("UpdateOrder from a stale version: %v, want Aborted", err)
+	}
+	if _, err := client.UpdateOrder(ctx, &ordersv1.UpdateOrderRequest{Order: &ordersv1.Order{Id: "99", Name: "x"}}); status.Code(err) != codes.NotFound {
+		t.Errorf("UpdateOrder of a missing order: %v, want NotFound", err)
+	}
+
+	list, err := client.ListOrders(ctx, &ordersv1.ListOrdersRequest{Table: "9"})
+	if err != nil || len(list.Orders) != 1 || list.Orders[0].Id != created.Id {
+		t.Fatalf("ListOrders: %+v, %v", list, err)
+	}
+
+	if _, err := client.DeleteOrder(ctx, &ordersv1.DeleteOrderRequest{Id: created.Id}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.GetOrder(ctx, &ordersv1.GetOrderRequest{Id: created.Id}); status.Code(err) != codes.NotFound {
+		t.Errorf("GetOrder after delete: %v, want NotFound", err)
+	}
+	// The HTTP API sees the same store.
+	if w := do(s, "GET", "/orders/"+created.Id, ""); w.Code != 404 {
+		t.Errorf("GET /orders/%s after gRPC delete: %d, want 404", created.Id, w.Code)
+	}
+}
+
+func TestGRPCRecovery(t *testing.T) {
+	unary := recoverUnary(newHookRegistry())
+	_, err := unary(context.Background(), nil, &grpc.UnaryServerInfo{FullMethod: "/test"},
+		func(context.Context, interface{}) (interface{}, error) { panic("boom") })
+	if status.Code(err) != codes.Internal {
+		t.Errorf("panicking call: %v, want Internal", err)
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// readyTimeout bounds how long a readiness probe waits on the database.
+const readyTimeout = 2 * time.Second
+
+var (
+	errWorkerStopped = errors.New("worker stopped")
+	errShuttingDown  = errors.New("shutting down")
+)
+
+const (
+	healthOK          = "ok"
+	healthFailing     = "failing"
+	healthUnavailable = "unavailable"
+)
+
+// pingStore is an orderStore whose connection can be checked.
+type pingStore interface {
+	Ping(ctx context.Context) error
+}
+
+// Ping checks that the database answers.
+func (s *sqlStore) Ping(ctx context.Context) error {
+	return s.db.PingContext(ctx)
+}
+
+// ping checks the store's database, if it has one.
+func (s *datastore) ping(ctx context.Context) error {
+	if db, ok := s.db.(pingStore); ok {
+		return db.Ping(ctx)
+	}
+	return nil
+}
+
+type healthCheck struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+type healthReport struct {
+	Status string        `json:"status"`
+	Checks []healthCheck `json:"checks,omitempty"`
+}
+
+// healthMonitor knows what the server depends on: the store and the
+// background workers started through track.
+type healthMonitor struct {
+	ctx     context.Context
+	store   *datastore
+	workers map[string]error
+	*sync.Mutex
+}
+
+func newHealthMonitor(ctx context.Context, store *datastore) *healthMonitor {
+	return &healthMonitor{ctx: ctx, store: store, workers: map[string]error{}, Mutex: &sync.Mutex{}}
+}
+
+// track runs the background worker name, remembering if it stops before the
+// server shuts down. Workers run until their context is done, so one that
+// returns earlier has failed.
+func (m *healthMonitor) track(name string, run func()) {
+	m.Lock()
+	m.workers[name] = nil
+	m.Unlock()
+	run()
+	if m.ctx.Err() == nil {
+		m.Lock()
+		m.workers[name] = errWorkerStopped
+		m.Unlock()
+	}
+}
+
+// ready checks every dependency. The server is not ready while shutting
+// down, so that load balancers stop sending it requests.
+func (m *healthMonitor) ready(ctx context.Context) healthReport {
+	rep := healthReport{Status: healthOK}
+	add := func(name string, err error) {
+		c := healthCheck{Name: name, Status: healthOK}
+		if err != nil {
+			c.Status, c.Error = healthFailing, err.Error()
+			rep.Status = healthUnavailable
+		}
+		rep.Checks = append(rep.Checks, c)
+	}
+	if m.ctx.Err() != nil {
+		add("server", errShuttingDown)
+	}
+	ctx, cancel := context.WithTimeout(ctx, readyTimeout)
+	defer cancel()
+	add("datastore", m.store.ping(ctx))
+	m.Lock()
+	names := make([]string, 0, len(m.workers))
+	for name := range m.workers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		add("worker:"+name, m.workers[name])
+	}
+	m.Unlock()
+	return rep
+}
+
+// healthHandler serves the probes: /healthz answers as long as the server
+// can serve requests at all, and /readyz once it can do useful work, with the
+// state of each dependency. Neither needs a session.
+type healthHandler struct {
+	monitor *healthMonitor
+}
+
+func (h *healthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("content-type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte("method not allowed"))
+		return
+	}
+	switch r.URL.Path {
+	case "/healthz":
+		writeJSON(w, r, http.StatusOK, healthReport{Status: healthOK})
+	case "/readyz":
+		rep := h.monitor.ready(r.Context())
+		status := http.StatusOK
+		if rep.Status != healthOK {
+			status = http.StatusServiceUnavailable
+		}
+		writeJSON(w, r, status, rep)
+	default:
+		notFound(w, r)
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// historyBookkeeping are order fields every change touches, left out of
+// history diffs.
+var historyBookkeeping = map[string]bool{"version": true, "updated_at": true}
+
+// historyEntry is one change in an order's history: what was done, when, by
+// whom, and the fields it changed. Seq counts an order's changes from 1.
+type historyEntry struct {
+	OrderID  string        `json:"order_id"`
+	Seq      int           `json:"seq"`
+	Time     time.Time     `json:"time"`
+	Action   string        `json:"action"`
+	StaffID  string        `json:"staff_id,omitempty"`
+	DeviceID string        `json:"device_id,omitempty"`
+	Changes  []fieldChange `json:"changes"`
+}
+
+// historyStore is an orderStore that keeps order history too.
+type historyStore interface {
+	// AppendHistory stores e as the next entry of its order's history and
+	// returns it numbered.
+	AppendHistory(e historyEntry) (historyEntry, error)
+	History(orderID string) ([]historyEntry, error)
+}
+
+// orderHistory is the history of orders kept in memory when there is no
+// database to keep it.
+type orderHistory struct {
+	m map[string][]historyEntry
+	*sync.Mutex
+}
+
+func newOrderHistory() *orderHistory {
+	return &orderHistory{m: map[string][]historyEntry{}, Mutex: &sync.Mutex{}}
+}
+
+// appendHistory adds e to its order's history, in the database when it keeps
+// history and in memory otherwise. It is append-only: entries are never
+// changed or removed, not even when the order is deleted.
+func (s *datastore) appendHistory(e historyEntry) (historyEntry, error) {
+	s.history.Lock()
+	defer s.history.Unlock()
+	if db, ok := s.db.(historyStore); ok {
+		return db.AppendHistory(e)
+	}
+	e.Seq = len(s.history.m[e.OrderID]) + 1
+	s.history.m[e.OrderID] = append(s.history.m[e.OrderID], e)
+	return e, nil
+}
+
+// historyOf returns the history of the order with id, oldest first.
+func (s *datastore) historyOf(id string) ([]historyEntry, error) {
+	if db, ok := s.db.(historyStore); ok {
+		return db.History(id)
+	}
+	s.history.Lock()
+	defer s.history.Unlock()
+	return append([]historyEntry{}, s.history.m[id]...), nil
+}
+
+// historyDiff lists the fields that differ between two order snapshots, as
+// the audit log's diffs do, without the bookkeeping fields. before is empty
+// when the order was created.
+func historyDiff(before, after []byte) ([]fieldChange, error) {
+	b, a := map[string]interface{}{}, map[string]interface{}{}
+	if err := flattenJSON(before, b); err != nil {
+		return nil, err
+	}
+	if err := flattenJSON(after, a); err != nil {
+		return nil, err
+	}
+	changes := diffFields(b, a)
+	kept := changes[:0]
+	for _, c := range changes {
+		if !historyBookkeeping[c.Field] {
+			kept = append(kept, c)
+		}
+	}
+	return kept, nil
+}
+
+// recordHistory adds an audited order change to the order's history. The
+// change has already been made, so a failure to record it is logged rather
+// than failing the request.
+func (h *orderHandler) recordHistory(r *http.Request, e auditEntry) {
+	entry := historyEntry{OrderID: e.OrderID, Time: e.Time, Action: e.Action, StaffID: e.StaffID, DeviceID: e.DeviceID, Changes: []fieldChange{}}
+	if e.HasDiff {
+		changes, err := historyDiff(e.before, e.after)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "order history", slog.String("order", e.OrderID), slog.String("error", err.Error()))
+			return
+		}
+		entry.Changes = changes
+	}
+	if _, err := h.store.appendHistory(entry); err != nil {
+		slog.ErrorContext(r.Context(), "order history", slog.String("order", e.OrderID), slog.String("error", err.Error()))
+	}
+}
+
+// History lists every change made to an order, oldest first: who made it,
+// when, and the fields it changed. The history of a deleted order is kept.
+func (h *orderHandler) History(w http.ResponseWriter, r *http.Request) {
+	id := pathParam(r, "id")
+	entries, err := h.store.historyOf(id)
+	if err != nil {
+		internalServerError(w, r)
+		return
+	}
+	if len(entries) == 0 {
+		h.store.RLock()
+		_, ok := h.store.m[id]
+		h.store.RUnlock()
+		if !ok {
+			notFound(w, r)
+			return
+		}
+	}
+	writeJSON(w, r, http.StatusOK, entries)
+}
+
+// AppendHistory numbers e after the order's last entry and inserts it, in
+// one transaction.
+func (s *sqlStore) AppendHistory(e historyEntry) (historyEntry, error) {
+	changes, err := json.Marshal(e.Changes)
+	if err != nil {
+		return historyEntry{}, err
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return historyEntry{}, err
+	}
+	if err := tx.QueryRow(`SELECT COALESCE(MAX(seq), 0) + 1 FROM order_history WHERE order_id = $1`, e.OrderID).Scan(&e.Seq); err != nil {
+		tx.Rollback()
+		return historyEntry{}, err
+	}
+	if _, err := tx.Exec(`INSERT INTO order_history (order_id, seq, at, action, staff_id, device_id, changes) VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+		e.OrderID, e.Seq, e.Time.UTC().Format(time.RFC3339Nano), e.Action, e.StaffID, e.DeviceID, string(changes)); err != nil {
+		tx.Rollback()
+		return historyEntry{}, err
+	}
+	return e, tx.Commit()
+}
+
+func (s *sqlStore) History(orderID string) ([]historyEntry, error) {
+	rows, err := s.db.Query(`SELECT seq, at, action, staff_id, device_id, changes FROM order_history WHERE order_id = $1 ORDER BY seq`, orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []historyEntry{}
+	for rows.Next() {
+		e := historyEntry{OrderID: orderID}
+		var at, changes string
+		if err := rows.Scan(&e.Seq, &at, &e.Action, &e.StaffID, &e.DeviceID, &changes); err != nil {
+			return nil, err
+		}
+		if e.Time, err = time.Parse(time.RFC3339Nano, at); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(changes), &e.Changes); err != nil {
+			return nil, err
+		}
+		out = append(out, e)
+	}
+	return out, rows.Err()
+}
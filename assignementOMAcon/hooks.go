@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+)
+
+// beforeCreateHook runs before an order is stored and may reject it.
+type beforeCreateHook func(ctx context.Context, o *order) error
+
+// beforePaymentHook runs before an order transitions to paid and may reject
+// the payment.
+type beforePaymentHook func(ctx context.Context, prev order, next *order) error
+
+// afterStatusChangeHook observes a committed change of an order's lifecycle
+// state.
+type afterStatusChangeHook func(ctx context.Context, prev, next order)
+
+// afterCreateHook observes an order once it has been stored.
+type afterCreateHook func(ctx context.Context, o order)
+
+// lowStockHook is notified when an inventory item drops below its threshold.
+type lowStockHook func(ctx context.Context, a stockAlert)
+
+// stuckOrderHook is notified when an order is first flagged as stuck.
+type stuckOrderHook func(ctx context.Context, s stuckOrder)
+
+// errorHook is told about unexpected errors, such as handler panics, so they
+// can be forwarded to an error tracker.
+type errorHook func(ctx context.Context, err error, stack []byte)
+
+// hookRegistry holds the interceptors registered by plugins.
+type hookRegistry struct {
+	beforeCreate      []beforeCreateHook
+	afterCreate       []afterCreateHook
+	beforePayment     []beforePaymentHook
+	afterStatusChange []afterStatusChangeHook
+	lowStock          []lowStockHook
+	stuckOrder        []stuckOrderHook
+	onError           []errorHook
+	*sync.RWMutex
+}
+
+func newHookRegistry() *hookRegistry {
+	return &hookRegistry{RWMutex: &sync.RWMutex{}}
+}
+
+func (h *hookRegistry) OnBeforeCreate(fn beforeCreateHook) {
+	h.Lock()
+	h.beforeCreate = append(h.beforeCreate, fn)
+	h.Unlock()
+}
+
+func (h *hookRegistry) OnAfterCreate(fn afterCreateHook) {
+	h.Lock()
+	h.afterCreate = append(h.afterCreate, fn)
+	h.Unlock()
+}
+
+func (h *hookRegistry) OnLowStock(fn lowStockHook) {
+	h.Lock()
+	h.lowStock = append(h.lowStock, fn)
+	h.Unlock()
+}
+
+func (h *hookRegistry) OnStuckOrder(fn stuckOrderHook) {
+	h.Lock()
+	h.stuckOrder = append(h.stuckOrder, fn)
+	h.Unlock()
+}
+
+func (h *hookRegistry) OnBeforePayment(fn beforePaymentHook) {
+	h.Lock()
+	h.beforePayment = append(h.beforePayment, fn)
+	h.Unlock()
+}
+
+func (h *hookRegistry) OnAfterStatusChange(fn afterStatusChangeHook) {
+	h.Lock()
+	h.afterStatusChange = append(h.afterStatusChange, fn)
+	h.Unlock()
+}
+
+func (h *hookRegistry) OnError(fn errorHook) {
+	h.Lock()
+	h.onError = append(h.onError, fn)
+	h.Unlock()
+}
+
+func (h *hookRegistry) runBeforeCreate(ctx context.Context, o *order) error {
+	h.RLock()
+	hooks := h.beforeCreate
+	h.RUnlock()
+	for _, fn := range hooks {
+		if err := fn(ctx, o); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (h *hookRegistry) runAfterCreate(ctx context.Context, o order) {
+	h.RLock()
+	hooks := h.afterCreate
+	h.RUnlock()
+	for _, fn := range hooks {
+		fn(ctx, o)
+	}
+}
+
+func (h *hookRegistry) runLowStock(ctx context.Context, a stockAlert) {
+	h.RLock()
+	hooks := h.lowStock
+	h.RUnlock()
+	for _, fn := range hooks {
+		fn(ctx, a)
+	}
+}
+
+func (h *hookRegistry) runStuckOrder(ctx context.Context, s stuckOrder) {
+	h.RLock()
+	hooks := h.stuckOrder
+	h.RUnlock()
+	for _, fn := range hooks {
+		fn(ctx, s)
+	}
+}
+
+func (h *hookRegistry) runBeforePayment(ctx context.Context, prev order, next *order) error {
+	if isPaid(prev) || !isPaid(*next) {
+		return nil
+	}
+	h.RLock()
+	hooks := h.beforePayment
+	h.RUnlock()
+	for _, fn := range hooks {
+		if err := fn(ctx, prev, next); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (h *hookRegistry) runAfterStatusChange(ctx context.Context, prev, next order) {
+	if prev.Payment == next.Payment {
+		return
+	}
+	h.RLock()
+	hooks := h.afterStatusChange
+	h.RUnlock()
+	for _, fn := range hooks {
+		fn(ctx, prev, next)
+	}
+}
+
+func (h *hookRegistry) runError(ctx context.Context, err error, stack []byte) {
+	h.RLock()
+	hooks := h.onError
+	h.RUnlock()
+	for _, fn := range hooks {
+		fn(ctx, err, stack)
+	}
+}
+
+// pluginHost is what a plugin can extend.
+type pluginHost struct {
+	Hooks      *hookRegistry
+	Validators *validatorRegistry
+}
+
+// plugin installs hooks and validation rules. Deployments add plugins by
+// dropping a file into this package that calls registerPlugin from an init
+// function.
+type plugin func(*pluginHost)
+
+var plugins []plugin
+
+func registerPlugin(p plugin) {
+	plugins = append(plugins, p)
+}
+
+func loadPlugins(host *pluginHost) {
+	for _, p := range plugins {
+		p(host)
+	}
+}
+
+// ruleError is returned by hooks to reject an operation with a message that is
+// safe to show to the client.
+type ruleError struct {
+	msg string
+}
+
+func (e *ruleError) Error() string {
+	return e.msg
+}
+
+func newRuleError(msg string) error {
+	return &ruleError{msg: msg}
+}
+
+// hookFailed reports a hook error: rule violations are 422, anything else 500.
+func hookFailed(w http.ResponseWriter, r *http.Request, err error) {
+	if re, ok := err.(*ruleError); ok {
+		writeError(w, r, http.StatusUnprocessableEntity, "rejected_by_rule", re.msg, nil)
+		return
+	}
+	internalServerError(w, r)
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	afterHoursReject   = "reject"
+	afterHoursSchedule = "schedule"
+)
+
+// guestChannels are the channels guests order through directly; orders taken
+// by staff are not held to opening hours.
+var guestChannels = map[string]bool{
+	channelWebsite:     true,
+	channelDeliveryApp: true,
+}
+
+// closedError rejects a guest order placed outside opening hours. NextOpen is
+// zero when the location has no upcoming opening hours.
+type closedError struct {
+	LocationID string
+	NextOpen   time.Time
+}
+
+func (e *closedError) Error() string {
+	if e.NextOpen.IsZero() {
+		return e.LocationID + " is closed"
+	}
+	return e.LocationID + " is closed until " + e.NextOpen.Format(time.RFC3339)
+}
+
+// clockMinutes parses HH:MM into minutes after midnight.
+func clockMinutes(s string) int {
+	parts := strings.SplitN(s, ":", 2)
+	if len(parts) != 2 {
+		return 0
+	}
+	h, _ := strconv.Atoi(parts[0])
+	m, _ := strconv.Atoi(parts[1])
+	return h*60 + m
+}
+
+// openAt reports whether the location is open at t and, if not, when it next
+// opens (within the coming week). Locations without opening hours are always
+// open.
+func (e effectiveSettings) openAt(t time.Time) (bool, time.Time) {
+	if e.OpeningHours == nil {
+		return true, time.Time{}
+	}
+	loc := e.location()
+	local := t.In(loc)
+	midnight := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, loc)
+	var next time.Time
+	// Start from yesterday so windows running past midnight are seen.
+	for d := -1; d <= 7; d++ {
+		day := midnight.AddDate(0, 0, d)
+		for _, win := range e.OpeningHours[weekdays[day.Weekday()]] {
+			open := day.Add(time.Duration(clockMinutes(win.Open)) * time.Minute)
+			end := day.Add(time.Duration(clockMinutes(win.Close)) * time.Minute)
+			if !end.After(open) {
+				end = end.AddDate(0, 0, 1)
+			}
+			if !local.Before(open) && local.Before(end) {
+				return true, time.Time{}
+			}
+			if open.After(local) && (next.IsZero() || open.Before(next)) {
+				next = open
+			}
+		}
+	}
+	return false, next
+}
+
+// afterHours applies a location's opening hours to a new guest order: outside
+// them it is rejected with a closedError, or, when the location's after_hours
+// setting is schedule, accepted and held for the kitchen until opening.
+func afterHours(settings *settingsStore) beforeCreateHook {
+	return func(ctx context.Context, o *order) error {
+		if !guestChannels[o.Channel] {
+			return nil
+		}
+		e := settings.resolve(orderLocation(*o))
+		now := time.Now()
+		open, next := e.openAt(now)
+		if open {
+			return nil
+		}
+		if e.AfterHours == afterHoursSchedule && !next.IsZero() {
+			at := next.UTC()
+			o.ScheduledFor = &at
+			return nil
+		}
+		return &closedError{LocationID: e.LocationID, NextOpen: next}
+	}
+}
+
+// scheduled reports whether an order is being held until a later time.
+func scheduled(o order, now time.Time) bool {
+	return o.ScheduledFor != nil && o.ScheduledFor.After(now)
+}
+
+// releaseScheduled fires the first course of scheduled orders once their time
+// comes, checking every interval until ctx is done.
+func releaseScheduled(ctx context.Context, store *datastore, kitchen *kitchenQueue, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-t.C:
+			var due []order
+			store.RLock()
+			for _, o := range store.m {
+				if o.ScheduledFor != nil && !scheduled(o, now) && !o.Locked && !isFinal(o) {
+					due = append(due, o)
+				}
+			}
+			store.RUnlock()
+			for _, o := range due {
+				kitchen.fireFirstCourse(ctx, o)
+			}
+		}
+	}
+}
+
+func closedMessage(e *closedError) string {
+	if e.NextOpen.IsZero() {
+		return fmt.Sprintf("%s is not taking orders", e.LocationID)
+	}
+	return fmt.Sprintf("%s is closed; orders open again at %s", e.LocationID, e.NextOpen.Format("Mon 15:04 MST"))
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var languageTagRe = regexp.MustCompile(`^[a-z]{2,3}(-[a-z0-9]{2,8})*$`)
+
+// menuText is a menu item's guest-facing text in one language.
+type menuText struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+}
+
+// requestedLanguages lists the languages the client wants, most preferred
+// first: ?lang= if given, otherwise the Accept-Language header.
+func requestedLanguages(r *http.Request) []string {
+	if lang := strings.ToLower(strings.TrimSpace(r.URL.Query().Get("lang"))); lang != "" {
+		return []string{lang}
+	}
+	type weighted struct {
+		tag string
+		q   float64
+	}
+	var prefs []weighted
+	for _, part := range strings.Split(r.Header.Get("Accept-Language"), ",") {
+		fields := strings.Split(strings.TrimSpace(part), ";")
+		tag := strings.ToLower(strings.TrimSpace(fields[0]))
+		if tag == "" || tag == "*" {
+			continue
+		}
+		q := 1.0
+		for _, f := range fields[1:] {
+			if v := strings.TrimSpace(f); strings.HasPrefix(v, "q=") {
+				if parsed, err := strconv.ParseFloat(v[2:], 64); err == nil {
+					q = parsed
+				}
+			}
+		}
+		if q > 0 {
+			prefs = append(prefs, weighted{tag, q})
+		}
+	}
+	sort.SliceStable(prefs, func(i, j int) bool { return prefs[i].q > prefs[j].q })
+	out := make([]string, len(prefs))
+	for i, p := range prefs {
+		out[i] = p.tag
+	}
+	return out
+}
+
+// localize returns the item with its name and description in the first
+// requested language it has a translation for, falling from a regional tag
+// to its base language (fr-ca to fr). Items without a matching translation
+// keep their own text.
+func (item menuItem) localize(langs []string) menuItem {
+	for _, lang := range langs {
+		for tag := lang; tag != ""; {
+			if t, ok := item.Translations[tag]; ok {
+				item.Name = t.Name
+				if t.Description != "" {
+					item.Description = t.Description
+				}
+				item.Language = tag
+				return item
+			}
+			i := strings.LastIndex(tag, "-")
+			if i < 0 {
+				break
+			}
+			tag = tag[:i]
+		}
+	}
+	return item
+}
+
+// searchText is every name an item is known by, for search and autocomplete
+// in any language.
+func (item menuItem) searchText() []string {
+	names := []string{item.Name}
+	for _, t := range item.Translations {
+		names = append(names, t.Name)
+	}
+	return names
+}
+
+func validTranslations(ts map[string]menuText) (map[string]menuText, bool) {
+	if len(ts) == 0 {
+		return nil, true
+	}
+	out := map[string]menuText{}
+	for tag, t := range ts {
+		tag = strings.ToLower(tag)
+		if !languageTagRe.MatchString(tag) || t.Name == "" {
+			return nil, false
+		}
+		out[tag] = t
+	}
+	return out, true
+}
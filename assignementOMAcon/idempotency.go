@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	idempotencyKeyHeader      = "Idempotency-Key"
+	idempotentReplayedHeader  = "Idempotent-Replayed"
+	maxIdempotencyKeyLength   = 255
+	defaultIdempotencyKeepFor = 24 * time.Hour
+)
+
+// idempotencyEntry is a request made with an Idempotency-Key. Until the
+// request finishes, done is open and the response fields are unset.
+type idempotencyEntry struct {
+	fingerprint [sha256.Size]byte
+	done        chan struct{}
+	status      int
+	header      http.Header
+	body        []byte
+	expires     time.Time
+}
+
+type idempotencyKey struct {
+	actor string
+	key   string
+}
+
+// idempotencyStore remembers the responses to requests made with an
+// Idempotency-Key header, so that a client retrying after a dropped
+// connection gets the first response again rather than a second order. Keys
+// belong to the staff member and device that sent them, and are kept for ttl.
+// Expired keys are swept at most once a minute.
+type idempotencyStore struct {
+	entries map[idempotencyKey]*idempotencyEntry
+	ttl     time.Duration
+	swept   time.Time
+	*sync.Mutex
+}
+
+func newIdempotencyStore(ttl time.Duration) *idempotencyStore {
+	return &idempotencyStore{entries: map[idempotencyKey]*idempotencyEntry{}, ttl: ttl, Mutex: &sync.Mutex{}}
+}
+
+// begin claims k for a request with the given fingerprint. It returns the
+// entry to fill in when the claim is new, or the existing entry otherwise.
+func (s *idempotencyStore) begin(k idempotencyKey, fingerprint [sha256.Size]byte, now time.Time) (*idempotencyEntry, bool) {
+	s.Lock()
+	defer s.Unlock()
+	if now.Sub(s.swept) > time.Minute {
+		for key, e := range s.entries {
+			if e.expired(now) {
+				delete(s.entries, key)
+			}
+		}
+		s.swept = now
+	}
+	if e, ok := s.entries[k]; ok && !e.expired(now) {
+		return e, false
+	}
+	e := &idempotencyEntry{fingerprint: fingerprint, done: make(chan struct{})}
+	s.entries[k] = e
+	return e, true
+}
+
+func (e *idempotencyEntry) expired(now time.Time) bool {
+	return !e.expires.IsZero() && now.After(e.expires)
+}
+
+// finish records the response to a claimed key. Only successes are kept:
+// after a failure the key is released, so that a retry is tried afresh
+// rather than failing again for a reason that may have passed.
+func (s *idempotencyStore) finish(k idempotencyKey, e *idempotencyEntry, rec *envelopeRecorder, now time.Time) {
+	if rec.status < 200 || rec.status >= 300 {
+		s.release(k, e)
+		return
+	}
+	header := rec.header.Clone()
+	// A replay is a request of its own, with its own ID.
+	header.Del(requestIDHeader)
+	s.Lock()
+	e.status, e.header, e.body = rec.status, header, rec.body.Bytes()
+	e.expires = now.Add(s.ttl)
+	s.Unlock()
+	close(e.done)
+}
+
+// release forgets a claimed key without a response. Requests waiting on it
+// find no status when done closes, and claim the key afresh.
+func (s *idempotencyStore) release(k idempotencyKey, e *idempotencyEntry) {
+	s.Lock()
+	delete(s.entries, k)
+	s.Unlock()
+	close(e.done)
+}
+
+// idempotent lets clients make next safe to retry by sending an
+// Idempotency-Key. A repeat of a finished request gets its response again,
+// marked Idempotent-Replayed; a repeat while the first is still running gets
+// 409, and reusing a key with a different body gets 422. Requests without
+// the header are served as usual.
+func (h *orderHandler) idempotent(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(idempotencyKeyHeader)
+		if key == "" {
+			next(w, r)
+			return
+		}
+		if len(key) > maxIdempotencyKeyLength {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(fmt.Sprintf("%s must be at most %d characters", idempotencyKeyHeader, maxIdempotencyKeyLength)))
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			bodyReadFailed(w, r, err)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		a := identifyActor(r, h.sessions, h.devices)
+		k := idempotencyKey{actor: a.StaffID + "/" + a.DeviceID, key: key}
+		fingerprint := sha256.Sum256(append([]byte(r.Method+" "+r.URL.Path+"\n"), body...))
+
+		e, claimed := h.idempotency.begin(k, fingerprint, time.Now())
+		for !claimed {
+			done := false
+			select {
+			case <-e.done:
+				done = true
+			default:
+			}
+			if done && e.status == 0 {
+				// The first request failed and released the key.
+				e, claimed = h.idempotency.begin(k, fingerprint, time.Now())
+				continue
+			}
+			if e.fingerprint != fingerprint {
+				writeError(w, r, http.StatusUnprocessableEntity, "idempotency_key_reused", idempotencyKeyHeader+" was already used for a different request", nil)
+				return
+			}
+			if !done {
+				writeError(w, r, http.StatusConflict, "idempotency_key_in_use", "a request with this "+idempotencyKeyHeader+" is still in progress", nil)
+				return
+			}
+			for name, v := range e.header {
+				w.Header()[name] = v
+			}
+			w.Header().Set(idempotentReplayedHeader, "true")
+			w.WriteHeader(e.status)
+			w.Write(e.body)
+			return
+		}
+		rec := &envelopeRecorder{header: w.Header()}
+		finished := false
+		defer func() {
+			// next panicked.
+			if !finished {
+				h.idempotency.release(k, e)
+			}
+		}()
+		next(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		h.idempotency.finish(k, e, rec, time.Now())
+		finished = true
+		w.WriteHeader(rec.status)
+		w.Write(rec.body.Bytes())
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"crypto/sha256"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func doIdempotent(s *server, key, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, "/orders", strings.NewReader(body))
+	r.Header.Set(apiKeyHeader, testAPIKey)
+	r.Header.Set("content-type", "application/json")
+	r.Header.Set(idempotencyKeyHeader, key)
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	return w
+}
+
+// TestIdempotency checks that a repeated request is replayed, and that keys
+// released or expired can be claimed again.
+func TestIdempotency(t *testing.T) {
+	s := newTestServer(t)
+	body := `{"id":"i1","name":"guest","table_number":"2","order_items":[{"name":"roti","quantity":1}]}`
+	if w := doIdempotent(s, "k1", body); w.Code != http.StatusOK {
+		t.Fatalf("first: %d %s", w.Code, w.Body)
+	}
+	if w := doIdempotent(s, "k1", body); w.Code != http.StatusOK || w.Header().Get(idempotentReplayedHeader) != "true" {
+		t.Errorf("repeat: %d, replayed %q", w.Code, w.Header().Get(idempotentReplayedHeader))
+	}
+
+	st := newIdempotencyStore(10 * time.Second)
+	k, now := idempotencyKey{actor: "a", key: "k"}, time.Now()
+	e, _ := st.begin(k, [sha256.Size]byte{}, now)
+	st.release(k, e)
+	// A request that found the key before it was released sees no response,
+	// and claims the key again.
+	<-e.done
+	if e.status != 0 {
+		t.Errorf("released key has status %d", e.status)
+	}
+	e, claimed := st.begin(k, [sha256.Size]byte{}, now)
+	if !claimed {
+		t.Fatal("released key not claimed again")
+	}
+	st.finish(k, e, &envelopeRecorder{header: http.Header{}, status: http.StatusOK}, now)
+	if _, claimed := st.begin(k, [sha256.Size]byte{}, now.Add(11*time.Second)); !claimed {
+		t.Error("expired key not claimed again before the sweep")
+	}
+}
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+	"io"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"time"
+)
+
+var menuImageRe = regexp.MustCompile(`^/menu/([a-z0-9-]+)/image(?:/([a-z]+))?$`)
+
+const (
+	// maxImageBytes bounds an uploaded file.
+	maxImageBytes = 5 << 20
+	// maxImagePixels bounds the decoded image, so that a small file cannot
+	// claim a canvas too big to resize.
+	maxImagePixels = 40_000_000
+)
+
+const (
+	imageStoreDisk = "disk"
+	imageStoreS3   = "s3"
+)
+
+// imageOriginal is the variant name of the file as uploaded.
+const imageOriginal = "original"
+
+// imageVariants are the sizes served to the guest-facing menu, each the
+// upload scaled down to fit a square of side pixels and saved as JPEG.
+// Images already smaller are not scaled up.
+var imageVariants = []struct {
+	name string
+	side int
+}{
+	{"thumb", 160},
+	{"small", 480},
+	{"large", 1200},
+}
+
+// imageTypes are the upload types accepted, by sniffed content type, and the
+// extension the original is kept under.
+var imageTypes = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/gif":  ".gif",
+}
+
+// menuImage is a menu item's picture. Version is a hash of the upload, so
+// every upload gets new URLs and browsers can cache each one for good.
+type menuImage struct {
+	Version     string            `json:"version"`
+	ContentType string            `json:"content_type"`
+	Width       int               `json:"width"`
+	Height      int               `json:"height"`
+	Bytes       int               `json:"bytes"`
+	URLs        map[string]string `json:"urls"`
+	UploadedAt  time.Time         `json:"uploaded_at"`
+}
+
+// key is where variant of item's image is stored.
+func (m *menuImage) key(item, variant string) string {
+	ext := ".jpg"
+	if variant == imageOriginal {
+		ext = imageTypes[m.ContentType]
+	}
+	return "menu/" + item + "/" + m.Version + "/" + variant + ext
+}
+
+func (m *menuImage) variants() []string {
+	names := []string{imageOriginal}
+	for _, v := range imageVariants {
+		names = append(names, v.name)
+	}
+	return names
+}
+
+// imageConfig is where menu images are kept: on disk (the default), under
+// Dir, or in an S3 bucket.
+type imageConfig struct {
+	Store string `json:"store"`
+	Dir   string `json:"dir"`
+	objectStoreConfig
+}
+
+func newImageStore(c imageConfig) (objectStore, error) {
+	switch c.Store {
+	case imageStoreDisk:
+		return &diskStore{dir: c.Dir}, nil
+	case imageStoreS3:
+		if c.Bucket == "" {
+			return nil, fmt.Errorf("bucket is required with store s3")
+		}
+		return newS3Store(c.objectStoreConfig)
+	default:
+		return nil, fmt.Errorf("store must be disk or s3, got %q", c.Store)
+	}
+}
+
+var errUnsupportedImage = errors.New("image must be a JPEG, PNG or GIF")
+
+// processImage checks an upload and renders its variants, keyed by name.
+func processImage(data []byte) (*menuImage, map[string][]byte, error) {
+	contentType := http.DetectContentType(data)
+	if _, ok := imageTypes[contentType]; !ok {
+		return nil, nil, errUnsupportedImage
+	}
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, nil, fmt.Errorf("image could not be read: %v", err)
+	}
+	if cfg.Width*cfg.Height > maxImagePixels {
+		return nil, nil, fmt.Errorf("image must be at most %d pixels, got %dx%d", maxImagePixels, cfg.Width, cfg.Height)
+	}
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, nil, fmt.Errorf("image could not be read: %v", err)
+	}
+	// JPEG has no transparency, so transparent pixels are laid on white.
+	flat := image.NewRGBA(image.Rect(0, 0, cfg.Width, cfg.Height))
+	draw.Draw(flat, flat.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	draw.Draw(flat, flat.Bounds(), src, src.Bounds().Min, draw.Over)
+
+	sum := sha256.Sum256(data)
+	img := &menuImage{
+		Version:     hex.EncodeToString(sum[:8]),
+		ContentType: contentType,
+		Width:       cfg.Width,
+		Height:      cfg.Height,
+		Bytes:       len(data),
+		UploadedAt:  time.Now().UTC(),
+	}
+	files := map[string][]byte{imageOriginal: data}
+	for _, v := range imageVariants {
+		var buf bytes.Buffer
+		if err := jpeg.Encode(&buf, fitImage(flat, v.side), &jpeg.Options{Quality: 85}); err != nil {
+			return nil, nil, err
+		}
+		files[v.name] = buf.Bytes()
+	}
+	return img, files, nil
+}
+
+// fitImage scales src down to fit a square of side pixels, averaging the
+// source pixels under each one.
+func fitImage(src *image.RGBA, side int) *image.RGBA {
+	w, h := src.Bounds().Dx(), src.Bounds().Dy()
+	if w <= side && h <= side {
+		return src
+	}
+	scale := float64(side) / float64(max(w, h))
+	dw, dh := max(1, int(float64(w)*scale+0.5)), max(1, int(float64(h)*scale+0.5))
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for dy := 0; dy < dh; dy++ {
+		y0, y1 := dy*h/dh, max((dy+1)*h/dh, dy*h/dh+1)
+		for dx := 0; dx < dw; dx++ {
+			x0, x1 := dx*w/dw, max((dx+1)*w/dw, dx*w/dw+1)
+			var sum [4]int
+			for y := y0; y < y1; y++ {
+				row := src.Pix[src.PixOffset(x0, y):src.PixOffset(x1, y)]
+				for i := 0; i < len(row); i += 4 {
+					sum[0] += int(row[i])
+					sum[1] += int(row[i+1])
+					sum[2] += int(row[i+2])
+					sum[3] += int(row[i+3])
+				}
+			}
+			n := (x1 - x0) * (y1 - y0)
+			o := dst.PixOffset(dx, dy)
+			for c := range sum {
+				dst.Pix[o+c] = uint8(sum[c] / n)
+			}
+		}
+	}
+	return dst
+}
+
+// setImage replaces the image of item id, returning the one it had.
+func (s *menuStore) setImage(id string, img *menuImage) (*menuImage, bool) {
+	s.Lock()
+	item, ok := s.m[id]
+	if !ok {
+		s.Unlock()
+		return nil, false
+	}
+	prev := item.Image
+	item.Image = img
+	s.m[id] = item
+	s.Unlock()
+	s.feed.publish(kindMenu, id, false)
+	return prev, true
+}
+
+// removeImage deletes the stored files of item's image. Failures are logged:
+// the image is already off the menu, so they only leave files behind.
+func (h *menuHandler) removeImage(ctx context.Context, item string, img *menuImage) {
+	if img == nil {
+		return
+	}
+	for _, v := range img.variants() {
+		if err := h.images.remove(ctx, img.key(item, v)); err != nil {
+			slog.ErrorContext(ctx, "menu image", slog.String("item", item), slog.String("error", err.Error()))
+		}
+	}
+}
+
+// UploadImage sets a menu item's picture from the multipart field "image".
+// The original and its resized variants are stored before the item points at
+// them, and the previous image's files are removed after.
+func (h *menuHandler) UploadImage(w http.ResponseWriter, r *http.Request) {
+	id := menuImageRe.FindStringSubmatch(r.URL.Path)[1]
+	if _, ok := h.menu.get(id); !ok {
+		notFound(w, r)
+		return
+	}
+	// Leave room for the multipart framing around the file.
+	r.Body = http.MaxBytesReader(w, r.Body, maxImageBytes+64<<10)
+	file, _, err := r.FormFile("image")
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.As(err, &tooLarge):
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		w.Write([]byte(fmt.Sprintf("image must be at most %d bytes", maxImageBytes)))
+		return
+	case err != nil:
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("body must be multipart/form-data with the file in an image field"))
+		return
+	}
+	defer file.Close()
+	data, err := io.ReadAll(io.LimitReader(file, maxImageBytes+1))
+	if err != nil {
+		internalServerError(w, r)
+		return
+	}
+	if len(data) > maxImageBytes {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		w.Write([]byte(fmt.Sprintf("image must be at most %d bytes", maxImageBytes)))
+		return
+	}
+	img, files, err := processImage(data)
+	switch {
+	case errors.Is(err, errUnsupportedImage):
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		w.Write([]byte(err.Error()))
+		return
+	case err != nil:
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	img.URLs = map[string]string{}
+	for _, v := range img.variants() {
+		obj := object{body: files[v], contentType: "image/jpeg"}
+		if v == imageOriginal {
+			obj.contentType = img.ContentType
+		}
+		if err := h.images.put(r.Context(), img.key(id, v), obj); err != nil {
+			slog.ErrorContext(r.Context(), "menu image", slog.String("item", id), slog.String("error", err.Error()))
+			h.removeImage(context.WithoutCancel(r.Context()), id, img)
+			internalServerError(w, r)
+			return
+		}
+		img.URLs[v] = "/menu/" + id + "/image/" + v + "?v=" + img.Version
+	}
+	prev, ok := h.menu.setImage(id, img)
+	if !ok {
+		// The item was deleted while the image was stored.
+		h.removeImage(context.WithoutCancel(r.Context()), id, img)
+		notFound(w, r)
+		return
+	}
+	if prev != nil && prev.Version != img.Version {
+		h.removeImage(context.WithoutCancel(r.Context()), id, prev)
+	}
+	item, _ := h.menu.get(id)
+	writeJSON(w, r, http.StatusOK, item)
+}
+
+// Image serves a variant of a menu item's picture, large unless one is
+// named. Like the rest of the menu it needs no session. URLs carrying the
+// current version may be cached indefinitely; others are revalidated.
+func (h *menuHandler) Image(w http.ResponseWriter, r *http.Request) {
+	matches := menuImageRe.FindStringSubmatch(r.URL.Path)
+	variant := matches[2]
+	if variant == "" {
+		variant = "large"
+	}
+	item, ok := h.menu.get(matches[1])
+	if !ok || item.Image == nil {
+		notFound(w, r)
+		return
+	}
+	if _, ok := item.Image.URLs[variant]; !ok {
+		notFound(w, r)
+		return
+	}
+	etag := `"` + item.Image.Version + "-" + variant + `"`
+	w.Header().Set("ETag", etag)
+	if r.URL.Query().Get("v") == item.Image.Version {
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	} else {
+		w.Header().Set("Cache-Control", "public, no-cache")
+	}
+	if r.Header.Get("If-None-Match") == etag {
+		w.Header().Del("content-type")
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	obj, err := h.images.get(r.Context(), item.Image.key(item.ID, variant))
+	if errors.Is(err, errObjectNotFound) {
+		notFound(w, r)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "menu image", slog.String("item", item.ID), slog.String("error", err.Error()))
+		internalServerError(w, r)
+		return
+	}
+	w.Header().Set("content-type", obj.contentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusOK)
+	w.Write(obj.body)
+}
+
+// DeleteImage takes a menu item's picture off the menu and removes its files.
+func (h *menuHandler) DeleteImage(w http.ResponseWriter, r *http.Request) {
+	id := menuImageRe.FindStringSubmatch(r.URL.Path)[1]
+	prev, ok := h.menu.setImage(id, nil)
+	if !ok || prev == nil {
+		notFound(w, r)
+		return
+	}
+	h.removeImage(r.Context(), id, prev)
+	w.WriteHeader(http.StatusNoContent)
+}
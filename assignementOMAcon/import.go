@@ -0,0 +1,437 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var importRe = regexp.MustCompile(`^/admin/import$`)
+
+const (
+	importCSV  = "csv"
+	importJSON = "json"
+)
+
+// importFields are the order fields an import can fill, which are also the
+// names used in a mapping.
+var importFields = []string{
+	"id", "name", "table_number", "items", "total", "tax", "tip",
+	"payment", "payment_method", "channel", "location_id", "created_at",
+}
+
+// importItemRe reads one item of an items column: "2 x biryani", "2x biryani",
+// "biryani x 2" or just "biryani".
+var importItemRe = regexp.MustCompile(`^(?:(\d+)\s*[xX]\s+(.+)|(.+?)\s+[xX]\s*(\d+)|(.+))$`)
+
+// importRequest is an export from the old POS and how to read it. Data holds
+// a CSV export, with a header row, and Records a JSON one. Mapping names the
+// column each order field comes from, defaulting to the field's own name;
+// Values translates a field's old values, such as {"payment": {"SETTLED":
+// "paid"}}; Defaults fill fields a row leaves empty. Items columns list
+// items separated by ItemSeparator (default ";"), and times are read with
+// TimeLayout (default RFC 3339) in UTC. Order IDs get IDPrefix (default
+// "legacy-") so they cannot clash with new orders.
+type importRequest struct {
+	Format        string                       `json:"format"`
+	Data          string                       `json:"data,omitempty"`
+	Records       []map[string]interface{}     `json:"records,omitempty"`
+	Mapping       map[string]string            `json:"mapping,omitempty"`
+	Values        map[string]map[string]string `json:"values,omitempty"`
+	Defaults      map[string]string            `json:"defaults,omitempty"`
+	ItemSeparator string                       `json:"item_separator,omitempty"`
+	TimeLayout    string                       `json:"time_layout,omitempty"`
+	IDPrefix      *string                      `json:"id_prefix,omitempty"`
+}
+
+func (req *importRequest) validate() []fieldError {
+	var errs []fieldError
+	switch req.Format {
+	case importCSV:
+		if strings.TrimSpace(req.Data) == "" {
+			errs = append(errs, fieldError{Field: "data", Message: "is required for csv imports"})
+		}
+	case importJSON:
+		if len(req.Records) == 0 {
+			errs = append(errs, fieldError{Field: "records", Message: "is required for json imports"})
+		}
+	default:
+		errs = append(errs, fieldError{Field: "format", Message: "must be csv or json"})
+	}
+	known := map[string]bool{}
+	for _, f := range importFields {
+		known[f] = true
+	}
+	for f := range req.Mapping {
+		if !known[f] {
+			errs = append(errs, fieldError{Field: "mapping." + f, Message: "is not an importable field"})
+		}
+	}
+	for f := range req.Defaults {
+		if !known[f] {
+			errs = append(errs, fieldError{Field: "defaults." + f, Message: "is not an importable field"})
+		}
+	}
+	for f := range req.Values {
+		if !known[f] {
+			errs = append(errs, fieldError{Field: "values." + f, Message: "is not an importable field"})
+		}
+	}
+	sort.Slice(errs, func(i, j int) bool { return errs[i].Field < errs[j].Field })
+	return errs
+}
+
+// rows returns the export's records keyed by column.
+func (req *importRequest) rows() ([]map[string]interface{}, error) {
+	if req.Format == importJSON {
+		return req.Records, nil
+	}
+	cr := csv.NewReader(strings.NewReader(req.Data))
+	cr.TrimLeadingSpace = true
+	lines, err := cr.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(lines) < 2 {
+		return nil, fmt.Errorf("needs a header row and at least one order")
+	}
+	header := lines[0]
+	rows := make([]map[string]interface{}, 0, len(lines)-1)
+	for _, line := range lines[1:] {
+		row := map[string]interface{}{}
+		for i, col := range header {
+			if i < len(line) {
+				row[strings.TrimSpace(col)] = line[i]
+			}
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+// value returns a row's value for an order field, after defaults and value
+// translation, or nil when it has none.
+func (req *importRequest) value(row map[string]interface{}, field string) interface{} {
+	col := field
+	if c, ok := req.Mapping[field]; ok {
+		col = c
+	}
+	v := row[col]
+	if s, ok := v.(string); v == nil || ok && strings.TrimSpace(s) == "" {
+		v = nil
+		if d, ok := req.Defaults[field]; ok {
+			v = d
+		}
+	}
+	switch t := v.(type) {
+	case string:
+		t = strings.TrimSpace(t)
+		if to, ok := req.Values[field][t]; ok {
+			return to
+		}
+		return t
+	case float64:
+		if to, ok := req.Values[field][strconv.FormatFloat(t, 'f', -1, 64)]; ok {
+			return to
+		}
+	}
+	return v
+}
+
+// text reads a field that should be a string. Numbers are accepted, since a
+// JSON export may have numeric IDs or table numbers.
+func (req *importRequest) text(row map[string]interface{}, field string) (string, error) {
+	switch v := req.value(row, field).(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	}
+	return "", fmt.Errorf("must be text")
+}
+
+// amount reads a money field given in major units, such as "12.50", into
+// minor units.
+func (req *importRequest) amount(row map[string]interface{}, field string) (int64, error) {
+	var f float64
+	switch v := req.value(row, field).(type) {
+	case nil:
+		return 0, nil
+	case float64:
+		f = v
+	case string:
+		var err error
+		if f, err = strconv.ParseFloat(v, 64); err != nil {
+			return 0, fmt.Errorf("must be an amount such as 12.50")
+		}
+	default:
+		return 0, fmt.Errorf("must be an amount such as 12.50")
+	}
+	if f < 0 || math.IsInf(f, 0) || math.IsNaN(f) {
+		return 0, fmt.Errorf("must not be negative")
+	}
+	return int64(math.Round(f * 100)), nil
+}
+
+// items reads an items field: a list of items in one string, or in a JSON
+// export an array of such strings or of {"name", "quantity"} objects.
+func (req *importRequest) items(row map[string]interface{}) (orderItems, error) {
+	sep := req.ItemSeparator
+	if sep == "" {
+		sep = ";"
+	}
+	var items orderItems
+	var add func(v interface{}) error
+	add = func(v interface{}) error {
+		switch t := v.(type) {
+		case string:
+			for _, part := range strings.Split(t, sep) {
+				if part = strings.TrimSpace(part); part == "" {
+					continue
+				}
+				m := importItemRe.FindStringSubmatch(part)
+				it := orderItem{Quantity: 1}
+				switch {
+				case m[1] != "":
+					it.Quantity, _ = strconv.Atoi(m[1])
+					it.Name = m[2]
+				case m[4] != "":
+					it.Quantity, _ = strconv.Atoi(m[4])
+					it.Name = m[3]
+				default:
+					it.Name = m[5]
+				}
+				items = append(items, it)
+			}
+		case map[string]interface{}:
+			name, _ := t["name"].(string)
+			qty, ok := t["quantity"].(float64)
+			if !ok {
+				qty = 1
+			}
+			if qty != math.Trunc(qty) {
+				return fmt.Errorf("quantities must be whole numbers")
+			}
+			items = append(items, orderItem{Name: strings.TrimSpace(name), Quantity: int(qty)})
+		case []interface{}:
+			for _, e := range t {
+				if err := add(e); err != nil {
+					return err
+				}
+			}
+		case nil:
+		default:
+			return fmt.Errorf("must be a list of items")
+		}
+		return nil
+	}
+	if err := add(req.value(row, "items")); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+// order builds the order a row describes, reporting each field that could
+// not be read.
+func (req *importRequest) order(row map[string]interface{}) (order, []fieldError) {
+	var o order
+	var errs []fieldError
+	fail := func(field string, err error) {
+		if err != nil {
+			errs = append(errs, fieldError{Field: field, Message: err.Error()})
+		}
+	}
+	var err error
+	for _, f := range []struct {
+		field string
+		dst   *string
+	}{
+		{"id", &o.ID}, {"name", &o.Name}, {"table_number", &o.TableNumber},
+		{"payment_method", &o.PaymentMethod}, {"channel", &o.Channel}, {"location_id", &o.LocationID},
+	} {
+		*f.dst, err = req.text(row, f.field)
+		fail(f.field, err)
+	}
+	var payment string
+	payment, err = req.text(row, "payment")
+	fail("payment", err)
+	o.Payment = parsePaymentStatus(payment)
+	o.Total, err = req.amount(row, "total")
+	fail("total", err)
+	o.Tax, err = req.amount(row, "tax")
+	fail("tax", err)
+	o.Tip, err = req.amount(row, "tip")
+	fail("tip", err)
+	o.OrderItems, err = req.items(row)
+	fail("items", err)
+	created, err := req.text(row, "created_at")
+	fail("created_at", err)
+	if created != "" {
+		layout := req.TimeLayout
+		if layout == "" {
+			layout = time.RFC3339
+		}
+		t, err := time.ParseInLocation(layout, created, time.UTC)
+		if err != nil {
+			fail("created_at", fmt.Errorf("must be a time in the layout %s", layout))
+		} else {
+			t = t.UTC()
+			o.CreatedAt = &t
+		}
+	}
+	if o.ID == "" {
+		errs = append(errs, fieldError{Field: "id", Message: "is required"})
+	} else {
+		prefix := "legacy-"
+		if req.IDPrefix != nil {
+			prefix = *req.IDPrefix
+		}
+		o.ID = prefix + o.ID
+	}
+	if len(o.OrderItems) == 0 {
+		errs = append(errs, fieldError{Field: "items", Message: "is required"})
+	}
+	return o, errs
+}
+
+// importRowError is a problem with one row of an import. Rows are counted
+// from 1, not counting a CSV header.
+type importRowError struct {
+	Row     int    `json:"row"`
+	OrderID string `json:"order_id,omitempty"`
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+type importReport struct {
+	DryRun   bool             `json:"dry_run"`
+	Rows     int              `json:"rows"`
+	Valid    int              `json:"valid"`
+	Imported int              `json:"imported"`
+	OrderIDs []string         `json:"order_ids"`
+	Errors   []importRowError `json:"errors"`
+}
+
+type importHandler struct {
+	orders   *orderHandler
+	sessions *sessionStore
+}
+
+func (h *importHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("content-type", "application/json")
+	switch {
+	case r.Method == http.MethodPost && importRe.MatchString(r.URL.Path):
+		h.Import(w, r)
+		return
+	default:
+		notFound(w, r)
+		return
+	}
+}
+
+// Import migrates orders exported from the old POS. Rows that fail
+// validation, whose order already exists, or that would take their location
+// past its quota of open orders are skipped and reported; the
+// rest are stored as they were, without running hooks, pricing or kitchen
+// tickets. Finished orders come in closed, so closing the day does not count
+// them again. With ?dry_run=true nothing is stored and the report says what
+// would have been.
+func (h *importHandler) Import(w http.ResponseWriter, r *http.Request) {
+	sess, ok := h.sessions.requireScope(w, r, "orders:manage")
+	if !ok {
+		return
+	}
+	var req importRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		decodeFailed(w, r, err)
+		return
+	}
+	if errs := req.validate(); len(errs) > 0 {
+		validationFailed(w, r, errs)
+		return
+	}
+	rows, err := req.rows()
+	if err != nil {
+		validationFailed(w, r, []fieldError{{Field: "data", Message: "must be CSV: " + err.Error()}})
+		return
+	}
+	dryRun, _ := strconv.ParseBool(r.URL.Query().Get("dry_run"))
+	rep := importReport{DryRun: dryRun, Rows: len(rows), OrderIDs: []string{}, Errors: []importRowError{}}
+	type validRow struct {
+		row int
+		o   order
+	}
+	var valid []validRow
+	seen := map[string]bool{}
+	h.orders.store.RLock()
+	for i, row := range rows {
+		o, errs := req.order(row)
+		if err := placeOrder(r, h.orders.sessions, &o); err != nil {
+			errs = append(errs, fieldError{Field: "location_id", Message: err.Error()})
+		}
+		if o.ID != "" && len(errs) == 0 {
+			tallyItems(&o)
+			errs = h.orders.validators.validate(o)
+		}
+		if _, exists := h.orders.store.m[o.ID]; o.ID != "" && exists {
+			errs = append(errs, fieldError{Field: "id", Message: "order already exists"})
+		} else if seen[o.ID] {
+			errs = append(errs, fieldError{Field: "id", Message: "appears earlier in the import"})
+		}
+		for _, e := range errs {
+			rep.Errors = append(rep.Errors, importRowError{Row: i + 1, OrderID: o.ID, Field: e.Field, Message: e.Message})
+		}
+		if len(errs) == 0 {
+			seen[o.ID] = true
+			valid = append(valid, validRow{row: i + 1, o: o})
+		}
+	}
+	h.orders.store.RUnlock()
+	rep.Valid = len(valid)
+	if dryRun {
+		for _, v := range valid {
+			rep.OrderIDs = append(rep.OrderIDs, v.o.ID)
+		}
+		writeJSON(w, r, http.StatusOK, rep)
+		return
+	}
+
+	now := time.Now()
+	for _, v := range valid {
+		o, created := v.o, v.o.CreatedAt
+		o.Locked = isFinal(o)
+		h.orders.store.Lock()
+		if _, exists := h.orders.store.m[o.ID]; exists {
+			h.orders.store.Unlock()
+			rep.Errors = append(rep.Errors, importRowError{Row: v.row, OrderID: o.ID, Field: "id", Message: "order already exists"})
+			continue
+		}
+		if err := h.orders.quotas.admit(h.orders.store.m, o)[0]; err != nil {
+			h.orders.store.Unlock()
+			rep.Errors = append(rep.Errors, importRowError{Row: v.row, OrderID: o.ID, Field: "location_id", Message: err.Error()})
+			continue
+		}
+		touch(&o, order{CreatedAt: created}, now)
+		if err := h.orders.store.put(o); err != nil {
+			h.orders.store.Unlock()
+			rep.Errors = append(rep.Errors, importRowError{Row: v.row, OrderID: o.ID, Field: "id", Message: "could not be stored: " + err.Error()})
+			continue
+		}
+		h.orders.store.Unlock()
+		h.orders.recordChange(r, "order.import", order{}, o)
+		h.orders.feed.publish(kindOrders, o.ID, false)
+		rep.Imported++
+		rep.OrderIDs = append(rep.OrderIDs, o.ID)
+	}
+	h.orders.audit.record(auditEntry{Action: "import.run", Ref: strconv.Itoa(rep.Imported), StaffID: sess.StaffID})
+	writeJSON(w, r, http.StatusOK, rep)
+}
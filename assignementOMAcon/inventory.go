@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	listInventoryRe   = regexp.MustCompile(`^/inventory/?$`)
+	inventoryAlertsRe = regexp.MustCompile(`^/inventory/alerts$`)
+	putInventoryRe    = regexp.MustCompile(`^/inventory/([^/]+)$`)
+	adjustInventoryRe = regexp.MustCompile(`^/inventory/([^/]+)/adjust$`)
+)
+
+type inventoryItem struct {
+	SKU       string `json:"sku"`
+	Name      string `json:"name"`
+	OnHand    int    `json:"on_hand"`
+	Threshold int    `json:"threshold"`
+}
+
+func (i inventoryItem) low() bool {
+	return i.OnHand < i.Threshold
+}
+
+type stockAlert struct {
+	SKU       string    `json:"sku"`
+	Name      string    `json:"name"`
+	OnHand    int       `json:"on_hand"`
+	Threshold int       `json:"threshold"`
+	RaisedAt  time.Time `json:"raised_at"`
+}
+
+type inventoryStore struct {
+	m      map[string]inventoryItem
+	alerts map[string]stockAlert
+	hooks  *hookRegistry
+	*sync.RWMutex
+}
+
+func newInventoryStore(hooks *hookRegistry) *inventoryStore {
+	return &inventoryStore{
+		m:       map[string]inventoryItem{},
+		alerts:  map[string]stockAlert{},
+		hooks:   hooks,
+		RWMutex: &sync.RWMutex{},
+	}
+}
+
+// put stores item and re-evaluates its alert. Callers hold the lock; raised
+// alerts are returned so notifications go out after it is released.
+func (s *inventoryStore) put(item inventoryItem, now time.Time) []stockAlert {
+	s.m[item.SKU] = item
+	if !item.low() {
+		delete(s.alerts, item.SKU)
+		return nil
+	}
+	if _, active := s.alerts[item.SKU]; active {
+		a := s.alerts[item.SKU]
+		a.OnHand = item.OnHand
+		s.alerts[item.SKU] = a
+		return nil
+	}
+	a := stockAlert{SKU: item.SKU, Name: item.Name, OnHand: item.OnHand, Threshold: item.Threshold, RaisedAt: now}
+	s.alerts[item.SKU] = a
+	return []stockAlert{a}
+}
+
+func (s *inventoryStore) set(item inventoryItem) {
+	s.Lock()
+	raised := s.put(item, time.Now().UTC())
+	s.Unlock()
+	s.notify(raised)
+}
+
+func (s *inventoryStore) adjust(sku string, delta int) (inventoryItem, bool) {
+	s.Lock()
+	item, ok := s.m[sku]
+	if !ok {
+		s.Unlock()
+		return inventoryItem{}, false
+	}
+	item.OnHand += delta
+	raised := s.put(item, time.Now().UTC())
+	s.Unlock()
+	s.notify(raised)
+	return item, true
+}
+
+// consume decrements stock for each named item on an order. Names that do not
+// match an inventory item are ignored.
+func (s *inventoryStore) consume(names []string) {
+	now := time.Now().UTC()
+	var raised []stockAlert
+	s.Lock()
+	for _, name := range names {
+		for _, item := range s.m {
+			if strings.EqualFold(item.Name, name) {
+				item.OnHand--
+				raised = append(raised, s.put(item, now)...)
+				break
+			}
+		}
+	}
+	s.Unlock()
+	s.notify(raised)
+}
+
+func (s *inventoryStore) notify(alerts []stockAlert) {
+	for _, a := range alerts {
+		log.Printf("low stock: %s (%s) on hand %d, threshold %d", a.Name, a.SKU, a.OnHand, a.Threshold)
+		s.hooks.runLowStock(context.Background(), a)
+	}
+}
+
+func (s *inventoryStore) list() []inventoryItem {
+	s.RLock()
+	out := make([]inventoryItem, 0, len(s.m))
+	for _, item := range s.m {
+		out = append(out, item)
+	}
+	s.RUnlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].SKU < out[j].SKU })
+	return out
+}
+
+func (s *inventoryStore) activeAlerts() []stockAlert {
+	s.RLock()
+	out := make([]stockAlert, 0, len(s.alerts))
+	for _, a := range s.alerts {
+		out = append(out, a)
+	}
+	s.RUnlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].RaisedAt.Before(out[j].RaisedAt) })
+	return out
+}
+
+// orderItemNames lists every item on an order, across all its courses.
+func orderItemNames(o order) []string {
+	var names []string
+	for _, c := range orderCourses(o) {
+		names = append(names, c.Items...)
+	}
+	return names
+}
+
+type inventoryHandler struct {
+	inventory *inventoryStore
+	sessions  *sessionStore
+}
+
+func (h *inventoryHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("content-type", "application/json")
+	scope := "orders:read"
+	if r.Method != http.MethodGet {
+		scope = "orders:manage"
+	}
+	if _, ok := h.sessions.requireScope(w, r, scope); !ok {
+		return
+	}
+	switch {
+	case r.Method == http.MethodGet && listInventoryRe.MatchString(r.URL.Path):
+		writeJSON(w, r, http.StatusOK, h.inventory.list())
+		return
+	case r.Method == http.MethodGet && inventoryAlertsRe.MatchString(r.URL.Path):
+		writeJSON(w, r, http.StatusOK, h.inventory.activeAlerts())
+		return
+	case r.Method == http.MethodPost && adjustInventoryRe.MatchString(r.URL.Path):
+		h.Adjust(w, r)
+		return
+	case r.Method == http.MethodPut && putInventoryRe.MatchString(r.URL.Path):
+		h.Put(w, r)
+		return
+	default:
+		notFound(w, r)
+		return
+	}
+}
+
+func (h *inventoryHandler) Put(w http.ResponseWriter, r *http.Request) {
+	matches := putInventoryRe.FindStringSubmatch(r.URL.Path)
+	var item inventoryItem
+	if err := json.NewDecoder(r.Body).Decode(&item); err != nil || item.Name == "" || item.Threshold < 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("name and a non-negative threshold are required"))
+		return
+	}
+	item.SKU = matches[1]
+	h.inventory.set(item)
+	writeJSON(w, r, http.StatusOK, item)
+}
+
+func (h *inventoryHandler) Adjust(w http.ResponseWriter, r *http.Request) {
+	matches := adjustInventoryRe.FindStringSubmatch(r.URL.Path)
+	var req struct {
+		Delta int `json:"delta"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("delta is required"))
+		return
+	}
+	item, ok := h.inventory.adjust(matches[1], req.Delta)
+	if !ok {
+		notFound(w, r)
+		return
+	}
+	writeJSON(w, r, http.StatusOK, item)
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+)
+
+// orderItem is one line of an order. UnitPrice is in minor units.
+// MenuItemID is the menu item the line is for, filled in from the name when
+// the client does not give it.
+type orderItem struct {
+	Name       string `json:"name"`
+	MenuItemID string `json:"menu_item_id,omitempty"`
+	Quantity   int    `json:"quantity"`
+	UnitPrice  int64  `json:"unit_price,omitempty"`
+	Notes      string `json:"notes,omitempty"`
+}
+
+// orderItems are the lines of an order. Orders used to list their items as
+// one comma-separated string ("biryani, biryani, roti"); that form is still
+// read, from clients and from orders stored before the change, and becomes
+// one line per distinct name.
+type orderItems []orderItem
+
+func (l *orderItems) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		*l = parseItemList(s)
+		return nil
+	}
+	var items []orderItem
+	if err := json.Unmarshal(b, &items); err != nil {
+		return err
+	}
+	*l = items
+	return nil
+}
+
+// parseItemList reads the old comma-separated item string.
+func parseItemList(s string) orderItems {
+	var out orderItems
+	index := map[string]int{}
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if i, ok := index[name]; ok {
+			out[i].Quantity++
+			continue
+		}
+		index[name] = len(out)
+		out = append(out, orderItem{Name: name, Quantity: 1})
+	}
+	return out
+}
+
+// names lists each item once per unit ordered.
+func (l orderItems) names() []string {
+	var out []string
+	for _, it := range l {
+		for i := 0; i < it.Quantity; i++ {
+			out = append(out, it.Name)
+		}
+	}
+	return out
+}
+
+// itemCount is an order's number of units. It used to be sent as a string,
+// which is still accepted.
+type itemCount int
+
+func (n *itemCount) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		v, err := strconv.Atoi(strings.TrimSpace(s))
+		if err != nil && strings.TrimSpace(s) != "" {
+			return err
+		}
+		*n = itemCount(v)
+		return nil
+	}
+	var v int
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	*n = itemCount(v)
+	return nil
+}
+
+// tallyItems fills in what an order's lines determine: TotalItems, Subtotal
+// and, when any line is priced, Total (subtotal plus tax). A computed total
+// replaces whatever service charge the client echoed back; the charge is
+// worked out again when the order is stored.
+func tallyItems(o *order) {
+	var count int
+	var subtotal int64
+	for _, it := range o.OrderItems {
+		count += it.Quantity
+		subtotal += int64(it.Quantity) * it.UnitPrice
+	}
+	o.TotalItems, o.Subtotal = itemCount(count), subtotal
+	if o.OrderItems.priced() {
+		o.Total, o.ServiceCharge = subtotal+o.Tax, nil
+	}
+}
+
+// priced reports whether any line carries a price, in which case the server
+// works out the order's totals.
+func (items orderItems) priced() bool {
+	for _, it := range items {
+		if it.UnitPrice > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func validateItems(o order) []fieldError {
+	var errs []fieldError
+	for i, it := range o.OrderItems {
+		field := "order_items." + strconv.Itoa(i)
+		switch {
+		case strings.TrimSpace(it.Name) == "":
+			errs = append(errs, fieldError{Field: field + ".name", Message: "is required"})
+		case it.Quantity < 1:
+			errs = append(errs, fieldError{Field: field + ".quantity", Message: "must be at least 1"})
+		case it.UnitPrice < 0:
+			errs = append(errs, fieldError{Field: field + ".unit_price", Message: "must not be negative"})
+		}
+	}
+	return errs
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// jsonAPIMediaType selects the JSON:API representation of orders, customers
+// and menu items when it appears in the Accept header.
+const jsonAPIMediaType = "application/vnd.api+json"
+
+const (
+	typeOrders    = "orders"
+	typeCustomers = "customers"
+	typeMenuItems = "menu-items"
+)
+
+type jsonAPIDocument struct {
+	Data     interface{}       `json:"data"`
+	Included []jsonAPIResource `json:"included,omitempty"`
+	JSONAPI  map[string]string `json:"jsonapi"`
+}
+
+type jsonAPIResource struct {
+	Type          string                         `json:"type"`
+	ID            string                         `json:"id"`
+	Attributes    map[string]interface{}         `json:"attributes"`
+	Relationships map[string]jsonAPIRelationship `json:"relationships,omitempty"`
+}
+
+// jsonAPIRelationship holds a linkage: one identifier for to-one
+// relationships, a list for to-many, or null.
+type jsonAPIRelationship struct {
+	Data interface{} `json:"data"`
+}
+
+type jsonAPIIdentifier struct {
+	Type string `json:"type"`
+	ID   string `json:"id"`
+}
+
+func wantsJSONAPI(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), jsonAPIMediaType)
+}
+
+// attributes turns a resource into its JSON:API attributes: its usual JSON
+// fields without the id.
+func attributes(v interface{}) map[string]interface{} {
+	attrs := map[string]interface{}{}
+	if b, err := json.Marshal(v); err == nil {
+		json.Unmarshal(b, &attrs)
+	}
+	delete(attrs, "id")
+	return attrs
+}
+
+// jsonAPI builds JSON:API documents, resolving relationships across the
+// order, customer and menu stores.
+type jsonAPI struct {
+	store     *datastore
+	customers *customerStore
+	menu      *menuStore
+}
+
+// orderResource links an order to the menu items it contains and to the
+// customer whose store credit or house account paid for it.
+func (j *jsonAPI) orderResource(o order) jsonAPIResource {
+	items := []jsonAPIIdentifier{}
+	seen := map[string]bool{}
+	for _, name := range orderItemNames(o) {
+		if item, ok := j.menu.byName(name); ok && !seen[item.ID] {
+			seen[item.ID] = true
+			items = append(items, jsonAPIIdentifier{Type: typeMenuItems, ID: item.ID})
+		}
+	}
+	var cust interface{}
+	for _, leg := range o.Payments {
+		if (leg.Method == tenderStoreCredit || leg.Method == tenderHouseAccount) && leg.Reference != "" {
+			cust = jsonAPIIdentifier{Type: typeCustomers, ID: leg.Reference}
+			break
+		}
+	}
+	return jsonAPIResource{
+		Type:       typeOrders,
+		ID:         o.ID,
+		Attributes: attributes(o),
+		Relationships: map[string]jsonAPIRelationship{
+			"menu-items": {Data: items},
+			"customer":   {Data: cust},
+		},
+	}
+}
+
+// customerResource links a customer to the orders on their ledger.
+func (j *jsonAPI) customerResource(c customer) jsonAPIResource {
+	orders := []jsonAPIIdentifier{}
+	seen := map[string]bool{}
+	j.customers.RLock()
+	for _, t := range j.customers.ledger {
+		if t.CustomerID == c.ID && t.OrderID != "" && !seen[t.OrderID] {
+			seen[t.OrderID] = true
+			orders = append(orders, jsonAPIIdentifier{Type: typeOrders, ID: t.OrderID})
+		}
+	}
+	j.customers.RUnlock()
+	return jsonAPIResource{
+		Type:          typeCustomers,
+		ID:            c.ID,
+		Attributes:    attributes(c),
+		Relationships: map[string]jsonAPIRelationship{"orders": {Data: orders}},
+	}
+}
+
+func (j *jsonAPI) menuResource(item menuItem) jsonAPIResource {
+	return jsonAPIResource{Type: typeMenuItems, ID: item.ID, Attributes: attributes(item)}
+}
+
+// resource looks up a related resource by identifier.
+func (j *jsonAPI) resource(id jsonAPIIdentifier) (jsonAPIResource, bool) {
+	switch id.Type {
+	case typeOrders:
+		j.store.RLock()
+		o, ok := j.store.m[id.ID]
+		j.store.RUnlock()
+		if ok {
+			return j.orderResource(o), true
+		}
+	case typeCustomers:
+		j.customers.RLock()
+		c, ok := j.customers.m[id.ID]
+		j.customers.RUnlock()
+		if ok {
+			return j.customerResource(c), true
+		}
+	case typeMenuItems:
+		if item, ok := j.menu.get(id.ID); ok {
+			return j.menuResource(item), true
+		}
+	}
+	return jsonAPIResource{}, false
+}
+
+// included resolves the relationships named in ?include= (comma-separated)
+// for the primary resources, once each and leaving out the primary ones.
+func (j *jsonAPI) included(r *http.Request, primary []jsonAPIResource) []jsonAPIResource {
+	names := splitList(r.URL.Query().Get("include"), nil)
+	if len(names) == 0 {
+		return nil
+	}
+	seen := map[jsonAPIIdentifier]bool{}
+	for _, res := range primary {
+		seen[jsonAPIIdentifier{Type: res.Type, ID: res.ID}] = true
+	}
+	out := []jsonAPIResource{}
+	for _, res := range primary {
+		for _, name := range names {
+			var ids []jsonAPIIdentifier
+			switch data := res.Relationships[name].Data.(type) {
+			case jsonAPIIdentifier:
+				ids = []jsonAPIIdentifier{data}
+			case []jsonAPIIdentifier:
+				ids = data
+			}
+			for _, id := range ids {
+				if seen[id] {
+					continue
+				}
+				seen[id] = true
+				if rel, ok := j.resource(id); ok {
+					out = append(out, rel)
+				}
+			}
+		}
+	}
+	sort.SliceStable(out, func(a, b int) bool { return out[a].Type < out[b].Type })
+	return out
+}
+
+func (j *jsonAPI) writeOne(w http.ResponseWriter, r *http.Request, status int, res jsonAPIResource) {
+	j.write(w, r, status, jsonAPIDocument{Data: res, Included: j.included(r, []jsonAPIResource{res})})
+}
+
+func (j *jsonAPI) writeMany(w http.ResponseWriter, r *http.Request, status int, res []jsonAPIResource) {
+	if res == nil {
+		res = []jsonAPIResource{}
+	}
+	j.write(w, r, status, jsonAPIDocument{Data: res, Included: j.included(r, res)})
+}
+
+func (j *jsonAPI) write(w http.ResponseWriter, r *http.Request, status int, doc jsonAPIDocument) {
+	doc.JSONAPI = map[string]string{"version": "1.0"}
+	w.Header().Set("content-type", jsonAPIMediaType)
+	writeJSON(w, r, status, doc)
+}
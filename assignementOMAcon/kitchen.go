@@ -0,0 +1,480 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	kitchenQueueRe    = regexp.MustCompile(`^/kitchen/queue$`)
+	kitchenStationsRe = regexp.MustCompile(`^/kitchen/stations$`)
+	bumpTicketRe      = regexp.MustCompile(`^/kitchen/tickets/([^/]+)-([0-9]+)-([a-z0-9_]+)/bump$`)
+)
+
+var defaultCourseNames = map[int]string{1: "starters", 2: "mains", 3: "dessert"}
+
+// course groups order items that the kitchen should send out together.
+// Held courses are not fired automatically; a server fires them explicitly.
+type course struct {
+	Number int      `json:"course"`
+	Name   string   `json:"name,omitempty"`
+	Items  []string `json:"items"`
+	Hold   bool     `json:"hold,omitempty"`
+}
+
+// orderCourses returns the order's courses in sequence. Orders placed without
+// courses are treated as a single course holding all their items.
+func orderCourses(o order) []course {
+	if len(o.Courses) == 0 {
+		items := o.OrderItems.names()
+		if len(items) == 0 {
+			return nil
+		}
+		return []course{{Number: 1, Name: "mains", Items: items}}
+	}
+	out := make([]course, len(o.Courses))
+	copy(out, o.Courses)
+	sort.SliceStable(out, func(i, j int) bool { return out[i].Number < out[j].Number })
+	for i := range out {
+		if out[i].Name == "" {
+			out[i].Name = defaultCourseNames[out[i].Number]
+		}
+	}
+	return out
+}
+
+const (
+	ticketWaiting = "waiting"
+	ticketHeld    = "held"
+	ticketFired   = "fired"
+	ticketBumped  = "bumped"
+)
+
+type ticket struct {
+	ID          string     `json:"id"`
+	OrderID     string     `json:"order_id"`
+	Reference   string     `json:"reference,omitempty"`
+	TableNumber string     `json:"table_number,omitempty"`
+	LocationID  string     `json:"location_id,omitempty"`
+	Course      int        `json:"course"`
+	CourseName  string     `json:"course_name,omitempty"`
+	Station     string     `json:"station"`
+	Items       []string   `json:"items"`
+	Status      string     `json:"status"`
+	FiredAt     *time.Time `json:"fired_at,omitempty"`
+	BumpedAt    *time.Time `json:"bumped_at,omitempty"`
+}
+
+func courseID(orderID string, course int) string {
+	return orderID + "-" + strconv.Itoa(course)
+}
+
+func ticketID(orderID string, course int, station string) string {
+	return courseID(orderID, course) + "-" + station
+}
+
+type ticketState struct {
+	firedAt  *time.Time
+	bumpedAt *time.Time
+}
+
+// kitchenQueue tracks when each course was fired and when each station bumped
+// its ticket for it. Tickets themselves are derived from the orders so edits
+// show up immediately.
+type kitchenQueue struct {
+	state map[string]ticketState
+	menu  *menuStore
+	// onFire, if set, receives each station ticket of a newly fired course.
+	onFire func(t ticket)
+	// changed wakes streams waiting for a course to be fired or bumped.
+	changed *broadcast
+	*sync.RWMutex
+}
+
+func newKitchenQueue(menu *menuStore) *kitchenQueue {
+	return &kitchenQueue{state: map[string]ticketState{}, menu: menu, changed: newBroadcast(), RWMutex: &sync.RWMutex{}}
+}
+
+func (q *kitchenQueue) bump(id string, now time.Time) {
+	q.Lock()
+	st := q.state[id]
+	st.bumpedAt = &now
+	q.state[id] = st
+	q.Unlock()
+	q.changed.notify()
+}
+
+type stationItems struct {
+	station string
+	items   []string
+}
+
+// byStation splits a course's items by the station that prepares them, in
+// the order each station first appears.
+func (q *kitchenQueue) byStation(items []string) []stationItems {
+	var out []stationItems
+	index := map[string]int{}
+	for _, item := range items {
+		station := q.menu.station(item)
+		i, ok := index[station]
+		if !ok {
+			i = len(out)
+			index[station] = i
+			out = append(out, stationItems{station: station})
+		}
+		out[i].items = append(out[i].items, item)
+	}
+	return out
+}
+
+func (q *kitchenQueue) fire(id string, now time.Time) bool {
+	q.Lock()
+	defer q.Unlock()
+	st := q.state[id]
+	if st.firedAt != nil {
+		return false
+	}
+	st.firedAt = &now
+	q.state[id] = st
+	q.changed.notify()
+	return true
+}
+
+// fireCourse fires one course of an order and hands its unbumped station
+// tickets to onFire the first time it is fired.
+func (q *kitchenQueue) fireCourse(o order, course int, now time.Time) {
+	if !q.fire(courseID(o.ID, course), now) || q.onFire == nil {
+		return
+	}
+	for _, t := range q.tickets(o) {
+		if t.Course == course && t.Status != ticketBumped {
+			q.onFire(t)
+		}
+	}
+}
+
+// bumpedSince counts the tickets bumped at or after since.
+func (q *kitchenQueue) bumpedSince(since time.Time) int {
+	q.RLock()
+	defer q.RUnlock()
+	n := 0
+	for _, st := range q.state {
+		if st.bumpedAt != nil && !st.bumpedAt.Before(since) {
+			n++
+		}
+	}
+	return n
+}
+
+// tickets builds the queue for one order, one ticket per course and station.
+// A course is fired once it has been fired explicitly or, unless held, once
+// every station has bumped the course before it; otherwise it is held or
+// waiting. Orders scheduled for later are held until their time.
+func (q *kitchenQueue) tickets(o order) []ticket {
+	courses := orderCourses(o)
+	split := make([][]stationItems, len(courses))
+	for i, c := range courses {
+		split[i] = q.byStation(c.Items)
+	}
+	q.RLock()
+	defer q.RUnlock()
+	var out []ticket
+	previousDone := true
+	later := scheduled(o, time.Now())
+	for i, c := range courses {
+		firedAt := q.state[courseID(o.ID, c.Number)].firedAt
+		var status string
+		switch {
+		case firedAt != nil:
+			status = ticketFired
+		case c.Hold || later:
+			status = ticketHeld
+		case previousDone:
+			status = ticketFired
+		default:
+			status = ticketWaiting
+		}
+		done := true
+		for _, g := range split[i] {
+			id := ticketID(o.ID, c.Number, g.station)
+			t := ticket{
+				ID:          id,
+				OrderID:     o.ID,
+				Reference:   o.Reference,
+				TableNumber: o.TableNumber,
+				LocationID:  o.LocationID,
+				Course:      c.Number,
+				CourseName:  c.Name,
+				Station:     g.station,
+				Items:       g.items,
+				Status:      status,
+				FiredAt:     firedAt,
+				BumpedAt:    q.state[id].bumpedAt,
+			}
+			if t.BumpedAt != nil {
+				t.Status = ticketBumped
+			} else {
+				done = false
+			}
+			out = append(out, t)
+		}
+		previousDone = previousDone && done
+	}
+	return out
+}
+
+// fireNext fires the course after the given one once every station has bumped
+// it, unless the next course is held.
+func (q *kitchenQueue) fireNext(o order, course int, now time.Time) {
+	for _, t := range q.tickets(o) {
+		if t.Course == course && t.Status != ticketBumped {
+			return
+		}
+		if t.Course > course {
+			if t.Status != ticketHeld {
+				q.fireCourse(o, t.Course, now)
+			}
+			return
+		}
+	}
+}
+
+type kitchenHandler struct {
+	queue    *kitchenQueue
+	store    *datastore
+	sessions *sessionStore
+}
+
+func (h *kitchenHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("content-type", "application/json")
+	if _, ok := h.sessions.requireScope(w, r, "kitchen"); !ok {
+		return
+	}
+	switch {
+	case r.Method == http.MethodGet && kitchenQueueRe.MatchString(r.URL.Path):
+		h.Queue(w, r)
+		return
+	case r.Method == http.MethodGet && kitchenStationsRe.MatchString(r.URL.Path):
+		h.Stations(w, r)
+		return
+	case r.Method == http.MethodPost && bumpTicketRe.MatchString(r.URL.Path):
+		h.Bump(w, r)
+		return
+	default:
+		notFound(w, r)
+		return
+	}
+}
+
+func (h *kitchenHandler) liveTickets() []ticket {
+	h.store.RLock()
+	orders := make([]order, 0, len(h.store.m))
+	for _, o := range h.store.m {
+		if !o.Locked && !isVoided(o) {
+			orders = append(orders, o)
+		}
+	}
+	h.store.RUnlock()
+
+	var out []ticket
+	for _, o := range orders {
+		out = append(out, h.queue.tickets(o)...)
+	}
+	return out
+}
+
+// Queue lists outstanding tickets, optionally for one ?station=: fired ones
+// first in the order they were fired, then waiting courses, then held courses
+// last, each by order, course number and station.
+func (h *kitchenHandler) Queue(w http.ResponseWriter, r *http.Request) {
+	station := r.URL.Query().Get("station")
+	queue := make([]ticket, 0)
+	for _, t := range h.liveTickets() {
+		if t.Status != ticketBumped && (station == "" || t.Station == station) {
+			queue = append(queue, t)
+		}
+	}
+	sort.SliceStable(queue, func(i, j int) bool {
+		a, b := queue[i], queue[j]
+		if ticketRank[a.Status] != ticketRank[b.Status] {
+			return ticketRank[a.Status] < ticketRank[b.Status]
+		}
+		if a.FiredAt != nil && b.FiredAt != nil && !a.FiredAt.Equal(*b.FiredAt) {
+			return a.FiredAt.Before(*b.FiredAt)
+		}
+		if a.OrderID != b.OrderID {
+			return a.OrderID < b.OrderID
+		}
+		if a.Course != b.Course {
+			return a.Course < b.Course
+		}
+		return a.Station < b.Station
+	})
+	writeJSON(w, r, http.StatusOK, queue)
+}
+
+// stationLoad summarises one station's queue. Ticket times run from when the
+// course was fired to when the station bumped its ticket.
+type stationLoad struct {
+	Station            string  `json:"station"`
+	Fired              int     `json:"fired"`
+	Waiting            int     `json:"waiting"`
+	Held               int     `json:"held"`
+	BumpedLastHour     int     `json:"bumped_last_hour"`
+	AvgTicketSeconds   float64 `json:"avg_ticket_seconds"`
+	OldestFiredSeconds float64 `json:"oldest_fired_seconds"`
+}
+
+// Stations reports the load on each station that has tickets.
+func (h *kitchenHandler) Stations(w http.ResponseWriter, r *http.Request) {
+	now := time.Now().UTC()
+	hourAgo := now.Add(-time.Hour)
+	loads := map[string]*stationLoad{}
+	total := map[string]time.Duration{}
+	for _, t := range h.liveTickets() {
+		l := loads[t.Station]
+		if l == nil {
+			l = &stationLoad{Station: t.Station}
+			loads[t.Station] = l
+		}
+		switch t.Status {
+		case ticketFired:
+			l.Fired++
+			if t.FiredAt != nil {
+				if age := now.Sub(*t.FiredAt).Seconds(); age > l.OldestFiredSeconds {
+					l.OldestFiredSeconds = age
+				}
+			}
+		case ticketWaiting:
+			l.Waiting++
+		case ticketHeld:
+			l.Held++
+		case ticketBumped:
+			if t.BumpedAt.Before(hourAgo) {
+				continue
+			}
+			l.BumpedLastHour++
+			if t.FiredAt != nil {
+				total[t.Station] += t.BumpedAt.Sub(*t.FiredAt)
+			}
+		}
+	}
+	out := make([]stationLoad, 0, len(loads))
+	for station, l := range loads {
+		if l.BumpedLastHour > 0 {
+			l.AvgTicketSeconds = (total[station] / time.Duration(l.BumpedLastHour)).Seconds()
+		}
+		out = append(out, *l)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Station < out[j].Station })
+	writeJSON(w, r, http.StatusOK, out)
+}
+
+var ticketRank = map[string]int{ticketFired: 0, ticketWaiting: 1, ticketHeld: 2}
+
+// Bump marks a station's fired ticket done. Once every station has bumped the
+// course, the order's next course is fired unless it is held.
+func (h *kitchenHandler) Bump(w http.ResponseWriter, r *http.Request) {
+	matches := bumpTicketRe.FindStringSubmatch(r.URL.Path)
+	h.store.RLock()
+	o, ok := h.store.m[matches[1]]
+	h.store.RUnlock()
+	if !ok {
+		notFound(w, r)
+		return
+	}
+	id := ticketID(matches[1], mustAtoi(matches[2]), matches[3])
+	var bumped *ticket
+	for _, t := range h.queue.tickets(o) {
+		if t.ID == id {
+			t := t
+			bumped = &t
+			break
+		}
+	}
+	if bumped == nil {
+		notFound(w, r)
+		return
+	}
+	if bumped.Status != ticketFired {
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte("ticket is " + bumped.Status))
+		return
+	}
+	now := time.Now().UTC()
+	h.queue.bump(id, now)
+	h.queue.fireNext(o, bumped.Course, now)
+	bumped.Status, bumped.BumpedAt = ticketBumped, &now
+	writeJSON(w, r, http.StatusOK, bumped)
+}
+
+// FireCourse lets a server send a course to the kitchen, including held
+// courses and courses whose predecessors are still cooking. It returns the
+// course's station tickets.
+func (h *orderHandler) FireCourse(w http.ResponseWriter, r *http.Request) {
+	if _, ok := h.sessions.requireScope(w, r, "orders:write"); !ok {
+		return
+	}
+	n, err := strconv.Atoi(pathParam(r, "course"))
+	if err != nil {
+		notFound(w, r)
+		return
+	}
+	h.store.RLock()
+	o, ok := h.store.m[pathParam(r, "id")]
+	h.store.RUnlock()
+	if !ok {
+		notFound(w, r)
+		return
+	}
+	var course []ticket
+	served := true
+	for _, t := range h.kitchen.tickets(o) {
+		if t.Course == n {
+			course = append(course, t)
+			served = served && t.Status == ticketBumped
+		}
+	}
+	if len(course) == 0 {
+		notFound(w, r)
+		return
+	}
+	if served {
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte("course already served"))
+		return
+	}
+	now := time.Now().UTC()
+	h.kitchen.fireCourse(o, n, now)
+	h.recordAudit(r, "order.course.fire", o.ID)
+	for i := range course {
+		if course[i].FiredAt == nil {
+			course[i].FiredAt = &now
+		}
+		if course[i].Status != ticketBumped {
+			course[i].Status = ticketFired
+		}
+	}
+	writeJSON(w, r, http.StatusOK, course)
+}
+
+// fireFirstCourse is installed as an after-create hook so a new order's first
+// course reaches the kitchen straight away.
+func (q *kitchenQueue) fireFirstCourse(ctx context.Context, o order) {
+	if scheduled(o, time.Now()) {
+		return
+	}
+	if cs := orderCourses(o); len(cs) > 0 && !cs[0].Hold {
+		q.fireCourse(o, cs[0].Number, time.Now().UTC())
+	}
+}
+
+func mustAtoi(s string) int {
+	n, _ := strconv.Atoi(s)
+	return n
+}
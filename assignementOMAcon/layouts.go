@@ -0,0 +1,308 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+var (
+	layoutRe        = regexp.MustCompile(`^/admin/layouts/(receipt|ticket)$`)
+	layoutPreviewRe = regexp.MustCompile(`^/admin/layouts/(receipt|ticket)/preview$`)
+)
+
+const (
+	layoutReceipt = "receipt"
+	layoutTicket  = "ticket"
+)
+
+// layout is the printed shape of a receipt or kitchen ticket. Each part is a
+// text/template: Header and Footer see the whole document, Line is applied to
+// each item. Logo is a text banner for printers; LogoURL is shown as an image
+// on the web receipt.
+type layout struct {
+	Kind       string     `json:"kind"`
+	LocationID string     `json:"location_id"`
+	Header     string     `json:"header"`
+	Line       string     `json:"line"`
+	Footer     string     `json:"footer"`
+	Logo       string     `json:"logo,omitempty"`
+	LogoURL    string     `json:"logo_url,omitempty"`
+	Default    bool       `json:"default,omitempty"`
+	UpdatedAt  *time.Time `json:"updated_at,omitempty"`
+}
+
+var defaultLayouts = map[string]layout{
+	layoutReceipt: {
+		Header: "{{with .Logo}}{{.}}\n{{end}}Receipt #{{with .Order.Reference}}{{.}}{{else}}{{.Order.ID}}{{end}}\nGuest: {{.Order.Name}}\nTable: {{.Order.TableNumber}}\n",
+		Line:   "{{.Quantity}} x {{.Name}}\n",
+		Footer: "{{with .Order.TotalItems}}Items: {{.}}\n{{end}}{{range .Order.Discounts}}{{.Name}}: -{{money .Amount}}\n{{end}}{{with .Order.ServiceCharge}}{{if .Amount}}Service charge ({{.Percent}}%): {{money .Amount}}\n{{end}}{{end}}{{if .Order.Total}}Total: {{money .Order.Total}}\n{{end}}Payment: {{.Order.Payment}}\n",
+	},
+	layoutTicket: {
+		Header: "{{upper .Ticket.Station}}\nOrder {{with .Ticket.Reference}}{{.}}{{else}}{{.Ticket.OrderID}}{{end}}  Table {{.Ticket.TableNumber}}\nCourse {{.Ticket.Course}} {{.Ticket.CourseName}}\n",
+		Line:   "  {{.Quantity}} x {{.Name}}\n",
+		Footer: "\n\n\n",
+	},
+}
+
+var layoutFuncs = template.FuncMap{
+	"upper": strings.ToUpper,
+	"lower": strings.ToLower,
+	"money": formatAmount,
+	"date":  func(t time.Time, layout string) string { return t.Format(layout) },
+	"padLeft": func(n int, s string) string {
+		return fmt.Sprintf("%*s", n, s)
+	},
+	"padRight": func(n int, s string) string {
+		return fmt.Sprintf("%-*s", n, s)
+	},
+}
+
+// layoutLine is the data for one Line template: an item and how many of it.
+type layoutLine struct {
+	Name     string
+	Quantity int
+}
+
+// layoutDoc is the data for Header and Footer. Order is set for receipts,
+// Ticket for kitchen tickets.
+type layoutDoc struct {
+	Logo      string
+	Location  string
+	Order     order
+	Ticket    ticket
+	Lines     []layoutLine
+	PrintedAt time.Time
+}
+
+type compiledLayout struct {
+	layout
+	header, line, footer *template.Template
+}
+
+func compileLayout(l layout) (compiledLayout, error) {
+	c := compiledLayout{layout: l}
+	parts := []struct {
+		name string
+		src  string
+		dst  **template.Template
+	}{{"header", l.Header, &c.header}, {"line", l.Line, &c.line}, {"footer", l.Footer, &c.footer}}
+	for _, p := range parts {
+		t, err := template.New(p.name).Funcs(layoutFuncs).Option("missingkey=error").Parse(p.src)
+		if err != nil {
+			return compiledLayout{}, err
+		}
+		*p.dst = t
+	}
+	return c, nil
+}
+
+// render lays out the document, grouping repeated items into one line.
+func (c compiledLayout) render(doc layoutDoc, items []string) (string, error) {
+	doc.Logo = c.Logo
+	doc.Lines = groupLines(items)
+	var b strings.Builder
+	if err := c.header.Execute(&b, doc); err != nil {
+		return "", err
+	}
+	for _, line := range doc.Lines {
+		if err := c.line.Execute(&b, line); err != nil {
+			return "", err
+		}
+	}
+	if err := c.footer.Execute(&b, doc); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+func groupLines(items []string) []layoutLine {
+	var out []layoutLine
+	index := map[string]int{}
+	for _, item := range items {
+		key := strings.ToLower(item)
+		if i, ok := index[key]; ok {
+			out[i].Quantity++
+			continue
+		}
+		index[key] = len(out)
+		out = append(out, layoutLine{Name: item, Quantity: 1})
+	}
+	return out
+}
+
+// layoutStore holds each location's layouts. Locations without their own
+// layout use the built-in default for the kind.
+type layoutStore struct {
+	m map[string]compiledLayout
+	*sync.RWMutex
+}
+
+func newLayoutStore() *layoutStore {
+	return &layoutStore{m: map[string]compiledLayout{}, RWMutex: &sync.RWMutex{}}
+}
+
+func (s *layoutStore) get(kind, location string) compiledLayout {
+	s.RLock()
+	c, ok := s.m[kind+"/"+location]
+	s.RUnlock()
+	if ok {
+		return c
+	}
+	l := defaultLayouts[kind]
+	l.Kind, l.LocationID, l.Default = kind, location, true
+	c, err := compileLayout(l)
+	if err != nil {
+		panic(err)
+	}
+	return c
+}
+
+func (s *layoutStore) put(c compiledLayout) {
+	s.Lock()
+	s.m[c.Kind+"/"+c.LocationID] = c
+	s.Unlock()
+}
+
+func (s *layoutStore) reset(kind, location string) {
+	s.Lock()
+	delete(s.m, kind+"/"+location)
+	s.Unlock()
+}
+
+func orderLocation(o order) string {
+	if o.LocationID == "" {
+		return defaultLocation
+	}
+	return o.LocationID
+}
+
+func (s *layoutStore) renderReceipt(o order) (string, error) {
+	loc := orderLocation(o)
+	return s.get(layoutReceipt, loc).render(layoutDoc{Location: loc, Order: o, PrintedAt: time.Now()}, orderItemNames(o))
+}
+
+func (s *layoutStore) renderTicket(t ticket) (string, error) {
+	loc := t.LocationID
+	if loc == "" {
+		loc = defaultLocation
+	}
+	return s.get(layoutTicket, loc).render(layoutDoc{Location: loc, Ticket: t, PrintedAt: time.Now()}, t.Items)
+}
+
+var sampleOrder = order{
+	ID:          "1001",
+	Number:      57,
+	Reference:   "T12-57",
+	Name:        "Sample Guest",
+	OrderItems:  orderItems{{Name: "biryani", Quantity: 2, UnitPrice: 1000}, {Name: "roti", Quantity: 1, UnitPrice: 450}},
+	TotalItems:  3,
+	Payment:     paymentPaid,
+	TableNumber: "12",
+	Subtotal:    2450,
+	Total:       2450,
+}
+
+// preview renders a layout against a sample order so mistakes in a template,
+// such as a misspelt field, surface when it is saved rather than when it is
+// printed.
+func preview(c compiledLayout) (string, error) {
+	o := sampleOrder
+	o.LocationID = c.LocationID
+	doc := layoutDoc{Location: c.LocationID, Order: o, PrintedAt: time.Now()}
+	items := orderItemNames(o)
+	if c.Kind == layoutTicket {
+		doc.Ticket = ticket{
+			ID: ticketID(o.ID, 1, defaultStation), OrderID: o.ID, Reference: o.Reference, TableNumber: o.TableNumber,
+			LocationID: c.LocationID, Course: 1, CourseName: "mains", Station: defaultStation,
+			Items: items, Status: ticketFired,
+		}
+	}
+	return c.render(doc, items)
+}
+
+type layoutHandler struct {
+	layouts  *layoutStore
+	sessions *sessionStore
+}
+
+func (h *layoutHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("content-type", "application/json")
+	if _, ok := h.sessions.requireScope(w, r, "orders:manage"); !ok {
+		return
+	}
+	location := r.URL.Query().Get("location")
+	if location == "" {
+		location = defaultLocation
+	}
+	switch {
+	case r.Method == http.MethodGet && layoutRe.MatchString(r.URL.Path):
+		kind := layoutRe.FindStringSubmatch(r.URL.Path)[1]
+		writeJSON(w, r, http.StatusOK, h.layouts.get(kind, location).layout)
+		return
+	case r.Method == http.MethodPut && layoutRe.MatchString(r.URL.Path):
+		h.Put(w, r, layoutRe.FindStringSubmatch(r.URL.Path)[1], location)
+		return
+	case r.Method == http.MethodDelete && layoutRe.MatchString(r.URL.Path):
+		h.layouts.reset(layoutRe.FindStringSubmatch(r.URL.Path)[1], location)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	case r.Method == http.MethodGet && layoutPreviewRe.MatchString(r.URL.Path):
+		h.Preview(w, r, layoutPreviewRe.FindStringSubmatch(r.URL.Path)[1], location)
+		return
+	default:
+		notFound(w, r)
+		return
+	}
+}
+
+// Put replaces a location's layout. Parts left empty keep the default.
+func (h *layoutHandler) Put(w http.ResponseWriter, r *http.Request, kind, location string) {
+	var l layout
+	if err := json.NewDecoder(r.Body).Decode(&l); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("invalid layout"))
+		return
+	}
+	def := defaultLayouts[kind]
+	if l.Header == "" {
+		l.Header = def.Header
+	}
+	if l.Line == "" {
+		l.Line = def.Line
+	}
+	if l.Footer == "" {
+		l.Footer = def.Footer
+	}
+	now := time.Now().UTC()
+	l.Kind, l.LocationID, l.Default, l.UpdatedAt = kind, location, false, &now
+	c, err := compileLayout(l)
+	if err == nil {
+		_, err = preview(c)
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	h.layouts.put(c)
+	writeJSON(w, r, http.StatusOK, c.layout)
+}
+
+// Preview renders the location's layout against a sample order as plain text.
+func (h *layoutHandler) Preview(w http.ResponseWriter, r *http.Request, kind, location string) {
+	text, err := preview(h.layouts.get(kind, location))
+	if err != nil {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	w.Header().Set("content-type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(text))
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+var (
+	linksRe        = regexp.MustCompile(`^/admin/links/?$`)
+	fileReceiptRe  = regexp.MustCompile(`^/files/receipts/([^/]+)$`)
+	fileExportRe   = regexp.MustCompile(`^/files/exports/([0-9]{4}-[0-9]{2}-[0-9]{2})/(audit|events)\.ndjson\.gz$`)
+	defaultLinkTTL = 24 * time.Hour
+	maxLinkTTL     = 7 * 24 * time.Hour
+)
+
+// linkSigner signs download links with HMAC-SHA256 so they can be handed to
+// someone without a staff session, such as an accountant or a guest, and stop
+// working once they expire.
+type linkSigner struct {
+	key []byte
+}
+
+// newLinkSigner signs with key. Without one a random key is made, and links
+// stop working when the server restarts.
+func newLinkSigner(key string) (*linkSigner, error) {
+	if key == "" {
+		b := make([]byte, 32)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		return &linkSigner{key: b}, nil
+	}
+	if len(key) < 32 {
+		return nil, fmt.Errorf("link signing key must be at least 32 characters")
+	}
+	return &linkSigner{key: []byte(key)}, nil
+}
+
+func (s *linkSigner) signature(path string, expires int64) string {
+	return hex.EncodeToString(hmacSHA256(s.key, path+"\n"+strconv.FormatInt(expires, 10)))
+}
+
+// sign returns path with its expiry and signature as query parameters.
+func (s *linkSigner) sign(path string, expires time.Time) string {
+	e := expires.Unix()
+	return path + "?expires=" + strconv.FormatInt(e, 10) + "&sig=" + s.signature(path, e)
+}
+
+// verify reports whether r carries a valid signature for its path, and
+// whether the link has expired.
+func (s *linkSigner) verify(r *http.Request, now time.Time) (valid, expired bool) {
+	q := r.URL.Query()
+	e, err := strconv.ParseInt(q.Get("expires"), 10, 64)
+	if err != nil {
+		return false, false
+	}
+	if !hmac.Equal([]byte(q.Get("sig")), []byte(s.signature(r.URL.Path, e))) {
+		return false, false
+	}
+	return true, !now.Before(time.Unix(e, 0))
+}
+
+// signedLink is a download link issued through /admin/links.
+type signedLink struct {
+	URL       string    `json:"url"`
+	Path      string    `json:"path"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// linkHandler issues signed links to files under /files/: a receipt,
+// /files/receipts/{order id}, or one stream of a day's export,
+// /files/exports/{date}/audit.ndjson.gz or events.ndjson.gz.
+type linkHandler struct {
+	signer   *linkSigner
+	store    *datastore
+	sessions *sessionStore
+	audit    *auditLog
+}
+
+func (h *linkHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("content-type", "application/json")
+	sess, ok := h.sessions.requireScope(w, r, "orders:manage")
+	if !ok {
+		return
+	}
+	if r.Method != http.MethodPost || !linksRe.MatchString(r.URL.Path) {
+		notFound(w, r)
+		return
+	}
+	h.Issue(w, r, sess)
+}
+
+// Issue signs a link to a file that expires after expires_in, a duration such
+// as 72h (default 24h, at most a week).
+func (h *linkHandler) Issue(w http.ResponseWriter, r *http.Request, sess session) {
+	var in struct {
+		Path      string `json:"path"`
+		ExpiresIn string `json:"expires_in"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		decodeFailed(w, r, err)
+		return
+	}
+	var errs []fieldError
+	ttl := defaultLinkTTL
+	if in.ExpiresIn != "" {
+		d, err := time.ParseDuration(in.ExpiresIn)
+		if err != nil || d <= 0 || d > maxLinkTTL {
+			errs = append(errs, fieldError{Field: "expires_in", Message: "must be a duration of at most 168h"})
+		}
+		ttl = d
+	}
+	switch m := fileReceiptRe.FindStringSubmatch(in.Path); {
+	case m != nil:
+		h.store.RLock()
+		_, ok := h.store.m[m[1]]
+		h.store.RUnlock()
+		if !ok {
+			errs = append(errs, fieldError{Field: "path", Message: "is a receipt for an unknown order"})
+		}
+	case fileExportRe.MatchString(in.Path):
+		if _, err := time.Parse(dateLayout, fileExportRe.FindStringSubmatch(in.Path)[1]); err != nil {
+			errs = append(errs, fieldError{Field: "path", Message: "has an invalid date"})
+		}
+	default:
+		errs = append(errs, fieldError{Field: "path", Message: "must be a receipt or export file under /files/"})
+	}
+	if len(errs) > 0 {
+		validationFailed(w, r, errs)
+		return
+	}
+	expires := time.Now().UTC().Add(ttl).Truncate(time.Second)
+	h.audit.record(auditEntry{Action: "link.issue", Ref: in.Path, StaffID: sess.StaffID})
+	writeJSON(w, r, http.StatusCreated, signedLink{URL: h.signer.sign(in.Path, expires), Path: in.Path, ExpiresAt: expires})
+}
+
+// fileHandler serves the files behind signed links. It takes no session: the
+// signature is the only credential.
+type fileHandler struct {
+	signer   *linkSigner
+	receipts *receiptHandler
+	audit    *auditLog
+	feed     *changeFeed
+}
+
+func (h *fileHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		notFound(w, r)
+		return
+	}
+	valid, expired := h.signer.verify(r, time.Now())
+	if !valid {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("invalid link signature"))
+		return
+	}
+	if expired {
+		w.WriteHeader(http.StatusGone)
+		w.Write([]byte("link has expired"))
+		return
+	}
+	w.Header().Set("Cache-Control", "private, no-store")
+	switch {
+	case fileReceiptRe.MatchString(r.URL.Path):
+		h.receipts.store.RLock()
+		o, ok := h.receipts.store.m[fileReceiptRe.FindStringSubmatch(r.URL.Path)[1]]
+		h.receipts.store.RUnlock()
+		if !ok {
+			notFound(w, r)
+			return
+		}
+		h.receipts.render(w, r, o)
+		return
+	case fileExportRe.MatchString(r.URL.Path):
+		h.Export(w, r)
+		return
+	default:
+		notFound(w, r)
+		return
+	}
+}
+
+// Export serves one stream of a day's export, built from the audit log and
+// change feed as the scheduled export would write it.
+func (h *fileHandler) Export(w http.ResponseWriter, r *http.Request) {
+	m := fileExportRe.FindStringSubmatch(r.URL.Path)
+	day, err := time.Parse(dateLayout, m[1])
+	if err != nil {
+		notFound(w, r)
+		return
+	}
+	entries, events := dayRecords(h.audit, h.feed, day)
+	records := entries
+	if m[2] == "events" {
+		if !h.feed.keeps(day) {
+			w.WriteHeader(http.StatusGone)
+			w.Write([]byte("change events of this day are no longer kept; use its export"))
+			return
+		}
+		records = events
+	}
+	body, err := encodeNDJSON(records)
+	if err != nil {
+		internalServerError(w, r)
+		return
+	}
+	w.Header().Set("content-type", "application/gzip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", m[2]+"-"+m[1]+".ndjson.gz"))
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+}
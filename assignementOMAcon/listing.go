@@ -0,0 +1,232 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// totalCountHeader carries the size of a collection a handler has already
+// paged itself, so the envelope reports it rather than paging again.
+const totalCountHeader = "X-Total-Count"
+
+// orderSorts are the orderings the orders list takes in ?sort=; a leading -
+// reverses one. Ties fall back to the order ID so pages do not overlap.
+var orderSorts = map[string]func(a, b order) int{
+	"name": func(a, b order) int {
+		return strings.Compare(strings.ToLower(a.Name), strings.ToLower(b.Name))
+	},
+	"table": func(a, b order) int {
+		return compareTables(a.TableNumber, b.TableNumber)
+	},
+	"created_at": func(a, b order) int {
+		return compareTimes(a.CreatedAt, b.CreatedAt)
+	},
+}
+
+// orderListing is what the orders list was asked for beyond its search:
+// filters, an ordering and a page.
+type orderListing struct {
+	payment string
+	status  string
+	table   string
+	sort    func(a, b order) int
+	desc    bool
+	offset  int
+	// limit is -1 for the rest of the list.
+	limit int
+}
+
+// pageLimits bound the pages of a list: Default items when the request does
+// not give ?limit=, and never more than Max. Zero leaves either unbounded.
+type pageLimits struct {
+	Default int `json:"default_page_size,omitempty"`
+	Max     int `json:"max_page_size,omitempty"`
+}
+
+func (l pageLimits) validate() error {
+	if l.Default < 0 || l.Max < 0 {
+		return fmt.Errorf("page sizes must not be negative")
+	}
+	if l.Max > 0 && l.Default > l.Max {
+		return fmt.Errorf("default page size %d is above the maximum %d", l.Default, l.Max)
+	}
+	return nil
+}
+
+// over returns base with the limits l sets taking its place.
+func (l pageLimits) over(base pageLimits) pageLimits {
+	if l.Default > 0 {
+		base.Default = l.Default
+	}
+	if l.Max > 0 {
+		base.Max = l.Max
+	}
+	return base
+}
+
+// clamp turns a requested page size, -1 when none was given, into the one
+// served: the default when none was given, and at most the maximum. It is -1
+// for the rest of the list.
+func (l pageLimits) clamp(n int) int {
+	if n < 0 && l.Default > 0 {
+		n = l.Default
+	}
+	if l.Max > 0 && (n < 0 || n > l.Max) {
+		n = l.Max
+	}
+	return n
+}
+
+// pagingConfig is the server's page limits (PAGE_SIZE_DEFAULT and
+// PAGE_SIZE_MAX), which Roles override for sessions of a role and API keys
+// override in turn for their own requests.
+type pagingConfig struct {
+	pageLimits
+	Roles map[string]pageLimits `json:"roles,omitempty"`
+}
+
+func (c pagingConfig) validate() error {
+	if err := c.pageLimits.validate(); err != nil {
+		return err
+	}
+	for role, l := range c.Roles {
+		if _, ok := roleScopes[role]; !ok {
+			return fmt.Errorf("page limits for unknown role %q", role)
+		}
+		if err := l.validate(); err != nil {
+			return fmt.Errorf("role %s: %w", role, err)
+		}
+	}
+	return nil
+}
+
+// limits returns the page limits for r's caller.
+func (c pagingConfig) limits(r *http.Request, sessions *sessionStore) pageLimits {
+	l := c.pageLimits
+	if sess, ok := sessions.fromRequest(r); ok {
+		l = sess.PageLimits.over(c.Roles[sess.Role].over(l))
+	}
+	return l
+}
+
+// parseOrderListing reads the listing from q, with its page size held to
+// limits.
+func parseOrderListing(q url.Values, limits pageLimits) (orderListing, error) {
+	l := orderListing{payment: q.Get("payment"), status: q.Get("status"), table: q.Get("table"), limit: -1}
+	if s := q.Get("sort"); s != "" {
+		l.desc = strings.HasPrefix(s, "-")
+		cmp, ok := orderSorts[strings.TrimPrefix(s, "-")]
+		if !ok {
+			return orderListing{}, fmt.Errorf("sort must be name, table or created_at, optionally prefixed with -")
+		}
+		l.sort = cmp
+	}
+	var err error
+	if l.offset, l.limit, err = parsePage(q, limits); err != nil {
+		return orderListing{}, err
+	}
+	return l, nil
+}
+
+// parsePage reads ?offset= and ?limit= from q, with the page size held to
+// limits. The limit is -1 for the rest of the list.
+func parsePage(q url.Values, limits pageLimits) (offset, limit int, err error) {
+	limit = -1
+	for _, opt := range []struct {
+		name string
+		dst  *int
+	}{{"offset", &offset}, {"limit", &limit}} {
+		v := q.Get(opt.name)
+		if v == "" {
+			continue
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return 0, 0, fmt.Errorf("%s must be a non-negative integer", opt.name)
+		}
+		*opt.dst = n
+	}
+	return offset, limits.clamp(limit), nil
+}
+
+// keep reports whether o passes the listing's filters. The payment filter
+// reads statuses as orders do, so ?payment=Done still finds paid orders.
+func (l orderListing) keep(o order) bool {
+	if l.payment != "" && o.Payment != parsePaymentStatus(l.payment) {
+		return false
+	}
+	if l.status != "" && !strings.EqualFold(string(o.Status), l.status) {
+		return false
+	}
+	return l.table == "" || o.TableNumber == l.table
+}
+
+// order sorts orders by the listing's ordering. Without one they are left as
+// they are when sorted by relevance, and otherwise listed oldest first.
+func (l orderListing) order(orders []order, byRelevance bool) {
+	cmp := l.sort
+	if cmp == nil {
+		if byRelevance {
+			return
+		}
+		cmp = orderSorts["created_at"]
+	}
+	sort.SliceStable(orders, func(i, j int) bool {
+		c := cmp(orders[i], orders[j])
+		if l.desc {
+			c = -c
+		}
+		if c == 0 {
+			return orders[i].ID < orders[j].ID
+		}
+		return c < 0
+	})
+}
+
+// page cuts the requested page out of orders.
+func (l orderListing) page(orders []order) []order {
+	start := minInt(l.offset, len(orders))
+	end := len(orders)
+	if l.limit >= 0 {
+		end = minInt(start+l.limit, end)
+	}
+	return orders[start:end]
+}
+
+// compareTables orders table numbers numerically where both are numbers, so
+// table 9 comes before table 12.
+func compareTables(a, b string) int {
+	x, errA := strconv.Atoi(a)
+	y, errB := strconv.Atoi(b)
+	switch {
+	case errA == nil && errB == nil:
+		return x - y
+	case errA == nil:
+		return -1
+	case errB == nil:
+		return 1
+	}
+	return strings.Compare(a, b)
+}
+
+// compareTimes orders unset times last.
+func compareTimes(a, b *time.Time) int {
+	switch {
+	case a == nil && b == nil:
+		return 0
+	case a == nil:
+		return 1
+	case b == nil:
+		return -1
+	case a.Before(*b):
+		return -1
+	case a.After(*b):
+		return 1
+	}
+	return 0
+}
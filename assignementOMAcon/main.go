@@ -1,101 +1,246 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"log"
+	"log/slog"
+	"net"
 	"net/http"
-	"regexp"
-	"sync"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 )
 
-var (
-	listOrderRe   = regexp.MustCompile(`/orders/`)
-	getOrderRe    = regexp.MustCompile(`/orders/:id`)
-	createOrderRe = regexp.MustCompile(`/orders/`)
-	updateOrderRe = regexp.MustCompile("order/orders/")
+const (
+	deleteHard = "hard"
+	deleteSoft = "soft"
 )
 
 type order struct {
-	ID          string `json:"id,omitempty"`
-	Name        string `json:"name,omitempty"`
-	OrderItems  string `json:"order_items,omitempty"`
-	TotalItems  string `json:"total_items,omitempty"`
-	Payment     string `json:"payment,omitempty"`
-	TableNumber string `json:"table_number,omitempty"`
+	ID            string             `json:"id,omitempty"`
+	Number        int64              `json:"number,omitempty"`
+	Reference     string             `json:"reference,omitempty"`
+	Name          string             `json:"name,omitempty"`
+	OrderItems    orderItems         `json:"order_items,omitempty"`
+	Courses       []course           `json:"courses,omitempty"`
+	TotalItems    itemCount          `json:"total_items,omitempty"`
+	Subtotal      int64              `json:"subtotal,omitempty"`
+	Discounts     []appliedPromotion `json:"discounts,omitempty"`
+	Discount      int64              `json:"discount,omitempty"`
+	Payment       paymentStatus      `json:"payment,omitempty"`
+	Status        orderStatus        `json:"status,omitempty"`
+	StatusHistory []statusChange     `json:"status_history,omitempty"`
+	TableNumber   string             `json:"table_number,omitempty"`
+	PartySize     int                `json:"party_size,omitempty"`
+	Channel       string             `json:"channel,omitempty"`
+	LocationID    string             `json:"location_id,omitempty"`
+	Total         int64              `json:"total,omitempty"`
+	Tax           int64              `json:"tax,omitempty"`
+	Tip           int64              `json:"tip,omitempty"`
+	ServiceCharge *serviceCharge     `json:"service_charge,omitempty"`
+	TotalOverride *priceOverride     `json:"total_override,omitempty"`
+	PaymentMethod string             `json:"payment_method,omitempty"`
+	Payments      []paymentLeg       `json:"payments,omitempty"`
+	ScheduledFor  *time.Time         `json:"scheduled_for,omitempty"`
+	Locked        bool               `json:"locked,omitempty"`
+	ReceiptURL    string             `json:"receipt_url,omitempty"`
+	TrackingURL   string             `json:"tracking_url,omitempty"`
+	DuplicateOf   string             `json:"duplicate_of,omitempty"`
+	Version       int64              `json:"version,omitempty"`
+	CreatedAt     *time.Time         `json:"created_at,omitempty"`
+	UpdatedAt     *time.Time         `json:"updated_at,omitempty"`
+}
+
+// touch bumps o's version past prev and stamps the modification time. The
+// creation time is stamped on an order's first write and kept after that.
+func touch(o *order, prev order, now time.Time) {
+	o.Version = prev.Version + 1
+	t := now.UTC()
+	o.UpdatedAt = &t
+	o.CreatedAt = prev.CreatedAt
+	if o.CreatedAt == nil {
+		o.CreatedAt = &t
+	}
 }
 
+// datastore is a write-through cache of every order, in front of an optional
+// orderStore database. Handlers read m directly under the read lock, and
+// change it only through put, drop and createAll under the write lock, which
+// write to the database before m. The database round-trip is made with the
+// lock held, so that a check made under the lock (the order's version, that
+// it is not closed, a quota) still holds when the change is stored; writes
+// are serialized by it, and reads wait for the write in progress.
 type datastore struct {
-	m map[string]order
-	*sync.RWMutex
+	m  map[string]order
+	db orderStore
+	// history is the orders' history, and reports their Z-reports, when db
+	// does not keep them.
+	history *orderHistory
+	reports *reportStore
+	*tracedRWMutex
 }
 
 type orderHandler struct {
-	store *datastore
+	store       *datastore
+	receipts    *receiptStore
+	tracking    *receiptStore
+	sessions    *sessionStore
+	devices     *deviceStore
+	audit       *auditLog
+	feed        *changeFeed
+	events      *eventBus
+	hooks       *hookRegistry
+	validators  *validatorRegistry
+	kitchen     *kitchenQueue
+	menu        *menuStore
+	jsonAPI     *jsonAPI
+	numbers     *orderNumbers
+	ulids       *ulidSource
+	sections    *sectionStore
+	deleteMode  string
+	duplicates  duplicateCheck
+	idempotency *idempotencyStore
+	settings    *settingsStore
+	paging      pagingConfig
+	promotions  *promotionStore
+	voids       *voidStore
+	overrides   *overrideStore
+	waste       *wasteLog
+	drawers     *drawerStore
+	quotas      *quotaStore
+	accounts    map[string]tenderAccount
+	routes      *router
+}
+
+// routeOrders builds the order routes. /order/ and /order/orders/ are the
+// original list and update paths, kept for clients that still use them.
+func (h *orderHandler) routeOrders() *router {
+	rt := newRouter()
+	rt.handle(http.MethodGet, "/orders", h.List)
+	rt.handle(http.MethodPost, "/orders", h.idempotent(h.Create))
+	rt.handle(http.MethodGet, "/orders/export", h.Export)
+	rt.handle(http.MethodPost, "/orders/import", h.Import)
+	rt.handle(http.MethodGet, "/orders/search", h.Search)
+	rt.handle(http.MethodGet, "/orders/{id}", h.Get)
+	rt.handle(http.MethodPut, "/orders/{id}", h.update)
+	rt.handle(http.MethodPatch, "/orders/{id}", h.Patch)
+	rt.handle(http.MethodDelete, "/orders/{id}", h.Delete)
+	rt.handle(http.MethodGet, "/orders/{id}/history", h.History)
+	rt.handle(http.MethodGet, "/orders/{id}/nutrition", h.Nutrition)
+	rt.handle(http.MethodGet, "/orders/{id}/payments", h.ListPayments)
+	rt.handle(http.MethodPost, "/orders/{id}/payments", h.AddPayment)
+	rt.handle(http.MethodPost, "/orders/{id}/payment", h.SetPayment)
+	rt.handle(http.MethodPost, "/orders/{id}/status", h.SetStatus)
+	rt.handle(http.MethodPost, "/orders/{id}/courses/{course}/fire", h.FireCourse)
+	rt.handle(http.MethodDelete, "/orders/{id}/service-charge", h.RemoveServiceCharge)
+	rt.handle(http.MethodGet, "/orders/{id}/voids", h.ListVoids)
+	rt.handle(http.MethodPost, "/orders/{id}/voids", h.RequestVoid)
+	rt.handle(http.MethodPost, "/orders/{id}/voids/{void}/approve", h.ApproveVoid)
+	rt.handle(http.MethodPost, "/orders/{id}/voids/{void}/reject", h.RejectVoid)
+	rt.handle(http.MethodPost, "/orders/{id}/comps", h.Comp)
+	rt.handle(http.MethodGet, "/orders/{id}/price-overrides", h.ListPriceOverrides)
+	rt.handle(http.MethodPost, "/orders/{id}/price-overrides", h.OverridePrice)
+	rt.handle(http.MethodGet, "/order", h.List)
+	rt.handle(http.MethodPut, "/order/orders", h.update)
+	return rt
 }
 
 func (h *orderHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("content-type", "application/json")
-	switch {
-	case r.Method == http.MethodGet && listOrderRe.MatchString(r.URL.Path):
-		h.List(w, r)
+	h.routes.ServeHTTP(w, r)
+}
+
+// List returns the orders, narrowed by ?channel=, ?payment=, ?status=, ?table=
+// and a ?q= search, ordered by ?sort= and paged with ?offset= and ?limit=.
+// Pages are held to the caller's page limits (see pagingConfig), and paged
+// lists report the full count in X-Total-Count. With ?since= only the
+// changes are returned (see ListDelta).
+func (h *orderHandler) List(w http.ResponseWriter, r *http.Request) {
+	channel := r.URL.Query().Get("channel")
+	q := r.URL.Query().Get("q")
+	listing, err := parseOrderListing(r.URL.Query(), h.paging.limits(r, h.sessions))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
 		return
-	case r.Method == http.MethodGet && getOrderRe.MatchString(r.URL.Path):
-		h.Get(w, r)
+	}
+	if r.URL.Query().Has("since") {
+		h.ListDelta(w, r, listing)
 		return
-	case r.Method == http.MethodPost && createOrderRe.MatchString(r.URL.Path):
-		h.Create(w, r)
+	}
+	lb := getListBuffer()
+	defer putListBuffer(lb)
+	users := h.listOrders(lb.orders[:0], channel, q, listing)
+	lb.orders = users
+	if hasODataOptions(r.URL.Query()) {
+		h.writeOData(w, r, users, listing)
 		return
-	case r.Method == http.MethodPut && updateOrderRe.MatchString(r.URL.Path):
-		h.update(w, r)
+	}
+	w.Header().Set(totalCountHeader, strconv.Itoa(len(users)))
+	users = listing.page(users)
+	if wantsJSONAPI(r) {
+		res := make([]jsonAPIResource, 0, len(users))
+		for _, o := range users {
+			res = append(res, h.jsonAPI.orderResource(o))
+		}
+		h.jsonAPI.writeMany(w, r, http.StatusOK, res)
 		return
-
-	default:
-		notFound(w, r)
+	}
+	jsonBytes, err := lb.encode(users)
+	if err != nil {
+		internalServerError(w, r)
 		return
 	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonBytes)
 }
 
-func (h *orderHandler) List(w http.ResponseWriter, r *http.Request) {
+// listOrders appends to dst the orders on channel that pass the listing's
+// filters and match the search q, ordered but not paged.
+func (h *orderHandler) listOrders(dst []order, channel, q string, listing orderListing) []order {
+	scores := map[string]float64{}
 	h.store.RLock()
-	users := make([]order, 0, len(h.store.m))
 	for _, v := range h.store.m {
-		users = append(users, v)
+		if channel != "" && v.Channel != channel {
+			continue
+		}
+		if !listing.keep(v) {
+			continue
+		}
+		if q != "" {
+			score := fuzzyScore(q, strings.Join(append(orderItemNames(v), v.Name, v.TableNumber), " "))
+			if score == 0 {
+				continue
+			}
+			scores[v.ID] = score
+		}
+		dst = append(dst, v)
 	}
 	h.store.RUnlock()
-	jsonBytes, err := json.Marshal(users)
-	if err != nil {
-		internalServerError(w, r)
-		return
+	if q != "" {
+		sort.SliceStable(dst, func(i, j int) bool { return scores[dst[i].ID] > scores[dst[j].ID] })
 	}
-	w.WriteHeader(http.StatusOK)
-	w.Write(jsonBytes)
+	listing.order(dst, q != "")
+	return dst
 }
 
 func (h *orderHandler) Get(w http.ResponseWriter, r *http.Request) {
-	matches := getOrderRe.FindStringSubmatch(r.URL.Path)
-	if len(matches) < 1 {
+	h.store.RLock()
+	u, ok := h.store.m[pathParam(r, "id")]
+	h.store.RUnlock()
+	if !ok {
 		notFound(w, r)
 		return
 	}
-	orders := make([]order, 0, len(h.store.m))
-	h.store.Lock()
-
-	u, ok := h.store.m[matches[1]]
-
-	for _, orderID := range orders {
-		if orderID.ID == r.URL.Query().Get("id") {
-			_, err := json.Marshal(u)
-			if err != nil {
-				internalServerError(w, r)
-				return
-			}
-		}
-	}
-
-	h.store.Unlock()
-	if !ok {
-		w.WriteHeader(http.StatusNotFound)
-		w.Write([]byte("user not found"))
+	if wantsJSONAPI(r) {
+		h.jsonAPI.writeOne(w, r, http.StatusOK, h.jsonAPI.orderResource(u))
 		return
 	}
 	jsonBytes, err := json.Marshal(u)
@@ -110,12 +255,14 @@ func (h *orderHandler) Get(w http.ResponseWriter, r *http.Request) {
 func (h *orderHandler) Create(w http.ResponseWriter, r *http.Request) {
 	var u order
 	if err := json.NewDecoder(r.Body).Decode(&u); err != nil {
-		internalServerError(w, r)
+		decodeFailed(w, r, err)
+		return
+	}
+	u, err := h.place(r, u, r.URL.Query().Get("allow_duplicate") == "true")
+	if err != nil {
+		mutateFailed(w, r, err)
 		return
 	}
-	h.store.Lock()
-	h.store.m[u.ID] = u
-	h.store.Unlock()
 	jsonBytes, err := json.Marshal(u)
 	if err != nil {
 		internalServerError(w, r)
@@ -125,102 +272,569 @@ func (h *orderHandler) Create(w http.ResponseWriter, r *http.Request) {
 	w.Write(jsonBytes)
 }
 
+// place prices, validates and creates an order sent by a client. The server
+// sets its payments, tax, tip and links. An order that looks like a repeat of
+// a recent one is flagged, or refused in block mode unless allowDuplicate.
+func (h *orderHandler) place(r *http.Request, u order, allowDuplicate bool) (order, error) {
+	defaultChannel(&u)
+	keepPayments(order{}, &u)
+	defaultPayment(&u)
+	unavailable := h.menu.price(order{}, &u)
+	tallyItems(&u)
+	if errs := append(unavailable, h.validators.validate(u)...); len(errs) > 0 {
+		return order{}, &validationError{fields: errs}
+	}
+	u.DuplicateOf, u.ReceiptURL = "", ""
+	if dup, ok := h.duplicates.find(h.store, u, time.Now()); ok && !allowDuplicate {
+		if h.duplicates.mode == duplicateBlock {
+			return order{}, &duplicateError{of: dup.ID}
+		}
+		u.DuplicateOf = dup.ID
+	}
+	return h.create(r, u)
+}
+
+// create stores a validated new order with the usual side effects (create and
+// payment hooks, receipt, audit, change feed). Orders from other sources, such
+// as delivery platforms, go through here so they reach the kitchen the same way.
+// An order whose ID is taken is refused with errOrderExists: changing an
+// order goes through update, which checks the change is allowed.
+func (h *orderHandler) create(r *http.Request, u order) (order, error) {
+	if u.ID != "" {
+		h.store.RLock()
+		_, exists := h.store.m[u.ID]
+		h.store.RUnlock()
+		if exists {
+			return order{}, errOrderExists
+		}
+	}
+	u, err := h.prepare(r, u, nil)
+	if err != nil {
+		return order{}, err
+	}
+	h.store.Lock()
+	if _, exists := h.store.m[u.ID]; exists {
+		h.store.Unlock()
+		return order{}, errOrderExists
+	}
+	if err := h.quotas.admit(h.store.m, u)[0]; err != nil {
+		h.store.Unlock()
+		return order{}, err
+	}
+	u.Locked = false
+	touch(&u, order{}, time.Now())
+	if err := h.store.put(u); err != nil {
+		h.store.Unlock()
+		return order{}, err
+	}
+	h.store.Unlock()
+	h.created(r, order{}, u)
+	return u, nil
+}
+
+// prepare readies a validated new order for storing: its location, ID, number
+// and reference, starting status, promotions, service charge, receipt and
+// tracking links, after the before-create and before-payment hooks.
+// IDs in reserved are treated as taken when generating an ID.
+func (h *orderHandler) prepare(r *http.Request, u order, reserved map[string]int) (order, error) {
+	if err := placeOrder(r, h.sessions, &u); err != nil {
+		return order{}, err
+	}
+	if u.ID == "" && h.ulids != nil {
+		id, err := h.ulids.next(time.Now())
+		if err != nil {
+			return order{}, err
+		}
+		u.ID = id
+	}
+	if err := h.number(&u, reserved); err != nil {
+		return order{}, err
+	}
+	h.reference(&u, time.Now())
+	h.store.RLock()
+	existing := h.store.m[u.ID]
+	h.store.RUnlock()
+	startStatus(existing, &u, identifyActor(r, h.sessions, h.devices).StaffID, time.Now())
+	if err := h.sections.authorize(r, h.sessions, existing, u); err != nil {
+		return order{}, err
+	}
+	applyPromotions(h.promotions, existing, &u, time.Now())
+	applyServiceCharge(h.settings, existing, &u)
+	keepTotalOverride(existing, &u)
+	if err := h.hooks.runBeforeCreate(r.Context(), &u); err != nil {
+		return order{}, err
+	}
+	if err := h.hooks.runBeforePayment(r.Context(), order{}, &u); err != nil {
+		return order{}, err
+	}
+	if err := h.attachReceipt(&u); err != nil {
+		return order{}, err
+	}
+	if err := h.attachTracking(&u); err != nil {
+		return order{}, err
+	}
+	return u, nil
+}
+
+// number gives u its order number, and an ID if it has none that is not
+// taken by a stored order or in reserved.
+func (h *orderHandler) number(u *order, reserved map[string]int) error {
+	h.store.RLock()
+	defer h.store.RUnlock()
+	return h.numbers.number(u, func(id string) bool {
+		_, stored := h.store.m[id]
+		_, held := reserved[id]
+		return stored || held
+	})
+}
+
+// created runs the side effects of a stored new order: audit, change feed,
+// order events and the after-create hooks.
+func (h *orderHandler) created(r *http.Request, prev, u order) {
+	h.recordChange(r, "order.create", prev, u)
+	h.feed.publish(kindOrders, u.ID, false)
+	h.events.created(u)
+	h.hooks.runAfterCreate(r.Context(), u)
+}
+
+// Delete cancels an order. In hard mode (ORDER_DELETE_MODE=hard, the default)
+// the order is erased; in soft mode it is kept with the cancelled status so it
+// still shows in reports as a void. Paid orders must be refunded instead.
+func (h *orderHandler) Delete(w http.ResponseWriter, r *http.Request) {
+	if _, ok := h.sessions.requireScope(w, r, "orders:manage"); !ok {
+		return
+	}
+	if err := h.cancel(r, pathParam(r, "id")); err != nil {
+		mutateFailed(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// cancel erases the order, or in soft mode marks it cancelled.
+func (h *orderHandler) cancel(r *http.Request, id string) error {
+	h.store.RLock()
+	o, ok := h.store.m[id]
+	h.store.RUnlock()
+	if !ok {
+		return errOrderNotFound
+	}
+	if isPaid(o) {
+		return errOrderPaid
+	}
+	var err error
+	if h.deleteMode == deleteSoft {
+		_, err = h.mutate(r, id, "order.cancel", func(o *order) error {
+			if isPaid(*o) {
+				return errOrderPaid
+			}
+			if isVoided(*o) {
+				return &transitionError{field: "status", from: string(o.Status), to: string(statusCancelled)}
+			}
+			o.Status = statusCancelled
+			o.StatusHistory = append(append([]statusChange(nil), o.StatusHistory...),
+				statusChange{Status: statusCancelled, At: time.Now().UTC(), StaffID: identifyActor(r, h.sessions, h.devices).StaffID})
+			return nil
+		})
+	} else {
+		err = h.remove(r, id)
+	}
+	return err
+}
+
+// remove deletes an order, auditing it, adding it to the order's history and
+// publishing the deletion to the change feed. Closed orders cannot be removed.
+func (h *orderHandler) remove(r *http.Request, id string) error {
+	h.store.Lock()
+	prev, ok := h.store.m[id]
+	switch {
+	case !ok:
+		h.store.Unlock()
+		return errOrderNotFound
+	case prev.Locked:
+		h.store.Unlock()
+		return errOrderLocked
+	}
+	if err := h.store.drop(id); err != nil {
+		h.store.Unlock()
+		return err
+	}
+	h.store.Unlock()
+	h.recordHistory(r, h.recordAudit(r, "order.delete", id))
+	h.feed.publish(kindOrders, id, true)
+	h.events.deleted(id)
+	return nil
+}
+
+// update replaces an order. On PUT /orders/{id} the body may leave out the ID;
+// on the legacy PUT /order/orders/ it must carry it. A body with a version is
+// refused with 409 unless the order is still at that version. The order's
+// payments, tax, tip and links are kept whatever the body says.
 func (h *orderHandler) update(w http.ResponseWriter, r *http.Request) {
 	var u order
 	if err := json.NewDecoder(r.Body).Decode(&u); err != nil {
+		decodeFailed(w, r, err)
+		return
+	}
+	if id := pathParam(r, "id"); id != "" {
+		if u.ID != "" && u.ID != id {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("order id in body does not match the path"))
+			return
+		}
+		u.ID = id
+	}
+	u, err := h.replace(r, u)
+	if err != nil {
+		mutateFailed(w, r, err)
+		return
+	}
+	jsonBytes, err := json.Marshal(u)
+	if err != nil {
 		internalServerError(w, r)
 		return
 	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonBytes)
+}
+
+// replace prices, validates and stores u in place of the order with its ID.
+func (h *orderHandler) replace(r *http.Request, u order) (order, error) {
+	h.store.RLock()
+	prev, ok := h.store.m[u.ID]
+	h.store.RUnlock()
+	if !ok {
+		return order{}, errOrderNotFound
+	}
+	keepPayments(prev, &u)
+	unavailable := h.menu.price(prev, &u)
+	tallyItems(&u)
+	if errs := append(unavailable, h.validators.validate(u)...); len(errs) > 0 {
+		return order{}, &validationError{fields: errs}
+	}
+
+	u.DuplicateOf, u.Reference = prev.DuplicateOf, prev.Reference
+	keepStatus(prev, &u)
+	if err := h.sections.authorize(r, h.sessions, prev, u); err != nil {
+		return order{}, err
+	}
+	applyPromotions(h.promotions, prev, &u, time.Now())
+	applyServiceCharge(h.settings, prev, &u)
+	keepTotalOverride(prev, &u)
+	if err := h.hooks.runBeforePayment(r.Context(), prev, &u); err != nil {
+		return order{}, err
+	}
 
 	h.store.Lock()
-	for index, item := range h.store.m {
-		if item.ID == u.ID {
-			h.store.m[index] = u
-		}
+	item, ok := h.store.m[u.ID]
+	if !ok {
+		// Deleted while the replacement was being prepared.
+		h.store.Unlock()
+		return order{}, errOrderNotFound
+	}
+	if item.Locked {
+		h.store.Unlock()
+		return order{}, errOrderLocked
+	}
+	// A replacement that names a version was made from that version, and
+	// must not overwrite changes made since.
+	if u.Version != 0 && u.Version != item.Version {
+		h.store.Unlock()
+		return order{}, &versionError{at: item.Version, want: u.Version}
+	}
+	// Payments taken while the replacement was being prepared are kept.
+	keepPayments(item, &u)
+	u.ReceiptURL, u.TrackingURL = item.ReceiptURL, item.TrackingURL
+	if err := checkTransition(item, u); err != nil {
+		h.store.Unlock()
+		return order{}, err
+	}
+	prev = item
+	u.Locked = false
+	u.Channel = item.Channel
+	u.LocationID = item.LocationID
+	u.Number = item.Number
+	touch(&u, item, time.Now())
+	if err := h.store.put(u); err != nil {
+		h.store.Unlock()
+		return order{}, err
 	}
 	h.store.Unlock()
+	h.recordChange(r, "order.update", prev, u)
+	h.feed.publish(kindOrders, u.ID, false)
+	h.events.updated(u)
+	h.hooks.runAfterStatusChange(r.Context(), prev, u)
+	return u, nil
+}
 
-	jsonBytes, err := json.Marshal(u)
+var (
+	errOrderNotFound = errors.New("order not found")
+	errOrderLocked   = errors.New("order is closed")
+	errOrderExists   = errors.New("order already exists")
+	errOrderConflict = errors.New("order was modified concurrently")
+	errOrderPaid     = errors.New("paid orders must be refunded, not cancelled")
+)
+
+// validationError rejects an order with invalid fields.
+type validationError struct {
+	fields []fieldError
+}
+
+func (e *validationError) Error() string {
+	parts := make([]string, len(e.fields))
+	for i, f := range e.fields {
+		parts[i] = f.Field + ": " + f.Message
+	}
+	return "the request has invalid fields: " + strings.Join(parts, "; ")
+}
+
+// versionError rejects a replacement made from an older version of the order.
+type versionError struct {
+	at, want int64
+}
+
+func (e *versionError) Error() string {
+	return fmt.Sprintf("order is at version %d, not %d; fetch it and try again", e.at, e.want)
+}
+
+// duplicateError refuses an order that looks like a repeat of order of.
+type duplicateError struct {
+	of string
+}
+
+func (e *duplicateError) Error() string {
+	return "order looks like a repeat of order " + e.of + "; resubmit with ?allow_duplicate=true if it is not"
+}
+
+// badRequestError rejects a mutation because of what the client sent.
+type badRequestError struct {
+	msg string
+}
+
+func (e *badRequestError) Error() string {
+	return e.msg
+}
+
+// mutate applies fn to a copy of the order and commits the result with the
+// usual side effects (payment hooks, receipt, version bump, audit, change feed,
+// status hooks). fn runs without the store lock held; if the order changed in
+// the meantime the mutation is retried.
+func (h *orderHandler) mutate(r *http.Request, id, action string, fn func(o *order) error) (order, error) {
+	for attempt := 0; attempt < 3; attempt++ {
+		h.store.RLock()
+		prev, ok := h.store.m[id]
+		h.store.RUnlock()
+		if !ok {
+			return order{}, errOrderNotFound
+		}
+		if prev.Locked {
+			return order{}, errOrderLocked
+		}
+		next := prev
+		if err := fn(&next); err != nil {
+			return order{}, err
+		}
+		if err := checkTransition(prev, next); err != nil {
+			return order{}, err
+		}
+		if err := h.sections.authorize(r, h.sessions, prev, next); err != nil {
+			return order{}, err
+		}
+		if err := h.hooks.runBeforePayment(r.Context(), prev, &next); err != nil {
+			return order{}, err
+		}
+		if err := h.attachReceipt(&next); err != nil {
+			return order{}, err
+		}
+
+		h.store.Lock()
+		if cur := h.store.m[id]; cur.Version != prev.Version {
+			h.store.Unlock()
+			continue
+		}
+		touch(&next, prev, time.Now())
+		if err := h.store.put(next); err != nil {
+			h.store.Unlock()
+			return order{}, err
+		}
+		h.store.Unlock()
+
+		h.recordChange(r, action, prev, next)
+		h.feed.publish(kindOrders, id, false)
+		h.events.updated(next)
+		h.hooks.runAfterStatusChange(r.Context(), prev, next)
+		return next, nil
+	}
+	return order{}, errOrderConflict
+}
+
+// mutateFailed maps an error from mutate to a response.
+func mutateFailed(w http.ResponseWriter, r *http.Request, err error) {
+	var bad *badRequestError
+	var forbidden *forbiddenError
+	var closed *closedError
+	var transition *transitionError
+	var quota *quotaError
+	var invalid *validationError
+	var version *versionError
+	var dup *duplicateError
+	switch {
+	case errors.Is(err, errOrderNotFound):
+		notFound(w, r)
+	case errors.Is(err, errOrderLocked):
+		orderLocked(w, r)
+	case errors.Is(err, errOrderExists):
+		writeError(w, r, http.StatusConflict, "order_exists", "order already exists; use PUT /orders/{id} to change it", nil)
+	case errors.Is(err, errOrderConflict):
+		writeError(w, r, http.StatusConflict, "version_conflict", err.Error(), nil)
+	case errors.Is(err, errOrderPaid):
+		writeError(w, r, http.StatusConflict, "", err.Error(), nil)
+	case errors.As(err, &invalid):
+		validationFailed(w, r, invalid.fields)
+	case errors.As(err, &version):
+		writeError(w, r, http.StatusConflict, "version_conflict", version.Error(), nil)
+	case errors.As(err, &dup):
+		writeError(w, r, http.StatusConflict, "duplicate_order", dup.Error(), map[string]string{"duplicate_of": dup.of})
+	case errors.As(err, &bad):
+		writeError(w, r, http.StatusBadRequest, "", bad.msg, nil)
+	case errors.As(err, &transition):
+		writeError(w, r, http.StatusConflict, "illegal_transition", transition.Error(), nil)
+	case errors.As(err, &closed):
+		details := struct {
+			Location string     `json:"location_id"`
+			NextOpen *time.Time `json:"next_open"`
+		}{Location: closed.LocationID}
+		if !closed.NextOpen.IsZero() {
+			next := closed.NextOpen.UTC()
+			details.NextOpen = &next
+		}
+		writeError(w, r, http.StatusUnprocessableEntity, "closed", closedMessage(closed), details)
+	case errors.As(err, &forbidden):
+		writeError(w, r, http.StatusForbidden, "", forbidden.msg, nil)
+	case errors.As(err, &quota):
+		writeError(w, r, http.StatusForbidden, "quota_exceeded", quota.Error(), struct {
+			Location      string `json:"location_id"`
+			MaxOpenOrders int    `json:"max_open_orders"`
+		}{quota.LocationID, quota.Max})
+	default:
+		hookFailed(w, r, err)
+	}
+}
+
+// attachReceipt issues the receipt shortlink once an order is paid.
+func (h *orderHandler) attachReceipt(u *order) error {
+	if !isPaid(*u) {
+		return nil
+	}
+	token, err := h.receipts.issue(u.ID)
+	if err != nil {
+		return err
+	}
+	u.ReceiptURL = receiptPath(token)
+	return nil
+}
+
+func (h *orderHandler) recordAudit(r *http.Request, action, orderID string) auditEntry {
+	a := identifyActor(r, h.sessions, h.devices)
+	return h.audit.record(auditEntry{Action: action, OrderID: orderID, StaffID: a.StaffID, DeviceID: a.DeviceID})
+}
+
+// recordChange audits an order mutation together with snapshots of the order
+// before and after it, and adds it to the order's history. before is the zero
+// order when the order was created.
+func (h *orderHandler) recordChange(r *http.Request, action string, before, after order) {
+	a := identifyActor(r, h.sessions, h.devices)
+	e := auditEntry{Action: action, OrderID: after.ID, StaffID: a.StaffID, DeviceID: a.DeviceID, HasDiff: true}
+	var err error
+	if before.ID != "" {
+		if e.before, err = json.Marshal(before); err != nil {
+			e.HasDiff = false
+		}
+	}
+	if e.after, err = json.Marshal(after); err != nil {
+		e.HasDiff = false
+	}
+	h.recordHistory(r, h.audit.record(e))
+}
+
+func writeJSON(w http.ResponseWriter, r *http.Request, status int, v interface{}) {
+	jsonBytes, err := json.Marshal(v)
 	if err != nil {
 		internalServerError(w, r)
 		return
 	}
-	w.WriteHeader(http.StatusOK)
+	w.WriteHeader(status)
 	w.Write(jsonBytes)
 }
 
 func internalServerError(w http.ResponseWriter, r *http.Request) {
-	w.WriteHeader(http.StatusInternalServerError)
-	w.Write([]byte("internal server error"))
+	writeError(w, r, http.StatusInternalServerError, "", "internal server error", nil)
+}
+
+func orderLocked(w http.ResponseWriter, r *http.Request) {
+	writeError(w, r, http.StatusConflict, "order_locked", "order is closed", nil)
 }
 
 func notFound(w http.ResponseWriter, r *http.Request) {
-	w.WriteHeader(http.StatusNotFound)
-	w.Write([]byte("not found"))
+	writeError(w, r, http.StatusNotFound, "", "not found", nil)
 }
 
 func main() {
-	var wg = sync.WaitGroup{}
-	wg.Add(1)
-
-	mux := http.NewServeMux()
-
-	orderH := &orderHandler{
-		store: &datastore{
-			m: map[string]order{
-				"1": {
-					ID:          "1",
-					Name:        "Rahul",
-					OrderItems:  "veg pulav, biryani",
-					TotalItems:  "2",
-					Payment:     "Done",
-					TableNumber: "11",
-				},
-				"2": {
-					ID:          "2",
-					Name:        "Mayur",
-					OrderItems:  "Pav Bhaji, manchurian",
-					TotalItems:  "2",
-					Payment:     "Done",
-					TableNumber: "123",
-				},
-				"3": {
-					ID:          "3",
-					Name:        "Nikhil",
-					OrderItems:  "veg pulav",
-					TotalItems:  "1",
-					Payment:     "Done",
-					TableNumber: "12",
-				},
-				"4": {
-					ID:          "4",
-					Name:        "Sanajana",
-					OrderItems:  "chicken khima,roti",
-					TotalItems:  "2",
-					Payment:     "pending",
-					TableNumber: "1234",
-				},
-				"5": {
-					ID:          "5",
-					Name:        "rohit",
-					OrderItems:  "pulav",
-					TotalItems:  "1",
-					Payment:     "pending",
-					TableNumber: "1",
-				},
-			},
-			RWMutex: &sync.RWMutex{},
-		},
-	}
-
-	mux.Handle("/order/", orderH)        // list
-	mux.Handle("/orders/", orderH)       // create order
-	mux.Handle("/orders/:id", orderH)    // get order by id
-	mux.Handle("/order/orders/", orderH) // modify order
+	// SIGINT or SIGTERM stops the background loops and shuts the server down,
+	// letting requests in flight finish for up to the shutdown timeout.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	cfg, err := loadConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+	// Everything logged, including through the log package, goes through
+	// logger.
+	logger, err := newLogger(os.Stderr, cfg.LogLevel, cfg.LogFormat)
+	if err != nil {
+		log.Fatal(err)
+	}
+	slog.SetDefault(logger)
 
+	s, err := newServer(ctx, cfg, logger)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer s.Close()
+	srv := newHTTPServer(cfg, s)
+	errc := make(chan error, 2)
+	go func() { errc <- srv.ListenAndServe() }()
+	if cfg.GRPCAddr != "" {
+		lis, err := net.Listen("tcp", cfg.GRPCAddr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		go func() { errc <- s.grpc.Serve(lis) }()
+	}
 	fmt.Println("server started......")
 
-	http.ListenAndServe("localhost:8081", mux)
-
-	wg.Wait()
+	select {
+	case err := <-errc:
+		log.Fatal(err)
+	case <-ctx.Done():
+	}
+	stop()
+	log.Printf("shutting down")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), time.Duration(cfg.ShutdownTimeout))
+	defer cancel()
+	// Watches end with the context, so gRPC calls in flight finish as HTTP
+	// requests do; any still running at the timeout are cut off.
+	stopped := make(chan struct{})
+	go func() {
+		s.grpc.GracefulStop()
+		close(stopped)
+	}()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		log.Printf("shutdown: %v", err)
+	}
+	select {
+	case <-stopped:
+	case <-shutdownCtx.Done():
+		s.grpc.Stop()
+	}
 }
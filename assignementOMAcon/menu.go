@@ -0,0 +1,363 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var (
+	listMenuRe   = regexp.MustCompile(`^/menu/?$`)
+	menuSearchRe = regexp.MustCompile(`^/menu/search$`)
+	menuItemRe   = regexp.MustCompile(`^/menu/([a-z0-9-]+)$`)
+	stationRe    = regexp.MustCompile(`^[a-z0-9_]+$`)
+)
+
+const kindMenu = "menu"
+
+// defaultStation prepares items that are not on the menu or not tagged with a
+// station.
+const defaultStation = "kitchen"
+
+type menuItem struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	Station     string `json:"station"`
+	Category    string `json:"category,omitempty"`
+	// Price is in minor units; zero leaves the price to the order line.
+	Price int64 `json:"price,omitempty"`
+	// Available is false while the item cannot be ordered, such as when it
+	// has sold out. Items are available unless set otherwise.
+	Available    *bool               `json:"available"`
+	Nutrition    *nutrition          `json:"nutrition,omitempty"`
+	Translations map[string]menuText `json:"translations,omitempty"`
+	// Language is the translation Name and Description were served in, when
+	// one matched the request.
+	Language string `json:"language,omitempty"`
+	// Image is set by uploading to /menu/{id}/image, not by PUT.
+	Image *menuImage `json:"image,omitempty"`
+}
+
+type menuStore struct {
+	m          map[string]menuItem
+	prefixes   []prefixEntry
+	popularity map[string]int
+	feed       *changeFeed
+	*sync.RWMutex
+}
+
+func newMenuStore(feed *changeFeed) *menuStore {
+	return &menuStore{
+		m:          map[string]menuItem{},
+		popularity: map[string]int{},
+		feed:       feed,
+		RWMutex:    &sync.RWMutex{},
+	}
+}
+
+func (s *menuStore) set(item menuItem) {
+	if item.Station == "" {
+		item.Station = defaultStation
+	}
+	if item.Available == nil {
+		available := true
+		item.Available = &available
+	}
+	s.Lock()
+	s.m[item.ID] = item
+	s.reindex()
+	s.Unlock()
+	s.feed.publish(kindMenu, item.ID, false)
+}
+
+func (s *menuStore) delete(id string) bool {
+	s.Lock()
+	_, ok := s.m[id]
+	delete(s.m, id)
+	s.reindex()
+	s.Unlock()
+	if ok {
+		s.feed.publish(kindMenu, id, true)
+	}
+	return ok
+}
+
+func (s *menuStore) get(id string) (menuItem, bool) {
+	s.RLock()
+	defer s.RUnlock()
+	item, ok := s.m[id]
+	return item, ok
+}
+
+func (s *menuStore) list() []menuItem {
+	s.RLock()
+	out := make([]menuItem, 0, len(s.m))
+	for _, item := range s.m {
+		out = append(out, item)
+	}
+	s.RUnlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out
+}
+
+// byName finds the menu item an order line refers to. Order items are free
+// text, so names match case-insensitively.
+func (s *menuStore) byName(name string) (menuItem, bool) {
+	s.RLock()
+	defer s.RUnlock()
+	for _, item := range s.m {
+		if strings.EqualFold(item.Name, name) {
+			return item, true
+		}
+	}
+	return menuItem{}, false
+}
+
+// resolve finds the menu item an order line is for: the one its
+// menu_item_id names, or failing that the one its name matches.
+func (s *menuStore) resolve(it orderItem) (menuItem, bool) {
+	if it.MenuItemID != "" {
+		return s.get(it.MenuItemID)
+	}
+	return s.byName(it.Name)
+}
+
+// price ties each of o's lines to its menu item and prices it. Lines for
+// items prev already had keep prev's price, which may have been overridden;
+// new lines take the menu price, or keep the client's when the menu has
+// none. New lines for items that are not available are reported.
+func (s *menuStore) price(prev order, o *order) []fieldError {
+	kept := map[string]int64{}
+	for _, it := range prev.OrderItems {
+		if item, ok := s.resolve(it); ok {
+			kept[item.ID] = it.UnitPrice
+		}
+	}
+	var errs []fieldError
+	for i := range o.OrderItems {
+		it := &o.OrderItems[i]
+		item, ok := s.resolve(*it)
+		if !ok {
+			continue
+		}
+		it.MenuItemID = item.ID
+		if price, ok := kept[item.ID]; ok {
+			it.UnitPrice = price
+			continue
+		}
+		if item.Available != nil && !*item.Available {
+			errs = append(errs, fieldError{Field: "order_items." + strconv.Itoa(i) + ".name", Message: "is not available"})
+		}
+		if item.Price > 0 {
+			it.UnitPrice = item.Price
+		}
+	}
+	return errs
+}
+
+// validateMenuItems requires every order line to be for an item on the menu.
+func validateMenuItems(menu *menuStore) validationRule {
+	return func(o order) []fieldError {
+		var errs []fieldError
+		for i, it := range o.OrderItems {
+			if _, ok := menu.resolve(it); ok {
+				continue
+			}
+			field := "order_items." + strconv.Itoa(i) + ".name"
+			if it.MenuItemID != "" {
+				field = "order_items." + strconv.Itoa(i) + ".menu_item_id"
+			}
+			errs = append(errs, fieldError{Field: field, Message: "is not on the menu"})
+		}
+		return errs
+	}
+}
+
+// station is where an order line is prepared.
+func (s *menuStore) station(name string) string {
+	if item, ok := s.byName(name); ok {
+		return item.Station
+	}
+	return defaultStation
+}
+
+func (s *menuStore) syncSource() syncSource {
+	return syncSource{
+		get: func(id string) (interface{}, bool) {
+			return s.get(id)
+		},
+		all: func() []interface{} {
+			items := s.list()
+			out := make([]interface{}, 0, len(items))
+			for _, item := range items {
+				out = append(out, item)
+			}
+			return out
+		},
+	}
+}
+
+type menuHandler struct {
+	menu     *menuStore
+	sessions *sessionStore
+	jsonAPI  *jsonAPI
+	images   objectStore
+}
+
+// ServeHTTP serves the menu. Reading it needs no session so guest-facing
+// ordering can show it; changing it needs orders:manage.
+func (h *menuHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("content-type", "application/json")
+	if r.Method != http.MethodGet {
+		if _, ok := h.sessions.requireScope(w, r, "orders:manage"); !ok {
+			return
+		}
+	} else {
+		w.Header().Set("Vary", "Accept-Language")
+	}
+	switch {
+	case r.Method == http.MethodGet && listMenuRe.MatchString(r.URL.Path):
+		h.List(w, r)
+		return
+	case r.Method == http.MethodGet && menuSuggestRe.MatchString(r.URL.Path):
+		h.Suggest(w, r)
+		return
+	case r.Method == http.MethodGet && menuSearchRe.MatchString(r.URL.Path):
+		h.Search(w, r)
+		return
+	case r.Method == http.MethodGet && menuItemRe.MatchString(r.URL.Path):
+		h.Get(w, r)
+		return
+	case r.Method == http.MethodGet && menuImageRe.MatchString(r.URL.Path):
+		h.Image(w, r)
+		return
+	case r.Method == http.MethodPost && menuImageRe.MatchString(r.URL.Path) && menuImageRe.FindStringSubmatch(r.URL.Path)[2] == "":
+		h.UploadImage(w, r)
+		return
+	case r.Method == http.MethodDelete && menuImageRe.MatchString(r.URL.Path) && menuImageRe.FindStringSubmatch(r.URL.Path)[2] == "":
+		h.DeleteImage(w, r)
+		return
+	case r.Method == http.MethodPut && menuItemRe.MatchString(r.URL.Path):
+		h.Put(w, r)
+		return
+	case r.Method == http.MethodDelete && menuItemRe.MatchString(r.URL.Path):
+		h.Delete(w, r)
+		return
+	default:
+		notFound(w, r)
+		return
+	}
+}
+
+func (h *menuHandler) List(w http.ResponseWriter, r *http.Request) {
+	langs := requestedLanguages(r)
+	items := h.menu.list()
+	for i := range items {
+		items[i] = items[i].localize(langs)
+	}
+	if wantsJSONAPI(r) {
+		res := make([]jsonAPIResource, 0, len(items))
+		for _, item := range items {
+			res = append(res, h.jsonAPI.menuResource(item))
+		}
+		h.jsonAPI.writeMany(w, r, http.StatusOK, res)
+		return
+	}
+	writeJSON(w, r, http.StatusOK, items)
+}
+
+func (h *menuHandler) Get(w http.ResponseWriter, r *http.Request) {
+	matches := menuItemRe.FindStringSubmatch(r.URL.Path)
+	item, ok := h.menu.get(matches[1])
+	if !ok {
+		notFound(w, r)
+		return
+	}
+	item = item.localize(requestedLanguages(r))
+	if wantsJSONAPI(r) {
+		h.jsonAPI.writeOne(w, r, http.StatusOK, h.jsonAPI.menuResource(item))
+		return
+	}
+	writeJSON(w, r, http.StatusOK, item)
+}
+
+type menuMatch struct {
+	menuItem
+	Score float64 `json:"score"`
+}
+
+// Search finds menu items whose name, in any language, matches ?q= despite
+// typos, best first.
+func (h *menuHandler) Search(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query().Get("q")
+	if strings.TrimSpace(q) == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("q is required"))
+		return
+	}
+	langs := requestedLanguages(r)
+	matches := []menuMatch{}
+	for _, item := range h.menu.list() {
+		best := 0.0
+		for _, name := range item.searchText() {
+			if score := fuzzyScore(q, name); score > best {
+				best = score
+			}
+		}
+		if best > 0 {
+			matches = append(matches, menuMatch{menuItem: item.localize(langs), Score: best})
+		}
+	}
+	sort.SliceStable(matches, func(i, j int) bool { return matches[i].Score > matches[j].Score })
+	writeJSON(w, r, http.StatusOK, matches)
+}
+
+func (h *menuHandler) Put(w http.ResponseWriter, r *http.Request) {
+	matches := menuItemRe.FindStringSubmatch(r.URL.Path)
+	var item menuItem
+	if err := json.NewDecoder(r.Body).Decode(&item); err != nil || item.Name == "" ||
+		(item.Station != "" && !stationRe.MatchString(item.Station)) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("name is required and station must be lowercase letters, digits or underscores"))
+		return
+	}
+	if item.Price < 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("price must not be negative"))
+		return
+	}
+	if item.Nutrition != nil && !item.Nutrition.valid() {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("nutrition values must be non-negative numbers"))
+		return
+	}
+	translations, ok := validTranslations(item.Translations)
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("translations must be keyed by language tag (e.g. fr, pt-br) and each needs a name"))
+		return
+	}
+	item.ID, item.Translations, item.Language, item.Image = matches[1], translations, "", nil
+	if prev, ok := h.menu.get(item.ID); ok {
+		item.Image = prev.Image
+	}
+	h.menu.set(item)
+	item, _ = h.menu.get(item.ID)
+	writeJSON(w, r, http.StatusOK, item)
+}
+
+func (h *menuHandler) Delete(w http.ResponseWriter, r *http.Request) {
+	matches := menuItemRe.FindStringSubmatch(r.URL.Path)
+	item, _ := h.menu.get(matches[1])
+	if !h.menu.delete(matches[1]) {
+		notFound(w, r)
+		return
+	}
+	h.removeImage(r.Context(), item.ID, item.Image)
+	w.WriteHeader(http.StatusNoContent)
+}
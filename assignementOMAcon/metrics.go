@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	openMetricsMediaType = "application/openmetrics-text"
+	// promTextMediaType is the older Prometheus text format, which scrapers
+	// that do not ask for OpenMetrics get. The two only differ in the
+	// content type for the metrics served here.
+	promTextMediaType = "text/plain; version=0.0.4; charset=utf-8"
+)
+
+var metricLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// metricSample is one value of a metric family. labels alternate names and
+// values.
+type metricSample struct {
+	labels []string
+	value  float64
+}
+
+// metricFamily is a gauge and its samples.
+type metricFamily struct {
+	name    string
+	help    string
+	samples []metricSample
+}
+
+func (f metricFamily) write(b *bytes.Buffer) {
+	fmt.Fprintf(b, "# TYPE %s gauge\n# HELP %s %s\n", f.name, f.name, f.help)
+	sort.Slice(f.samples, func(i, j int) bool {
+		return strings.Join(f.samples[i].labels, "\x00") < strings.Join(f.samples[j].labels, "\x00")
+	})
+	for _, s := range f.samples {
+		b.WriteString(f.name)
+		for i := 0; i+1 < len(s.labels); i += 2 {
+			sep := ","
+			if i == 0 {
+				sep = "{"
+			}
+			fmt.Fprintf(b, `%s%s="%s"`, sep, s.labels[i], metricLabelEscaper.Replace(s.labels[i+1]))
+		}
+		if len(s.labels) > 0 {
+			b.WriteString("}")
+		}
+		b.WriteString(" " + strconv.FormatFloat(s.value, 'g', -1, 64) + "\n")
+	}
+}
+
+// gauges accumulates samples by label set, for families whose samples are
+// counted up order by order.
+type gauges struct {
+	labels map[string][]string
+	values map[string]float64
+}
+
+func newGauges() *gauges {
+	return &gauges{labels: map[string][]string{}, values: map[string]float64{}}
+}
+
+func (g *gauges) add(v float64, labels ...string) {
+	key := strings.Join(labels, "\x00")
+	g.labels[key] = labels
+	g.values[key] += v
+}
+
+func (g *gauges) family(name, help string) metricFamily {
+	f := metricFamily{name: name, help: help}
+	for key := range g.labels {
+		f.samples = append(f.samples, metricSample{labels: g.labels[key], value: g.values[key]})
+	}
+	return f
+}
+
+// isOpen reports whether an order is still being dealt with: not yet both
+// served and paid, and neither voided, refunded nor closed with the day.
+func isOpen(o order) bool {
+	if o.Locked || isVoided(o) || isRefunded(o) {
+		return false
+	}
+	return !isPaid(o) || o.Status != statusServed
+}
+
+type metricsHandler struct {
+	store    *datastore
+	kitchen  *kitchenHandler
+	sessions *sessionStore
+}
+
+// ServeHTTP serves business gauges in the OpenMetrics text format, for
+// alerting on the state of the restaurant rather than only on errors:
+//
+//	orders_open                      open orders, by location and status
+//	orders_payment_pending           unpaid orders, by location
+//	orders_payment_pending_amount    what those orders are still owed
+//	kitchen_queue_tickets            unbumped tickets, by station and status
+//	kitchen_ticket_age_seconds_avg   mean age of fired tickets, by station
+//	kitchen_ticket_age_seconds_max   age of the oldest fired ticket
+//
+// Every status is reported for the default location, so alerts see zeros
+// rather than missing series. Scrapers need orders:manage, for example
+// through a manager API key sent as a bearer token.
+func (h *metricsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte("method not allowed"))
+		return
+	}
+	if _, ok := h.sessions.requireScope(w, r, "orders:manage"); !ok {
+		return
+	}
+	now := time.Now().UTC()
+
+	open, pending, owed := newGauges(), newGauges(), newGauges()
+	for _, s := range []orderStatus{statusReceived, statusPreparing, statusReady, statusServed} {
+		open.add(0, "location_id", defaultLocation, "status", string(s))
+	}
+	pending.add(0, "location_id", defaultLocation)
+	owed.add(0, "location_id", defaultLocation)
+	h.store.RLock()
+	for _, o := range h.store.m {
+		if !isOpen(o) {
+			continue
+		}
+		location := o.LocationID
+		if location == "" {
+			location = defaultLocation
+		}
+		status := o.Status
+		if status == "" {
+			status = statusReceived
+		}
+		open.add(1, "location_id", location, "status", string(status))
+		if !isPaid(o) {
+			pending.add(1, "location_id", location)
+			owed.add(float64(o.Total), "location_id", location)
+		}
+	}
+	h.store.RUnlock()
+
+	queue, ages, oldest := newGauges(), map[string]time.Duration{}, map[string]time.Duration{}
+	fired := map[string]int{}
+	for _, t := range h.kitchen.liveTickets() {
+		if t.Status == ticketBumped {
+			continue
+		}
+		queue.add(1, "station", t.Station, "status", t.Status)
+		if t.Status == ticketFired && t.FiredAt != nil {
+			age := now.Sub(*t.FiredAt)
+			ages[t.Station] += age
+			fired[t.Station]++
+			if age > oldest[t.Station] {
+				oldest[t.Station] = age
+			}
+		}
+	}
+	avgAge, maxAge := newGauges(), newGauges()
+	for station, n := range fired {
+		avgAge.add((ages[station] / time.Duration(n)).Seconds(), "station", station)
+		maxAge.add(oldest[station].Seconds(), "station", station)
+	}
+
+	var b bytes.Buffer
+	for _, f := range []metricFamily{
+		open.family("orders_open", "Orders not yet served and paid, nor voided, refunded or closed."),
+		pending.family("orders_payment_pending", "Open orders not yet paid."),
+		owed.family("orders_payment_pending_amount", "Total still owed on open orders not yet paid."),
+		queue.family("kitchen_queue_tickets", "Kitchen tickets not yet bumped."),
+		avgAge.family("kitchen_ticket_age_seconds_avg", "Mean time since fired of tickets not yet bumped."),
+		maxAge.family("kitchen_ticket_age_seconds_max", "Time since fired of the oldest ticket not yet bumped."),
+	} {
+		f.write(&b)
+	}
+	b.WriteString("# EOF\n")
+	if strings.Contains(r.Header.Get("Accept"), openMetricsMediaType) {
+		w.Header().Set("content-type", openMetricsMediaType+"; version=1.0.0; charset=utf-8")
+	} else {
+		w.Header().Set("content-type", promTextMediaType)
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(b.Bytes())
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// middleware wraps a handler with cross-cutting behaviour.
+type middleware func(http.Handler) http.Handler
+
+// defaultMiddlewareOrder lists the chain from outermost to innermost. It can be
+// overridden with the MIDDLEWARE environment variable, but auth cannot be left
+// out.
+var defaultMiddlewareOrder = []string{"requestid", "logging", "paths", "naming", "envelope", "errors", "recovery", "cors", "ratelimit", "auth", "quota"}
+
+// chain applies mws around h so that mws[0] sees the request first.
+func chain(h http.Handler, mws ...middleware) http.Handler {
+	for i := len(mws) - 1; i >= 0; i-- {
+		h = mws[i](h)
+	}
+	return h
+}
+
+// splitList splits a comma-separated list, falling back to def when spec is
+// empty.
+func splitList(spec string, def []string) []string {
+	if strings.TrimSpace(spec) == "" {
+		return def
+	}
+	var names []string
+	for _, name := range strings.Split(spec, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// buildChain resolves names against the available middleware and wraps h.
+func buildChain(h http.Handler, names []string, available map[string]middleware) (http.Handler, error) {
+	mws := make([]middleware, 0, len(names))
+	seen := map[string]bool{}
+	for _, name := range names {
+		mw, ok := available[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown middleware %q", name)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("middleware %q listed twice", name)
+		}
+		seen[name] = true
+		mws = append(mws, mw)
+	}
+	return chain(h, mws...), nil
+}
+
+// statusRecorder captures the status code written by the wrapped handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (rec *statusRecorder) WriteHeader(code int) {
+	rec.status = code
+	rec.ResponseWriter.WriteHeader(code)
+}
+
+func (rec *statusRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	return rec.ResponseWriter.Write(b)
+}
+
+// Hijack hands the connection over for WebSocket upgrades, which are logged
+// as switching protocols.
+func (rec *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := rec.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+	rec.status = http.StatusSwitchingProtocols
+	return hj.Hijack()
+}
+
+// Flush passes flushes through for streamed responses.
+func (rec *statusRecorder) Flush() {
+	if f, ok := rec.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// newLogger builds the server's logger from LOG_LEVEL (debug, info, warn or
+// error) and LOG_FORMAT (text or json).
+func newLogger(w io.Writer, level, format string) (*slog.Logger, error) {
+	var lvl slog.Level
+	if level != "" {
+		if err := lvl.UnmarshalText([]byte(level)); err != nil {
+			return nil, fmt.Errorf("LOG_LEVEL must be debug, info, warn or error, got %q", level)
+		}
+	}
+	opts := &slog.HandlerOptions{Level: lvl}
+	switch format {
+	case "", "text":
+		return slog.New(requestIDHandler{slog.NewTextHandler(w, opts)}), nil
+	case "json":
+		return slog.New(requestIDHandler{slog.NewJSONHandler(w, opts)}), nil
+	}
+	return nil, fmt.Errorf("LOG_FORMAT must be text or json, got %q", format)
+}
+
+// loggingMiddleware logs each request once it is served, at error level for
+// server errors and warn for client errors. The line carries the request ID
+// set by requestIDMiddleware, as do the handlers' own lines about it.
+func loggingMiddleware(logger *slog.Logger) middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			rec := &statusRecorder{ResponseWriter: w}
+			next.ServeHTTP(rec, r)
+			if rec.status == 0 {
+				rec.status = http.StatusOK
+			}
+			level := slog.LevelInfo
+			switch {
+			case rec.status >= 500:
+				level = slog.LevelError
+			case rec.status >= 400:
+				level = slog.LevelWarn
+			}
+			logger.LogAttrs(r.Context(), level, "request",
+				slog.String("method", r.Method),
+				slog.String("path", r.URL.Path),
+				slog.Int("status", rec.status),
+				slog.Duration("latency", time.Since(start)),
+			)
+		})
+	}
+}
+
+// corsMiddleware allows cross-origin requests from origins ("*" for any) and
+// answers preflight requests directly.
+func corsMiddleware(origins []string) middleware {
+	allowed := map[string]bool{}
+	for _, o := range origins {
+		allowed[o] = true
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			origin := r.Header.Get("Origin")
+			if origin != "" && (allowed["*"] || allowed[origin]) {
+				w.Header().Set("Access-Control-Allow-Origin", origin)
+				w.Header().Add("Vary", "Origin")
+				w.Header().Set("Access-Control-Expose-Headers", requestIDHeader+", "+idempotentReplayedHeader+", Retry-After")
+				if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+					w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE, OPTIONS")
+					w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type, "+apiKeyHeader+", "+deviceTokenHeader+", "+envelopeHeader+", "+fieldNamingHeader+", "+requestIDHeader+", "+idempotencyKeyHeader)
+					w.Header().Set("Access-Control-Max-Age", "600")
+					w.WriteHeader(http.StatusNoContent)
+					return
+				}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+type ctxKey int
+
+const (
+	sessionCtxKey ctxKey = iota
+	pathParamsCtxKey
+	requestIDCtxKey
+)
+
+// authMiddleware resolves the request's credentials, if any, and stores the
+// session on the request context. Requests under one of the route rules need
+// its scope; other handlers enforce their own.
+func authMiddleware(sessions *sessionStore, rules *authConfig) middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if rule, ok := rules.rule(r); ok {
+				if _, ok := sessions.requireScope(w, r, rule.Scope); !ok {
+					return
+				}
+			}
+			if sess, ok := sessions.fromRequest(r); ok {
+				r = r.WithContext(context.WithValue(r.Context(), sessionCtxKey, sess))
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func sessionFromContext(ctx context.Context) (session, bool) {
+	sess, ok := ctx.Value(sessionCtxKey).(session)
+	return sess, ok
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"unicode"
+)
+
+const fieldNamingHeader = "X-Field-Naming"
+
+const (
+	namingSnake = "snake"
+	namingCamel = "camel"
+)
+
+// validFieldNaming checks a field_naming, X-Field-Naming or API key setting.
+func validFieldNaming(v string) error {
+	if v != namingSnake && v != namingCamel {
+		return fmt.Errorf("field naming must be snake or camel, got %q", v)
+	}
+	return nil
+}
+
+// snakeToCamel turns order_items into orderItems.
+func snakeToCamel(s string) string {
+	if !strings.Contains(s, "_") {
+		return s
+	}
+	var b strings.Builder
+	upper := false
+	for i, r := range s {
+		switch {
+		case r == '_' && i > 0:
+			upper = true
+		case upper:
+			b.WriteRune(unicode.ToUpper(r))
+			upper = false
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// camelToSnake turns orderItems, and orderID, into order_items and order_id.
+func camelToSnake(s string) string {
+	var b strings.Builder
+	prev := rune(0)
+	for _, r := range s {
+		if unicode.IsUpper(r) {
+			if prev != 0 && (unicode.IsLower(prev) || unicode.IsDigit(prev)) {
+				b.WriteByte('_')
+			}
+			r = unicode.ToLower(r)
+		}
+		b.WriteRune(r)
+		prev = r
+	}
+	return b.String()
+}
+
+// renameKeys rewrites the object keys of a JSON document with rename, leaving
+// values and the order of keys as they are.
+func renameKeys(doc []byte, rename func(string) string) ([]byte, error) {
+	type frame struct {
+		object bool
+		key    bool
+		n      int
+	}
+	dec := json.NewDecoder(bytes.NewReader(doc))
+	dec.UseNumber()
+	var out bytes.Buffer
+	var stack []frame
+	done := func() {
+		if len(stack) == 0 {
+			return
+		}
+		top := &stack[len(stack)-1]
+		top.n++
+		if top.object {
+			top.key = true
+		}
+	}
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		closing := tok == json.Delim('}') || tok == json.Delim(']')
+		if len(stack) > 0 && !closing {
+			top := &stack[len(stack)-1]
+			switch {
+			case top.object && !top.key:
+				out.WriteByte(':')
+			case top.n > 0:
+				out.WriteByte(',')
+			}
+		}
+		switch v := tok.(type) {
+		case json.Delim:
+			out.WriteByte(byte(v))
+			if closing {
+				stack = stack[:len(stack)-1]
+				done()
+			} else {
+				stack = append(stack, frame{object: v == '{', key: v == '{'})
+			}
+			continue
+		case string:
+			isKey := len(stack) > 0 && stack[len(stack)-1].key
+			if isKey {
+				v = rename(v)
+			}
+			b, _ := json.Marshal(v)
+			out.Write(b)
+			if isKey {
+				stack[len(stack)-1].key = false
+				continue
+			}
+		case json.Number:
+			out.WriteString(string(v))
+		default:
+			b, _ := json.Marshal(v)
+			out.Write(b)
+		}
+		done()
+	}
+	return out.Bytes(), nil
+}
+
+// fieldNaming picks the naming for a request: its X-Field-Naming header,
+// then its API key's setting, then the server default.
+func fieldNaming(r *http.Request, sessions *sessionStore, def string) (string, error) {
+	if v := r.Header.Get(fieldNamingHeader); v != "" {
+		return v, validFieldNaming(v)
+	}
+	if sess, ok := sessions.fromRequest(r); ok && sess.FieldNaming != "" {
+		return sess.FieldNaming, nil
+	}
+	return def, nil
+}
+
+// namingMiddleware lets clients use camelCase keys in place of the API's
+// snake_case ones. For a camelCase request the JSON body and query parameter
+// names are rewritten to snake_case before the handler sees them (bodies that
+// are not JSON are left alone), and the keys of a JSON response to
+// camelCase. Only keys change, including the keys
+// of maps, so snake_case data used as a key, such as a tender name, comes
+// back camelCased and is turned back on the way in. Event streams and
+// WebSockets pass through.
+func namingMiddleware(sessions *sessionStore, def string) middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			naming, err := fieldNaming(r, sessions, def)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(err.Error()))
+				return
+			}
+			if naming == namingSnake || r.Header.Get("Accept") == eventStreamMediaType || isWebSocketUpgrade(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if r.URL.RawQuery != "" {
+				q := url.Values{}
+				for k, v := range r.URL.Query() {
+					q[camelToSnake(k)] = v
+				}
+				r.URL.RawQuery = q.Encode()
+			}
+			if r.Body != nil {
+				body, err := io.ReadAll(r.Body)
+				r.Body.Close()
+				if err != nil {
+					w.WriteHeader(http.StatusBadRequest)
+					w.Write([]byte("could not read request body"))
+					return
+				}
+				if renamed, err := renameKeys(body, camelToSnake); err == nil {
+					body = renamed
+				}
+				r.Body = io.NopCloser(bytes.NewReader(body))
+				r.ContentLength = int64(len(body))
+			}
+			rec := &envelopeRecorder{header: w.Header()}
+			next.ServeHTTP(rec, r)
+			if rec.status == 0 {
+				rec.status = http.StatusOK
+			}
+			body := rec.body.Bytes()
+			if strings.Contains(rec.header.Get("content-type"), "json") {
+				if renamed, err := renameKeys(body, snakeToCamel); err == nil {
+					body = renamed
+					rec.header.Del("Content-Length")
+				}
+			}
+			w.WriteHeader(rec.status)
+			w.Write(body)
+		})
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// orderNumbers hands out the short, sequential numbers staff and guests call
+// orders by. The last number is written to a file before it is handed out,
+// so numbers never repeat across restarts; with a daily reset they start
+// again from 1 each (UTC) day. Numbers taken by orders that are then rejected
+// are not reused.
+type orderNumbers struct {
+	path  string
+	daily bool
+	state numberState
+	*sync.Mutex
+}
+
+type numberState struct {
+	Day  string `json:"day,omitempty"`
+	Last int64  `json:"last"`
+}
+
+// newOrderNumbers loads the counter from path, if set; without a path the
+// counter lives in memory only.
+func newOrderNumbers(path string, daily bool) (*orderNumbers, error) {
+	n := &orderNumbers{path: path, daily: daily, Mutex: &sync.Mutex{}}
+	if path == "" {
+		return n, nil
+	}
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return n, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &n.state); err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+// take returns the next number.
+func (n *orderNumbers) take(now time.Time) (int64, error) {
+	n.Lock()
+	defer n.Unlock()
+	next := n.state
+	if day := now.UTC().Format(dateLayout); n.daily && next.Day != day {
+		next = numberState{Day: day}
+	}
+	next.Last++
+	if err := n.save(next); err != nil {
+		return 0, err
+	}
+	n.state = next
+	return next.Last, nil
+}
+
+// orderID is the ID given to an order created without one. Numbers repeat
+// when they reset daily, so the day is part of the ID.
+func (n *orderNumbers) orderID(number int64, now time.Time) string {
+	if n.daily {
+		return now.UTC().Format("20060102") + "-" + strconv.FormatInt(number, 10)
+	}
+	return strconv.FormatInt(number, 10)
+}
+
+// save writes the state to a temporary file and renames it over the old one
+// so a crash cannot leave a half-written counter.
+func (n *orderNumbers) save(s numberState) error {
+	if n.path == "" {
+		return nil
+	}
+	b, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(n.path), filepath.Base(n.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), n.path)
+}
+
+// number gives a new order its number, and an ID if it came without one.
+// Numbers whose ID is taken, such as by an order created with that ID, are
+// skipped, so a generated ID never replaces another order.
+func (n *orderNumbers) number(u *order, taken func(id string) bool) error {
+	now := time.Now()
+	for {
+		num, err := n.take(now)
+		if err != nil {
+			return err
+		}
+		u.Number = num
+		if u.ID != "" {
+			return nil
+		}
+		if id := n.orderID(num, now); !taken(id) {
+			u.ID = id
+			return nil
+		}
+	}
+}
+
+// resume carries on from the highest number of the orders already kept, so
+// that without a counter file numbers do not start again from 1 when the
+// server restarts. With a daily reset only today's orders count.
+func (n *orderNumbers) resume(orders map[string]order, now time.Time) {
+	n.Lock()
+	defer n.Unlock()
+	day := now.UTC().Format(dateLayout)
+	for _, o := range orders {
+		if n.daily {
+			if o.CreatedAt == nil || o.CreatedAt.UTC().Format(dateLayout) != day {
+				continue
+			}
+			if n.state.Day != day {
+				n.state = numberState{Day: day}
+			}
+		}
+		if o.Number > n.state.Last {
+			n.state.Last = o.Number
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"math"
+	"net/http"
+)
+
+// nutrition is per serving. Macros are in grams, sodium in milligrams.
+type nutrition struct {
+	Calories float64 `json:"calories"`
+	ProteinG float64 `json:"protein_g"`
+	CarbsG   float64 `json:"carbs_g"`
+	FatG     float64 `json:"fat_g"`
+	SugarG   float64 `json:"sugar_g,omitempty"`
+	SodiumMg float64 `json:"sodium_mg,omitempty"`
+}
+
+func (n nutrition) valid() bool {
+	for _, v := range []float64{n.Calories, n.ProteinG, n.CarbsG, n.FatG, n.SugarG, n.SodiumMg} {
+		if v < 0 || math.IsNaN(v) || math.IsInf(v, 0) {
+			return false
+		}
+	}
+	return true
+}
+
+func (n *nutrition) add(m nutrition) {
+	n.Calories += m.Calories
+	n.ProteinG += m.ProteinG
+	n.CarbsG += m.CarbsG
+	n.FatG += m.FatG
+	n.SugarG += m.SugarG
+	n.SodiumMg += m.SodiumMg
+}
+
+// orderNutrition totals an order's items. Items that are not on the menu, or
+// have no nutrition recorded, are listed in Unknown so the total is not taken
+// for the whole meal.
+type orderNutrition struct {
+	OrderID string    `json:"order_id"`
+	Total   nutrition `json:"total"`
+	Items   []string  `json:"items"`
+	Unknown []string  `json:"unknown"`
+}
+
+func (s *menuStore) orderNutrition(o order) orderNutrition {
+	out := orderNutrition{OrderID: o.ID, Items: []string{}, Unknown: []string{}}
+	for _, name := range orderItemNames(o) {
+		item, ok := s.byName(name)
+		if !ok || item.Nutrition == nil {
+			out.Unknown = append(out.Unknown, name)
+			continue
+		}
+		out.Total.add(*item.Nutrition)
+		out.Items = append(out.Items, name)
+	}
+	return out
+}
+
+func (h *orderHandler) Nutrition(w http.ResponseWriter, r *http.Request) {
+	if _, ok := h.sessions.requireScope(w, r, "orders:read"); !ok {
+		return
+	}
+	id := pathParam(r, "id")
+	h.store.RLock()
+	o, ok := h.store.m[id]
+	h.store.RUnlock()
+	if !ok {
+		notFound(w, r)
+		return
+	}
+	writeJSON(w, r, http.StatusOK, h.menu.orderNutrition(o))
+}
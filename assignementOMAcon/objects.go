@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var errObjectNotFound = errors.New("object not found")
+
+// object is a stored file and the headers it is served with.
+type object struct {
+	body            []byte
+	contentType     string
+	contentEncoding string
+}
+
+// objectStore is where exports and uploaded files are kept. Keys are
+// slash-separated paths.
+type objectStore interface {
+	put(ctx context.Context, key string, obj object) error
+	// get returns errObjectNotFound for a key that was never put or has been
+	// removed.
+	get(ctx context.Context, key string) (object, error)
+	remove(ctx context.Context, key string) error
+}
+
+// s3Store keeps objects in an S3-compatible bucket, such as AWS S3, MinIO or
+// Google Cloud Storage with HMAC keys, addressed by path and signed with AWS
+// Signature Version 4.
+type s3Store struct {
+	endpoint  string
+	bucket    string
+	region    string
+	accessKey string
+	secretKey string
+	client    *http.Client
+}
+
+// objectStoreConfig locates an S3-compatible bucket: its endpoint, region
+// (default us-east-1) and keys.
+type objectStoreConfig struct {
+	Bucket    string `json:"bucket"`
+	Endpoint  string `json:"endpoint"`
+	Region    string `json:"region"`
+	AccessKey string `json:"access_key"`
+	SecretKey string `json:"secret_key"`
+}
+
+func newS3Store(c objectStoreConfig) (*s3Store, error) {
+	s := &s3Store{
+		endpoint:  strings.TrimRight(c.Endpoint, "/"),
+		bucket:    c.Bucket,
+		region:    c.Region,
+		accessKey: c.AccessKey,
+		secretKey: c.SecretKey,
+		client:    &http.Client{Timeout: time.Minute},
+	}
+	if u, err := url.Parse(s.endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("endpoint must be an http or https URL, got %q", s.endpoint)
+	}
+	if s.accessKey == "" || s.secretKey == "" {
+		return nil, fmt.Errorf("access_key and secret_key are required with a bucket")
+	}
+	if s.region == "" {
+		s.region = "us-east-1"
+	}
+	return s, nil
+}
+
+func (s *s3Store) put(ctx context.Context, key string, obj object) error {
+	req, err := s.request(ctx, http.MethodPut, key, obj.body)
+	if err != nil {
+		return err
+	}
+	if obj.contentType != "" {
+		req.Header.Set("content-type", obj.contentType)
+	}
+	if obj.contentEncoding != "" {
+		req.Header.Set("content-encoding", obj.contentEncoding)
+	}
+	_, _, err = s.do(req, key, obj.body)
+	return err
+}
+
+func (s *s3Store) get(ctx context.Context, key string) (object, error) {
+	req, err := s.request(ctx, http.MethodGet, key, nil)
+	if err != nil {
+		return object{}, err
+	}
+	// Objects are returned as stored, not decompressed on the way.
+	req.Header.Set("accept-encoding", "identity")
+	header, body, err := s.do(req, key, nil)
+	if err != nil {
+		return object{}, err
+	}
+	return object{
+		body:            body,
+		contentType:     header.Get("content-type"),
+		contentEncoding: header.Get("content-encoding"),
+	}, nil
+}
+
+func (s *s3Store) remove(ctx context.Context, key string) error {
+	req, err := s.request(ctx, http.MethodDelete, key, nil)
+	if err != nil {
+		return err
+	}
+	_, _, err = s.do(req, key, nil)
+	return err
+}
+
+func (s *s3Store) request(ctx context.Context, method, key string, body []byte) (*http.Request, error) {
+	segments := strings.Split(key, "/")
+	for i, seg := range segments {
+		segments[i] = url.PathEscape(seg)
+	}
+	return http.NewRequestWithContext(ctx, method,
+		s.endpoint+"/"+url.PathEscape(s.bucket)+"/"+strings.Join(segments, "/"), bytes.NewReader(body))
+}
+
+// do signs and sends req, returning the response's headers and body. A 404
+// is errObjectNotFound.
+func (s *s3Store) do(req *http.Request, key string, body []byte) (http.Header, []byte, error) {
+	s.sign(req, body, time.Now().UTC())
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil, errObjectNotFound
+	}
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, nil, fmt.Errorf("%s %s returned %s: %s", strings.ToLower(req.Method), key, resp.Status, bytes.TrimSpace(msg))
+	}
+	b, err := io.ReadAll(resp.Body)
+	return resp.Header, b, err
+}
+
+// sign adds an AWS Signature Version 4 authorization to req.
+func (s *s3Store) sign(req *http.Request, body []byte, now time.Time) {
+	day, stamp := now.Format("20060102"), now.Format("20060102T150405Z")
+	payload := sha256.Sum256(body)
+	req.Header.Set("x-amz-date", stamp)
+	req.Header.Set("x-amz-content-sha256", hex.EncodeToString(payload[:]))
+	var names []string
+	var headers strings.Builder
+	for _, name := range []string{"content-encoding", "content-type", "host", "x-amz-content-sha256", "x-amz-date"} {
+		v := req.Header.Get(name)
+		if name == "host" {
+			v = req.URL.Host
+		}
+		if v == "" {
+			continue
+		}
+		names = append(names, name)
+		headers.WriteString(name + ":" + strings.TrimSpace(v) + "\n")
+	}
+	signed := strings.Join(names, ";")
+	canonical := strings.Join([]string{
+		req.Method, req.URL.EscapedPath(), req.URL.RawQuery, headers.String(), signed, hex.EncodeToString(payload[:]),
+	}, "\n")
+	scope := day + "/" + s.region + "/s3/aws4_request"
+	hashed := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + stamp + "\n" + scope + "\n" + hex.EncodeToString(hashed[:])
+	key := []byte("AWS4" + s.secretKey)
+	for _, part := range []string{day, s.region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	req.Header.Set("authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKey, scope, signed, hex.EncodeToString(hmacSHA256(key, toSign))))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// diskStore keeps objects as files under dir. It records nothing beside the
+// body, so an object's content type comes from its key's extension and a .gz
+// key is served gzip-encoded.
+type diskStore struct {
+	dir string
+}
+
+func (s *diskStore) path(key string) (string, error) {
+	p := filepath.Join(s.dir, filepath.FromSlash(key))
+	if !strings.HasPrefix(p, filepath.Clean(s.dir)+string(filepath.Separator)) {
+		return "", fmt.Errorf("object key %q is outside the store", key)
+	}
+	return p, nil
+}
+
+func (s *diskStore) put(ctx context.Context, key string, obj object) error {
+	p, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		return err
+	}
+	// Write beside the target and rename so readers never see half a file.
+	tmp, err := os.CreateTemp(filepath.Dir(p), ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(obj.body); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), p)
+}
+
+func (s *diskStore) get(ctx context.Context, key string) (object, error) {
+	p, err := s.path(key)
+	if err != nil {
+		return object{}, err
+	}
+	body, err := os.ReadFile(p)
+	if errors.Is(err, fs.ErrNotExist) {
+		return object{}, errObjectNotFound
+	}
+	if err != nil {
+		return object{}, err
+	}
+	obj := object{body: body}
+	ext := filepath.Ext(key)
+	if ext == ".gz" {
+		obj.contentEncoding = "gzip"
+		ext = filepath.Ext(strings.TrimSuffix(key, ext))
+	}
+	obj.contentType = mime.TypeByExtension(ext)
+	return obj, nil
+}
+
+func (s *diskStore) remove(ctx context.Context, key string) error {
+	p, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	// Tidy up the directories the key emptied; removing one that still has
+	// files fails, which ends the walk.
+	root := filepath.Clean(s.dir)
+	for dir := filepath.Dir(p); dir != root && os.Remove(dir) == nil; dir = filepath.Dir(dir) {
+	}
+	return nil
+}
@@ -0,0 +1,589 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// odataQuery is the subset of OData query options the orders collection
+// supports: $filter, $orderby, $top, $skip, $select and $count. Fields are the
+// order's JSON keys.
+type odataQuery struct {
+	filter  odataExpr
+	orderBy []odataOrder
+	top     int
+	skip    int
+	selects []string
+	count   bool
+}
+
+type odataOrder struct {
+	field string
+	desc  bool
+}
+
+// hasODataOptions reports whether the query uses any OData option.
+func hasODataOptions(q url.Values) bool {
+	for k := range q {
+		if strings.HasPrefix(k, "$") {
+			return true
+		}
+	}
+	return false
+}
+
+func parseODataQuery(q url.Values) (odataQuery, error) {
+	oq := odataQuery{top: -1}
+	for k := range q {
+		switch k {
+		case "$filter", "$orderby", "$top", "$skip", "$select", "$count":
+		default:
+			if strings.HasPrefix(k, "$") {
+				return odataQuery{}, fmt.Errorf("unsupported query option %s", k)
+			}
+		}
+	}
+	if s := q.Get("$filter"); s != "" {
+		p := &odataParser{tokens: odataTokens(s)}
+		expr, err := p.parseOr()
+		if err == nil && p.pos < len(p.tokens) {
+			err = fmt.Errorf("unexpected %q", p.tokens[p.pos])
+		}
+		if err != nil {
+			return odataQuery{}, fmt.Errorf("$filter: %w", err)
+		}
+		oq.filter = expr
+	}
+	for _, part := range splitList(q.Get("$orderby"), nil) {
+		f := strings.Fields(part)
+		if len(f) > 2 || (len(f) == 2 && f[1] != "asc" && f[1] != "desc") {
+			return odataQuery{}, fmt.Errorf("$orderby: %q must be a field optionally followed by asc or desc", part)
+		}
+		oq.orderBy = append(oq.orderBy, odataOrder{field: f[0], desc: len(f) == 2 && f[1] == "desc"})
+	}
+	for _, opt := range []struct {
+		name string
+		dst  *int
+	}{{"$top", &oq.top}, {"$skip", &oq.skip}} {
+		if v := q.Get(opt.name); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				return odataQuery{}, fmt.Errorf("%s must be a non-negative integer", opt.name)
+			}
+			*opt.dst = n
+		}
+	}
+	oq.selects = splitList(q.Get("$select"), nil)
+	if v := q.Get("$count"); v != "" {
+		c, err := strconv.ParseBool(v)
+		if err != nil {
+			return odataQuery{}, fmt.Errorf("$count must be true or false")
+		}
+		oq.count = c
+	}
+	return oq, nil
+}
+
+// odataResult is the OData JSON shape for a collection.
+type odataResult struct {
+	Count *int                     `json:"@odata.count,omitempty"`
+	Value []map[string]interface{} `json:"value"`
+}
+
+// apply filters, sorts, pages and projects orders.
+func (oq odataQuery) apply(orders []order) odataResult {
+	rows := make([]map[string]interface{}, 0, len(orders))
+	for _, o := range orders {
+		row := orderFields(o)
+		if oq.filter == nil || odataTrue(oq.filter.eval(row)) {
+			rows = append(rows, row)
+		}
+	}
+	// Orders are kept in a map, so fall back to id order to keep pages stable.
+	orderBy := oq.orderBy
+	if len(orderBy) == 0 {
+		orderBy = []odataOrder{{field: "id"}}
+	}
+	sort.SliceStable(rows, func(i, j int) bool {
+		for _, ob := range orderBy {
+			c := odataCompare(rows[i][ob.field], rows[j][ob.field])
+			if c != 0 {
+				return (c < 0) != ob.desc
+			}
+		}
+		return false
+	})
+	res := odataResult{}
+	if oq.count {
+		n := len(rows)
+		res.Count = &n
+	}
+	rows = rows[minInt(oq.skip, len(rows)):]
+	if oq.top >= 0 && oq.top < len(rows) {
+		rows = rows[:oq.top]
+	}
+	if len(oq.selects) > 0 {
+		for i, row := range rows {
+			picked := map[string]interface{}{}
+			for _, f := range oq.selects {
+				if v, ok := row[f]; ok {
+					picked[f] = v
+				}
+			}
+			rows[i] = picked
+		}
+	}
+	res.Value = rows
+	return res
+}
+
+// orderFields is the order as its JSON fields. Numbers are float64.
+func orderFields(o order) map[string]interface{} {
+	fields := map[string]interface{}{}
+	if b, err := json.Marshal(o); err == nil {
+		json.Unmarshal(b, &fields)
+	}
+	return fields
+}
+
+// writeOData answers an OData query over orders. ?offset= and ?limit= stand
+// in for $skip and $top when those are not given, and pages are held to the
+// caller's page limits as the other lists are. A $filter comparing a field
+// with a literal of another type fails validation.
+func (h *orderHandler) writeOData(w http.ResponseWriter, r *http.Request, orders []order, listing orderListing) {
+	oq, err := parseODataQuery(r.URL.Query())
+	var mismatch *odataTypeError
+	switch {
+	case errors.As(err, &mismatch):
+		validationFailed(w, r, []fieldError{{Field: "$filter", Message: mismatch.Error()}})
+		return
+	case err != nil:
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if !r.URL.Query().Has("$top") {
+		oq.top = listing.limit
+	}
+	if !r.URL.Query().Has("$skip") {
+		oq.skip = listing.offset
+	}
+	oq.top = h.paging.limits(r, h.sessions).clamp(oq.top)
+	writeJSON(w, r, http.StatusOK, oq.apply(orders))
+}
+
+// odataFieldTypes is the type of each order field as $filter sees it:
+// number, string or boolean, with times as strings. Lists and objects have
+// no type, and are only compared with null.
+var odataFieldTypes = func() map[string]string {
+	types := map[string]string{}
+	t := reflect.TypeOf(order{})
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		ft := f.Type
+		if ft.Kind() == reflect.Ptr {
+			ft = ft.Elem()
+		}
+		switch {
+		case ft == reflect.TypeOf(time.Time{}), ft.Kind() == reflect.String:
+			types[name] = "string"
+		case ft.Kind() == reflect.Bool:
+			types[name] = "boolean"
+		case ft.Kind() >= reflect.Int && ft.Kind() <= reflect.Float64:
+			types[name] = "number"
+		default:
+			types[name] = ""
+		}
+	}
+	return types
+}()
+
+// odataTypeError rejects a $filter that compares field with a literal of
+// another type, or passes the string function fn a field or literal that is
+// not a string.
+type odataTypeError struct {
+	fn, field, want string
+	literal         interface{}
+}
+
+func (e *odataTypeError) Error() string {
+	switch {
+	case e.fn != "" && e.field != "" && e.want == "":
+		return fmt.Sprintf("%s takes strings, and %s is a list or object", e.fn, e.field)
+	case e.fn != "" && e.field != "":
+		return fmt.Sprintf("%s takes strings, and %s is a %s", e.fn, e.field, e.want)
+	case e.fn != "":
+		return fmt.Sprintf("%s takes strings, not %s", e.fn, odataLiteralText(e.literal))
+	case e.want == "":
+		return fmt.Sprintf("%s can only be compared with null", e.field)
+	}
+	return fmt.Sprintf("%s is a %s, not %s", e.field, e.want, odataLiteralText(e.literal))
+}
+
+func odataLiteralText(v interface{}) string {
+	if s, ok := v.(string); ok {
+		return "'" + s + "'"
+	}
+	return fmt.Sprint(v)
+}
+
+// odataType is the type of a literal, as odataFieldTypes names them.
+func odataType(v interface{}) string {
+	switch v.(type) {
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case bool:
+		return "boolean"
+	}
+	return ""
+}
+
+// checkOperands rejects comparing a field with a literal of another type.
+// Numbers may be compared with string fields, which orders use for numbers
+// such as table_number. Fields that orders do not have are left alone: they
+// are null.
+func checkOperands(a, b odataExpr) error {
+	f, ok := a.(odataField)
+	l, isLit := b.(odataLiteral)
+	if !ok || !isLit {
+		if f, ok = b.(odataField); ok {
+			l, isLit = a.(odataLiteral)
+		}
+	}
+	if !ok || !isLit || l.v == nil {
+		return nil
+	}
+	want, known := odataFieldTypes[string(f)]
+	got := odataType(l.v)
+	if !known || got == want || (want == "string" && got == "number") {
+		return nil
+	}
+	return &odataTypeError{field: string(f), want: want, literal: l.v}
+}
+
+// odataExpr is a node of a parsed $filter expression. eval returns a bool,
+// float64, string or nil.
+type odataExpr interface {
+	eval(row map[string]interface{}) interface{}
+}
+
+type odataField string
+
+func (f odataField) eval(row map[string]interface{}) interface{} {
+	return row[string(f)]
+}
+
+type odataLiteral struct {
+	v interface{}
+}
+
+func (l odataLiteral) eval(row map[string]interface{}) interface{} {
+	return l.v
+}
+
+type odataBinary struct {
+	op          string
+	left, right odataExpr
+}
+
+func (b odataBinary) eval(row map[string]interface{}) interface{} {
+	switch b.op {
+	case "and":
+		return odataTrue(b.left.eval(row)) && odataTrue(b.right.eval(row))
+	case "or":
+		return odataTrue(b.left.eval(row)) || odataTrue(b.right.eval(row))
+	}
+	l, r := b.left.eval(row), b.right.eval(row)
+	if l == nil || r == nil {
+		switch b.op {
+		case "eq":
+			return l == nil && r == nil
+		case "ne":
+			return (l == nil) != (r == nil)
+		}
+		return false
+	}
+	c := odataCompare(l, r)
+	switch b.op {
+	case "eq":
+		return c == 0
+	case "ne":
+		return c != 0
+	case "gt":
+		return c > 0
+	case "ge":
+		return c >= 0
+	case "lt":
+		return c < 0
+	case "le":
+		return c <= 0
+	}
+	return false
+}
+
+type odataNot struct {
+	expr odataExpr
+}
+
+func (n odataNot) eval(row map[string]interface{}) interface{} {
+	return !odataTrue(n.expr.eval(row))
+}
+
+// odataCall is one of the string functions contains, startswith and
+// endswith. Matching ignores case.
+type odataCall struct {
+	fn          string
+	left, right odataExpr
+}
+
+func (c odataCall) eval(row map[string]interface{}) interface{} {
+	l, ok1 := c.left.eval(row).(string)
+	r, ok2 := c.right.eval(row).(string)
+	if !ok1 || !ok2 {
+		return false
+	}
+	l, r = strings.ToLower(l), strings.ToLower(r)
+	switch c.fn {
+	case "contains":
+		return strings.Contains(l, r)
+	case "startswith":
+		return strings.HasPrefix(l, r)
+	default:
+		return strings.HasSuffix(l, r)
+	}
+}
+
+func odataTrue(v interface{}) bool {
+	b, ok := v.(bool)
+	return ok && b
+}
+
+// odataCompare orders two values: numbers numerically, anything else by its
+// text. nil sorts first.
+func odataCompare(a, b interface{}) int {
+	switch {
+	case a == nil && b == nil:
+		return 0
+	case a == nil:
+		return -1
+	case b == nil:
+		return 1
+	}
+	if x, ok := odataNumber(a); ok {
+		if y, ok := odataNumber(b); ok {
+			switch {
+			case x < y:
+				return -1
+			case x > y:
+				return 1
+			}
+			return 0
+		}
+	}
+	return strings.Compare(fmt.Sprint(a), fmt.Sprint(b))
+}
+
+// odataNumber reads numbers, including the numeric strings orders use for
+// fields such as table_number.
+func odataNumber(v interface{}) (float64, bool) {
+	switch v := v.(type) {
+	case float64:
+		return v, true
+	case string:
+		n, err := strconv.ParseFloat(v, 64)
+		return n, err == nil
+	}
+	return 0, false
+}
+
+// odataTokens splits a $filter into identifiers, numbers, quoted strings
+// (kept with their quotes) and punctuation.
+func odataTokens(s string) []string {
+	var out []string
+	rs := []rune(s)
+	for i := 0; i < len(rs); {
+		switch c := rs[i]; {
+		case unicode.IsSpace(c):
+			i++
+		case c == '(' || c == ')' || c == ',':
+			out = append(out, string(c))
+			i++
+		case c == '\'':
+			j := i + 1
+			for j < len(rs) {
+				if rs[j] == '\'' {
+					if j+1 < len(rs) && rs[j+1] == '\'' {
+						j += 2
+						continue
+					}
+					break
+				}
+				j++
+			}
+			out = append(out, string(rs[i:minInt(j+1, len(rs))]))
+			i = j + 1
+		default:
+			j := i
+			for j < len(rs) && !unicode.IsSpace(rs[j]) && !strings.ContainsRune("(),'", rs[j]) {
+				j++
+			}
+			out = append(out, string(rs[i:j]))
+			i = j
+		}
+	}
+	return out
+}
+
+type odataParser struct {
+	tokens []string
+	pos    int
+}
+
+func (p *odataParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *odataParser) next() string {
+	t := p.peek()
+	p.pos++
+	return t
+}
+
+func (p *odataParser) expect(t string) error {
+	if got := p.next(); got != t {
+		return fmt.Errorf("expected %q, got %q", t, got)
+	}
+	return nil
+}
+
+func (p *odataParser) parseOr() (odataExpr, error) {
+	left, err := p.parseAnd()
+	for err == nil && p.peek() == "or" {
+		p.next()
+		var right odataExpr
+		if right, err = p.parseAnd(); err == nil {
+			left = odataBinary{op: "or", left: left, right: right}
+		}
+	}
+	return left, err
+}
+
+func (p *odataParser) parseAnd() (odataExpr, error) {
+	left, err := p.parseUnary()
+	for err == nil && p.peek() == "and" {
+		p.next()
+		var right odataExpr
+		if right, err = p.parseUnary(); err == nil {
+			left = odataBinary{op: "and", left: left, right: right}
+		}
+	}
+	return left, err
+}
+
+func (p *odataParser) parseUnary() (odataExpr, error) {
+	if p.peek() == "not" {
+		p.next()
+		e, err := p.parseUnary()
+		return odataNot{expr: e}, err
+	}
+	if p.peek() == "(" {
+		p.next()
+		e, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		return e, p.expect(")")
+	}
+	switch fn := p.peek(); fn {
+	case "contains", "startswith", "endswith":
+		p.next()
+		if err := p.expect("("); err != nil {
+			return nil, err
+		}
+		left, err := p.parseOperand()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(","); err != nil {
+			return nil, err
+		}
+		right, err := p.parseOperand()
+		if err != nil {
+			return nil, err
+		}
+		for _, operand := range []odataExpr{left, right} {
+			switch o := operand.(type) {
+			case odataField:
+				if want, ok := odataFieldTypes[string(o)]; ok && want != "string" {
+					return nil, &odataTypeError{fn: fn, field: string(o), want: want}
+				}
+			case odataLiteral:
+				if odataType(o.v) != "string" {
+					return nil, &odataTypeError{fn: fn, literal: o.v}
+				}
+			}
+		}
+		return odataCall{fn: fn, left: left, right: right}, p.expect(")")
+	}
+	left, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+	op := p.next()
+	switch op {
+	case "eq", "ne", "gt", "ge", "lt", "le":
+	default:
+		return nil, fmt.Errorf("expected a comparison operator, got %q", op)
+	}
+	right, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+	if err := checkOperands(left, right); err != nil {
+		return nil, err
+	}
+	return odataBinary{op: op, left: left, right: right}, nil
+}
+
+// parseOperand reads a field name or a literal: a quoted string, a number,
+// true, false or null.
+func (p *odataParser) parseOperand() (odataExpr, error) {
+	t := p.next()
+	switch {
+	case t == "":
+		return nil, fmt.Errorf("unexpected end of expression")
+	case strings.HasPrefix(t, "'"):
+		if len(t) < 2 || !strings.HasSuffix(t, "'") {
+			return nil, fmt.Errorf("unterminated string %s", t)
+		}
+		return odataLiteral{v: strings.ReplaceAll(t[1:len(t)-1], "''", "'")}, nil
+	case t == "true" || t == "false":
+		return odataLiteral{v: t == "true"}, nil
+	case t == "null":
+		return odataLiteral{v: nil}, nil
+	}
+	if n, err := strconv.ParseFloat(t, 64); err == nil {
+		return odataLiteral{v: n}, nil
+	}
+	for _, c := range t {
+		if !unicode.IsLetter(c) && !unicode.IsDigit(c) && c != '_' {
+			return nil, fmt.Errorf("unexpected %q", t)
+		}
+	}
+	return odataField(t), nil
+}
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// apiOperation documents one endpoint for /openapi.json. body and response
+// are zero values of the types read and written, or nil when the endpoint
+// takes or returns no JSON, or one the spec leaves as a free-form object.
+type apiOperation struct {
+	method   string
+	path     string
+	tag      string
+	summary  string
+	scope    string
+	query    []string
+	body     interface{}
+	response interface{}
+	status   int
+}
+
+// apiOperations describes the endpoints outside the order router, and adds
+// summaries and types to the routes it has. Order routes missing here are
+// still listed in the spec, read from the router itself.
+var apiOperations = []apiOperation{
+	{method: http.MethodPost, path: "/auth/pin", tag: "auth", summary: "Sign in with a staff PIN", body: pinLoginRequest{}, response: session{}},
+
+	{method: http.MethodGet, path: "/orders", tag: "orders", summary: "List orders", scope: "orders:read",
+		query: []string{"channel", "payment", "status", "table", "q", "sort", "offset", "limit", "since"}, response: []order{}},
+	{method: http.MethodPost, path: "/orders", tag: "orders", summary: "Create an order", scope: "orders:write", body: order{}, response: order{}, status: http.StatusCreated},
+	{method: http.MethodPost, path: "/orders/import", tag: "orders", summary: "Create many orders from JSON or CSV, all or none", scope: "orders:manage", body: []order{}, response: orderImportReport{}},
+	{method: http.MethodGet, path: "/orders/export", tag: "orders", summary: "Download orders as CSV or Excel, one row per order line", scope: "orders:manage", query: []string{"format", "from", "to"}},
+	{method: http.MethodGet, path: "/orders/search", tag: "orders", summary: "Search orders by customer name, item and table, ranked and highlighted", scope: "orders:read",
+		query: []string{"q", "payment", "status", "table", "offset", "limit"}, response: []orderSearchHit{}},
+	{method: http.MethodGet, path: "/orders/{id}", tag: "orders", summary: "Get an order", scope: "orders:read", query: []string{"include"}, response: order{}},
+	{method: http.MethodPut, path: "/orders/{id}", tag: "orders", summary: "Replace an order; a non-zero version must match the stored one", scope: "orders:write", body: order{}, response: order{}},
+	{method: http.MethodPatch, path: "/orders/{id}", tag: "orders", summary: "Change some fields of an order (JSON Merge Patch)", scope: "orders:write", body: order{}, response: order{}},
+	{method: http.MethodDelete, path: "/orders/{id}", tag: "orders", summary: "Delete an order", scope: "orders:write", status: http.StatusNoContent},
+	{method: http.MethodGet, path: "/orders/{id}/history", tag: "orders", summary: "Every change made to an order, with field diffs", scope: "orders:read", response: []historyEntry{}},
+	{method: http.MethodGet, path: "/orders/{id}/nutrition", tag: "orders", summary: "Nutrition totals for an order", scope: "orders:read", response: orderNutrition{}},
+	{method: http.MethodGet, path: "/orders/{id}/payments", tag: "payments", summary: "List an order's payments", scope: "orders:read", response: paymentsView{}},
+	{method: http.MethodPost, path: "/orders/{id}/payments", tag: "payments", summary: "Add a payment to an order", scope: "orders:write", body: paymentLeg{}, response: paymentsView{}},
+	{method: http.MethodGet, path: "/orders/{id}/voids", tag: "voids", summary: "List an order's void requests", scope: "orders:read", response: []itemVoid{}},
+	{method: http.MethodGet, path: "/orders/{id}/price-overrides", tag: "orders", summary: "List an order's price overrides", scope: "orders:read", response: []priceOverride{}},
+
+	{method: http.MethodGet, path: "/menu", tag: "menu", summary: "List menu items", response: []menuItem{}},
+	{method: http.MethodGet, path: "/menu/{item}", tag: "menu", summary: "Get a menu item", response: menuItem{}},
+	{method: http.MethodPut, path: "/menu/{item}", tag: "menu", summary: "Add or change a menu item", scope: "orders:manage", body: menuItem{}, response: menuItem{}},
+	{method: http.MethodPost, path: "/menu/{item}/image", tag: "menu", summary: "Upload a menu item's image (multipart field image: JPEG, PNG or GIF up to 5 MiB)", scope: "orders:manage", response: menuItem{}},
+	{method: http.MethodGet, path: "/menu/{item}/image/{variant}", tag: "menu", summary: "Get a menu item's image: thumb, small, large or original"},
+	{method: http.MethodDelete, path: "/menu/{item}/image", tag: "menu", summary: "Remove a menu item's image", scope: "orders:manage", status: http.StatusNoContent},
+	{method: http.MethodGet, path: "/menu/search", tag: "menu", summary: "Search the menu", query: []string{"q"}},
+
+	{method: http.MethodGet, path: "/tables", tag: "tables", summary: "List tables with their live status", scope: "orders:read", query: []string{"location"}, response: []tableOverlay{}},
+	{method: http.MethodGet, path: "/tables/{number}", tag: "tables", summary: "Get a table", scope: "orders:read", query: []string{"location"}, response: tableOverlay{}},
+	{method: http.MethodPut, path: "/tables/{number}", tag: "tables", summary: "Add or change a table", scope: "orders:manage", query: []string{"location"}, body: tableInput{}, response: tableOverlay{}},
+	{method: http.MethodDelete, path: "/tables/{number}", tag: "tables", summary: "Remove a table", scope: "orders:manage", query: []string{"location"}, status: http.StatusNoContent},
+	{method: http.MethodGet, path: "/floorplan", tag: "tables", summary: "Get a location's floor plan", scope: "orders:read", query: []string{"location"}, response: floorPlan{}},
+	{method: http.MethodPut, path: "/floorplan", tag: "tables", summary: "Replace a location's floor plan", scope: "orders:manage", query: []string{"location"}, body: floorPlan{}, response: floorPlan{}},
+
+	{method: http.MethodGet, path: "/reservations", tag: "reservations", summary: "List reservations", scope: "orders:write", query: []string{"location"}, response: []reservation{}},
+	{method: http.MethodPost, path: "/reservations", tag: "reservations", summary: "Make a reservation", scope: "orders:write", body: reservation{}, response: reservation{}, status: http.StatusCreated},
+	{method: http.MethodPost, path: "/reservations/{id}/cancel", tag: "reservations", summary: "Cancel a reservation", scope: "orders:write", response: reservation{}},
+
+	{method: http.MethodGet, path: "/customers", tag: "customers", summary: "List customers", scope: "orders:write", response: []customer{}},
+	{method: http.MethodPost, path: "/customers", tag: "customers", summary: "Add a customer", scope: "orders:write", body: customer{}, response: customer{}, status: http.StatusCreated},
+	{method: http.MethodGet, path: "/customers/{id}", tag: "customers", summary: "Get a customer", scope: "orders:write", response: customer{}},
+	{method: http.MethodPost, path: "/giftcards", tag: "giftcards", summary: "Issue a gift card", scope: "orders:manage", response: giftCard{}, status: http.StatusCreated},
+	{method: http.MethodGet, path: "/giftcards/{code}", tag: "giftcards", summary: "Get a gift card", response: giftCard{}},
+	{method: http.MethodPost, path: "/giftcards/{code}/redeem", tag: "giftcards", summary: "Redeem a gift card", scope: "orders:write", response: giftCard{}},
+
+	{method: http.MethodGet, path: "/kitchen/queue", tag: "kitchen", summary: "Outstanding kitchen tickets", scope: "kitchen", query: []string{"station"}, response: []ticket{}},
+	{method: http.MethodGet, path: "/orders/stuck", tag: "kitchen", summary: "Orders stuck in a status", scope: "orders:read", response: []stuckOrder{}},
+	{method: http.MethodGet, path: "/inventory", tag: "inventory", summary: "List stock", scope: "orders:read", response: []inventoryItem{}},
+	{method: http.MethodGet, path: "/inventory/alerts", tag: "inventory", summary: "Items below their threshold", scope: "orders:read", response: []stockAlert{}},
+	{method: http.MethodPut, path: "/inventory/{sku}", tag: "inventory", summary: "Add or change a stock item", scope: "orders:manage", body: inventoryItem{}, response: inventoryItem{}},
+
+	{method: http.MethodPost, path: "/reports/close-day", tag: "reports", summary: "Close the business day and lock its orders", scope: "orders:manage", query: []string{"date"}, response: zReport{}},
+	{method: http.MethodGet, path: "/reports/z/{date}", tag: "reports", summary: "Get a day's Z report", scope: "orders:manage", response: zReport{}},
+	{method: http.MethodGet, path: "/reports/hourly", tag: "reports", summary: "Sales by hour", scope: "orders:manage", query: []string{"date"}, response: hourlyReport{}},
+	{method: http.MethodGet, path: "/reports/sla", tag: "reports", summary: "Time spent in each order stage", scope: "orders:manage", query: []string{"from", "to"}, response: slaReport{}},
+	{method: http.MethodGet, path: "/reports/sales-mix", tag: "reports", summary: "Sales by menu category", scope: "orders:manage", query: []string{"from", "to"}, response: salesMixReport{}},
+	{method: http.MethodGet, path: "/reports/forecast", tag: "reports", summary: "Demand forecast", scope: "orders:manage", query: []string{"horizon", "weeks"}, response: forecast{}},
+	{method: http.MethodGet, path: "/reports/feedback", tag: "reports", summary: "Guest feedback ratings", scope: "orders:manage", query: []string{"from", "to"}, response: feedbackReport{}},
+
+	{method: http.MethodPost, path: "/sync/mutations", tag: "sync", summary: "Upload offline mutations", body: syncUpload{}, response: syncResponse{}},
+	{method: http.MethodGet, path: "/sync", tag: "sync", summary: "Changes since a sync token", query: []string{"since"}, response: deltaResponse{}},
+	{method: http.MethodGet, path: "/track/{token}", tag: "guests", summary: "Order tracking page for guests"},
+	{method: http.MethodGet, path: "/r/{token}", tag: "guests", summary: "Receipt page for guests"},
+	{method: http.MethodGet, path: "/ws/orders", tag: "orders", summary: "Stream order events over a WebSocket", scope: "orders:read", query: []string{"location", "token"}, status: http.StatusSwitchingProtocols},
+
+	{method: http.MethodGet, path: "/healthz", tag: "admin", summary: "Liveness probe", response: healthReport{}},
+	{method: http.MethodGet, path: "/readyz", tag: "admin", summary: "Readiness probe, with the state of the datastore and background workers", response: healthReport{}},
+	{method: http.MethodGet, path: "/metrics", tag: "admin", summary: "Business gauges in the OpenMetrics text format", scope: "orders:manage"},
+	{method: http.MethodGet, path: "/admin/audit", tag: "admin", summary: "List audit entries",
+		query: []string{"offset", "limit"}, scope: "orders:manage", response: []auditEntry{}},
+	{method: http.MethodGet, path: "/admin/settings", tag: "admin", summary: "Get global settings", scope: "orders:manage", response: settings{}},
+	{method: http.MethodGet, path: "/settings", tag: "admin", summary: "Settings in effect at a location", scope: "orders:read", query: []string{"location"}, response: effectiveSettings{}},
+	{method: http.MethodGet, path: "/admin/exports", tag: "admin", summary: "List export runs", scope: "orders:manage", response: []exportRun{}},
+	{method: http.MethodPost, path: "/admin/exports", tag: "admin", summary: "Export a day now", scope: "orders:manage", query: []string{"date"}, response: exportRun{}},
+	{method: http.MethodGet, path: "/admin/report-schedules", tag: "admin", summary: "List report email schedules", scope: "orders:manage", response: []reportSchedule{}},
+	{method: http.MethodGet, path: "/admin/report-schedules/{id}", tag: "admin", summary: "Get a report email schedule", scope: "orders:manage", response: reportSchedule{}},
+	{method: http.MethodPut, path: "/admin/report-schedules/{id}", tag: "admin", summary: "Add or change a report email schedule", scope: "orders:manage", body: reportSchedule{}, response: reportSchedule{}},
+	{method: http.MethodDelete, path: "/admin/report-schedules/{id}", tag: "admin", summary: "Remove a report email schedule", scope: "orders:manage", status: http.StatusNoContent},
+	{method: http.MethodPost, path: "/admin/report-schedules/{id}/send", tag: "admin", summary: "Email a schedule's reports now", scope: "orders:manage", query: []string{"date"}, response: reportSchedule{}},
+	{method: http.MethodPost, path: "/admin/import", tag: "admin", summary: "Import legacy orders", scope: "orders:manage", query: []string{"dry_run"}, body: importRequest{}, response: importReport{}},
+	{method: http.MethodGet, path: "/admin/webhooks/deliveries", tag: "admin", summary: "List webhook deliveries", scope: "orders:manage", query: []string{"status", "platform", "order_id"}, response: []webhookDelivery{}},
+	{method: http.MethodPost, path: "/admin/webhooks/deliveries/{id}/redeliver", tag: "admin", summary: "Redeliver a failed webhook", scope: "orders:manage", response: webhookDelivery{}},
+	{method: http.MethodPost, path: "/admin/links", tag: "admin", summary: "Sign a download link", scope: "orders:manage", response: signedLink{}, status: http.StatusCreated},
+	{method: http.MethodGet, path: "/files/receipts/{id}", tag: "files", summary: "Download a receipt through a signed link", query: []string{"expires", "sig"}},
+	{method: http.MethodGet, path: "/files/exports/{date}/{stream}", tag: "files", summary: "Download an export through a signed link", query: []string{"expires", "sig"}},
+}
+
+// openAPISpec builds the OpenAPI 3 document from apiOperations and the routes
+// of the given routers, with schemas read from the Go types.
+func openAPISpec(ops []apiOperation, routers ...*router) map[string]interface{} {
+	byKey := map[string]apiOperation{}
+	for _, op := range ops {
+		byKey[op.method+" "+op.path] = op
+	}
+	for _, rt := range routers {
+		for _, route := range rt.routes {
+			path := "/" + strings.Join(route.segments, "/")
+			if _, ok := byKey[route.method+" "+path]; !ok {
+				byKey[route.method+" "+path] = apiOperation{method: route.method, path: path, tag: route.segments[0]}
+			}
+		}
+	}
+	keys := make([]string, 0, len(byKey))
+	for k := range byKey {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	s := &schemaSet{components: map[string]interface{}{}}
+	paths := map[string]map[string]interface{}{}
+	for _, k := range keys {
+		op := byKey[k]
+		if paths[op.path] == nil {
+			paths[op.path] = map[string]interface{}{}
+		}
+		paths[op.path][strings.ToLower(op.method)] = s.operation(op)
+	}
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":       "Order management API",
+			"version":     "1.0.0",
+			"description": "Orders, menu, tables and the rest of the restaurant's operations. Most endpoints need a bearer token from POST /auth/pin.",
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"schemas": s.components,
+			"securitySchemes": map[string]interface{}{
+				"bearerAuth": map[string]interface{}{"type": "http", "scheme": "bearer"},
+			},
+		},
+	}
+}
+
+func (s *schemaSet) operation(op apiOperation) map[string]interface{} {
+	out := map[string]interface{}{"tags": []string{op.tag}, "operationId": operationID(op)}
+	if op.summary != "" {
+		out["summary"] = op.summary
+	}
+	var params []interface{}
+	for _, seg := range splitPath(op.path) {
+		if strings.HasPrefix(seg, "{") && strings.HasSuffix(seg, "}") {
+			params = append(params, map[string]interface{}{
+				"name": seg[1 : len(seg)-1], "in": "path", "required": true, "schema": map[string]string{"type": "string"},
+			})
+		}
+	}
+	for _, q := range op.query {
+		params = append(params, map[string]interface{}{"name": q, "in": "query", "schema": map[string]string{"type": "string"}})
+	}
+	if len(params) > 0 {
+		out["parameters"] = params
+	}
+	if op.body != nil || (op.method != http.MethodGet && op.method != http.MethodDelete && op.response != nil) {
+		body := map[string]interface{}{"type": "object"}
+		if op.body != nil {
+			body = s.schema(reflect.TypeOf(op.body))
+		}
+		out["requestBody"] = map[string]interface{}{
+			"required": true,
+			"content":  map[string]interface{}{"application/json": map[string]interface{}{"schema": body}},
+		}
+	}
+	status := op.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	ok := map[string]interface{}{"description": http.StatusText(status)}
+	if op.response != nil {
+		ok["content"] = map[string]interface{}{"application/json": map[string]interface{}{"schema": s.schema(reflect.TypeOf(op.response))}}
+	}
+	responses := map[string]interface{}{strconv.Itoa(status): ok}
+	if _, ok := out["requestBody"]; ok {
+		responses["400"] = map[string]interface{}{
+			"description": "The request is invalid",
+			"content":     map[string]interface{}{"application/json": map[string]interface{}{"schema": s.schema(reflect.TypeOf(apiError{}))}},
+		}
+	}
+	if op.scope != "" {
+		out["security"] = []map[string][]string{{"bearerAuth": {}}}
+		out["description"] = "Requires the " + op.scope + " scope."
+		responses["401"] = map[string]string{"description": "No valid session"}
+		responses["403"] = map[string]string{"description": "The session lacks the " + op.scope + " scope"}
+	}
+	out["responses"] = responses
+	return out
+}
+
+func operationID(op apiOperation) string {
+	var b strings.Builder
+	b.WriteString(strings.ToLower(op.method))
+	for _, seg := range splitPath(op.path) {
+		seg = strings.Trim(seg, "{}")
+		for _, part := range strings.FieldsFunc(seg, func(r rune) bool { return r == '-' || r == '_' || r == '.' }) {
+			b.WriteString(strings.ToUpper(part[:1]) + part[1:])
+		}
+	}
+	return b.String()
+}
+
+// schemaSet turns Go types into JSON schemas, keeping named structs as
+// components referred to by $ref.
+type schemaSet struct {
+	components map[string]interface{}
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+func (s *schemaSet) schema(t reflect.Type) map[string]interface{} {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch {
+	case t == timeType:
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	case t == reflect.TypeOf(json.RawMessage{}):
+		return map[string]interface{}{}
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]interface{}{"type": "string", "format": "byte"}
+		}
+		return map[string]interface{}{"type": "array", "items": s.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": s.schema(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return s.object(t)
+		}
+		name := strings.ToUpper(t.Name()[:1]) + t.Name()[1:]
+		if _, ok := s.components[name]; !ok {
+			s.components[name] = nil
+			s.components[name] = s.object(t)
+		}
+		return map[string]interface{}{"$ref": "#/components/schemas/" + name}
+	}
+	return map[string]interface{}{}
+}
+
+// object is the schema of a struct's JSON fields, with embedded structs'
+// fields folded in as encoding/json does.
+func (s *schemaSet) object(t reflect.Type) map[string]interface{} {
+	props := map[string]interface{}{}
+	var add func(t reflect.Type)
+	add = func(t reflect.Type) {
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			tag := f.Tag.Get("json")
+			if tag == "-" {
+				continue
+			}
+			name := strings.Split(tag, ",")[0]
+			if f.Anonymous && name == "" {
+				ft := f.Type
+				if ft.Kind() == reflect.Ptr {
+					ft = ft.Elem()
+				}
+				if ft.Kind() == reflect.Struct {
+					add(ft)
+				}
+				continue
+			}
+			if !f.IsExported() {
+				continue
+			}
+			if name == "" {
+				name = f.Name
+			}
+			props[name] = s.schema(f.Type)
+		}
+	}
+	add(t)
+	return map[string]interface{}{"type": "object", "properties": props}
+}
+
+// swaggerUIPage loads Swagger UI from a CDN and points it at /openapi.json.
+const swaggerUIPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Order management API</title>
+<link rel="stylesheet" href="https://unpkg.com/swagger-ui-dist@5/swagger-ui.css">
+</head>
+<body>
+<div id="swagger-ui"></div>
+<script src="https://unpkg.com/swagger-ui-dist@5/swagger-ui-bundle.js"></script>
+<script>SwaggerUIBundle({url: "/openapi.json", dom_id: "#swagger-ui"});</script>
+</body>
+</html>
+`
+
+// docsHandler serves the OpenAPI document at /openapi.json and Swagger UI at
+// /docs. The document is built once, when the handler is made.
+type docsHandler struct {
+	spec []byte
+}
+
+func newDocsHandler(routers ...*router) (*docsHandler, error) {
+	spec, err := json.Marshal(openAPISpec(apiOperations, routers...))
+	if err != nil {
+		return nil, err
+	}
+	return &docsHandler{spec: spec}, nil
+}
+
+func (h *docsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		notFound(w, r)
+		return
+	}
+	switch r.URL.Path {
+	case "/openapi.json":
+		w.Header().Set("content-type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(h.spec)
+	case "/docs", "/docs/":
+		w.Header().Set("content-type", "text/html; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(swaggerUIPage))
+	default:
+		notFound(w, r)
+	}
+}
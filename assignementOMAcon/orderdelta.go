@@ -0,0 +1,100 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// orderDelta is what changed in an orders list since the client's ?since=
+// cursor: orders placed since then, orders changed since then, and the IDs of
+// orders that were deleted or no longer pass the list's filters. Removed may
+// name orders the client never had; it can ignore those.
+type orderDelta struct {
+	Seq     int64    `json:"seq"`
+	Reset   bool     `json:"reset,omitempty"`
+	Added   []order  `json:"added"`
+	Changed []order  `json:"changed"`
+	Removed []string `json:"removed"`
+}
+
+// listMatches reports whether o belongs in a list narrowed by ?channel=, ?q=
+// and the listing's filters.
+func listMatches(o order, channel, q string, l orderListing) bool {
+	if channel != "" && o.Channel != channel || !l.keep(o) {
+		return false
+	}
+	return q == "" || fuzzyScore(q, strings.Join(append(orderItemNames(o), o.Name, o.TableNumber), " ")) > 0
+}
+
+// ListDelta answers GET /orders?since=, for dashboards that poll the list:
+// rather than the whole list again they get what changed after the seq of
+// their last response. since=0, or a cursor ahead of the server (after a
+// restart), gets every matching order as added, with reset set in the latter
+// case so the client drops what it has. The list's filters apply; paging does
+// not.
+func (h *orderHandler) ListDelta(w http.ResponseWriter, r *http.Request, listing orderListing) {
+	since, err := strconv.ParseInt(r.URL.Query().Get("since"), 10, 64)
+	if err != nil || since < 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("since must be a non-negative sequence number"))
+		return
+	}
+	if r.URL.Query().Get("offset") != "" || r.URL.Query().Get("limit") != "" {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("since cannot be combined with offset or limit"))
+		return
+	}
+	channel, q := r.URL.Query().Get("channel"), r.URL.Query().Get("q")
+	changes, head := h.feed.since(since)
+	delta := orderDelta{Seq: head, Added: []order{}, Changed: []order{}, Removed: []string{}}
+	if since == 0 || since > head {
+		delta.Reset = since > head
+		h.store.RLock()
+		for _, o := range h.store.m {
+			if listMatches(o, channel, q, listing) {
+				delta.Added = append(delta.Added, o)
+			}
+		}
+		h.store.RUnlock()
+		listing.order(delta.Added, false)
+		writeJSON(w, r, http.StatusOK, delta)
+		return
+	}
+	// Orders placed after the client's last response are new to it.
+	seenAt, _ := h.feed.timeOf(since)
+	h.store.RLock()
+	for _, c := range changes {
+		if c.Kind != kindOrders {
+			continue
+		}
+		o, ok := h.store.m[c.ID]
+		switch {
+		case !ok || c.Deleted || !listMatches(o, channel, q, listing):
+			delta.Removed = append(delta.Removed, c.ID)
+		case o.CreatedAt != nil && o.CreatedAt.After(seenAt):
+			delta.Added = append(delta.Added, o)
+		default:
+			delta.Changed = append(delta.Changed, o)
+		}
+	}
+	h.store.RUnlock()
+	listing.order(delta.Added, false)
+	listing.order(delta.Changed, false)
+	writeJSON(w, r, http.StatusOK, delta)
+}
+
+// timeOf returns when the change at seq was made, if the feed still has it.
+func (f *changeFeed) timeOf(seq int64) (time.Time, bool) {
+	f.RLock()
+	defer f.RUnlock()
+	if len(f.history) == 0 {
+		return time.Time{}, false
+	}
+	i := seq - f.history[0].Seq
+	if i < 0 || i >= int64(len(f.history)) {
+		return time.Time{}, false
+	}
+	return f.history[i].At, true
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/csv"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	exportFormatCSV  = "csv"
+	exportFormatXLSX = "xlsx"
+)
+
+// orderExportColumns head an order export. Each row is one order line with
+// its order's fields repeated; an order without lines gets one row with the
+// line columns empty.
+var orderExportColumns = []string{
+	"order_id", "reference", "created_at", "name", "table_number", "channel", "location_id",
+	"status", "payment", "payment_method", "item", "menu_item_id", "quantity", "unit_price",
+	"line_total", "subtotal", "discount", "tax", "tip", "total",
+}
+
+// orderExportRows flattens o into rows of cells, amounts as decimal major
+// units.
+func orderExportRows(o order) [][]interface{} {
+	created := ""
+	if o.CreatedAt != nil {
+		created = o.CreatedAt.UTC().Format(time.RFC3339)
+	}
+	amount := func(minor int64) float64 { return float64(minor) / 100 }
+	head := []interface{}{o.ID, o.Reference, created, o.Name, o.TableNumber, o.Channel, o.LocationID,
+		string(o.Status), string(o.Payment), o.PaymentMethod}
+	tail := []interface{}{amount(o.Subtotal), amount(o.Discount), amount(o.Tax), amount(o.Tip), amount(o.Total)}
+	lines := o.OrderItems
+	if len(lines) == 0 {
+		lines = orderItems{{}}
+	}
+	rows := make([][]interface{}, 0, len(lines))
+	for _, it := range lines {
+		row := append(append([]interface{}{}, head...), it.Name, it.MenuItemID)
+		if it.Name == "" {
+			row = append(row, "", "", "")
+		} else {
+			row = append(row, it.Quantity, amount(it.UnitPrice), amount(int64(it.Quantity)*it.UnitPrice))
+		}
+		rows = append(rows, append(row, tail...))
+	}
+	return rows
+}
+
+// csvCell writes a cell as CSV text, amounts to two decimal places. Text
+// that a spreadsheet would take for a formula, such as a guest name starting
+// with "=", is quoted with a leading apostrophe.
+func csvCell(c interface{}) string {
+	switch v := c.(type) {
+	case string:
+		if v != "" && strings.ContainsRune("=+-@", rune(v[0])) {
+			return "'" + v
+		}
+		return v
+	case int:
+		return strconv.Itoa(v)
+	case float64:
+		return strconv.FormatFloat(v, 'f', 2, 64)
+	}
+	return ""
+}
+
+// Export streams the orders placed between ?from= and ?to= (inclusive dates,
+// default today) as ?format=csv (the default) or xlsx, oldest first, for
+// managers' end-of-day spreadsheets.
+func (h *orderHandler) Export(w http.ResponseWriter, r *http.Request) {
+	if _, ok := h.sessions.requireScope(w, r, "orders:manage"); !ok {
+		return
+	}
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = exportFormatCSV
+	}
+	if format != exportFormatCSV && format != exportFormatXLSX {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("format must be csv or xlsx"))
+		return
+	}
+	from, to, err := parseDateRange(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	var orders []order
+	h.store.RLock()
+	for _, o := range h.store.m {
+		if o.CreatedAt != nil && !o.CreatedAt.Before(from) && o.CreatedAt.Before(to) {
+			orders = append(orders, o)
+		}
+	}
+	h.store.RUnlock()
+	sort.Slice(orders, func(i, j int) bool {
+		if !orders[i].CreatedAt.Equal(*orders[j].CreatedAt) {
+			return orders[i].CreatedAt.Before(*orders[j].CreatedAt)
+		}
+		return orders[i].ID < orders[j].ID
+	})
+
+	filename := "orders-" + from.Format(dateLayout) + "-to-" + to.AddDate(0, 0, -1).Format(dateLayout) + "." + format
+	w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`"`)
+	if format == exportFormatXLSX {
+		w.Header().Set("content-type", xlsxMediaType)
+		x, err := newXLSXWriter(w, "Orders")
+		if err != nil {
+			return
+		}
+		header := make([]interface{}, len(orderExportColumns))
+		for i, c := range orderExportColumns {
+			header[i] = c
+		}
+		x.writeRow(header...)
+		for _, o := range orders {
+			for _, row := range orderExportRows(o) {
+				if x.writeRow(row...) != nil {
+					return
+				}
+			}
+		}
+		x.Close()
+		return
+	}
+	w.Header().Set("content-type", "text/csv; charset=utf-8")
+	cw := csv.NewWriter(w)
+	cw.Write(orderExportColumns)
+	record := make([]string, len(orderExportColumns))
+	for _, o := range orders {
+		for _, row := range orderExportRows(o) {
+			for i, c := range row {
+				record[i] = csvCell(c)
+			}
+			if cw.Write(record) != nil {
+				return
+			}
+		}
+	}
+	cw.Flush()
+}
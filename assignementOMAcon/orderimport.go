@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	maxOrderImportBytes = 5 << 20
+	maxOrderImportRows  = 1000
+)
+
+// orderImportRow is the outcome for one row, counted from 1 without a CSV
+// header. A row is created, failed, or skipped when it was fine but another
+// row failed.
+type orderImportRow struct {
+	Row     int          `json:"row"`
+	Status  string       `json:"status"`
+	OrderID string       `json:"order_id,omitempty"`
+	Errors  []fieldError `json:"errors,omitempty"`
+}
+
+type orderImportReport struct {
+	Created int              `json:"created"`
+	Failed  int              `json:"failed"`
+	Rows    []orderImportRow `json:"rows"`
+}
+
+// fail marks row i failed with errs.
+func (rep *orderImportReport) fail(i int, errs ...fieldError) {
+	rep.Rows[i].Status = "failed"
+	rep.Rows[i].Errors = append(rep.Rows[i].Errors, errs...)
+}
+
+// failed counts the failed rows and marks the rest skipped.
+func (rep *orderImportReport) failed() bool {
+	rep.Failed = 0
+	for i := range rep.Rows {
+		if rep.Rows[i].Status == "failed" {
+			rep.Failed++
+		}
+	}
+	if rep.Failed == 0 {
+		return false
+	}
+	for i := range rep.Rows {
+		if rep.Rows[i].Status != "failed" {
+			rep.Rows[i].Status = "skipped"
+		}
+	}
+	return true
+}
+
+// importFailed answers an import in which some rows failed, with the report
+// in the error's details.
+func importFailed(w http.ResponseWriter, r *http.Request, rep orderImportReport) {
+	writeError(w, r, http.StatusUnprocessableEntity, "import_failed", fmt.Sprintf("%d of %d orders failed, so none were created", rep.Failed, len(rep.Rows)), rep)
+}
+
+// readOrderImport reads the orders in an import body: a JSON array of orders,
+// a text/csv body, or a multipart/form-data upload with the file in a file
+// field. Rows that cannot be read come back as errors at their index.
+func readOrderImport(r *http.Request) ([]order, map[int][]fieldError, error) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	var data []byte
+	var err error
+	switch mediaType {
+	case "multipart/form-data":
+		file, hdr, ferr := r.FormFile("file")
+		if ferr != nil {
+			return nil, nil, ferr
+		}
+		defer file.Close()
+		if data, err = io.ReadAll(file); err != nil {
+			return nil, nil, err
+		}
+		mediaType, _, _ = mime.ParseMediaType(hdr.Header.Get("Content-Type"))
+		if mediaType != "application/json" && !strings.HasSuffix(strings.ToLower(hdr.Filename), ".json") {
+			mediaType = "text/csv"
+		}
+	default:
+		if data, err = io.ReadAll(r.Body); err != nil {
+			return nil, nil, err
+		}
+	}
+	if mediaType == "text/csv" {
+		return readOrderImportCSV(data)
+	}
+	var raw []json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, nil, fmt.Errorf("body must be a JSON array of orders: %v", err)
+	}
+	orders := make([]order, len(raw))
+	errs := map[int][]fieldError{}
+	for i, doc := range raw {
+		if err := json.NewDecoder(bytes.NewReader(doc)).Decode(&orders[i]); err != nil {
+			errs[i] = []fieldError{{Field: "body", Message: "must be a JSON order: " + err.Error()}}
+		}
+	}
+	return orders, errs, nil
+}
+
+func readOrderImportCSV(data []byte) ([]order, map[int][]fieldError, error) {
+	empty := ""
+	req := &importRequest{Format: importCSV, Data: string(data), IDPrefix: &empty}
+	rows, err := req.rows()
+	if err != nil {
+		return nil, nil, fmt.Errorf("body must be CSV: %v", err)
+	}
+	orders := make([]order, len(rows))
+	errs := map[int][]fieldError{}
+	for i, row := range rows {
+		o := &orders[i]
+		fail := func(field string, err error) {
+			if err != nil {
+				errs[i] = append(errs[i], fieldError{Field: field, Message: err.Error()})
+			}
+		}
+		var payment, partySize string
+		for _, f := range []struct {
+			field string
+			dst   *string
+		}{
+			{"id", &o.ID}, {"name", &o.Name}, {"table_number", &o.TableNumber}, {"party_size", &partySize},
+			{"channel", &o.Channel}, {"location_id", &o.LocationID}, {"payment", &payment},
+			{"payment_method", &o.PaymentMethod},
+		} {
+			*f.dst, err = req.text(row, f.field)
+			fail(f.field, err)
+		}
+		if payment != "" {
+			o.Payment = parsePaymentStatus(payment)
+		}
+		if partySize != "" {
+			if o.PartySize, err = strconv.Atoi(partySize); err != nil {
+				fail("party_size", errors.New("must be a whole number"))
+			}
+		}
+		o.OrderItems, err = req.items(row)
+		fail("items", err)
+	}
+	return orders, errs, nil
+}
+
+// Import creates many orders at once, from a JSON array of orders or a CSV
+// file with the columns id, name, table_number, party_size, channel,
+// location_id, payment, payment_method and items, which lists the items as a
+// legacy import does ("2 x biryani; naan"). Every row is checked as POST
+// /orders would check it, and the orders are only created if all of them
+// pass: otherwise nothing is stored and the 422 error's details hold the
+// report of what was wrong with each row.
+// With a database the orders are written in one transaction. Imported orders
+// are not compared with recent ones for repeats.
+func (h *orderHandler) Import(w http.ResponseWriter, r *http.Request) {
+	if _, ok := h.sessions.requireScope(w, r, "orders:manage"); !ok {
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxOrderImportBytes)
+	orders, readErrs, err := readOrderImport(r)
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.As(err, &tooLarge):
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		w.Write([]byte(fmt.Sprintf("imports must be at most %d bytes", maxOrderImportBytes)))
+		return
+	case err != nil:
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	case len(orders) == 0:
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("import has no orders"))
+		return
+	case len(orders) > maxOrderImportRows:
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		w.Write([]byte(fmt.Sprintf("imports must have at most %d orders", maxOrderImportRows)))
+		return
+	}
+
+	rep := orderImportReport{Rows: make([]orderImportRow, len(orders))}
+	seen := map[string]int{}
+	h.store.RLock()
+	for i := range orders {
+		u := &orders[i]
+		rep.Rows[i] = orderImportRow{Row: i + 1, OrderID: u.ID}
+		if errs, ok := readErrs[i]; ok {
+			rep.fail(i, errs...)
+			continue
+		}
+		defaultChannel(u)
+		defaultPayment(u)
+		unavailable := h.menu.price(order{}, u)
+		tallyItems(u)
+		if errs := append(unavailable, h.validators.validate(*u)...); len(errs) > 0 {
+			rep.fail(i, errs...)
+		}
+		if u.ID == "" {
+			continue
+		}
+		if _, exists := h.store.m[u.ID]; exists {
+			rep.fail(i, fieldError{Field: "id", Message: "order already exists"})
+		} else if first, ok := seen[u.ID]; ok {
+			rep.fail(i, fieldError{Field: "id", Message: fmt.Sprintf("is also used by row %d", first+1)})
+		} else {
+			seen[u.ID] = i
+		}
+	}
+	h.store.RUnlock()
+	if rep.failed() {
+		importFailed(w, r, rep)
+		return
+	}
+
+	for i := range orders {
+		// Generated IDs must not clash with the IDs of other rows either.
+		u, err := h.prepare(r, orders[i], seen)
+		if err != nil {
+			rep.fail(i, fieldError{Field: "order", Message: err.Error()})
+			continue
+		}
+		orders[i] = u
+		seen[u.ID] = i
+		rep.Rows[i].OrderID = u.ID
+	}
+	if rep.failed() {
+		importFailed(w, r, rep)
+		return
+	}
+
+	now := time.Now()
+	h.store.Lock()
+	for i := range orders {
+		if _, exists := h.store.m[orders[i].ID]; exists {
+			rep.fail(i, fieldError{Field: "id", Message: "order already exists"})
+		}
+		orders[i].Locked = false
+		touch(&orders[i], order{}, now)
+	}
+	for i, err := range h.quotas.admit(h.store.m, orders...) {
+		if err != nil {
+			rep.fail(i, fieldError{Field: "location_id", Message: err.Error()})
+		}
+	}
+	if rep.failed() {
+		h.store.Unlock()
+		importFailed(w, r, rep)
+		return
+	}
+	if err := h.store.createAll(orders); err != nil {
+		h.store.Unlock()
+		mutateFailed(w, r, err)
+		return
+	}
+	h.store.Unlock()
+	for i, u := range orders {
+		h.created(r, order{}, u)
+		rep.Rows[i].Status = "created"
+	}
+	rep.Created = len(orders)
+	writeJSON(w, r, http.StatusOK, rep)
+}
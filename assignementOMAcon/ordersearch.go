@@ -0,0 +1,153 @@
+package main
+
+import (
+	"html"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// orderSearchHit is an order found by a search, with how well it matched and
+// where.
+type orderSearchHit struct {
+	Order      order             `json:"order"`
+	Score      float64           `json:"score"`
+	Highlights []searchHighlight `json:"highlights"`
+}
+
+// searchHighlight is a field of the order that matched: its value, and the
+// value as HTML-escaped text with the matching words in <mark> tags, ready to
+// show. Items are reported under the field items, one highlight per item.
+type searchHighlight struct {
+	Field    string `json:"field"`
+	Value    string `json:"value"`
+	Fragment string `json:"fragment"`
+}
+
+// highlight marks the words of value that match a word of query, as
+// fuzzyScore matches them. It reports false when none do.
+func highlight(query []string, value string) (string, bool) {
+	var b strings.Builder
+	found := false
+	last := 0
+	for i := 0; i < len(value); {
+		r, size := utf8.DecodeRuneInString(value[i:])
+		if !isWordRune(r) {
+			i += size
+			continue
+		}
+		end := i + size
+		for end < len(value) {
+			r, size := utf8.DecodeRuneInString(value[end:])
+			if !isWordRune(r) {
+				break
+			}
+			end += size
+		}
+		word := strings.ToLower(value[i:end])
+		for _, q := range query {
+			if wordScore(q, word) > 0 {
+				b.WriteString(html.EscapeString(value[last:i]))
+				b.WriteString("<mark>" + html.EscapeString(value[i:end]) + "</mark>")
+				last, found = end, true
+				break
+			}
+		}
+		i = end
+	}
+	b.WriteString(html.EscapeString(value[last:]))
+	return b.String(), found
+}
+
+// isWordRune reports whether r belongs to a word, as fuzzyWords splits them.
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.IsMark(r)
+}
+
+// searchOrder scores o against q and finds the fields to highlight. A zero
+// score means o does not match.
+func searchOrder(q string, words []string, o order) orderSearchHit {
+	items := orderItemNames(o)
+	hit := orderSearchHit{Order: o, Highlights: []searchHighlight{}}
+	hit.Score = fuzzyScore(q, strings.Join(append(items, o.Name, o.TableNumber), " "))
+	if hit.Score == 0 {
+		return hit
+	}
+	fields := []searchHighlight{{Field: "name", Value: o.Name}, {Field: "table_number", Value: o.TableNumber}}
+	seen := map[string]bool{}
+	for _, item := range items {
+		if !seen[item] {
+			seen[item] = true
+			fields = append(fields, searchHighlight{Field: "items", Value: item})
+		}
+	}
+	for _, f := range fields {
+		if fragment, ok := highlight(words, f.Value); ok {
+			f.Fragment = fragment
+			hit.Highlights = append(hit.Highlights, f)
+		}
+	}
+	return hit
+}
+
+// Search finds orders by customer name, item and table number without
+// knowing their ID. Matching ignores case and forgives typos and unfinished
+// words as ?q= on the list does. Results come best first, newest first among
+// equals, each with the fields that matched highlighted. ?payment=, ?status=
+// and ?table= narrow the search, and ?offset= and ?limit= page it within the
+// caller's page limits, with the full count in X-Total-Count.
+func (h *orderHandler) Search(w http.ResponseWriter, r *http.Request) {
+	q := strings.TrimSpace(r.URL.Query().Get("q"))
+	words := fuzzyWords(q)
+	if len(words) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("q is required"))
+		return
+	}
+	listing, err := parseOrderListing(r.URL.Query(), h.paging.limits(r, h.sessions))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if listing.sort != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("search results are ranked, so sort is not supported"))
+		return
+	}
+	var hits []orderSearchHit
+	h.store.RLock()
+	for _, o := range h.store.m {
+		if !listing.keep(o) {
+			continue
+		}
+		if hit := searchOrder(q, words, o); hit.Score > 0 {
+			hits = append(hits, hit)
+		}
+	}
+	h.store.RUnlock()
+	sort.Slice(hits, func(i, j int) bool {
+		a, b := hits[i], hits[j]
+		if a.Score != b.Score {
+			return a.Score > b.Score
+		}
+		ta, tb := a.Order.CreatedAt, b.Order.CreatedAt
+		if ta != nil && tb != nil && !ta.Equal(*tb) {
+			return ta.After(*tb)
+		}
+		if (ta == nil) != (tb == nil) {
+			return ta != nil
+		}
+		return a.Order.ID < b.Order.ID
+	})
+	w.Header().Set(totalCountHeader, strconv.Itoa(len(hits)))
+	start := minInt(listing.offset, len(hits))
+	end := len(hits)
+	if listing.limit >= 0 {
+		end = minInt(start+listing.limit, end)
+	}
+	writeJSON(w, r, http.StatusOK, append([]orderSearchHit{}, hits[start:end]...))
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// orderStatus is where an order is in being made and brought to the table,
+// apart from how it is paid for.
+type orderStatus string
+
+const (
+	statusReceived  orderStatus = "received"
+	statusPreparing orderStatus = "preparing"
+	statusReady     orderStatus = "ready"
+	statusServed    orderStatus = "served"
+	// statusCancelled is the status a soft-deleted order is left in.
+	statusCancelled orderStatus = "cancelled"
+)
+
+// orderStatusTransitions lists the statuses each status may move to. Orders
+// only move forward, one step at a time, and may be cancelled until they are
+// paid for. Cancelled orders are done with.
+var orderStatusTransitions = map[orderStatus][]orderStatus{
+	statusReceived:  {statusPreparing, statusCancelled},
+	statusPreparing: {statusReady, statusCancelled},
+	statusReady:     {statusServed, statusCancelled},
+	statusServed:    {statusCancelled},
+	statusCancelled: nil,
+}
+
+// orderStatusScopes is the scope needed to move an order into each status:
+// the kitchen starts and finishes orders, floor staff serve them.
+var orderStatusScopes = map[orderStatus]string{
+	statusPreparing: "kitchen",
+	statusReady:     "kitchen",
+	statusServed:    "orders:write",
+}
+
+func (s orderStatus) valid() bool {
+	_, ok := orderStatusTransitions[s]
+	return ok
+}
+
+// canAdvance reports whether an order may go from one status to another.
+// Orders stored before statuses existed may start anywhere.
+func canAdvance(from, to orderStatus) bool {
+	if from == to || from == "" {
+		return true
+	}
+	for _, next := range orderStatusTransitions[from] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+// statusChange records when an order reached a status, and who moved it.
+type statusChange struct {
+	Status  orderStatus `json:"status"`
+	At      time.Time   `json:"at"`
+	StaffID string      `json:"staff_id,omitempty"`
+}
+
+// startStatus marks a new order received, whatever status the client sent.
+// An order created over one that already has a status keeps that status.
+func startStatus(prev order, o *order, staffID string, now time.Time) {
+	if prev.Status != "" {
+		keepStatus(prev, o)
+		return
+	}
+	o.Status = statusReceived
+	o.StatusHistory = []statusChange{{Status: statusReceived, At: now.UTC(), StaffID: staffID}}
+}
+
+// keepStatus carries prev's status over to next. The status only changes
+// through SetStatus.
+func keepStatus(prev order, next *order) {
+	next.Status, next.StatusHistory = prev.Status, prev.StatusHistory
+}
+
+// SetStatus moves an order to the next status in its workflow, recording when
+// and by whom.
+func (h *orderHandler) SetStatus(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Status orderStatus `json:"status"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		decodeFailed(w, r, err)
+		return
+	}
+	req.Status = orderStatus(strings.ToLower(strings.TrimSpace(string(req.Status))))
+	scope, ok := orderStatusScopes[req.Status]
+	if !ok {
+		validationFailed(w, r, []fieldError{{Field: "status", Message: "must be preparing, ready or served"}})
+		return
+	}
+	sess, ok := h.sessions.requireScope(w, r, scope)
+	if !ok {
+		return
+	}
+	o, err := h.mutate(r, pathParam(r, "id"), "order.status", func(o *order) error {
+		if isVoided(*o) {
+			return &badRequestError{msg: "cancelled orders have no status to change"}
+		}
+		if o.Status == req.Status {
+			return &transitionError{field: "status", from: string(o.Status), to: string(req.Status)}
+		}
+		o.Status = req.Status
+		o.StatusHistory = append(append([]statusChange(nil), o.StatusHistory...),
+			statusChange{Status: req.Status, At: time.Now().UTC(), StaffID: sess.StaffID})
+		return nil
+	})
+	if err != nil {
+		mutateFailed(w, r, err)
+		return
+	}
+	writeJSON(w, r, http.StatusOK, o)
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var overrideReportRe = regexp.MustCompile(`^/reports/price-overrides$`)
+
+const (
+	overrideItem  = "item"
+	overrideTotal = "total"
+)
+
+// priceOverride is a manager setting a price by hand: an item's unit price,
+// or the total the guest pays. Original and Price are unit prices for item
+// overrides and totals for total overrides; Amount is how much less the
+// order comes to because of it (negative when the price went up).
+type priceOverride struct {
+	ID       string    `json:"id,omitempty"`
+	OrderID  string    `json:"order_id"`
+	Kind     string    `json:"kind"`
+	Item     string    `json:"item,omitempty"`
+	Quantity int       `json:"quantity,omitempty"`
+	Original int64     `json:"original"`
+	Price    int64     `json:"price"`
+	Amount   int64     `json:"amount"`
+	Reason   string    `json:"reason"`
+	StaffID  string    `json:"staff_id"`
+	At       time.Time `json:"at"`
+}
+
+type overrideStore struct {
+	overrides []priceOverride
+	*sync.RWMutex
+}
+
+func newOverrideStore() *overrideStore {
+	return &overrideStore{RWMutex: &sync.RWMutex{}}
+}
+
+func (s *overrideStore) add(o priceOverride) priceOverride {
+	s.Lock()
+	defer s.Unlock()
+	o.ID = strconv.Itoa(len(s.overrides) + 1)
+	s.overrides = append(s.overrides, o)
+	return o
+}
+
+// list returns the overrides keep accepts, oldest first.
+func (s *overrideStore) list(keep func(priceOverride) bool) []priceOverride {
+	s.RLock()
+	defer s.RUnlock()
+	out := []priceOverride{}
+	for _, o := range s.overrides {
+		if keep(o) {
+			out = append(out, o)
+		}
+	}
+	return out
+}
+
+// keepTotalOverride carries a total override over to next, whose total has
+// otherwise just been worked out again from its items.
+func keepTotalOverride(prev order, next *order) {
+	next.TotalOverride = prev.TotalOverride
+	if next.TotalOverride != nil {
+		next.Total = next.TotalOverride.Price
+	}
+}
+
+// OverridePrice sets an item's unit price ({"item", "unit_price"}) or the
+// order's total ({"total"}) by hand. Only managers may, and they must say why.
+// An item override reprices the line, so promotions and the service charge
+// follow it; a total override replaces the total until another one does.
+func (h *orderHandler) OverridePrice(w http.ResponseWriter, r *http.Request) {
+	sess, ok := h.sessions.requireScope(w, r, "orders:manage")
+	if !ok {
+		return
+	}
+	var req struct {
+		Item      string `json:"item"`
+		UnitPrice *int64 `json:"unit_price"`
+		Total     *int64 `json:"total"`
+		Reason    string `json:"reason"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		decodeFailed(w, r, err)
+		return
+	}
+	var errs []fieldError
+	if strings.TrimSpace(req.Reason) == "" {
+		errs = append(errs, fieldError{Field: "reason", Message: "is required"})
+	}
+	switch {
+	case (req.UnitPrice == nil) == (req.Total == nil):
+		errs = append(errs, fieldError{Field: "total", Message: "give either an item's unit_price or a total"})
+	case req.UnitPrice != nil && req.Item == "":
+		errs = append(errs, fieldError{Field: "item", Message: "is required with unit_price"})
+	case req.UnitPrice != nil && *req.UnitPrice < 0:
+		errs = append(errs, fieldError{Field: "unit_price", Message: "must not be negative"})
+	case req.Total != nil && *req.Total < 0:
+		errs = append(errs, fieldError{Field: "total", Message: "must not be negative"})
+	}
+	if len(errs) > 0 {
+		validationFailed(w, r, errs)
+		return
+	}
+	ov := priceOverride{Reason: strings.TrimSpace(req.Reason), StaffID: sess.StaffID, At: time.Now().UTC()}
+	o, err := h.mutate(r, pathParam(r, "id"), "order.price_override", func(o *order) error {
+		if isFinal(*o) {
+			return &badRequestError{msg: "settled orders cannot be changed"}
+		}
+		before := *o
+		ov.OrderID = o.ID
+		if req.Total != nil {
+			ov.Kind, ov.Original, ov.Price = overrideTotal, o.Total, *req.Total
+			ov.Amount = ov.Original - ov.Price
+			set := ov
+			o.TotalOverride = &set
+			o.Total = ov.Price
+			return nil
+		}
+		line := findLine(*o, req.Item)
+		if line < 0 {
+			return &badRequestError{msg: "the order has no " + req.Item}
+		}
+		items := append(orderItems{}, o.OrderItems...)
+		it := items[line]
+		ov.Kind, ov.Item, ov.Quantity = overrideItem, it.Name, it.Quantity
+		ov.Original, ov.Price = it.UnitPrice, *req.UnitPrice
+		ov.Amount = int64(it.Quantity) * (ov.Original - ov.Price)
+		items[line].UnitPrice = ov.Price
+		o.OrderItems = items
+		tallyItems(o)
+		applyPromotions(h.promotions, before, o, time.Now())
+		applyServiceCharge(h.settings, before, o)
+		keepTotalOverride(before, o)
+		return nil
+	})
+	if err != nil {
+		mutateFailed(w, r, err)
+		return
+	}
+	h.overrides.add(ov)
+	writeJSON(w, r, http.StatusOK, o)
+}
+
+func (h *orderHandler) ListPriceOverrides(w http.ResponseWriter, r *http.Request) {
+	if _, ok := h.sessions.requireScope(w, r, "orders:read"); !ok {
+		return
+	}
+	id := pathParam(r, "id")
+	writeJSON(w, r, http.StatusOK, h.overrides.list(func(o priceOverride) bool { return o.OrderID == id }))
+}
+
+type overrideTotalLine struct {
+	Key    string `json:"key"`
+	Count  int    `json:"count"`
+	Amount int64  `json:"amount"`
+}
+
+// overrideReport covers the prices managers set by hand between From and To.
+// Amount is how much less orders came to because of them.
+type overrideReport struct {
+	From      string              `json:"from"`
+	To        string              `json:"to"`
+	Count     int                 `json:"count"`
+	Amount    int64               `json:"amount"`
+	ByStaff   []overrideTotalLine `json:"by_staff"`
+	ByKind    []overrideTotalLine `json:"by_kind"`
+	Overrides []priceOverride     `json:"overrides"`
+}
+
+// PriceOverrides reports the price overrides made between ?from= and ?to=
+// (inclusive dates, default today), per manager and kind, with each override
+// and its reason.
+func (h *reportHandler) PriceOverrides(w http.ResponseWriter, r *http.Request) {
+	from, to, err := parseDateRange(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	rep := overrideReport{
+		From: from.Format(dateLayout),
+		To:   to.AddDate(0, 0, -1).Format(dateLayout),
+		Overrides: h.overrides.list(func(o priceOverride) bool {
+			return !o.At.Before(from) && o.At.Before(to)
+		}),
+	}
+	byStaff, byKind := map[string]*overrideTotalLine{}, map[string]*overrideTotalLine{}
+	addTo := func(m map[string]*overrideTotalLine, key string, o priceOverride) {
+		if m[key] == nil {
+			m[key] = &overrideTotalLine{Key: key}
+		}
+		m[key].Count++
+		m[key].Amount += o.Amount
+	}
+	for _, o := range rep.Overrides {
+		rep.Count++
+		rep.Amount += o.Amount
+		addTo(byStaff, o.StaffID, o)
+		addTo(byKind, o.Kind, o)
+	}
+	rep.ByStaff, rep.ByKind = sortedOverrides(byStaff), sortedOverrides(byKind)
+	writeJSON(w, r, http.StatusOK, rep)
+}
+
+// sortedOverrides lists totals largest amount first.
+func sortedOverrides(m map[string]*overrideTotalLine) []overrideTotalLine {
+	out := make([]overrideTotalLine, 0, len(m))
+	for _, t := range m {
+		out = append(out, *t)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Amount != out[j].Amount {
+			return out[i].Amount > out[j].Amount
+		}
+		return out[i].Key < out[j].Key
+	})
+	return out
+}
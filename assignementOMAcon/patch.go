@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"time"
+)
+
+const (
+	mergePatchMediaType = "application/merge-patch+json"
+	maxPatchBytes       = 1 << 20
+)
+
+var errPatchInvalid = errors.New("patched order is invalid")
+
+// mergePatch applies a JSON merge patch (RFC 7396) to doc: objects merge key
+// by key, null removes a key, and anything else replaces what was there.
+func mergePatch(doc, patch interface{}) interface{} {
+	p, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	d, ok := doc.(map[string]interface{})
+	if !ok {
+		d = map[string]interface{}{}
+	}
+	for k, v := range p {
+		if v == nil {
+			delete(d, k)
+			continue
+		}
+		d[k] = mergePatch(d[k], v)
+	}
+	return d
+}
+
+// patchOrder applies patch to o. Fields the server owns, and those with
+// endpoints of their own such as payments, the service charge and price
+// overrides, keep their current values whatever the patch says.
+func patchOrder(o order, patch interface{}) (order, error) {
+	b, err := json.Marshal(o)
+	if err != nil {
+		return order{}, err
+	}
+	var doc interface{}
+	if err := json.Unmarshal(b, &doc); err != nil {
+		return order{}, err
+	}
+	if b, err = json.Marshal(mergePatch(doc, patch)); err != nil {
+		return order{}, err
+	}
+	var next order
+	if err := json.Unmarshal(b, &next); err != nil {
+		return order{}, &badRequestError{msg: "patch does not produce a valid order: " + err.Error()}
+	}
+	next.ID, next.Number, next.Reference, next.Channel, next.LocationID = o.ID, o.Number, o.Reference, o.Channel, o.LocationID
+	next.Payments, next.ServiceCharge, next.TotalOverride, next.Locked = o.Payments, o.ServiceCharge, o.TotalOverride, o.Locked
+	next.ReceiptURL, next.TrackingURL, next.DuplicateOf = o.ReceiptURL, o.TrackingURL, o.DuplicateOf
+	next.Version, next.CreatedAt, next.UpdatedAt = o.Version, o.CreatedAt, o.UpdatedAt
+	keepStatus(o, &next)
+	return next, nil
+}
+
+// Patch changes only the fields in the request body, with merge-patch
+// semantics, so a client can set the payment status or move a table without
+// sending the items back.
+func (h *orderHandler) Patch(w http.ResponseWriter, r *http.Request) {
+	if ct := r.Header.Get("content-type"); ct != "" {
+		if mt, _, err := mime.ParseMediaType(ct); err != nil || (mt != mergePatchMediaType && mt != "application/json") {
+			w.WriteHeader(http.StatusUnsupportedMediaType)
+			w.Write([]byte("patches must be " + mergePatchMediaType))
+			return
+		}
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxPatchBytes)
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		bodyReadFailed(w, r, err)
+		return
+	}
+	var patch interface{}
+	if err := json.Unmarshal(body, &patch); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("body must be a JSON merge patch"))
+		return
+	}
+	if _, ok := patch.(map[string]interface{}); !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("body must be a JSON object"))
+		return
+	}
+	var invalid []fieldError
+	o, err := h.mutate(r, pathParam(r, "id"), "order.patch", func(o *order) error {
+		next, err := patchOrder(*o, patch)
+		if err != nil {
+			return err
+		}
+		unavailable := h.menu.price(*o, &next)
+		tallyItems(&next)
+		if invalid = append(unavailable, h.validators.validate(next)...); len(invalid) > 0 {
+			return errPatchInvalid
+		}
+		applyPromotions(h.promotions, *o, &next, time.Now())
+		applyServiceCharge(h.settings, *o, &next)
+		keepTotalOverride(*o, &next)
+		*o = next
+		return nil
+	})
+	if errors.Is(err, errPatchInvalid) {
+		validationFailed(w, r, invalid)
+		return
+	}
+	if err != nil {
+		mutateFailed(w, r, err)
+		return
+	}
+	writeJSON(w, r, http.StatusOK, o)
+}
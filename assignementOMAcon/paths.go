@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+)
+
+const (
+	// pathsLenient serves a request for a non-canonical path as if the
+	// canonical one had been asked for.
+	pathsLenient = "lenient"
+	// pathsStrict redirects it to the canonical path instead.
+	pathsStrict = "strict"
+)
+
+func validPathMode(v string) error {
+	if v != pathsLenient && v != pathsStrict {
+		return fmt.Errorf("path mode must be lenient or strict, got %q", v)
+	}
+	return nil
+}
+
+// canonicalPath is p with repeated slashes collapsed, . and .. resolved and
+// any trailing slash dropped, so /orders/, //orders and /orders/./ are all
+// /orders. A path that mux serves only as a subtree, such as /reports/, keeps
+// its slash: mux would otherwise answer the bare path with a redirect back.
+func canonicalPath(p string, mux *http.ServeMux) string {
+	if p == "" || p[0] != '/' {
+		p = "/" + p
+	}
+	clean := path.Clean(p)
+	if clean == "/" {
+		return clean
+	}
+	probe := &http.Request{Method: http.MethodGet, Host: "localhost", URL: &url.URL{Path: clean}}
+	if _, pattern := mux.Handler(probe); pattern == clean+"/" {
+		return pattern
+	}
+	return clean
+}
+
+// pathMiddleware gives every route one spelling. In lenient mode a request
+// for a non-canonical path is rewritten before the routes see it, so the
+// regex routes match /tables/5/ as they do /tables/5; in strict mode it gets
+// a 308 to the canonical path, which keeps the method and body. Paths with
+// escaped slashes are passed through untouched.
+func pathMiddleware(mode string, mux *http.ServeMux) middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.RawPath != "" || r.Method == http.MethodConnect {
+				next.ServeHTTP(w, r)
+				return
+			}
+			canonical := canonicalPath(r.URL.Path, mux)
+			if canonical == r.URL.Path {
+				next.ServeHTTP(w, r)
+				return
+			}
+			u := *r.URL
+			u.Path = canonical
+			if mode == pathsStrict {
+				http.Redirect(w, r, u.RequestURI(), http.StatusPermanentRedirect)
+				return
+			}
+			r2 := new(http.Request)
+			*r2 = *r
+			r2.URL = &u
+			r2.RequestURI = u.RequestURI()
+			next.ServeHTTP(w, r2)
+		})
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	tenderCash         = "cash"
+	tenderCard         = "card"
+	tenderGiftCard     = "gift_card"
+	tenderStoreCredit  = "store_credit"
+	tenderHouseAccount = "house_account"
+	tenderSplit        = "split"
+)
+
+var tenders = map[string]bool{
+	tenderCash:         true,
+	tenderCard:         true,
+	tenderGiftCard:     true,
+	tenderStoreCredit:  true,
+	tenderHouseAccount: true,
+}
+
+var (
+	errAccountNotFound   = errors.New("account not found")
+	errInsufficientFunds = errors.New("insufficient balance")
+)
+
+// tenderAccount is a balance that payment legs of one method draw on, such as
+// gift cards or customer store credit. The leg's reference names the account.
+type tenderAccount interface {
+	// debit takes amount from the account and returns its canonical reference.
+	debit(ref string, amount int64, orderID, staffID string, now time.Time) (string, error)
+	// refund reverses a debit.
+	refund(ref string, amount int64, orderID, staffID string, now time.Time)
+}
+
+func accountFailed(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, errAccountNotFound):
+		notFound(w, r)
+	case errors.Is(err, errInsufficientFunds):
+		writeError(w, r, http.StatusConflict, "insufficient_funds", err.Error(), nil)
+	default:
+		internalServerError(w, r)
+	}
+}
+
+// paymentLeg is one tender applied to an order. Amounts are in minor currency
+// units; Change is what was handed back when cash overpaid the balance, and
+// Tip is left on top of Amount for the staff. Cash legs name the drawer they
+// went into and record its session.
+type paymentLeg struct {
+	ID            string    `json:"id"`
+	Method        string    `json:"method"`
+	Amount        int64     `json:"amount"`
+	Change        int64     `json:"change,omitempty"`
+	Tip           int64     `json:"tip,omitempty"`
+	Reference     string    `json:"reference,omitempty"`
+	Drawer        string    `json:"drawer,omitempty"`
+	DrawerSession string    `json:"drawer_session,omitempty"`
+	At            time.Time `json:"at"`
+}
+
+// amountPaid sums the order's payment legs net of change.
+func amountPaid(o order) int64 {
+	var paid int64
+	for _, leg := range o.Payments {
+		paid += leg.Amount - leg.Change
+	}
+	return paid
+}
+
+// keepPayments carries prev's payments over to next: its legs, payment
+// status and method, tax and tip. Clients cannot set them on an order they
+// create or replace; they change only as payment legs are recorded.
+func keepPayments(prev order, next *order) {
+	next.Payments, next.Payment, next.PaymentMethod = prev.Payments, prev.Payment, prev.PaymentMethod
+	next.Tax, next.Tip = prev.Tax, prev.Tip
+}
+
+func balanceDue(o order) int64 {
+	if due := o.Total - amountPaid(o); due > 0 {
+		return due
+	}
+	return 0
+}
+
+type paymentsView struct {
+	OrderID    string        `json:"order_id"`
+	Total      int64         `json:"total"`
+	Paid       int64         `json:"paid"`
+	BalanceDue int64         `json:"balance_due"`
+	Payment    paymentStatus `json:"payment"`
+	Legs       []paymentLeg  `json:"legs"`
+}
+
+func newPaymentsView(o order) paymentsView {
+	legs := o.Payments
+	if legs == nil {
+		legs = []paymentLeg{}
+	}
+	return paymentsView{
+		OrderID:    o.ID,
+		Total:      o.Total,
+		Paid:       amountPaid(o),
+		BalanceDue: balanceDue(o),
+		Payment:    o.Payment,
+		Legs:       legs,
+	}
+}
+
+func (h *orderHandler) ListPayments(w http.ResponseWriter, r *http.Request) {
+	id := pathParam(r, "id")
+	h.store.RLock()
+	o, ok := h.store.m[id]
+	h.store.RUnlock()
+	if !ok {
+		notFound(w, r)
+		return
+	}
+	writeJSON(w, r, http.StatusOK, newPaymentsView(o))
+}
+
+// AddPayment records one payment leg. The order is marked paid once its legs
+// cover the total; only cash may exceed the balance, and the excess is
+// recorded as change. A tip on the leg is added to the order's tip. Cash goes
+// into the named drawer, or the only one open; with no drawer open it is
+// taken without one.
+func (h *orderHandler) AddPayment(w http.ResponseWriter, r *http.Request) {
+	orderID := pathParam(r, "id")
+	var leg paymentLeg
+	if err := json.NewDecoder(r.Body).Decode(&leg); err != nil || !tenders[leg.Method] || leg.Amount <= 0 || leg.Tip < 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("a known payment method, a positive amount and a tip of zero or more are required"))
+		return
+	}
+	leg.DrawerSession = ""
+	if leg.Method != tenderCash {
+		leg.Drawer = ""
+	} else if id, ok := h.drawers.forCash(leg.Drawer); ok {
+		leg.DrawerSession = id
+	} else {
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte("cash payments need the name of an open drawer"))
+		return
+	}
+	a := identifyActor(r, h.sessions, h.devices)
+	account, onAccount := h.accounts[leg.Method]
+	if onAccount {
+		// Take the money off the account first so two terminals cannot spend
+		// the same balance; give it back if the order does not accept the leg.
+		if leg.Reference == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(leg.Method + " payments need the account reference"))
+			return
+		}
+		ref, err := account.debit(leg.Reference, leg.Amount, orderID, a.StaffID, time.Now().UTC())
+		if err != nil {
+			accountFailed(w, r, err)
+			return
+		}
+		leg.Reference = ref
+		h.audit.record(auditEntry{Action: leg.Method + ".debit", Ref: ref, OrderID: orderID, StaffID: a.StaffID, DeviceID: a.DeviceID})
+	}
+	o, err := h.mutate(r, orderID, "order.payment", func(o *order) error {
+		return applyPaymentLeg(o, leg, time.Now().UTC())
+	})
+	if err != nil {
+		if onAccount {
+			account.refund(leg.Reference, leg.Amount, orderID, a.StaffID, time.Now().UTC())
+			h.audit.record(auditEntry{Action: leg.Method + ".refund", Ref: leg.Reference, OrderID: orderID, StaffID: a.StaffID, DeviceID: a.DeviceID})
+		}
+		mutateFailed(w, r, err)
+		return
+	}
+	if leg.DrawerSession != "" {
+		added := o.Payments[len(o.Payments)-1]
+		h.drawers.record(leg.DrawerSession, drawerCash{OrderID: orderID, LegID: added.ID, Amount: added.Amount - added.Change + added.Tip, At: added.At})
+	}
+	writeJSON(w, r, http.StatusCreated, newPaymentsView(o))
+}
+
+func applyPaymentLeg(o *order, leg paymentLeg, now time.Time) error {
+	if isPaid(*o) {
+		return &badRequestError{msg: "order is already paid"}
+	}
+	due := balanceDue(*o)
+	if leg.Amount > due {
+		if leg.Method != tenderCash {
+			return &badRequestError{msg: "amount exceeds balance due"}
+		}
+		leg.Change = leg.Amount - due
+	}
+	leg.ID = strconv.Itoa(len(o.Payments) + 1)
+	leg.At = now
+	o.Payments = append(append([]paymentLeg{}, o.Payments...), leg)
+	o.Tip += leg.Tip
+	if balanceDue(*o) == 0 {
+		o.Payment = paymentPaid
+		o.PaymentMethod = leg.Method
+		for _, l := range o.Payments {
+			if l.Method != leg.Method {
+				o.PaymentMethod = tenderSplit
+			}
+		}
+	}
+	return nil
+}
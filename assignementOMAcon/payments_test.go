@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// TestOrderPaymentsServerOwned checks that an order's payments cannot be set
+// by creating or replacing it, only by recording payment legs.
+func TestOrderPaymentsServerOwned(t *testing.T) {
+	s := newTestServer(t)
+	w := do(s, http.MethodPost, "/orders", `{"id":"p1","name":"guest","table_number":"3",
+		"order_items":[{"name":"roti","quantity":2,"unit_price":150}],
+		"payment":"paid","payment_method":"card","tax":-300,"tip":500,
+		"payments":[{"id":"1","method":"card","amount":300}],"receipt_url":"/r/forged"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("create: status %d: %s", w.Code, w.Body)
+	}
+	var o order
+	if err := json.Unmarshal(w.Body.Bytes(), &o); err != nil {
+		t.Fatal(err)
+	}
+	if o.Payment != paymentPending || len(o.Payments) != 0 || o.PaymentMethod != "" ||
+		o.Tax != 0 || o.Tip != 0 || o.ReceiptURL != "" || o.Total != 300 {
+		t.Fatalf("create kept client payment fields: %+v", o)
+	}
+
+	w = do(s, http.MethodPost, "/orders/p1/payments", `{"method":"card","amount":300,"tip":40}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("pay: status %d: %s", w.Code, w.Body)
+	}
+
+	w = do(s, http.MethodPut, "/orders/p1", `{"name":"guest","table_number":"3",
+		"order_items":[{"name":"roti","quantity":2,"unit_price":150}],
+		"payment":"pending","tip":0,"payments":[],"receipt_url":"","tracking_url":""}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("update: status %d: %s", w.Code, w.Body)
+	}
+	o = order{}
+	if err := json.Unmarshal(w.Body.Bytes(), &o); err != nil {
+		t.Fatal(err)
+	}
+	if o.Payment != paymentPaid || len(o.Payments) != 1 || o.Tip != 40 ||
+		o.ReceiptURL == "" || o.TrackingURL == "" {
+		t.Fatalf("update dropped the stored payments or links: %+v", o)
+	}
+}
+
+// TestSetPaymentPaid checks that an order is only marked paid by the payment
+// status endpoint once its legs cover the total.
+func TestSetPaymentPaid(t *testing.T) {
+	s := newTestServer(t)
+	w := do(s, http.MethodPost, "/orders", `{"id":"p2","name":"guest","table_number":"3",
+		"order_items":[{"name":"roti","quantity":1,"unit_price":200}]}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("create: status %d: %s", w.Code, w.Body)
+	}
+	if w := do(s, http.MethodPost, "/orders/p2/payment", `{"status":"paid"}`); w.Code != http.StatusBadRequest {
+		t.Errorf("paid with nothing paid: status %d, want 400: %s", w.Code, w.Body)
+	}
+	if w := do(s, http.MethodPost, "/orders/p2/payment", `{"status":"settled"}`); w.Code != http.StatusBadRequest ||
+		!json.Valid(w.Body.Bytes()) {
+		t.Errorf("unknown status: status %d, want a 400 error body: %s", w.Code, w.Body)
+	}
+	if w := do(s, http.MethodPost, "/orders/p2/payments", `{"method":"card","amount":200}`); w.Code != http.StatusCreated {
+		t.Fatalf("pay: status %d: %s", w.Code, w.Body)
+	}
+	if w := do(s, http.MethodPost, "/orders/p2/payment", `{"status":"refunded"}`); w.Code != http.StatusOK {
+		t.Errorf("refund: status %d: %s", w.Code, w.Body)
+	}
+}
+
+// TestSyncPaymentsServerOwned checks that offline sync cannot set payments
+// either, and that mutation outcomes are forgotten once they expire.
+func TestSyncPaymentsServerOwned(t *testing.T) {
+	s := newTestServer(t)
+	w := do(s, http.MethodPost, "/sync/mutations", `{"client_id":"tab","mutations":[{"mutation_id":"m1","op":"create",
+		"order":{"id":"s1","name":"guest","table_number":"3","order_items":[{"name":"roti","quantity":1,"unit_price":100}],
+		"payment":"paid","tip":500,"payments":[{"id":"1","method":"card","amount":100}],"receipt_url":"/r/forged"}}]}`)
+	var resp syncResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || len(resp.Applied) != 1 {
+		t.Fatalf("sync create: %d %s", w.Code, w.Body)
+	}
+	if o := resp.Applied[0].Order; o.Payment != paymentPending || len(o.Payments) != 0 || o.Tip != 0 || o.ReceiptURL != "" {
+		t.Errorf("sync create kept client payment fields: %+v", o)
+	}
+
+	h := newSyncHandler(s.orders, newChangeFeed())
+	start := time.Now()
+	h.remember(seenMutation{key: "tab/1", at: start})
+	h.remember(seenMutation{key: "tab/2", at: start.Add(syncSeenTTL)})
+	if _, ok := h.seen["tab/1"]; ok || len(h.seen) != 1 || len(h.seenOrder) != 1 {
+		t.Errorf("expired mutation still remembered: %v", h.seen)
+	}
+}
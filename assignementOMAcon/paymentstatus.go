@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// paymentStatus is where an order is in being paid for.
+type paymentStatus string
+
+const (
+	paymentPending    paymentStatus = "pending"
+	paymentAuthorized paymentStatus = "authorized"
+	paymentPaid       paymentStatus = "paid"
+	paymentRefunded   paymentStatus = "refunded"
+	paymentFailed     paymentStatus = "failed"
+)
+
+// paymentTransitions lists the statuses each status may move to. Refunded
+// orders are done with.
+var paymentTransitions = map[paymentStatus][]paymentStatus{
+	paymentPending:    {paymentAuthorized, paymentPaid, paymentFailed},
+	paymentAuthorized: {paymentPaid, paymentFailed},
+	paymentFailed:     {paymentPending, paymentAuthorized, paymentPaid},
+	paymentPaid:       {paymentRefunded},
+	paymentRefunded:   nil,
+}
+
+// paymentAliases are the free-text statuses orders carried before the status
+// was typed; they are still accepted and read as the status they meant.
+var paymentAliases = map[string]paymentStatus{
+	"done": paymentPaid,
+}
+
+// parsePaymentStatus reads a status without regard to case, mapping the old
+// free-text values. Unknown statuses are kept so validation can report them.
+func parsePaymentStatus(s string) paymentStatus {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if p, ok := paymentAliases[s]; ok {
+		return p
+	}
+	return paymentStatus(s)
+}
+
+func (p *paymentStatus) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	*p = parsePaymentStatus(s)
+	return nil
+}
+
+func (p paymentStatus) valid() bool {
+	_, ok := paymentTransitions[p]
+	return ok
+}
+
+// canTransition reports whether an order may go from one status to another.
+// Orders stored before statuses were checked count as pending.
+func canTransition(from, to paymentStatus) bool {
+	if from == "" {
+		from = paymentPending
+	}
+	if from == to {
+		return true
+	}
+	for _, next := range paymentTransitions[from] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+// transitionError rejects a change to a status the current one cannot move
+// to. field is which status: payment or status.
+type transitionError struct {
+	field, from, to string
+}
+
+func (e *transitionError) Error() string {
+	return e.field + " cannot go from " + e.from + " to " + e.to
+}
+
+// checkTransition rejects changes to the payment status or the order status
+// that their state machines do not allow.
+func checkTransition(prev, next order) error {
+	if !canTransition(prev.Payment, next.Payment) {
+		return &transitionError{field: "payment", from: string(prev.Payment), to: string(next.Payment)}
+	}
+	if !canAdvance(prev.Status, next.Status) {
+		return &transitionError{field: "status", from: string(prev.Status), to: string(next.Status)}
+	}
+	return nil
+}
+
+// defaultPayment starts orders created without a status as pending.
+func defaultPayment(o *order) {
+	if o.Payment == "" {
+		o.Payment = paymentPending
+	}
+}
+
+const paymentStatusMessage = "must be pending, authorized, paid, refunded or failed"
+
+func validatePayment(o order) []fieldError {
+	if o.Payment != "" && !o.Payment.valid() {
+		return []fieldError{{Field: "payment", Message: paymentStatusMessage}}
+	}
+	return nil
+}
+
+// SetPayment moves an order to another payment status, if the current one
+// allows it. An order is only paid once payment legs cover its total, so
+// marking one paid that they do not cover is refused.
+func (h *orderHandler) SetPayment(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Status paymentStatus `json:"status"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		decodeFailed(w, r, err)
+		return
+	}
+	if !req.Status.valid() {
+		validationFailed(w, r, []fieldError{{Field: "status", Message: paymentStatusMessage}})
+		return
+	}
+	o, err := h.mutate(r, pathParam(r, "id"), "order.payment_status", func(o *order) error {
+		if req.Status == paymentPaid && o.Payment != paymentPaid && (len(o.Payments) == 0 || balanceDue(*o) > 0) {
+			return &badRequestError{msg: "order is paid once payment legs cover its total; record them at /orders/{id}/payments"}
+		}
+		o.Payment = req.Status
+		return nil
+	})
+	if err != nil {
+		mutateFailed(w, r, err)
+		return
+	}
+	writeJSON(w, r, http.StatusOK, o)
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"context"
+	"os"
+	"time"
+)
+
+// The closing-time plugin rejects new orders after LAST_ORDER_TIME (HH:MM,
+// server local time). It does nothing when the variable is unset.
+func init() {
+	registerPlugin(func(p *pluginHost) {
+		cutoff, err := time.Parse("15:04", os.Getenv("LAST_ORDER_TIME"))
+		if err != nil {
+			return
+		}
+		p.Hooks.OnBeforeCreate(func(ctx context.Context, o *order) error {
+			now := time.Now()
+			if now.Hour()*60+now.Minute() >= cutoff.Hour()*60+cutoff.Minute() {
+				return newRuleError("kitchen is closed for new orders")
+			}
+			return nil
+		})
+	})
+}
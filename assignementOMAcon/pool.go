@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"sync"
+)
+
+// maxPooledListBytes caps the buffers kept for reuse, so one unusually large
+// list does not keep its memory for good.
+const maxPooledListBytes = 4 << 20
+
+// listBuffer is what listing orders needs per request: a slice for the
+// matching orders and an encoder writing into a buffer. Dashboards poll the
+// list every few seconds, so these are reused through listBuffers rather than
+// allocated for each poll.
+type listBuffer struct {
+	orders []order
+	buf    bytes.Buffer
+	enc    *json.Encoder
+}
+
+var listBuffers = sync.Pool{New: func() interface{} {
+	b := &listBuffer{}
+	b.enc = json.NewEncoder(&b.buf)
+	return b
+}}
+
+func getListBuffer() *listBuffer {
+	return listBuffers.Get().(*listBuffer)
+}
+
+// putListBuffer returns b to the pool. Nothing may use its orders or encoded
+// bytes afterwards.
+func putListBuffer(b *listBuffer) {
+	if b.buf.Cap() > maxPooledListBytes {
+		return
+	}
+	// Drop the orders so the pool does not keep them alive.
+	clear(b.orders)
+	b.orders = b.orders[:0]
+	b.buf.Reset()
+	listBuffers.Put(b)
+}
+
+// encode marshals v as json.Marshal would. The bytes are only good until b
+// is used again.
+func (b *listBuffer) encode(v interface{}) ([]byte, error) {
+	b.buf.Reset()
+	if err := b.enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(b.buf.Bytes(), []byte("\n")), nil
+}
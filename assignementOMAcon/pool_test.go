@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// newBenchServer is a test server with a busy evening's worth of orders.
+func newBenchServer(t testing.TB) *server {
+	s := newTestServer(t)
+	s.orders.store.Lock()
+	for i := 0; i < 200; i++ {
+		id := fmt.Sprintf("b%d", i)
+		s.orders.store.m[id] = order{
+			ID:          id,
+			Name:        fmt.Sprintf("guest %d", i),
+			OrderItems:  orderItems{{Name: "roti", Quantity: 2}, {Name: "biryani", Quantity: 1}},
+			TotalItems:  3,
+			Payment:     paymentPending,
+			TableNumber: fmt.Sprint(i%40 + 1),
+		}
+	}
+	s.orders.store.Unlock()
+	return s
+}
+
+// listPooled lists and encodes the orders as List does, with pooled buffers.
+func listPooled(h *orderHandler) int {
+	lb := getListBuffer()
+	defer putListBuffer(lb)
+	lb.orders = h.listOrders(lb.orders[:0], "", "", orderListing{limit: -1})
+	b, err := lb.encode(lb.orders)
+	if err != nil {
+		panic(err)
+	}
+	return len(b)
+}
+
+// listUnpooled is listPooled without the pool: the baseline it is measured
+// against.
+func listUnpooled(h *orderHandler) int {
+	b, err := json.Marshal(h.listOrders(nil, "", "", orderListing{limit: -1}))
+	if err != nil {
+		panic(err)
+	}
+	return len(b)
+}
+
+// BenchmarkList polls the order list as a dashboard does.
+func BenchmarkList(b *testing.B) {
+	s := newBenchServer(b)
+	r := httptest.NewRequest(http.MethodGet, "/orders", nil)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		w := httptest.NewRecorder()
+		s.orders.ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			b.Fatalf("status %d: %s", w.Code, w.Body)
+		}
+	}
+}
+
+// BenchmarkListEncode compares listing with and without the pool.
+func BenchmarkListEncode(b *testing.B) {
+	s := newBenchServer(b)
+	for name, list := range map[string]func(*orderHandler) int{"pooled": listPooled, "unpooled": listUnpooled} {
+		b.Run(name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				list(s.orders)
+			}
+		})
+	}
+}
+
+// TestListPoolAllocs checks that the pool saves the list's allocations.
+func TestListPoolAllocs(t *testing.T) {
+	s := newBenchServer(t)
+	listPooled(s.orders)
+	pooled := testing.AllocsPerRun(50, func() { listPooled(s.orders) })
+	unpooled := testing.AllocsPerRun(50, func() { listUnpooled(s.orders) })
+	if pooled >= unpooled {
+		t.Errorf("pooled list makes %v allocations, unpooled %v", pooled, unpooled)
+	}
+}
@@ -0,0 +1,415 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	listPrintersRe      = regexp.MustCompile(`^/admin/printers/?$`)
+	printerRe           = regexp.MustCompile(`^/admin/printers/([a-z0-9-]+)$`)
+	testPrinterRe       = regexp.MustCompile(`^/admin/printers/([a-z0-9-]+)/test$`)
+	listPrinterGroupsRe = regexp.MustCompile(`^/admin/printer-groups/?$`)
+	printerGroupRe      = regexp.MustCompile(`^/admin/printer-groups/([a-z0-9-]+)$`)
+	listPrintRoutesRe   = regexp.MustCompile(`^/admin/print-routes/?$`)
+	printRouteRe        = regexp.MustCompile(`^/admin/print-routes/([a-z0-9_]+)$`)
+	listPrintJobsRe     = regexp.MustCompile(`^/admin/print-jobs/?$`)
+)
+
+const (
+	// defaultRoute is the route used for stations without one of their own.
+	defaultRoute = "default"
+	// printerRetryAfter is how long a printer that failed is skipped before it
+	// is tried again.
+	printerRetryAfter = 30 * time.Second
+	printTimeout      = 5 * time.Second
+	printJobHistory   = 200
+)
+
+var errNoPrinter = errors.New("no printer available")
+
+type printer struct {
+	ID            string     `json:"id"`
+	Name          string     `json:"name"`
+	Address       string     `json:"address"`
+	Disabled      bool       `json:"disabled,omitempty"`
+	Online        bool       `json:"online"`
+	LastError     string     `json:"last_error,omitempty"`
+	LastCheckedAt *time.Time `json:"last_checked_at,omitempty"`
+}
+
+// printerGroup lists printers in failover order: the first is the primary,
+// the rest are backups.
+type printerGroup struct {
+	ID       string   `json:"id"`
+	Name     string   `json:"name"`
+	Printers []string `json:"printers"`
+}
+
+// printRoute sends a station's tickets to a printer group.
+type printRoute struct {
+	Station string `json:"station"`
+	Group   string `json:"group"`
+}
+
+type printJob struct {
+	ID        string    `json:"id"`
+	Time      time.Time `json:"time"`
+	Station   string    `json:"station"`
+	TicketID  string    `json:"ticket_id,omitempty"`
+	Group     string    `json:"group,omitempty"`
+	PrinterID string    `json:"printer_id,omitempty"`
+	Failover  bool      `json:"failover,omitempty"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// printTransport delivers a rendered document to a printer address.
+type printTransport func(ctx context.Context, address string, doc []byte) error
+
+// rawTCPTransport writes to the printer's raw port (usually 9100), which
+// network receipt printers accept plain text on.
+func rawTCPTransport(ctx context.Context, address string, doc []byte) error {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	_, err = conn.Write(doc)
+	return err
+}
+
+type printerStore struct {
+	printers  map[string]printer
+	groups    map[string]printerGroup
+	routes    map[string]string
+	jobs      []printJob
+	nextJob   int
+	transport printTransport
+	layouts   *layoutStore
+	*sync.RWMutex
+}
+
+func newPrinterStore(transport printTransport, layouts *layoutStore) *printerStore {
+	return &printerStore{
+		printers:  map[string]printer{},
+		groups:    map[string]printerGroup{},
+		routes:    map[string]string{},
+		transport: transport,
+		layouts:   layouts,
+		RWMutex:   &sync.RWMutex{},
+	}
+}
+
+// candidates returns the group for a station and its printers in the order
+// they should be tried. Printers that failed recently are moved to the end so
+// a dead primary does not delay every ticket.
+func (s *printerStore) candidates(station string, now time.Time) (string, []printer) {
+	s.RLock()
+	defer s.RUnlock()
+	groupID, ok := s.routes[station]
+	if !ok {
+		groupID = s.routes[defaultRoute]
+	}
+	var ready, resting []printer
+	for _, id := range s.groups[groupID].Printers {
+		p, ok := s.printers[id]
+		if !ok || p.Disabled {
+			continue
+		}
+		if !p.Online && p.LastCheckedAt != nil && now.Sub(*p.LastCheckedAt) < printerRetryAfter {
+			resting = append(resting, p)
+		} else {
+			ready = append(ready, p)
+		}
+	}
+	return groupID, append(ready, resting...)
+}
+
+func (s *printerStore) markChecked(id string, err error, now time.Time) {
+	s.Lock()
+	defer s.Unlock()
+	p, ok := s.printers[id]
+	if !ok {
+		return
+	}
+	p.Online, p.LastError, p.LastCheckedAt = err == nil, "", &now
+	if err != nil {
+		p.LastError = err.Error()
+	}
+	s.printers[id] = p
+}
+
+func (s *printerStore) send(p printer, doc []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), printTimeout)
+	defer cancel()
+	err := s.transport(ctx, p.Address, doc)
+	s.markChecked(p.ID, err, time.Now().UTC())
+	return err
+}
+
+// print sends doc to the station's printer group, falling back through the
+// group until one printer accepts it, and records the job.
+func (s *printerStore) print(station, ticketID string, doc []byte) printJob {
+	now := time.Now().UTC()
+	groupID, candidates := s.candidates(station, now)
+	job := printJob{Time: now, Station: station, TicketID: ticketID, Group: groupID, Error: errNoPrinter.Error()}
+	if groupID == "" {
+		job.Error = "no print route for station " + station
+	}
+	for i, p := range candidates {
+		if err := s.send(p, doc); err != nil {
+			job.Error = fmt.Sprintf("%s: %v", p.ID, err)
+			continue
+		}
+		job.PrinterID, job.Failover, job.Error = p.ID, i > 0, ""
+		break
+	}
+	return s.recordJob(job)
+}
+
+func (s *printerStore) recordJob(job printJob) printJob {
+	s.Lock()
+	defer s.Unlock()
+	s.nextJob++
+	job.ID = strconv.Itoa(s.nextJob)
+	s.jobs = append(s.jobs, job)
+	if len(s.jobs) > printJobHistory {
+		s.jobs = s.jobs[len(s.jobs)-printJobHistory:]
+	}
+	return job
+}
+
+// printTicket is installed as the kitchen queue's fire callback. Printing
+// happens in the background so a slow printer never holds up the kitchen.
+// Kitchens without any print routes work from the screens alone.
+func (s *printerStore) printTicket(t ticket) {
+	s.RLock()
+	routed := len(s.routes) > 0
+	s.RUnlock()
+	if !routed {
+		return
+	}
+	doc, err := s.layouts.renderTicket(t)
+	if err != nil {
+		s.recordJob(printJob{Time: time.Now().UTC(), Station: t.Station, TicketID: t.ID, Error: err.Error()})
+		return
+	}
+	go s.print(t.Station, t.ID, []byte(doc))
+}
+
+type printerHandler struct {
+	printers *printerStore
+	sessions *sessionStore
+}
+
+func (h *printerHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("content-type", "application/json")
+	if _, ok := h.sessions.requireScope(w, r, "orders:manage"); !ok {
+		return
+	}
+	switch {
+	case r.Method == http.MethodGet && listPrintersRe.MatchString(r.URL.Path):
+		h.ListPrinters(w, r)
+		return
+	case r.Method == http.MethodPut && printerRe.MatchString(r.URL.Path):
+		h.PutPrinter(w, r)
+		return
+	case r.Method == http.MethodDelete && printerRe.MatchString(r.URL.Path):
+		h.deleteFrom(w, r, printerRe, func(id string) bool {
+			_, ok := h.printers.printers[id]
+			delete(h.printers.printers, id)
+			return ok
+		})
+		return
+	case r.Method == http.MethodPost && testPrinterRe.MatchString(r.URL.Path):
+		h.TestPrinter(w, r)
+		return
+	case r.Method == http.MethodGet && listPrinterGroupsRe.MatchString(r.URL.Path):
+		h.ListGroups(w, r)
+		return
+	case r.Method == http.MethodPut && printerGroupRe.MatchString(r.URL.Path):
+		h.PutGroup(w, r)
+		return
+	case r.Method == http.MethodDelete && printerGroupRe.MatchString(r.URL.Path):
+		h.deleteFrom(w, r, printerGroupRe, func(id string) bool {
+			_, ok := h.printers.groups[id]
+			delete(h.printers.groups, id)
+			return ok
+		})
+		return
+	case r.Method == http.MethodGet && listPrintRoutesRe.MatchString(r.URL.Path):
+		h.ListRoutes(w, r)
+		return
+	case r.Method == http.MethodPut && printRouteRe.MatchString(r.URL.Path):
+		h.PutRoute(w, r)
+		return
+	case r.Method == http.MethodDelete && printRouteRe.MatchString(r.URL.Path):
+		h.deleteFrom(w, r, printRouteRe, func(station string) bool {
+			_, ok := h.printers.routes[station]
+			delete(h.printers.routes, station)
+			return ok
+		})
+		return
+	case r.Method == http.MethodGet && listPrintJobsRe.MatchString(r.URL.Path):
+		h.printers.RLock()
+		jobs := make([]printJob, len(h.printers.jobs))
+		copy(jobs, h.printers.jobs)
+		h.printers.RUnlock()
+		writeJSON(w, r, http.StatusOK, jobs)
+		return
+	default:
+		notFound(w, r)
+		return
+	}
+}
+
+func (h *printerHandler) deleteFrom(w http.ResponseWriter, r *http.Request, re *regexp.Regexp, del func(id string) bool) {
+	matches := re.FindStringSubmatch(r.URL.Path)
+	h.printers.Lock()
+	ok := del(matches[1])
+	h.printers.Unlock()
+	if !ok {
+		notFound(w, r)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *printerHandler) ListPrinters(w http.ResponseWriter, r *http.Request) {
+	h.printers.RLock()
+	out := make([]printer, 0, len(h.printers.printers))
+	for _, p := range h.printers.printers {
+		out = append(out, p)
+	}
+	h.printers.RUnlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	writeJSON(w, r, http.StatusOK, out)
+}
+
+func (h *printerHandler) PutPrinter(w http.ResponseWriter, r *http.Request) {
+	matches := printerRe.FindStringSubmatch(r.URL.Path)
+	var p printer
+	if err := json.NewDecoder(r.Body).Decode(&p); err != nil || p.Address == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("address is required"))
+		return
+	}
+	if _, _, err := net.SplitHostPort(p.Address); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("address must be host:port"))
+		return
+	}
+	p.ID = matches[1]
+	h.printers.Lock()
+	// Keep the health state of a printer that is only being renamed or moved
+	// in or out of service.
+	if prev, ok := h.printers.printers[p.ID]; ok && prev.Address == p.Address {
+		p.Online, p.LastError, p.LastCheckedAt = prev.Online, prev.LastError, prev.LastCheckedAt
+	} else {
+		p.Online, p.LastError, p.LastCheckedAt = false, "", nil
+	}
+	h.printers.printers[p.ID] = p
+	h.printers.Unlock()
+	writeJSON(w, r, http.StatusOK, p)
+}
+
+// TestPrinter prints a test page on one printer, without failover, and
+// reports its updated health.
+func (h *printerHandler) TestPrinter(w http.ResponseWriter, r *http.Request) {
+	matches := testPrinterRe.FindStringSubmatch(r.URL.Path)
+	h.printers.RLock()
+	p, ok := h.printers.printers[matches[1]]
+	h.printers.RUnlock()
+	if !ok {
+		notFound(w, r)
+		return
+	}
+	err := h.printers.send(p, []byte("TEST PAGE\n"+p.Name+"\n\n\n"))
+	h.printers.RLock()
+	p = h.printers.printers[p.ID]
+	h.printers.RUnlock()
+	status := http.StatusOK
+	if err != nil {
+		status = http.StatusBadGateway
+	}
+	writeJSON(w, r, status, p)
+}
+
+func (h *printerHandler) ListGroups(w http.ResponseWriter, r *http.Request) {
+	h.printers.RLock()
+	out := make([]printerGroup, 0, len(h.printers.groups))
+	for _, g := range h.printers.groups {
+		out = append(out, g)
+	}
+	h.printers.RUnlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	writeJSON(w, r, http.StatusOK, out)
+}
+
+func (h *printerHandler) PutGroup(w http.ResponseWriter, r *http.Request) {
+	matches := printerGroupRe.FindStringSubmatch(r.URL.Path)
+	var g printerGroup
+	if err := json.NewDecoder(r.Body).Decode(&g); err != nil || len(g.Printers) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("printers must list at least one printer id"))
+		return
+	}
+	g.ID = matches[1]
+	h.printers.Lock()
+	defer h.printers.Unlock()
+	for _, id := range g.Printers {
+		if _, ok := h.printers.printers[id]; !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("unknown printer " + id))
+			return
+		}
+	}
+	h.printers.groups[g.ID] = g
+	writeJSON(w, r, http.StatusOK, g)
+}
+
+func (h *printerHandler) ListRoutes(w http.ResponseWriter, r *http.Request) {
+	h.printers.RLock()
+	out := make([]printRoute, 0, len(h.printers.routes))
+	for station, group := range h.printers.routes {
+		out = append(out, printRoute{Station: station, Group: group})
+	}
+	h.printers.RUnlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].Station < out[j].Station })
+	writeJSON(w, r, http.StatusOK, out)
+}
+
+// PutRoute points a station, or "default" for all other stations, at a
+// printer group.
+func (h *printerHandler) PutRoute(w http.ResponseWriter, r *http.Request) {
+	matches := printRouteRe.FindStringSubmatch(r.URL.Path)
+	var rt printRoute
+	if err := json.NewDecoder(r.Body).Decode(&rt); err != nil || rt.Group == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("group is required"))
+		return
+	}
+	rt.Station = matches[1]
+	h.printers.Lock()
+	defer h.printers.Unlock()
+	if _, ok := h.printers.groups[rt.Group]; !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("unknown printer group " + rt.Group))
+		return
+	}
+	h.printers.routes[rt.Station] = rt.Group
+	writeJSON(w, r, http.StatusOK, rt)
+}
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	listPromotionsRe = regexp.MustCompile(`^/promotions/?$`)
+	promotionRe      = regexp.MustCompile(`^/promotions/([0-9]+)$`)
+)
+
+const (
+	// promoBOGO makes every Free units free for each Buy units bought of an
+	// item or category, the cheapest units in each group going free.
+	promoBOGO = "bogo"
+	// promoCategory takes Percent off every item in a category.
+	promoCategory = "category"
+	// promoMinSpend takes Amount, or Percent, off orders of at least
+	// MinSpend.
+	promoMinSpend = "min_spend"
+)
+
+const (
+	// stackCombine promotions apply alongside any others.
+	stackCombine = "combine"
+	// stackExclusive promotions apply only to orders no other promotion has
+	// discounted yet, and stop any after them from applying.
+	stackExclusive = "exclusive"
+)
+
+// promotion is a discount applied automatically when an order is priced.
+// Promotions are tried highest Priority first (ties by ID), each on what the
+// ones before it left of the bill, so a category discount after a
+// buy-one-get-one does not discount the free units again.
+type promotion struct {
+	ID       string     `json:"id"`
+	Name     string     `json:"name"`
+	Kind     string     `json:"kind"`
+	Item     string     `json:"item,omitempty"`
+	Category string     `json:"category,omitempty"`
+	Buy      int        `json:"buy,omitempty"`
+	Free     int        `json:"free,omitempty"`
+	Percent  float64    `json:"percent,omitempty"`
+	Amount   int64      `json:"amount,omitempty"`
+	MinSpend int64      `json:"min_spend,omitempty"`
+	Priority int        `json:"priority"`
+	Stacking string     `json:"stacking"`
+	Active   bool       `json:"active"`
+	StartsAt *time.Time `json:"starts_at,omitempty"`
+	EndsAt   *time.Time `json:"ends_at,omitempty"`
+}
+
+func (p promotion) validate() []fieldError {
+	var errs []fieldError
+	if strings.TrimSpace(p.Name) == "" {
+		errs = append(errs, fieldError{Field: "name", Message: "is required"})
+	}
+	if p.Stacking != stackCombine && p.Stacking != stackExclusive {
+		errs = append(errs, fieldError{Field: "stacking", Message: "must be combine or exclusive"})
+	}
+	percentOK := p.Percent > 0 && p.Percent <= 100
+	switch p.Kind {
+	case promoBOGO:
+		if (p.Item == "") == (p.Category == "") {
+			errs = append(errs, fieldError{Field: "item", Message: "give either an item or a category"})
+		}
+		if p.Buy < 1 || p.Free < 1 {
+			errs = append(errs, fieldError{Field: "buy", Message: "buy and free must be at least 1"})
+		}
+	case promoCategory:
+		if p.Category == "" {
+			errs = append(errs, fieldError{Field: "category", Message: "is required"})
+		}
+		if !percentOK {
+			errs = append(errs, fieldError{Field: "percent", Message: "must be more than 0 and at most 100"})
+		}
+	case promoMinSpend:
+		if p.MinSpend <= 0 {
+			errs = append(errs, fieldError{Field: "min_spend", Message: "must be positive"})
+		}
+		if (p.Amount > 0) == percentOK || p.Amount < 0 {
+			errs = append(errs, fieldError{Field: "amount", Message: "give either a positive amount or a percent"})
+		}
+	default:
+		errs = append(errs, fieldError{Field: "kind", Message: "must be bogo, category or min_spend"})
+	}
+	if p.StartsAt != nil && p.EndsAt != nil && !p.EndsAt.After(*p.StartsAt) {
+		errs = append(errs, fieldError{Field: "ends_at", Message: "must be after starts_at"})
+	}
+	return errs
+}
+
+func (p promotion) runningAt(now time.Time) bool {
+	return p.Active && (p.StartsAt == nil || !now.Before(*p.StartsAt)) && (p.EndsAt == nil || now.Before(*p.EndsAt))
+}
+
+// appliedPromotion is a promotion's discount on an order.
+type appliedPromotion struct {
+	PromotionID string `json:"promotion_id"`
+	Name        string `json:"name"`
+	Amount      int64  `json:"amount"`
+}
+
+type promotionStore struct {
+	m    map[string]promotion
+	menu *menuStore
+	*sync.RWMutex
+}
+
+func newPromotionStore(menu *menuStore) *promotionStore {
+	return &promotionStore{m: map[string]promotion{}, menu: menu, RWMutex: &sync.RWMutex{}}
+}
+
+// running lists the promotions running at now in the order they are tried.
+func (s *promotionStore) running(now time.Time) []promotion {
+	s.RLock()
+	out := make([]promotion, 0, len(s.m))
+	for _, p := range s.m {
+		if p.runningAt(now) {
+			out = append(out, p)
+		}
+	}
+	s.RUnlock()
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Priority != out[j].Priority {
+			return out[i].Priority > out[j].Priority
+		}
+		return mustAtoi(out[i].ID) < mustAtoi(out[j].ID)
+	})
+	return out
+}
+
+// pricedUnit is one unit of an order line and what is left to pay for it.
+type pricedUnit struct {
+	name     string
+	category string
+	price    int64
+}
+
+func (p promotion) matches(u pricedUnit) bool {
+	if p.Item != "" {
+		return strings.EqualFold(u.name, p.Item)
+	}
+	return strings.EqualFold(u.category, p.Category)
+}
+
+// discount works out p's discount on what is left of the bill, taking it off
+// units and returning it with any order-level discount to take off the rest.
+func (p promotion) discount(units []pricedUnit, orderOff int64) (unitsOff, off int64) {
+	switch p.Kind {
+	case promoBOGO:
+		var idx []int
+		for i, u := range units {
+			if u.price > 0 && p.matches(u) {
+				idx = append(idx, i)
+			}
+		}
+		sort.SliceStable(idx, func(a, b int) bool { return units[idx[a]].price > units[idx[b]].price })
+		group := p.Buy + p.Free
+		for g := 0; g+group <= len(idx); g += group {
+			for _, i := range idx[g+p.Buy : g+group] {
+				unitsOff += units[i].price
+				units[i].price = 0
+			}
+		}
+	case promoCategory:
+		for i, u := range units {
+			if u.price > 0 && p.matches(u) {
+				d := int64(math.Round(float64(u.price) * p.Percent / 100))
+				units[i].price -= d
+				unitsOff += d
+			}
+		}
+	case promoMinSpend:
+		var left int64
+		for _, u := range units {
+			left += u.price
+		}
+		left -= orderOff
+		if left < p.MinSpend {
+			return 0, 0
+		}
+		off = p.Amount
+		if p.Percent > 0 {
+			off = int64(math.Round(float64(left) * p.Percent / 100))
+		}
+		if off > left {
+			off = left
+		}
+	}
+	return unitsOff, off
+}
+
+// apply prices the promotions running at now into o, which tallyItems has
+// just totalled, taking the discount off Total.
+func (s *promotionStore) apply(o *order, now time.Time) {
+	o.Discounts, o.Discount = nil, 0
+	if !o.OrderItems.priced() {
+		return
+	}
+	var units []pricedUnit
+	for _, it := range o.OrderItems {
+		category := ""
+		if item, ok := s.menu.byName(it.Name); ok {
+			category = item.Category
+		}
+		for i := 0; i < it.Quantity; i++ {
+			units = append(units, pricedUnit{name: it.Name, category: category, price: it.UnitPrice})
+		}
+	}
+	var orderOff int64
+	for _, p := range s.running(now) {
+		if p.Stacking == stackExclusive && len(o.Discounts) > 0 {
+			break
+		}
+		trial := append([]pricedUnit(nil), units...)
+		unitsOff, off := p.discount(trial, orderOff)
+		if unitsOff+off == 0 {
+			continue
+		}
+		units, orderOff = trial, orderOff+off
+		o.Discounts = append(o.Discounts, appliedPromotion{PromotionID: p.ID, Name: p.Name, Amount: unitsOff + off})
+		o.Discount += unitsOff + off
+		if p.Stacking == stackExclusive {
+			break
+		}
+	}
+	o.Total -= o.Discount
+}
+
+// applyPromotions prices next's discounts. Settled orders keep the discounts
+// they were charged with.
+func applyPromotions(promotions *promotionStore, prev order, next *order, now time.Time) {
+	if !isFinal(prev) {
+		promotions.apply(next, now)
+		return
+	}
+	next.Discounts, next.Discount = prev.Discounts, prev.Discount
+	if next.OrderItems.priced() {
+		next.Total -= next.Discount
+	}
+}
+
+type promotionHandler struct {
+	promotions *promotionStore
+	sessions   *sessionStore
+	audit      *auditLog
+}
+
+func (h *promotionHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("content-type", "application/json")
+	scope := "orders:manage"
+	if r.Method == http.MethodGet {
+		scope = "orders:read"
+	}
+	sess, ok := h.sessions.requireScope(w, r, scope)
+	if !ok {
+		return
+	}
+	switch {
+	case r.Method == http.MethodGet && listPromotionsRe.MatchString(r.URL.Path):
+		h.promotions.RLock()
+		out := make([]promotion, 0, len(h.promotions.m))
+		for _, p := range h.promotions.m {
+			out = append(out, p)
+		}
+		h.promotions.RUnlock()
+		sort.Slice(out, func(i, j int) bool { return mustAtoi(out[i].ID) < mustAtoi(out[j].ID) })
+		writeJSON(w, r, http.StatusOK, out)
+		return
+	case r.Method == http.MethodGet && promotionRe.MatchString(r.URL.Path):
+		h.promotions.RLock()
+		p, ok := h.promotions.m[promotionRe.FindStringSubmatch(r.URL.Path)[1]]
+		h.promotions.RUnlock()
+		if !ok {
+			notFound(w, r)
+			return
+		}
+		writeJSON(w, r, http.StatusOK, p)
+		return
+	case r.Method == http.MethodPost && listPromotionsRe.MatchString(r.URL.Path):
+		h.Save(w, r, sess, "")
+		return
+	case r.Method == http.MethodPut && promotionRe.MatchString(r.URL.Path):
+		h.Save(w, r, sess, promotionRe.FindStringSubmatch(r.URL.Path)[1])
+		return
+	case r.Method == http.MethodDelete && promotionRe.MatchString(r.URL.Path):
+		id := promotionRe.FindStringSubmatch(r.URL.Path)[1]
+		h.promotions.Lock()
+		_, ok := h.promotions.m[id]
+		delete(h.promotions.m, id)
+		h.promotions.Unlock()
+		if !ok {
+			notFound(w, r)
+			return
+		}
+		h.audit.record(auditEntry{Action: "promotion.delete", Ref: id, StaffID: sess.StaffID})
+		w.WriteHeader(http.StatusNoContent)
+		return
+	default:
+		notFound(w, r)
+		return
+	}
+}
+
+// Save creates a promotion, or replaces the one with id. Stacking defaults to
+// combine. Orders already priced keep their discounts until they next change.
+func (h *promotionHandler) Save(w http.ResponseWriter, r *http.Request, sess session, id string) {
+	var p promotion
+	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("invalid promotion"))
+		return
+	}
+	if p.Stacking == "" {
+		p.Stacking = stackCombine
+	}
+	if errs := p.validate(); len(errs) > 0 {
+		validationFailed(w, r, errs)
+		return
+	}
+	status := http.StatusOK
+	h.promotions.Lock()
+	if id == "" {
+		id = strconv.Itoa(len(h.promotions.m) + 1)
+		for _, taken := h.promotions.m[id]; taken; _, taken = h.promotions.m[id] {
+			id = strconv.Itoa(mustAtoi(id) + 1)
+		}
+		status = http.StatusCreated
+	} else if _, ok := h.promotions.m[id]; !ok {
+		h.promotions.Unlock()
+		notFound(w, r)
+		return
+	}
+	p.ID = id
+	h.promotions.m[id] = p
+	h.promotions.Unlock()
+	h.audit.record(auditEntry{Action: "promotion.save", Ref: id, StaffID: sess.StaffID})
+	writeJSON(w, r, status, p)
+}
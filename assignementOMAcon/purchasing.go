@@ -0,0 +1,377 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	listSuppliersRe      = regexp.MustCompile(`^/suppliers/?$`)
+	createSupplierRe     = regexp.MustCompile(`^/suppliers/?$`)
+	listPurchaseOrdersRe = regexp.MustCompile(`^/purchase-orders/?$`)
+	createPurchaseOrdRe  = regexp.MustCompile(`^/purchase-orders/?$`)
+	getPurchaseOrderRe   = regexp.MustCompile(`^/purchase-orders/([^/]+)$`)
+	receivePurchaseOrdRe = regexp.MustCompile(`^/purchase-orders/([^/]+)/receive$`)
+	purchasingReportRe   = regexp.MustCompile(`^/purchasing/report$`)
+)
+
+const (
+	poOpen              = "open"
+	poPartiallyReceived = "partially_received"
+	poReceived          = "received"
+)
+
+const dateLayout = "2006-01-02"
+
+type supplier struct {
+	ID      string `json:"id"`
+	Name    string `json:"name"`
+	Contact string `json:"contact,omitempty"`
+}
+
+// poLine is one SKU on a purchase order. Costs are in minor currency units.
+type poLine struct {
+	SKU      string `json:"sku"`
+	Quantity int    `json:"quantity"`
+	UnitCost int64  `json:"unit_cost"`
+	Received int    `json:"received"`
+}
+
+type poReceipt struct {
+	At    time.Time          `json:"at"`
+	Lines []receivedQuantity `json:"lines"`
+}
+
+type receivedQuantity struct {
+	SKU      string `json:"sku"`
+	Quantity int    `json:"quantity"`
+}
+
+type purchaseOrder struct {
+	ID         string      `json:"id"`
+	SupplierID string      `json:"supplier_id"`
+	Status     string      `json:"status"`
+	Lines      []poLine    `json:"lines"`
+	Receipts   []poReceipt `json:"receipts,omitempty"`
+	CreatedAt  time.Time   `json:"created_at"`
+}
+
+func (po purchaseOrder) unitCost(sku string) int64 {
+	for _, l := range po.Lines {
+		if l.SKU == sku {
+			return l.UnitCost
+		}
+	}
+	return 0
+}
+
+type purchasingStore struct {
+	suppliers map[string]supplier
+	orders    map[string]purchaseOrder
+	nextID    map[string]int
+	*sync.RWMutex
+}
+
+func newPurchasingStore() *purchasingStore {
+	return &purchasingStore{
+		suppliers: map[string]supplier{},
+		orders:    map[string]purchaseOrder{},
+		nextID:    map[string]int{},
+		RWMutex:   &sync.RWMutex{},
+	}
+}
+
+func (s *purchasingStore) newID(prefix string) string {
+	s.nextID[prefix]++
+	return prefix + "-" + strconv.Itoa(s.nextID[prefix])
+}
+
+type purchasingHandler struct {
+	purchasing *purchasingStore
+	inventory  *inventoryStore
+	store      *datastore
+	sessions   *sessionStore
+	audit      *auditLog
+}
+
+func (h *purchasingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("content-type", "application/json")
+	sess, ok := h.sessions.requireScope(w, r, "orders:manage")
+	if !ok {
+		return
+	}
+	switch {
+	case r.Method == http.MethodGet && listSuppliersRe.MatchString(r.URL.Path):
+		h.ListSuppliers(w, r)
+		return
+	case r.Method == http.MethodPost && createSupplierRe.MatchString(r.URL.Path):
+		h.CreateSupplier(w, r)
+		return
+	case r.Method == http.MethodGet && listPurchaseOrdersRe.MatchString(r.URL.Path):
+		h.List(w, r)
+		return
+	case r.Method == http.MethodGet && getPurchaseOrderRe.MatchString(r.URL.Path):
+		h.Get(w, r)
+		return
+	case r.Method == http.MethodPost && createPurchaseOrdRe.MatchString(r.URL.Path):
+		h.Create(w, r)
+		return
+	case r.Method == http.MethodPost && receivePurchaseOrdRe.MatchString(r.URL.Path):
+		h.Receive(w, r, sess)
+		return
+	case r.Method == http.MethodGet && purchasingReportRe.MatchString(r.URL.Path):
+		h.Report(w, r)
+		return
+	default:
+		notFound(w, r)
+		return
+	}
+}
+
+func (h *purchasingHandler) ListSuppliers(w http.ResponseWriter, r *http.Request) {
+	h.purchasing.RLock()
+	out := make([]supplier, 0, len(h.purchasing.suppliers))
+	for _, s := range h.purchasing.suppliers {
+		out = append(out, s)
+	}
+	h.purchasing.RUnlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	writeJSON(w, r, http.StatusOK, out)
+}
+
+func (h *purchasingHandler) CreateSupplier(w http.ResponseWriter, r *http.Request) {
+	var s supplier
+	if err := json.NewDecoder(r.Body).Decode(&s); err != nil || s.Name == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("name is required"))
+		return
+	}
+	h.purchasing.Lock()
+	s.ID = h.purchasing.newID("sup")
+	h.purchasing.suppliers[s.ID] = s
+	h.purchasing.Unlock()
+	writeJSON(w, r, http.StatusCreated, s)
+}
+
+func (h *purchasingHandler) List(w http.ResponseWriter, r *http.Request) {
+	h.purchasing.RLock()
+	out := make([]purchaseOrder, 0, len(h.purchasing.orders))
+	for _, po := range h.purchasing.orders {
+		out = append(out, po)
+	}
+	h.purchasing.RUnlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].CreatedAt.Before(out[j].CreatedAt) })
+	writeJSON(w, r, http.StatusOK, out)
+}
+
+func (h *purchasingHandler) Get(w http.ResponseWriter, r *http.Request) {
+	matches := getPurchaseOrderRe.FindStringSubmatch(r.URL.Path)
+	h.purchasing.RLock()
+	po, ok := h.purchasing.orders[matches[1]]
+	h.purchasing.RUnlock()
+	if !ok {
+		notFound(w, r)
+		return
+	}
+	writeJSON(w, r, http.StatusOK, po)
+}
+
+func (h *purchasingHandler) Create(w http.ResponseWriter, r *http.Request) {
+	var po purchaseOrder
+	if err := json.NewDecoder(r.Body).Decode(&po); err != nil || len(po.Lines) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("supplier_id and lines are required"))
+		return
+	}
+	known := map[string]bool{}
+	for _, item := range h.inventory.list() {
+		known[item.SKU] = true
+	}
+	for i, l := range po.Lines {
+		if !known[l.SKU] || l.Quantity <= 0 || l.UnitCost < 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(fmt.Sprintf("line %d: unknown sku or invalid quantity/cost", i)))
+			return
+		}
+		po.Lines[i].Received = 0
+	}
+
+	h.purchasing.Lock()
+	if _, ok := h.purchasing.suppliers[po.SupplierID]; !ok {
+		h.purchasing.Unlock()
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("unknown supplier"))
+		return
+	}
+	po.ID = h.purchasing.newID("po")
+	po.Status = poOpen
+	po.Receipts = nil
+	po.CreatedAt = time.Now().UTC()
+	h.purchasing.orders[po.ID] = po
+	h.purchasing.Unlock()
+	writeJSON(w, r, http.StatusCreated, po)
+}
+
+// Receive books delivered stock against a purchase order and adds it to
+// inventory. An empty request receives everything still outstanding.
+func (h *purchasingHandler) Receive(w http.ResponseWriter, r *http.Request, sess session) {
+	matches := receivePurchaseOrdRe.FindStringSubmatch(r.URL.Path)
+	var req struct {
+		Lines []receivedQuantity `json:"lines"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("invalid receipt"))
+			return
+		}
+	}
+
+	h.purchasing.Lock()
+	po, ok := h.purchasing.orders[matches[1]]
+	if !ok {
+		h.purchasing.Unlock()
+		notFound(w, r)
+		return
+	}
+	if len(req.Lines) == 0 {
+		for _, l := range po.Lines {
+			if l.Quantity > l.Received {
+				req.Lines = append(req.Lines, receivedQuantity{SKU: l.SKU, Quantity: l.Quantity - l.Received})
+			}
+		}
+	}
+	lines := make([]poLine, len(po.Lines))
+	copy(lines, po.Lines)
+	for _, rl := range req.Lines {
+		found := false
+		for i := range lines {
+			if lines[i].SKU == rl.SKU {
+				found = true
+				lines[i].Received += rl.Quantity
+				if rl.Quantity <= 0 || lines[i].Received > lines[i].Quantity {
+					h.purchasing.Unlock()
+					w.WriteHeader(http.StatusBadRequest)
+					w.Write([]byte("receipt exceeds ordered quantity for " + rl.SKU))
+					return
+				}
+			}
+		}
+		if !found {
+			h.purchasing.Unlock()
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("sku not on purchase order: " + rl.SKU))
+			return
+		}
+	}
+	if len(req.Lines) == 0 {
+		h.purchasing.Unlock()
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte("purchase order already received"))
+		return
+	}
+	po.Lines = lines
+	po.Status = poReceived
+	for _, l := range po.Lines {
+		if l.Received < l.Quantity {
+			po.Status = poPartiallyReceived
+		}
+	}
+	po.Receipts = append(po.Receipts, poReceipt{At: time.Now().UTC(), Lines: req.Lines})
+	h.purchasing.orders[po.ID] = po
+	h.purchasing.Unlock()
+
+	for _, rl := range req.Lines {
+		h.inventory.adjust(rl.SKU, rl.Quantity)
+	}
+	h.audit.record(auditEntry{Action: "purchase_order.receive", Ref: po.ID, StaffID: sess.StaffID})
+	writeJSON(w, r, http.StatusOK, po)
+}
+
+type supplierCost struct {
+	SupplierID string `json:"supplier_id"`
+	Cost       int64  `json:"cost"`
+}
+
+type purchasingReport struct {
+	From        string         `json:"from"`
+	To          string         `json:"to"`
+	CostOfGoods int64          `json:"cost_of_goods"`
+	BySupplier  []supplierCost `json:"by_supplier"`
+	Sales       salesSummary   `json:"sales"`
+}
+
+type salesSummary struct {
+	Orders    int `json:"orders"`
+	ItemsSold int `json:"items_sold"`
+}
+
+// Report totals the cost of goods received in [from, to] next to the orders
+// taken over the same days.
+func (h *purchasingHandler) Report(w http.ResponseWriter, r *http.Request) {
+	from, to, err := parseDateRange(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	rep := purchasingReport{From: from.Format(dateLayout), To: to.AddDate(0, 0, -1).Format(dateLayout), BySupplier: []supplierCost{}}
+	bySupplier := map[string]int64{}
+	h.purchasing.RLock()
+	for _, po := range h.purchasing.orders {
+		for _, rc := range po.Receipts {
+			if rc.At.Before(from) || !rc.At.Before(to) {
+				continue
+			}
+			for _, l := range rc.Lines {
+				cost := int64(l.Quantity) * po.unitCost(l.SKU)
+				rep.CostOfGoods += cost
+				bySupplier[po.SupplierID] += cost
+			}
+		}
+	}
+	h.purchasing.RUnlock()
+	for id, cost := range bySupplier {
+		rep.BySupplier = append(rep.BySupplier, supplierCost{SupplierID: id, Cost: cost})
+	}
+	sort.Slice(rep.BySupplier, func(i, j int) bool { return rep.BySupplier[i].SupplierID < rep.BySupplier[j].SupplierID })
+
+	h.store.RLock()
+	for _, o := range h.store.m {
+		if o.UpdatedAt == nil || o.UpdatedAt.Before(from) || !o.UpdatedAt.Before(to) {
+			continue
+		}
+		rep.Sales.Orders++
+		rep.Sales.ItemsSold += len(orderItemNames(o))
+	}
+	h.store.RUnlock()
+	writeJSON(w, r, http.StatusOK, rep)
+}
+
+// parseDateRange reads ?from= and ?to= (YYYY-MM-DD, UTC, both inclusive) and
+// returns the half-open interval [from, to+1d). Both default to today.
+func parseDateRange(r *http.Request) (time.Time, time.Time, error) {
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	from, to := today, today
+	var err error
+	if v := r.URL.Query().Get("from"); v != "" {
+		if from, err = time.Parse(dateLayout, v); err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("from must be YYYY-MM-DD")
+		}
+	}
+	if v := r.URL.Query().Get("to"); v != "" {
+		if to, err = time.Parse(dateLayout, v); err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("to must be YYYY-MM-DD")
+		}
+	}
+	if to.Before(from) {
+		return time.Time{}, time.Time{}, fmt.Errorf("to is before from")
+	}
+	return from, to.AddDate(0, 0, 1), nil
+}
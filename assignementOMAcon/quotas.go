@@ -0,0 +1,387 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	globalQuotaRe   = regexp.MustCompile(`^/admin/quotas/?$`)
+	locationQuotaRe = regexp.MustCompile(`^/admin/quotas/locations/([^/]+)$`)
+	listQuotasRe    = regexp.MustCompile(`^/admin/quotas/locations/?$`)
+)
+
+// quotaConfig limits what one location may use of the shared server: how
+// many orders it may have open at once and how many requests it may make a
+// minute. Zero means no limit.
+type quotaConfig struct {
+	MaxOpenOrders     int `json:"max_open_orders"`
+	RequestsPerMinute int `json:"requests_per_minute"`
+}
+
+func (c quotaConfig) validate() error {
+	if c.MaxOpenOrders < 0 || c.RequestsPerMinute < 0 {
+		return fmt.Errorf("quotas must not be negative")
+	}
+	return nil
+}
+
+// quotaOverride is a location's own quotas. Fields left null fall back to the
+// global quota.
+type quotaOverride struct {
+	MaxOpenOrders     *int `json:"max_open_orders"`
+	RequestsPerMinute *int `json:"requests_per_minute"`
+}
+
+func (o quotaOverride) validate() error {
+	for _, p := range []*int{o.MaxOpenOrders, o.RequestsPerMinute} {
+		if p != nil && *p < 0 {
+			return fmt.Errorf("quotas must not be negative")
+		}
+	}
+	return nil
+}
+
+// quotaUsage is how much of its quotas a location is using.
+type quotaUsage struct {
+	OpenOrders int `json:"open_orders"`
+	// Requests were made in the minute that started at WindowStart.
+	Requests    int        `json:"requests"`
+	WindowStart *time.Time `json:"window_start,omitempty"`
+}
+
+// effectiveQuota is the quotas a location runs with, where each came from and
+// how much of them it uses.
+type effectiveQuota struct {
+	LocationID        string            `json:"location_id"`
+	MaxOpenOrders     int               `json:"max_open_orders"`
+	RequestsPerMinute int               `json:"requests_per_minute"`
+	Sources           map[string]string `json:"sources"`
+	Usage             quotaUsage        `json:"usage"`
+}
+
+// requestWindow counts a location's requests in the minute from start.
+type requestWindow struct {
+	start time.Time
+	count int
+}
+
+// quotaError refuses an order that would take its location past its quota
+// of open orders.
+type quotaError struct {
+	LocationID string
+	Max        int
+}
+
+func (e *quotaError) Error() string {
+	return fmt.Sprintf("%s has reached its quota of %d open orders", e.LocationID, e.Max)
+}
+
+// quotaStore layers per-location quotas over global ones, as settingsStore
+// does settings, and counts each location's requests. Windows over a minute
+// old are forgotten, so made-up locations do not pile up.
+type quotaStore struct {
+	global    quotaConfig
+	locations map[string]quotaOverride
+	windows   map[string]*requestWindow
+	swept     time.Time
+	*sync.RWMutex
+}
+
+func newQuotaStore(global quotaConfig) *quotaStore {
+	return &quotaStore{
+		global:    global,
+		locations: map[string]quotaOverride{},
+		windows:   map[string]*requestWindow{},
+		RWMutex:   &sync.RWMutex{},
+	}
+}
+
+// resolve works out a location's quotas: its override where set, the global
+// quota otherwise. Usage is left for the caller to fill in.
+func (s *quotaStore) resolve(location string) effectiveQuota {
+	s.RLock()
+	defer s.RUnlock()
+	return s.resolveLocked(location)
+}
+
+func (s *quotaStore) resolveLocked(location string) effectiveQuota {
+	g, o := s.global, s.locations[location]
+	e := effectiveQuota{LocationID: location, Sources: map[string]string{}}
+	pick := func(name string, dst *int, over *int, global int) {
+		*dst, e.Sources[name] = global, "global"
+		if over != nil {
+			*dst, e.Sources[name] = *over, "location"
+		}
+	}
+	pick("max_open_orders", &e.MaxOpenOrders, o.MaxOpenOrders, g.MaxOpenOrders)
+	pick("requests_per_minute", &e.RequestsPerMinute, o.RequestsPerMinute, g.RequestsPerMinute)
+	return e
+}
+
+// allow counts a request against location's requests a minute, or reports
+// how long until its next minute starts when it has none left.
+func (s *quotaStore) allow(location string, now time.Time) (time.Duration, bool) {
+	s.Lock()
+	defer s.Unlock()
+	if now.Sub(s.swept) > time.Minute {
+		for k, win := range s.windows {
+			if now.Sub(win.start) >= time.Minute {
+				delete(s.windows, k)
+			}
+		}
+		s.swept = now
+	}
+	max := s.resolveLocked(location).RequestsPerMinute
+	if max == 0 {
+		return 0, true
+	}
+	win, ok := s.windows[location]
+	if !ok || now.Sub(win.start) >= time.Minute {
+		win = &requestWindow{start: now}
+		s.windows[location] = win
+	}
+	if win.count >= max {
+		return win.start.Add(time.Minute).Sub(now), false
+	}
+	win.count++
+	return 0, true
+}
+
+// requests is how many requests location has made this minute, and when the
+// minute started.
+func (s *quotaStore) requests(location string, now time.Time) (int, *time.Time) {
+	s.RLock()
+	defer s.RUnlock()
+	win, ok := s.windows[location]
+	if !ok || now.Sub(win.start) >= time.Minute {
+		return 0, nil
+	}
+	start := win.start
+	return win.count, &start
+}
+
+// admit checks that storing orders leaves every location within its quota
+// of open orders, given the orders already stored. The caller holds the
+// store's lock, so that orders created at the same time cannot both take the
+// last place. It returns a quotaError for each order that does not fit.
+func (s *quotaStore) admit(stored map[string]order, orders ...order) []error {
+	s.RLock()
+	defer s.RUnlock()
+	if s.global.MaxOpenOrders == 0 && len(s.locations) == 0 {
+		return make([]error, len(orders))
+	}
+	open := openOrders(stored)
+	errs := make([]error, len(orders))
+	for i, o := range orders {
+		if !isOpen(o) {
+			continue
+		}
+		location := orderLocation(o)
+		if max := s.resolveLocked(location).MaxOpenOrders; max > 0 && open[location] >= max {
+			errs[i] = &quotaError{LocationID: location, Max: max}
+			continue
+		}
+		open[location]++
+	}
+	return errs
+}
+
+// openOrders counts the open orders at each location.
+func openOrders(m map[string]order) map[string]int {
+	open := map[string]int{}
+	for _, o := range m {
+		if isOpen(o) {
+			open[orderLocation(o)]++
+		}
+	}
+	return open
+}
+
+// sessionLocation is the location a session's requests are counted against:
+// the one its credentials are bound to, or the default location.
+func sessionLocation(sess session) string {
+	if sess.LocationID != "" {
+		return sess.LocationID
+	}
+	return defaultLocation
+}
+
+// placeOrder puts a new order at the location the caller's credentials are
+// bound to, refusing one for another location. Callers bound to no location,
+// such as head-office keys and platform webhooks, name it in the order, or
+// get the default location.
+func placeOrder(r *http.Request, sessions *sessionStore, u *order) error {
+	if sess, ok := sessions.fromRequest(r); ok && sess.LocationID != "" {
+		if u.LocationID != "" && u.LocationID != sess.LocationID {
+			return &forbiddenError{msg: "orders can only be placed at " + sess.LocationID}
+		}
+		u.LocationID = sess.LocationID
+	}
+	if u.LocationID == "" {
+		u.LocationID = defaultLocation
+	}
+	return nil
+}
+
+// quotaMiddleware answers requests from a location that has used up its
+// requests for the minute with 429 and a Retry-After header saying when the
+// next minute starts. It runs after auth and counts only requests with a
+// session, against the location the session's credentials are bound to, so
+// callers cannot pick which location's quota they use. Health
+// probes and the quota admin endpoints are never counted, so a manager can
+// always raise a quota that is being hit.
+func quotaMiddleware(quotas *quotaStore) middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			sess, ok := sessionFromContext(r.Context())
+			if !ok || r.URL.Path == "/healthz" || r.URL.Path == "/readyz" || strings.HasPrefix(r.URL.Path, "/admin/quotas") {
+				next.ServeHTTP(w, r)
+				return
+			}
+			location := sessionLocation(sess)
+			wait, ok := quotas.allow(location, time.Now())
+			if !ok {
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+				writeError(w, r, http.StatusTooManyRequests, "quota_exceeded",
+					location+" has used its requests for this minute", map[string]string{"location_id": location})
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// quotaHandler lets managers see and change quotas:
+//
+//	GET    /admin/quotas                   the global quotas
+//	PUT    /admin/quotas                   replace them
+//	GET    /admin/quotas/locations         every location with an override or usage
+//	GET    /admin/quotas/locations/{id}    a location's quotas and usage
+//	PUT    /admin/quotas/locations/{id}    replace its overrides
+//	DELETE /admin/quotas/locations/{id}    drop them, back to the global quotas
+type quotaHandler struct {
+	quotas   *quotaStore
+	store    *datastore
+	sessions *sessionStore
+	audit    *auditLog
+}
+
+func (h *quotaHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("content-type", "application/json")
+	sess, ok := h.sessions.requireScope(w, r, "orders:manage")
+	if !ok {
+		return
+	}
+	switch {
+	case r.Method == http.MethodGet && globalQuotaRe.MatchString(r.URL.Path):
+		h.quotas.RLock()
+		g := h.quotas.global
+		h.quotas.RUnlock()
+		writeJSON(w, r, http.StatusOK, g)
+	case r.Method == http.MethodPut && globalQuotaRe.MatchString(r.URL.Path):
+		var c quotaConfig
+		if err := json.NewDecoder(r.Body).Decode(&c); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("invalid quotas"))
+			return
+		}
+		if err := c.validate(); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		h.quotas.Lock()
+		h.quotas.global = c
+		h.quotas.Unlock()
+		h.audit.record(auditEntry{Action: "quotas.global.update", StaffID: sess.StaffID})
+		writeJSON(w, r, http.StatusOK, c)
+	case r.Method == http.MethodGet && listQuotasRe.MatchString(r.URL.Path):
+		h.List(w, r)
+	case r.Method == http.MethodGet && locationQuotaRe.MatchString(r.URL.Path):
+		id := locationQuotaRe.FindStringSubmatch(r.URL.Path)[1]
+		h.store.RLock()
+		open := openOrders(h.store.m)
+		h.store.RUnlock()
+		writeJSON(w, r, http.StatusOK, h.usage(id, open, time.Now()))
+	case r.Method == http.MethodPut && locationQuotaRe.MatchString(r.URL.Path):
+		id := locationQuotaRe.FindStringSubmatch(r.URL.Path)[1]
+		var o quotaOverride
+		if err := json.NewDecoder(r.Body).Decode(&o); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("invalid quotas"))
+			return
+		}
+		if err := o.validate(); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		h.quotas.Lock()
+		h.quotas.locations[id] = o
+		h.quotas.Unlock()
+		h.audit.record(auditEntry{Action: "quotas.location.update", Ref: id, StaffID: sess.StaffID})
+		h.store.RLock()
+		open := openOrders(h.store.m)
+		h.store.RUnlock()
+		writeJSON(w, r, http.StatusOK, h.usage(id, open, time.Now()))
+	case r.Method == http.MethodDelete && locationQuotaRe.MatchString(r.URL.Path):
+		id := locationQuotaRe.FindStringSubmatch(r.URL.Path)[1]
+		h.quotas.Lock()
+		delete(h.quotas.locations, id)
+		h.quotas.Unlock()
+		h.audit.record(auditEntry{Action: "quotas.location.reset", Ref: id, StaffID: sess.StaffID})
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		notFound(w, r)
+	}
+}
+
+// List shows every location that has an override, open orders or requests
+// this minute, by ID.
+func (h *quotaHandler) List(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	h.store.RLock()
+	open := openOrders(h.store.m)
+	h.store.RUnlock()
+	seen := map[string]bool{}
+	for id := range open {
+		seen[id] = true
+	}
+	h.quotas.RLock()
+	for id := range h.quotas.locations {
+		seen[id] = true
+	}
+	for id, win := range h.quotas.windows {
+		if now.Sub(win.start) < time.Minute {
+			seen[id] = true
+		}
+	}
+	h.quotas.RUnlock()
+	ids := make([]string, 0, len(seen))
+	for id := range seen {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	out := make([]effectiveQuota, 0, len(ids))
+	for _, id := range ids {
+		out = append(out, h.usage(id, open, now))
+	}
+	writeJSON(w, r, http.StatusOK, out)
+}
+
+// usage resolves location's quotas with what it is using of them.
+func (h *quotaHandler) usage(location string, open map[string]int, now time.Time) effectiveQuota {
+	e := h.quotas.resolve(location)
+	e.Usage.OpenOrders = open[location]
+	e.Usage.Requests, e.Usage.WindowStart = h.quotas.requests(location, now)
+	return e
+}
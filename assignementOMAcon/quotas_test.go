@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestQuotas(t *testing.T) {
+	const annexKey = "annex-key"
+	s := newTestServer(t, apiKey{Name: "annex", Role: roleManager, Key: annexKey, LocationID: "annex"})
+	newOrder := `{"name":"guest","table_number":"7","order_items":[{"name":"roti","quantity":1}]}`
+
+	// The seed leaves five orders open at the default location.
+	if w := do(s, http.MethodPut, "/admin/quotas/locations/main", `{"max_open_orders":6}`); w.Code != http.StatusOK {
+		t.Fatalf("PUT quota: %d %s", w.Code, w.Body)
+	}
+	if w := do(s, http.MethodPost, "/orders", newOrder); w.Code != http.StatusOK {
+		t.Fatalf("POST within quota: %d %s", w.Code, w.Body)
+	}
+	w := do(s, http.MethodPost, "/orders", newOrder)
+	if w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), `"code":"quota_exceeded"`) {
+		t.Errorf("POST over quota: %d %s, want 403 quota_exceeded", w.Code, w.Body)
+	}
+	// Offline sync creates orders too, and is held to the same quota.
+	w = do(s, http.MethodPost, "/sync/mutations", `{"client_id":"tab","mutations":[{"mutation_id":"m1","op":"create",
+		"order":{"id":"s1","name":"guest","table_number":"7","order_items":[{"name":"roti","quantity":1}]}}]}`)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"reason":"quota_exceeded"`) {
+		t.Errorf("sync create over quota: %d %s, want it rejected", w.Code, w.Body)
+	}
+	if w := doWithKey(s, annexKey, http.MethodPost, "/orders", newOrder); w.Code != http.StatusOK ||
+		!strings.Contains(w.Body.String(), `"location_id":"annex"`) {
+		t.Errorf("POST with a key for another location: %d %s", w.Code, w.Body)
+	}
+	// A key bound to a location cannot place orders at another one.
+	main := `{"name":"guest","location_id":"main","table_number":"7","order_items":[{"name":"roti","quantity":1}]}`
+	if w := doWithKey(s, annexKey, http.MethodPost, "/orders", main); w.Code != http.StatusForbidden {
+		t.Errorf("POST for main with the annex key: %d %s, want 403", w.Code, w.Body)
+	}
+
+	if w := do(s, http.MethodPut, "/admin/quotas", `{"requests_per_minute":3}`); w.Code != http.StatusOK {
+		t.Fatalf("PUT global quota: %d %s", w.Code, w.Body)
+	}
+	for i := 0; i < 3; i++ {
+		if w := do(s, http.MethodGet, "/orders/1", ""); w.Code != http.StatusOK {
+			t.Fatalf("GET %d within quota: %d %s", i, w.Code, w.Body)
+		}
+	}
+	w = do(s, http.MethodGet, "/orders/1", "")
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Errorf("GET over quota: %d, Retry-After %q, want 429 with Retry-After", w.Code, w.Header().Get("Retry-After"))
+	}
+	// The location comes from the credentials, not from what the request says.
+	r := httptest.NewRequest(http.MethodGet, "/orders/1?location=annex", nil)
+	r.Header.Set(apiKeyHeader, testAPIKey)
+	r.Header.Set("X-Location-ID", "annex")
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("GET naming another location: %d, want 429", w.Code)
+	}
+	if w := doWithKey(s, annexKey, http.MethodGet, "/orders/1", ""); w.Code != http.StatusOK {
+		t.Errorf("GET with a key for another location: %d %s", w.Code, w.Body)
+	}
+	// Quota admin is never limited, so the quota can be lifted.
+	if w := do(s, http.MethodDelete, "/admin/quotas/locations/main", ""); w.Code != http.StatusNoContent {
+		t.Errorf("DELETE quota: %d %s", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rateLimitConfig is how many requests a client may make: Rate a second on
+// average, in bursts of up to Burst, which defaults to Rate rounded up.
+// Without a rate requests are not limited.
+type rateLimitConfig struct {
+	Rate  float64 `json:"rate"`
+	Burst int     `json:"burst"`
+}
+
+func (c rateLimitConfig) validate() error {
+	if c.Rate < 0 || math.IsInf(c.Rate, 0) || math.IsNaN(c.Rate) {
+		return fmt.Errorf("rate must be a positive number of requests a second")
+	}
+	if c.Burst < 0 {
+		return fmt.Errorf("burst must be a positive integer")
+	}
+	if c.Burst > 0 && c.Rate == 0 {
+		return fmt.Errorf("burst needs a rate")
+	}
+	return nil
+}
+
+func (c rateLimitConfig) enabled() bool {
+	return c.Rate > 0
+}
+
+// tokenBucket holds a client's unspent requests as of at.
+type tokenBucket struct {
+	tokens float64
+	at     time.Time
+}
+
+// rateLimiter keeps a token bucket per client. Buckets that have refilled
+// are forgotten, so clients that come and go do not pile up.
+type rateLimiter struct {
+	config  rateLimitConfig
+	buckets map[string]*tokenBucket
+	swept   time.Time
+	*sync.Mutex
+}
+
+func newRateLimiter(c rateLimitConfig) *rateLimiter {
+	return &rateLimiter{config: c, buckets: map[string]*tokenBucket{}, Mutex: &sync.Mutex{}}
+}
+
+// allow spends one of key's tokens, or reports how long until it has one.
+func (l *rateLimiter) allow(key string, now time.Time) (time.Duration, bool) {
+	l.Lock()
+	defer l.Unlock()
+	refill := time.Duration(float64(l.config.Burst) / l.config.Rate * float64(time.Second))
+	if now.Sub(l.swept) > refill {
+		for k, b := range l.buckets {
+			if now.Sub(b.at) > refill {
+				delete(l.buckets, k)
+			}
+		}
+		l.swept = now
+	}
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: float64(l.config.Burst), at: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(float64(l.config.Burst), b.tokens+now.Sub(b.at).Seconds()*l.config.Rate)
+	b.at = now
+	if b.tokens < 1 {
+		return time.Duration((1 - b.tokens) / l.config.Rate * float64(time.Second)), false
+	}
+	b.tokens--
+	return 0, true
+}
+
+// rateLimitKey names the client a request counts against: its API key when
+// it carries a valid one, so terminals behind one address are limited apart,
+// and otherwise its address. Unknown keys count against the address, so
+// made-up keys cannot be used to get fresh buckets.
+func rateLimitKey(r *http.Request, auth *authConfig) string {
+	key := r.Header.Get(apiKeyHeader)
+	if key == "" {
+		key = strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	}
+	if key != "" && auth != nil {
+		if sess, ok := auth.apiKeySession(key); ok {
+			return sess.StaffID
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+// rateLimitMiddleware answers clients that go over their rate with 429 and a
+// Retry-After header saying when to try again. Health probes are never
+// limited, so an orchestrator probing often does not take the server out of
+// rotation. It does nothing unless a rate is set.
+func rateLimitMiddleware(c rateLimitConfig, auth *authConfig) middleware {
+	limiter := newRateLimiter(c)
+	return func(next http.Handler) http.Handler {
+		if !c.enabled() {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/healthz" || r.URL.Path == "/readyz" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			wait, ok := limiter.allow(rateLimitKey(r, auth), time.Now())
+			if !ok {
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+				writeError(w, r, http.StatusTooManyRequests, "rate_limited", "too many requests", nil)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"crypto/rand"
+	"html/template"
+	"math/big"
+	"net/http"
+	"regexp"
+	"sync"
+)
+
+var receiptRe = regexp.MustCompile(`^/r/([0-9A-Za-z]+)$`)
+
+const receiptTokenAlphabet = "0123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz"
+
+// receiptStore maps short tokens to order IDs, for receipt and tracking
+// links.
+type receiptStore struct {
+	m       map[string]string
+	byOrder map[string]string
+	*sync.RWMutex
+}
+
+func newReceiptStore() *receiptStore {
+	return &receiptStore{
+		m:       map[string]string{},
+		byOrder: map[string]string{},
+		RWMutex: &sync.RWMutex{},
+	}
+}
+
+// issue returns the short token for an order, creating one the first time the
+// order is paid. Re-issuing for the same order returns the existing token.
+func (s *receiptStore) issue(orderID string) (string, error) {
+	s.Lock()
+	defer s.Unlock()
+	if token, ok := s.byOrder[orderID]; ok {
+		return token, nil
+	}
+	for {
+		token, err := randomToken(8)
+		if err != nil {
+			return "", err
+		}
+		if _, taken := s.m[token]; taken {
+			continue
+		}
+		s.m[token] = orderID
+		s.byOrder[orderID] = token
+		return token, nil
+	}
+}
+
+func (s *receiptStore) lookup(token string) (string, bool) {
+	s.RLock()
+	defer s.RUnlock()
+	orderID, ok := s.m[token]
+	return orderID, ok
+}
+
+func randomToken(n int) (string, error) {
+	max := big.NewInt(int64(len(receiptTokenAlphabet)))
+	b := make([]byte, n)
+	for i := range b {
+		idx, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		b[i] = receiptTokenAlphabet[idx.Int64()]
+	}
+	return string(b), nil
+}
+
+func receiptPath(token string) string {
+	return "/r/" + token
+}
+
+func isPaid(o order) bool {
+	return o.Payment == paymentPaid
+}
+
+var receiptTmpl = template.Must(template.New("receipt").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><meta name="viewport" content="width=device-width, initial-scale=1"><title>Receipt #{{with .Order.Reference}}{{.}}{{else}}{{.Order.ID}}{{end}}</title></head>
+<body>
+{{with .LogoURL}}<img src="{{.}}" alt="">{{end}}
+<pre>{{.Text}}</pre>
+{{with .Nutrition}}{{if .Items}}<section>
+<h2>Nutrition</h2>
+<p>{{printf "%.0f" .Total.Calories}} kcal &middot; protein {{printf "%.1f" .Total.ProteinG}} g &middot; carbohydrate {{printf "%.1f" .Total.CarbsG}} g &middot; fat {{printf "%.1f" .Total.FatG}} g{{if .Total.SugarG}} &middot; sugars {{printf "%.1f" .Total.SugarG}} g{{end}}{{if .Total.SodiumMg}} &middot; sodium {{printf "%.0f" .Total.SodiumMg}} mg{{end}}</p>
+{{if .Unknown}}<p>Not included: {{range $i, $n := .Unknown}}{{if $i}}, {{end}}{{$n}}{{end}}</p>{{end}}
+</section>{{end}}{{end}}
+</body>
+</html>
+`))
+
+type receiptHandler struct {
+	store    *datastore
+	receipts *receiptStore
+	layouts  *layoutStore
+	menu     *menuStore
+	feedback *feedbackStore
+	audit    *auditLog
+}
+
+func (h *receiptHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost && feedbackRe.MatchString(r.URL.Path) {
+		h.Feedback(w, r, feedbackRe.FindStringSubmatch(r.URL.Path)[1])
+		return
+	}
+	matches := receiptRe.FindStringSubmatch(r.URL.Path)
+	if r.Method != http.MethodGet || len(matches) < 2 {
+		notFound(w, r)
+		return
+	}
+	orderID, ok := h.receipts.lookup(matches[1])
+	if !ok {
+		notFound(w, r)
+		return
+	}
+	h.store.RLock()
+	o, ok := h.store.m[orderID]
+	h.store.RUnlock()
+	if !ok {
+		notFound(w, r)
+		return
+	}
+	h.render(w, r, o)
+}
+
+// render writes an order's receipt page.
+func (h *receiptHandler) render(w http.ResponseWriter, r *http.Request, o order) {
+	text, err := h.layouts.renderReceipt(o)
+	if err != nil {
+		internalServerError(w, r)
+		return
+	}
+	w.Header().Set("content-type", "text/html; charset=utf-8")
+	page := struct {
+		Order     order
+		Text      string
+		LogoURL   string
+		Nutrition orderNutrition
+	}{o, text, h.layouts.get(layoutReceipt, orderLocation(o)).LogoURL, h.menu.orderNutrition(o)}
+	if err := receiptTmpl.Execute(w, page); err != nil {
+		internalServerError(w, r)
+		return
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"runtime/debug"
+)
+
+// recoveryMiddleware turns a handler panic into a logged stack trace, a call
+// to the registered error hooks, and a 500 error response.
+func recoveryMiddleware(hooks *hookRegistry) middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			defer func() {
+				rv := recover()
+				if rv == nil {
+					return
+				}
+				if rv == http.ErrAbortHandler {
+					panic(rv)
+				}
+				stack := debug.Stack()
+				err, ok := rv.(error)
+				if !ok {
+					err = fmt.Errorf("%v", rv)
+				}
+				slog.ErrorContext(r.Context(), "panic",
+					slog.String("method", r.Method),
+					slog.String("path", r.URL.Path),
+					slog.String("error", err.Error()),
+					slog.String("stack", string(stack)),
+				)
+				hooks.runError(r.Context(), err, stack)
+				writeError(w, r, http.StatusInternalServerError, "", "an unexpected error occurred", nil)
+			}()
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// defaultReferenceFormat references orders by their number alone.
+const defaultReferenceFormat = "{seq}"
+
+// referencePlaceholderRe matches the placeholders an order reference format
+// may use:
+//
+//	{seq}       the order number; {seq:4} pads it with zeros to 4 digits
+//	{table}     the table number
+//	{date}      the day the order was placed, as YYYYMMDD in the location's
+//	            time zone
+//	{location}  the location ID
+//	{channel}   the channel the order came in through
+//
+// so "T{table}-{seq}" gives T12-57 and "{date}-{seq:3}" gives 20240501-057.
+var referencePlaceholderRe = regexp.MustCompile(`\{([a-z]+)(?::([1-9]))?\}`)
+
+var referenceFields = map[string]func(o order, placed time.Time) string{
+	"seq":      func(o order, _ time.Time) string { return strconv.FormatInt(o.Number, 10) },
+	"table":    func(o order, _ time.Time) string { return o.TableNumber },
+	"date":     func(_ order, placed time.Time) string { return placed.Format("20060102") },
+	"location": func(o order, _ time.Time) string { return o.LocationID },
+	"channel":  func(o order, _ time.Time) string { return o.Channel },
+}
+
+func validateReferenceFormat(format string) error {
+	for _, m := range referencePlaceholderRe.FindAllStringSubmatch(format, -1) {
+		if _, ok := referenceFields[m[1]]; !ok {
+			return fmt.Errorf("order_reference has unknown placeholder {%s}", m[1])
+		}
+		if m[2] != "" && m[1] != "seq" {
+			return fmt.Errorf("order_reference can only pad {seq}")
+		}
+	}
+	return nil
+}
+
+// formatReference fills in format for o, placed at placed.
+func formatReference(format string, o order, placed time.Time) string {
+	return referencePlaceholderRe.ReplaceAllStringFunc(format, func(p string) string {
+		m := referencePlaceholderRe.FindStringSubmatch(p)
+		field, ok := referenceFields[m[1]]
+		if !ok {
+			return p
+		}
+		v := field(o, placed)
+		if width, _ := strconv.Atoi(m[2]); len(v) < width {
+			v = fmt.Sprintf("%0*s", width, v)
+		}
+		return v
+	})
+}
+
+// reference gives a newly numbered order its reference, in its location's
+// format. The reference stays as it was given even if the order later moves
+// table.
+func (h *orderHandler) reference(u *order, now time.Time) {
+	e := h.settings.resolve(u.LocationID)
+	u.Reference = formatReference(e.OrderReference, *u, now.In(e.location()))
+}
@@ -0,0 +1,470 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	listReportSchedulesRe = regexp.MustCompile(`^/admin/report-schedules/?$`)
+	reportScheduleRe      = regexp.MustCompile(`^/admin/report-schedules/([a-z0-9-]+)$`)
+	sendReportScheduleRe  = regexp.MustCompile(`^/admin/report-schedules/([a-z0-9-]+)/send$`)
+)
+
+const mailTimeout = 30 * time.Second
+
+var errMailNotConfigured = errors.New("email is not configured")
+
+// scheduledReport is a report that can be mailed: the report handler it is
+// rendered by and the query that makes it cover one UTC day.
+type scheduledReport struct {
+	title string
+	path  string
+	query func(day time.Time) url.Values
+	serve http.HandlerFunc
+}
+
+func dayRangeQuery(day time.Time) url.Values {
+	return url.Values{"from": {day.Format(dateLayout)}, "to": {day.Format(dateLayout)}}
+}
+
+// newScheduledReports lists the reports schedules may include, by name.
+func newScheduledReports(reports *reportHandler, tips *tipHandler) map[string]scheduledReport {
+	return map[string]scheduledReport{
+		"daily-sales": {
+			title: "Daily sales by hour",
+			path:  "/reports/hourly",
+			query: func(day time.Time) url.Values { return url.Values{"date": {day.Format(dateLayout)}} },
+			serve: reports.Hourly,
+		},
+		"channels":  {title: "Sales by channel", path: "/reports/channels", query: dayRangeQuery, serve: reports.Channels},
+		"sales-mix": {title: "Sales mix", path: "/reports/sales-mix", query: dayRangeQuery, serve: reports.SalesMix},
+		"sla":       {title: "Order status times", path: "/reports/sla", query: dayRangeQuery, serve: reports.SLA},
+		"tips": {
+			title: "Tip payout",
+			path:  "/tips/payout",
+			query: func(day time.Time) url.Values {
+				return url.Values{"from": {day.Format(time.RFC3339)}, "to": {day.AddDate(0, 0, 1).Format(time.RFC3339)}}
+			},
+			serve: tips.Payout,
+		},
+	}
+}
+
+// render runs the report for day and returns it as indented JSON.
+func (rep scheduledReport) render(ctx context.Context, day time.Time) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rep.path+"?"+rep.query(day).Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	rec := &envelopeRecorder{header: http.Header{}}
+	rep.serve(rec, req)
+	if rec.status >= 400 {
+		return nil, fmt.Errorf("%s: %d %s", rep.path, rec.status, strings.TrimSpace(rec.body.String()))
+	}
+	var out bytes.Buffer
+	if err := json.Indent(&out, rec.body.Bytes(), "", "  "); err != nil {
+		return nil, fmt.Errorf("%s: %v", rep.path, err)
+	}
+	return out.Bytes(), nil
+}
+
+// reportSchedule mails the previous UTC day's reports to its recipients
+// whenever its cron expression fires. LastError is the outcome of the last
+// delivery, empty when it went out.
+type reportSchedule struct {
+	ID         string     `json:"id"`
+	Name       string     `json:"name,omitempty"`
+	Cron       string     `json:"cron"`
+	Reports    []string   `json:"reports"`
+	Recipients []string   `json:"recipients"`
+	Disabled   bool       `json:"disabled,omitempty"`
+	NextRunAt  *time.Time `json:"next_run_at,omitempty"`
+	LastRunAt  *time.Time `json:"last_run_at,omitempty"`
+	LastError  string     `json:"last_error,omitempty"`
+	schedule   cronSchedule
+}
+
+// mailTransport hands a message to a mail server for the given recipients.
+type mailTransport func(ctx context.Context, from string, to []string, msg []byte) error
+
+// smtpTransport sends through an SMTP server at addr (host:port), upgrading
+// to TLS when the server offers STARTTLS and logging in when user is set.
+func smtpTransport(addr, user, pass string) mailTransport {
+	return func(ctx context.Context, from string, to []string, msg []byte) error {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return err
+		}
+		var d net.Dialer
+		conn, err := d.DialContext(ctx, "tcp", addr)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		if deadline, ok := ctx.Deadline(); ok {
+			conn.SetDeadline(deadline)
+		}
+		c, err := smtp.NewClient(conn, host)
+		if err != nil {
+			return err
+		}
+		defer c.Close()
+		if ok, _ := c.Extension("STARTTLS"); ok {
+			if err := c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+				return err
+			}
+		}
+		if user != "" {
+			if err := c.Auth(smtp.PlainAuth("", user, pass, host)); err != nil {
+				return err
+			}
+		}
+		if err := c.Mail(from); err != nil {
+			return err
+		}
+		for _, rcpt := range to {
+			if err := c.Rcpt(rcpt); err != nil {
+				return err
+			}
+		}
+		wc, err := c.Data()
+		if err != nil {
+			return err
+		}
+		if _, err := wc.Write(msg); err != nil {
+			return err
+		}
+		if err := wc.Close(); err != nil {
+			return err
+		}
+		return c.Quit()
+	}
+}
+
+// smtpConfig is the server reports are mailed through: Addr (host:port),
+// the login, and From, the sender address. Without an address schedules can
+// be managed but nothing is sent.
+type smtpConfig struct {
+	Addr     string `json:"addr"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+	From     string `json:"from"`
+}
+
+// mailConfig is how reports are sent.
+type mailConfig struct {
+	transport mailTransport
+	from      string
+}
+
+func newMailConfig(c smtpConfig) (mailConfig, error) {
+	if c.Addr == "" {
+		return mailConfig{}, nil
+	}
+	if _, _, err := net.SplitHostPort(c.Addr); err != nil {
+		return mailConfig{}, fmt.Errorf("addr must be host:port, got %q", c.Addr)
+	}
+	from, err := mail.ParseAddress(c.From)
+	if err != nil {
+		return mailConfig{}, fmt.Errorf("from must be an email address when addr is set")
+	}
+	return mailConfig{
+		transport: smtpTransport(c.Addr, c.Username, c.Password),
+		from:      from.Address,
+	}, nil
+}
+
+// reportMailer keeps the report schedules and sends them when they are due.
+type reportMailer struct {
+	schedules map[string]reportSchedule
+	reports   map[string]scheduledReport
+	mail      mailConfig
+	*sync.RWMutex
+}
+
+func newReportMailer(reports map[string]scheduledReport, mail mailConfig) *reportMailer {
+	return &reportMailer{schedules: map[string]reportSchedule{}, reports: reports, mail: mail, RWMutex: &sync.RWMutex{}}
+}
+
+// run checks for due schedules every minute until ctx is done.
+func (m *reportMailer) run(ctx context.Context) {
+	t := time.NewTicker(time.Minute)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-t.C:
+			m.sendDue(ctx, now.UTC())
+		}
+	}
+}
+
+// sendDue delivers every schedule whose next run has come. The next run is
+// moved on before sending, so a slow mail server cannot get a schedule sent
+// twice.
+func (m *reportMailer) sendDue(ctx context.Context, now time.Time) {
+	var due []reportSchedule
+	m.Lock()
+	for id, s := range m.schedules {
+		if s.Disabled || s.NextRunAt == nil || s.NextRunAt.After(now) {
+			continue
+		}
+		due = append(due, s)
+		next := s.schedule.next(now)
+		s.NextRunAt = &next
+		m.schedules[id] = s
+	}
+	m.Unlock()
+	for _, s := range due {
+		yesterday := now.Truncate(24*time.Hour).AddDate(0, 0, -1)
+		if s = m.deliver(ctx, s, yesterday, now); s.LastError != "" {
+			log.Printf("report schedule %s: %s", s.ID, s.LastError)
+		}
+	}
+}
+
+// deliver mails the schedule's reports for day and records the outcome.
+func (m *reportMailer) deliver(ctx context.Context, s reportSchedule, day, now time.Time) reportSchedule {
+	ctx, cancel := context.WithTimeout(ctx, mailTimeout)
+	defer cancel()
+	err := errMailNotConfigured
+	if m.mail.transport != nil {
+		var msg []byte
+		if msg, err = m.compose(ctx, s, day, now); err == nil {
+			err = m.mail.transport(ctx, m.mail.from, s.Recipients, msg)
+		}
+	}
+	m.Lock()
+	defer m.Unlock()
+	// The schedule may have been changed or deleted while it was sending.
+	if cur, ok := m.schedules[s.ID]; ok {
+		s = cur
+	}
+	s.LastRunAt, s.LastError = &now, ""
+	if err != nil {
+		s.LastError = err.Error()
+	}
+	if _, ok := m.schedules[s.ID]; ok {
+		m.schedules[s.ID] = s
+	}
+	return s
+}
+
+// compose renders the reports into a plain text message.
+func (m *reportMailer) compose(ctx context.Context, s reportSchedule, day, now time.Time) ([]byte, error) {
+	name := s.Name
+	if name == "" {
+		name = s.ID
+	}
+	// Names come from the API; keep them from adding header lines.
+	subject := strings.NewReplacer("\r", " ", "\n", " ").Replace(name + " for " + day.Format(dateLayout))
+
+	var body bytes.Buffer
+	qp := quotedprintable.NewWriter(&body)
+	for _, id := range s.Reports {
+		rep := m.reports[id]
+		out, err := rep.render(ctx, day)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(qp, "%s (%s)\n%s\n\n%s\n\n", rep.title, day.Format(dateLayout), strings.Repeat("-", len(rep.title)+len(dateLayout)+3), out)
+	}
+	if err := qp.Close(); err != nil {
+		return nil, err
+	}
+
+	var msg bytes.Buffer
+	for _, h := range [][2]string{
+		{"From", m.mail.from},
+		{"To", strings.Join(s.Recipients, ", ")},
+		{"Subject", mime.QEncoding.Encode("utf-8", subject)},
+		{"Date", now.Format(time.RFC1123Z)},
+		{"MIME-Version", "1.0"},
+		{"Content-Type", "text/plain; charset=utf-8"},
+		{"Content-Transfer-Encoding", "quoted-printable"},
+	} {
+		msg.WriteString(h[0] + ": " + h[1] + "\r\n")
+	}
+	msg.WriteString("\r\n")
+	msg.Write(body.Bytes())
+	return msg.Bytes(), nil
+}
+
+type reportScheduleHandler struct {
+	mailer   *reportMailer
+	sessions *sessionStore
+	audit    *auditLog
+}
+
+func (h *reportScheduleHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("content-type", "application/json")
+	sess, ok := h.sessions.requireScope(w, r, "orders:manage")
+	if !ok {
+		return
+	}
+	switch {
+	case r.Method == http.MethodGet && listReportSchedulesRe.MatchString(r.URL.Path):
+		h.List(w, r)
+		return
+	case r.Method == http.MethodGet && reportScheduleRe.MatchString(r.URL.Path):
+		h.Get(w, r)
+		return
+	case r.Method == http.MethodPut && reportScheduleRe.MatchString(r.URL.Path):
+		h.Put(w, r, sess)
+		return
+	case r.Method == http.MethodDelete && reportScheduleRe.MatchString(r.URL.Path):
+		h.Delete(w, r, sess)
+		return
+	case r.Method == http.MethodPost && sendReportScheduleRe.MatchString(r.URL.Path):
+		h.Send(w, r, sess)
+		return
+	default:
+		notFound(w, r)
+		return
+	}
+}
+
+func (h *reportScheduleHandler) List(w http.ResponseWriter, r *http.Request) {
+	h.mailer.RLock()
+	out := make([]reportSchedule, 0, len(h.mailer.schedules))
+	for _, s := range h.mailer.schedules {
+		out = append(out, s)
+	}
+	h.mailer.RUnlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	writeJSON(w, r, http.StatusOK, out)
+}
+
+func (h *reportScheduleHandler) Get(w http.ResponseWriter, r *http.Request) {
+	matches := reportScheduleRe.FindStringSubmatch(r.URL.Path)
+	h.mailer.RLock()
+	s, ok := h.mailer.schedules[matches[1]]
+	h.mailer.RUnlock()
+	if !ok {
+		notFound(w, r)
+		return
+	}
+	writeJSON(w, r, http.StatusOK, s)
+}
+
+// Put creates or replaces a schedule. Reports are named from daily-sales,
+// channels, sales-mix, sla and tips.
+func (h *reportScheduleHandler) Put(w http.ResponseWriter, r *http.Request, sess session) {
+	matches := reportScheduleRe.FindStringSubmatch(r.URL.Path)
+	var s reportSchedule
+	if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("invalid request body"))
+		return
+	}
+	var err error
+	if s.schedule, err = parseCron(s.Cron); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if len(s.Reports) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("reports is required"))
+		return
+	}
+	for _, id := range s.Reports {
+		if _, ok := h.mailer.reports[id]; !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("unknown report " + id))
+			return
+		}
+	}
+	if len(s.Recipients) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("recipients is required"))
+		return
+	}
+	for i, rcpt := range s.Recipients {
+		addr, err := mail.ParseAddress(rcpt)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(fmt.Sprintf("recipient %q is not an email address", rcpt)))
+			return
+		}
+		s.Recipients[i] = addr.Address
+	}
+	s.ID = matches[1]
+	s.NextRunAt = nil
+	if !s.Disabled {
+		next := s.schedule.next(time.Now().UTC())
+		s.NextRunAt = &next
+	}
+	h.mailer.Lock()
+	prev := h.mailer.schedules[s.ID]
+	s.LastRunAt, s.LastError = prev.LastRunAt, prev.LastError
+	h.mailer.schedules[s.ID] = s
+	h.mailer.Unlock()
+	h.audit.record(auditEntry{Action: "report_schedule.put", Ref: s.ID, StaffID: sess.StaffID})
+	writeJSON(w, r, http.StatusOK, s)
+}
+
+func (h *reportScheduleHandler) Delete(w http.ResponseWriter, r *http.Request, sess session) {
+	matches := reportScheduleRe.FindStringSubmatch(r.URL.Path)
+	h.mailer.Lock()
+	_, ok := h.mailer.schedules[matches[1]]
+	delete(h.mailer.schedules, matches[1])
+	h.mailer.Unlock()
+	if !ok {
+		notFound(w, r)
+		return
+	}
+	h.audit.record(auditEntry{Action: "report_schedule.delete", Ref: matches[1], StaffID: sess.StaffID})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Send mails a schedule now, for ?date=YYYY-MM-DD or by default yesterday,
+// whether or not it is disabled, and leaves its next run as it was. It
+// answers 502 with the schedule when the mail did not go out.
+func (h *reportScheduleHandler) Send(w http.ResponseWriter, r *http.Request, sess session) {
+	matches := sendReportScheduleRe.FindStringSubmatch(r.URL.Path)
+	now := time.Now().UTC()
+	day := now.Truncate(24*time.Hour).AddDate(0, 0, -1)
+	if v := r.URL.Query().Get("date"); v != "" {
+		d, err := time.Parse(dateLayout, v)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("date must be YYYY-MM-DD"))
+			return
+		}
+		day = d
+	}
+	h.mailer.RLock()
+	s, ok := h.mailer.schedules[matches[1]]
+	h.mailer.RUnlock()
+	if !ok {
+		notFound(w, r)
+		return
+	}
+	s = h.mailer.deliver(r.Context(), s, day, now)
+	h.audit.record(auditEntry{Action: "report_schedule.send", Ref: s.ID, StaffID: sess.StaffID})
+	status := http.StatusOK
+	if s.LastError != "" {
+		status = http.StatusBadGateway
+	}
+	writeJSON(w, r, status, s)
+}
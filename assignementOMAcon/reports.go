@@ -0,0 +1,406 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	closeDayRe = regexp.MustCompile(`^/reports/close-day$`)
+	getZRe     = regexp.MustCompile(`^/reports/z/([0-9]{4}-[0-9]{2}-[0-9]{2})$`)
+)
+
+type tenderTotal struct {
+	Method string `json:"method"`
+	Count  int    `json:"count"`
+	Amount int64  `json:"amount"`
+}
+
+type countAmount struct {
+	Count  int   `json:"count"`
+	Amount int64 `json:"amount"`
+}
+
+// zReport is the end-of-day summary. Amounts are in minor currency units.
+type zReport struct {
+	BusinessDate    string        `json:"business_date"`
+	ClosedAt        time.Time     `json:"closed_at"`
+	ClosedBy        string        `json:"closed_by"`
+	OrdersClosed    int           `json:"orders_closed"`
+	GrossSales      int64         `json:"gross_sales"`
+	TaxCollected    int64         `json:"tax_collected"`
+	Tips            int64         `json:"tips"`
+	ByPaymentMethod []tenderTotal `json:"by_payment_method"`
+	ByChannel       []tenderTotal `json:"by_channel"`
+	Voids           countAmount   `json:"voids"`
+	Refunds         countAmount   `json:"refunds"`
+	OpenOrders      int           `json:"open_orders"`
+	Printable       string        `json:"printable"`
+}
+
+// isVoided reports whether an order was cancelled; reports count it as a
+// void.
+func isVoided(o order) bool {
+	return o.Status == statusCancelled
+}
+
+func isRefunded(o order) bool {
+	return o.Payment == paymentRefunded
+}
+
+// isFinal reports whether an order has reached a state the day can be closed
+// on.
+func isFinal(o order) bool {
+	return isPaid(o) || isVoided(o) || isRefunded(o)
+}
+
+// businessDate is the day an order is closed with: the UTC date it was
+// created. Orders from before creation times were kept have none, and are
+// closed with the first day closed.
+func businessDate(o order) string {
+	if o.CreatedAt == nil {
+		return ""
+	}
+	return o.CreatedAt.UTC().Format(dateLayout)
+}
+
+// zReportStore is an orderStore that keeps Z-reports too.
+type zReportStore interface {
+	// CloseDay stores the orders closing the day locked together with its
+	// Z-report, all or none.
+	CloseDay(locked []order, rep zReport) error
+	ZReport(date string) (zReport, bool, error)
+}
+
+// reportStore is the Z-reports kept in memory when there is no database to
+// keep them.
+type reportStore struct {
+	zReports map[string]zReport
+	*sync.RWMutex
+}
+
+func newReportStore() *reportStore {
+	return &reportStore{zReports: map[string]zReport{}, RWMutex: &sync.RWMutex{}}
+}
+
+// closeDay stores the orders closing a day locked together with the day's
+// Z-report: if one cannot be stored, none is. The caller holds the write lock.
+// A database that cannot store them in one go has the orders already written
+// put back.
+func (s *datastore) closeDay(locked []order, rep zReport) error {
+	if db, ok := s.db.(zReportStore); ok {
+		if err := db.CloseDay(locked, rep); err != nil {
+			return err
+		}
+	} else {
+		if s.db != nil {
+			for i, o := range locked {
+				if err := s.db.Update(o); err != nil {
+					for _, done := range locked[:i] {
+						s.db.Update(s.m[done.ID])
+					}
+					return err
+				}
+			}
+		}
+		s.reports.Lock()
+		s.reports.zReports[rep.BusinessDate] = rep
+		s.reports.Unlock()
+	}
+	for _, o := range locked {
+		s.m[o.ID] = o
+	}
+	return nil
+}
+
+// zReport returns the Z-report of the day date, if it has been closed.
+func (s *datastore) zReport(date string) (zReport, bool, error) {
+	if db, ok := s.db.(zReportStore); ok {
+		return db.ZReport(date)
+	}
+	s.reports.RLock()
+	defer s.reports.RUnlock()
+	rep, ok := s.reports.zReports[date]
+	return rep, ok, nil
+}
+
+type reportHandler struct {
+	store     *datastore
+	sessions  *sessionStore
+	audit     *auditLog
+	feed      *changeFeed
+	events    *eventBus
+	voids     *voidStore
+	waste     *wasteLog
+	feedback  *feedbackStore
+	overrides *overrideStore
+	menu      *menuStore
+}
+
+func (h *reportHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("content-type", "application/json")
+	sess, ok := h.sessions.requireScope(w, r, "orders:manage")
+	if !ok {
+		return
+	}
+	switch {
+	case r.Method == http.MethodPost && closeDayRe.MatchString(r.URL.Path):
+		h.CloseDay(w, r, sess)
+		return
+	case r.Method == http.MethodGet && getZRe.MatchString(r.URL.Path):
+		h.GetZ(w, r)
+		return
+	case r.Method == http.MethodGet && channelReportRe.MatchString(r.URL.Path):
+		h.Channels(w, r)
+		return
+	case r.Method == http.MethodGet && hourlyReportRe.MatchString(r.URL.Path):
+		h.Hourly(w, r)
+		return
+	case r.Method == http.MethodGet && forecastRe.MatchString(r.URL.Path):
+		h.Forecast(w, r)
+		return
+	case r.Method == http.MethodGet && wasteReportRe.MatchString(r.URL.Path):
+		h.Waste(w, r)
+		return
+	case r.Method == http.MethodGet && feedbackReportRe.MatchString(r.URL.Path):
+		h.Feedback(w, r)
+		return
+	case r.Method == http.MethodGet && overrideReportRe.MatchString(r.URL.Path):
+		h.PriceOverrides(w, r)
+		return
+	case r.Method == http.MethodGet && slaReportRe.MatchString(r.URL.Path):
+		h.SLA(w, r)
+		return
+	case r.Method == http.MethodGet && salesMixRe.MatchString(r.URL.Path):
+		h.SalesMix(w, r)
+		return
+	default:
+		notFound(w, r)
+		return
+	}
+}
+
+// CloseDay totals the finished orders of the business date (?date=YYYY-MM-DD,
+// default today) that have not been closed yet, locks them against further
+// edits and stores the Z-report under the date. The locks and the report are
+// stored together, so a failure leaves the day open. Pass ?format=text for
+// the printable form.
+func (h *reportHandler) CloseDay(w http.ResponseWriter, r *http.Request, sess session) {
+	date := r.URL.Query().Get("date")
+	if date == "" {
+		date = time.Now().UTC().Format(dateLayout)
+	} else if _, err := time.Parse(dateLayout, date); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("date must be YYYY-MM-DD"))
+		return
+	}
+
+	h.store.Lock()
+	_, done, err := h.store.zReport(date)
+	if err != nil {
+		h.store.Unlock()
+		internalServerError(w, r)
+		return
+	}
+	if done {
+		h.store.Unlock()
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte("day already closed"))
+		return
+	}
+
+	now := time.Now().UTC()
+	rep := zReport{BusinessDate: date, ClosedAt: now, ClosedBy: sess.StaffID}
+	byMethod := map[string]*tenderTotal{}
+	byChannel := map[string]*tenderTotal{}
+	var locked []order
+	for _, o := range h.store.m {
+		if day := businessDate(o); o.Locked || (day != "" && day != date) {
+			continue
+		}
+		if !isFinal(o) {
+			rep.OpenOrders++
+			continue
+		}
+		switch {
+		case isVoided(o):
+			rep.Voids.Count++
+			rep.Voids.Amount += o.Total
+		case isRefunded(o):
+			rep.Refunds.Count++
+			rep.Refunds.Amount += o.Total
+		default:
+			rep.GrossSales += o.Total
+			rep.TaxCollected += o.Tax
+			rep.Tips += o.Tip
+			addTender := func(method string, amount int64) {
+				if method == "" {
+					method = "unspecified"
+				}
+				t := byMethod[method]
+				if t == nil {
+					t = &tenderTotal{Method: method}
+					byMethod[method] = t
+				}
+				t.Count++
+				t.Amount += amount
+			}
+			if len(o.Payments) == 0 {
+				addTender(o.PaymentMethod, o.Total)
+			}
+			for _, leg := range o.Payments {
+				addTender(leg.Method, leg.Amount-leg.Change)
+			}
+			channel := o.Channel
+			if channel == "" {
+				channel = channelWalkIn
+			}
+			c := byChannel[channel]
+			if c == nil {
+				c = &tenderTotal{Method: channel}
+				byChannel[channel] = c
+			}
+			c.Count++
+			c.Amount += o.Total
+		}
+		rep.OrdersClosed++
+		o.Locked = true
+		touch(&o, o, now)
+		locked = append(locked, o)
+	}
+
+	rep.ByPaymentMethod = make([]tenderTotal, 0, len(byMethod))
+	for _, t := range byMethod {
+		rep.ByPaymentMethod = append(rep.ByPaymentMethod, *t)
+	}
+	sort.Slice(rep.ByPaymentMethod, func(i, j int) bool { return rep.ByPaymentMethod[i].Method < rep.ByPaymentMethod[j].Method })
+	rep.ByChannel = make([]tenderTotal, 0, len(byChannel))
+	for _, c := range byChannel {
+		rep.ByChannel = append(rep.ByChannel, *c)
+	}
+	sort.Slice(rep.ByChannel, func(i, j int) bool { return rep.ByChannel[i].Method < rep.ByChannel[j].Method })
+	rep.Printable = rep.format()
+	if err := h.store.closeDay(locked, rep); err != nil {
+		h.store.Unlock()
+		internalServerError(w, r)
+		return
+	}
+	h.store.Unlock()
+
+	for _, o := range locked {
+		h.feed.publish(kindOrders, o.ID, false)
+		h.events.updated(o)
+	}
+	h.audit.record(auditEntry{Action: "day.close", Ref: date, StaffID: sess.StaffID})
+	h.writeZ(w, r, http.StatusOK, rep)
+}
+
+func (h *reportHandler) GetZ(w http.ResponseWriter, r *http.Request) {
+	matches := getZRe.FindStringSubmatch(r.URL.Path)
+	rep, ok, err := h.store.zReport(matches[1])
+	if err != nil {
+		internalServerError(w, r)
+		return
+	}
+	if !ok {
+		notFound(w, r)
+		return
+	}
+	h.writeZ(w, r, http.StatusOK, rep)
+}
+
+func (h *reportHandler) writeZ(w http.ResponseWriter, r *http.Request, status int, rep zReport) {
+	if r.URL.Query().Get("format") == "text" {
+		w.Header().Set("content-type", "text/plain; charset=utf-8")
+		w.WriteHeader(status)
+		w.Write([]byte(rep.Printable))
+		return
+	}
+	writeJSON(w, r, status, rep)
+}
+
+func formatAmount(minor int64) string {
+	sign := ""
+	if minor < 0 {
+		sign, minor = "-", -minor
+	}
+	return fmt.Sprintf("%s%d.%02d", sign, minor/100, minor%100)
+}
+
+// format renders the report for a 32-column receipt printer.
+func (rep zReport) format() string {
+	var b strings.Builder
+	line := func(label, value string) {
+		fmt.Fprintf(&b, "%-20s%12s\n", label, value)
+	}
+	fmt.Fprintf(&b, "Z-REPORT %s\n", rep.BusinessDate)
+	fmt.Fprintf(&b, "Closed %s by %s\n\n", rep.ClosedAt.Format("2006-01-02 15:04"), rep.ClosedBy)
+	line("Orders closed", fmt.Sprint(rep.OrdersClosed))
+	line("Gross sales", formatAmount(rep.GrossSales))
+	line("Tax collected", formatAmount(rep.TaxCollected))
+	line("Tips", formatAmount(rep.Tips))
+	for _, t := range rep.ByPaymentMethod {
+		line(fmt.Sprintf("  %s (%d)", t.Method, t.Count), formatAmount(t.Amount))
+	}
+	line("By channel", "")
+	for _, c := range rep.ByChannel {
+		line(fmt.Sprintf("  %s (%d)", c.Method, c.Count), formatAmount(c.Amount))
+	}
+	line(fmt.Sprintf("Voids (%d)", rep.Voids.Count), formatAmount(rep.Voids.Amount))
+	line(fmt.Sprintf("Refunds (%d)", rep.Refunds.Count), formatAmount(rep.Refunds.Amount))
+	line("Still open", fmt.Sprint(rep.OpenOrders))
+	return b.String()
+}
+
+// CloseDay updates the locked orders and inserts the Z-report in one
+// transaction. A report for the same date already stored fails it.
+func (s *sqlStore) CloseDay(locked []order, rep zReport) error {
+	doc, err := json.Marshal(rep)
+	if err != nil {
+		return err
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	for _, o := range locked {
+		doc, updated, err := orderRow(o)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		if _, err := tx.Exec(`UPDATE orders SET doc = $1, version = $2, updated_at = $3 WHERE id = $4`,
+			doc, o.Version, updated, o.ID); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("order %s: %w", o.ID, err)
+		}
+	}
+	if _, err := tx.Exec(`INSERT INTO z_reports (business_date, doc) VALUES ($1, $2)`, rep.BusinessDate, string(doc)); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *sqlStore) ZReport(date string) (zReport, bool, error) {
+	var doc string
+	err := s.db.QueryRow(`SELECT doc FROM z_reports WHERE business_date = $1`, date).Scan(&doc)
+	if err == sql.ErrNoRows {
+		return zReport{}, false, nil
+	}
+	if err != nil {
+		return zReport{}, false, err
+	}
+	var rep zReport
+	if err := json.Unmarshal([]byte(doc), &rep); err != nil {
+		return zReport{}, false, err
+	}
+	return rep, true, nil
+}
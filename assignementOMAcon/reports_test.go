@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestCloseDay checks that closing a day locks only that day's orders, and
+// that the Z-report and the locks are kept in the database together.
+func TestCloseDay(t *testing.T) {
+	dsn := filepath.Join(t.TempDir(), "orders.db")
+	open := func() *server {
+		cfg := defaultConfig()
+		cfg.Seed = true
+		cfg.Store = storeConfig{Driver: storeSQLite, DSN: dsn}
+		cfg.Auth.APIKeys = []apiKey{{Name: "test", Role: roleManager, Key: testAPIKey}}
+		auth, err := loadAuthConfig(cfg.Auth)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg.Auth = *auth
+		ctx, cancel := context.WithCancel(context.Background())
+		s, err := newServer(ctx, cfg, slog.New(slog.NewTextHandler(io.Discard, nil)))
+		if err != nil {
+			cancel()
+			t.Fatal(err)
+		}
+		t.Cleanup(func() {
+			cancel()
+			s.Close()
+		})
+		return s
+	}
+
+	s := open()
+	today := time.Now().UTC()
+	yesterday := today.AddDate(0, 0, -1)
+	for _, id := range []string{"c1", "c2"} {
+		body := `{"id":"` + id + `","name":"guest","table_number":"4","order_items":[{"name":"roti","quantity":1,"unit_price":100}]}`
+		if w := do(s, http.MethodPost, "/orders", body); w.Code != http.StatusOK {
+			t.Fatalf("create %s: %d %s", id, w.Code, w.Body)
+		}
+		if w := do(s, http.MethodPost, "/orders/"+id+"/payments", `{"method":"card","amount":100}`); w.Code != http.StatusCreated {
+			t.Fatalf("pay %s: %d %s", id, w.Code, w.Body)
+		}
+	}
+	// c2 was taken yesterday.
+	s.orders.store.Lock()
+	c2 := s.orders.store.m["c2"]
+	c2.CreatedAt = &yesterday
+	if err := s.orders.store.put(c2); err != nil {
+		t.Fatal(err)
+	}
+	s.orders.store.Unlock()
+
+	date := today.Format(dateLayout)
+	w := do(s, http.MethodPost, "/reports/close-day?date="+date, "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("close %s: %d %s", date, w.Code, w.Body)
+	}
+	var rep zReport
+	if err := json.Unmarshal(w.Body.Bytes(), &rep); err != nil {
+		t.Fatal(err)
+	}
+	if rep.GrossSales != 100 {
+		t.Errorf("gross sales %d, want only today's order", rep.GrossSales)
+	}
+	if w := do(s, http.MethodPost, "/reports/close-day?date="+date, ""); w.Code != http.StatusConflict {
+		t.Errorf("closing %s again: %d, want 409", date, w.Code)
+	}
+
+	// Another server on the same database sees the report and the locks.
+	s2 := open()
+	if w := do(s2, http.MethodGet, "/reports/z/"+date, ""); w.Code != http.StatusOK {
+		t.Errorf("Z-report after restart: %d %s", w.Code, w.Body)
+	}
+	s2.orders.store.RLock()
+	c1, c2 := s2.orders.store.m["c1"], s2.orders.store.m["c2"]
+	s2.orders.store.RUnlock()
+	if !c1.Locked || c2.Locked {
+		t.Errorf("after closing %s: c1 locked %v, c2 locked %v; want only c1", date, c1.Locked, c2.Locked)
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"regexp"
+)
+
+const requestIDHeader = "X-Request-ID"
+
+// requestIDRe is what a client-supplied request ID may look like. Anything
+// else, such as an ID long enough to bloat every log line, is replaced.
+var requestIDRe = regexp.MustCompile(`^[A-Za-z0-9._:+/=-]{1,128}$`)
+
+// requestIDMiddleware gives every request an ID: the client's X-Request-ID
+// when it has a usable one, or a new one. The ID is echoed on the response,
+// kept on the request context for log lines and error bodies, and left in
+// the request's header for handlers that forward it.
+func requestIDMiddleware() middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			id := r.Header.Get(requestIDHeader)
+			if !requestIDRe.MatchString(id) {
+				id, _ = randomToken(16)
+				r.Header.Set(requestIDHeader, id)
+			}
+			w.Header().Set(requestIDHeader, id)
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDCtxKey, id)))
+		})
+	}
+}
+
+// requestID is the ID of the request ctx belongs to, or "" outside one.
+func requestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDCtxKey).(string)
+	return id
+}
+
+// requestIDHandler adds the request ID to records logged with a request's
+// context, as slog.InfoContext(r.Context(), ...) does.
+type requestIDHandler struct {
+	slog.Handler
+}
+
+func (h requestIDHandler) Handle(ctx context.Context, rec slog.Record) error {
+	if id := requestID(ctx); id != "" {
+		rec.AddAttrs(slog.String("request_id", id))
+	}
+	return h.Handler.Handle(ctx, rec)
+}
+
+func (h requestIDHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return requestIDHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h requestIDHandler) WithGroup(name string) slog.Handler {
+	return requestIDHandler{h.Handler.WithGroup(name)}
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	listReservationsRe  = regexp.MustCompile(`^/reservations/?$`)
+	createReservationRe = regexp.MustCompile(`^/reservations/?$`)
+	cancelReservationRe = regexp.MustCompile(`^/reservations/([^/]+)/cancel$`)
+	createFeedRe        = regexp.MustCompile(`^/reservations/feeds$`)
+	revokeFeedRe        = regexp.MustCompile(`^/reservations/feeds/([0-9A-Za-z]+)$`)
+	calendarFeedRe      = regexp.MustCompile(`^/calendar/([0-9A-Za-z]+)\.ics$`)
+)
+
+const defaultLocation = "main"
+
+const defaultReservationLength = 90 * time.Minute
+
+type reservation struct {
+	ID          string    `json:"id"`
+	LocationID  string    `json:"location_id"`
+	Name        string    `json:"name"`
+	Phone       string    `json:"phone,omitempty"`
+	PartySize   int       `json:"party_size"`
+	Start       time.Time `json:"start"`
+	Minutes     int       `json:"minutes,omitempty"`
+	TableNumber string    `json:"table_number,omitempty"`
+	Notes       string    `json:"notes,omitempty"`
+	Cancelled   bool      `json:"cancelled,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+func (res reservation) end() time.Time {
+	if res.Minutes > 0 {
+		return res.Start.Add(time.Duration(res.Minutes) * time.Minute)
+	}
+	return res.Start.Add(defaultReservationLength)
+}
+
+type reservationStore struct {
+	m      map[string]reservation
+	feeds  map[string]string // token -> location
+	nextID int
+	*sync.RWMutex
+}
+
+func newReservationStore() *reservationStore {
+	return &reservationStore{
+		m:       map[string]reservation{},
+		feeds:   map[string]string{},
+		RWMutex: &sync.RWMutex{},
+	}
+}
+
+func (s *reservationStore) forLocation(location string) []reservation {
+	s.RLock()
+	out := make([]reservation, 0)
+	for _, res := range s.m {
+		if location == "" || res.LocationID == location {
+			out = append(out, res)
+		}
+	}
+	s.RUnlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].Start.Before(out[j].Start) })
+	return out
+}
+
+type reservationHandler struct {
+	reservations *reservationStore
+	sessions     *sessionStore
+}
+
+func (h *reservationHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("content-type", "application/json")
+	if r.Method == http.MethodGet && calendarFeedRe.MatchString(r.URL.Path) {
+		h.Feed(w, r)
+		return
+	}
+	scope := "orders:write"
+	if createFeedRe.MatchString(r.URL.Path) || revokeFeedRe.MatchString(r.URL.Path) {
+		scope = "orders:manage"
+	}
+	if _, ok := h.sessions.requireScope(w, r, scope); !ok {
+		return
+	}
+	switch {
+	case r.Method == http.MethodGet && listReservationsRe.MatchString(r.URL.Path):
+		writeJSON(w, r, http.StatusOK, h.reservations.forLocation(r.URL.Query().Get("location")))
+		return
+	case r.Method == http.MethodPost && createReservationRe.MatchString(r.URL.Path):
+		h.Create(w, r)
+		return
+	case r.Method == http.MethodPost && cancelReservationRe.MatchString(r.URL.Path):
+		h.Cancel(w, r)
+		return
+	case r.Method == http.MethodPost && createFeedRe.MatchString(r.URL.Path):
+		h.CreateFeed(w, r)
+		return
+	case r.Method == http.MethodDelete && revokeFeedRe.MatchString(r.URL.Path):
+		h.RevokeFeed(w, r)
+		return
+	default:
+		notFound(w, r)
+		return
+	}
+}
+
+func (h *reservationHandler) Create(w http.ResponseWriter, r *http.Request) {
+	var res reservation
+	if err := json.NewDecoder(r.Body).Decode(&res); err != nil || res.Name == "" || res.PartySize <= 0 || res.Start.IsZero() || res.Minutes < 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("name, party_size and start are required"))
+		return
+	}
+	if res.LocationID == "" {
+		res.LocationID = defaultLocation
+	}
+	res.Cancelled = false
+	res.CreatedAt = time.Now().UTC()
+	h.reservations.Lock()
+	h.reservations.nextID++
+	res.ID = strconv.Itoa(h.reservations.nextID)
+	h.reservations.m[res.ID] = res
+	h.reservations.Unlock()
+	writeJSON(w, r, http.StatusCreated, res)
+}
+
+func (h *reservationHandler) Cancel(w http.ResponseWriter, r *http.Request) {
+	matches := cancelReservationRe.FindStringSubmatch(r.URL.Path)
+	h.reservations.Lock()
+	res, ok := h.reservations.m[matches[1]]
+	if ok {
+		res.Cancelled = true
+		h.reservations.m[res.ID] = res
+	}
+	h.reservations.Unlock()
+	if !ok {
+		notFound(w, r)
+		return
+	}
+	writeJSON(w, r, http.StatusOK, res)
+}
+
+// CreateFeed issues a secret calendar URL for one location. Anyone holding
+// the URL can read that location's bookings, so it is revocable.
+func (h *reservationHandler) CreateFeed(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		LocationID string `json:"location_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("invalid request"))
+		return
+	}
+	if req.LocationID == "" {
+		req.LocationID = defaultLocation
+	}
+	token, err := randomToken(32)
+	if err != nil {
+		internalServerError(w, r)
+		return
+	}
+	h.reservations.Lock()
+	h.reservations.feeds[token] = req.LocationID
+	h.reservations.Unlock()
+	writeJSON(w, r, http.StatusCreated, map[string]string{
+		"location_id": req.LocationID,
+		"token":       token,
+		"url":         "/calendar/" + token + ".ics",
+	})
+}
+
+func (h *reservationHandler) RevokeFeed(w http.ResponseWriter, r *http.Request) {
+	matches := revokeFeedRe.FindStringSubmatch(r.URL.Path)
+	h.reservations.Lock()
+	_, ok := h.reservations.feeds[matches[1]]
+	delete(h.reservations.feeds, matches[1])
+	h.reservations.Unlock()
+	if !ok {
+		notFound(w, r)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *reservationHandler) Feed(w http.ResponseWriter, r *http.Request) {
+	matches := calendarFeedRe.FindStringSubmatch(r.URL.Path)
+	h.reservations.RLock()
+	location, ok := h.reservations.feeds[matches[1]]
+	h.reservations.RUnlock()
+	if !ok {
+		notFound(w, r)
+		return
+	}
+	w.Header().Set("content-type", "text/calendar; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(renderICal(location, h.reservations.forLocation(location), time.Now().UTC())))
+}
+
+const icalTime = "20060102T150405Z"
+
+// renderICal renders reservations as an RFC 5545 calendar.
+func renderICal(location string, reservations []reservation, now time.Time) string {
+	var b strings.Builder
+	line := func(format string, args ...interface{}) {
+		b.WriteString(foldICalLine(fmt.Sprintf(format, args...)))
+		b.WriteString("\r\n")
+	}
+	line("BEGIN:VCALENDAR")
+	line("VERSION:2.0")
+	line("PRODID:-//assignementOMAcon//reservations//EN")
+	line("CALSCALE:GREGORIAN")
+	line("X-WR-CALNAME:%s", icalEscape("Reservations - "+location))
+	for _, res := range reservations {
+		status := "CONFIRMED"
+		if res.Cancelled {
+			status = "CANCELLED"
+		}
+		line("BEGIN:VEVENT")
+		line("UID:reservation-%s@%s", res.ID, icalEscape(location))
+		line("DTSTAMP:%s", now.Format(icalTime))
+		line("DTSTART:%s", res.Start.UTC().Format(icalTime))
+		line("DTEND:%s", res.end().UTC().Format(icalTime))
+		line("SUMMARY:%s", icalEscape(fmt.Sprintf("%s (party of %d)", res.Name, res.PartySize)))
+		if res.TableNumber != "" {
+			line("LOCATION:%s", icalEscape("Table "+res.TableNumber))
+		}
+		desc := res.Notes
+		if res.Phone != "" {
+			desc = strings.TrimSpace("Phone: " + res.Phone + "\n" + desc)
+		}
+		if desc != "" {
+			line("DESCRIPTION:%s", icalEscape(desc))
+		}
+		line("STATUS:%s", status)
+		line("END:VEVENT")
+	}
+	line("END:VCALENDAR")
+	return b.String()
+}
+
+var icalEscaper = strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`)
+
+func icalEscape(s string) string {
+	return icalEscaper.Replace(s)
+}
+
+// foldICalLine splits content lines longer than 75 octets as RFC 5545
+// requires, without breaking UTF-8 sequences.
+func foldICalLine(s string) string {
+	const limit = 75
+	if len(s) <= limit {
+		return s
+	}
+	var b strings.Builder
+	width := 0
+	for _, r := range s {
+		n := len(string(r))
+		if width+n > limit {
+			b.WriteString("\r\n ")
+			width = 1
+		}
+		b.WriteRune(r)
+		width += n
+	}
+	return b.String()
+}
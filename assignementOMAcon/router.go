@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// router dispatches on method and path. Patterns are slash-separated
+// segments; a segment written {name} captures whatever is in that position
+// and handlers read it back with pathParam. Trailing slashes are ignored, so
+// /orders and /orders/ are the same route.
+//
+// When several patterns match a path the one with more literal segments wins,
+// whatever order they were added in, so /orders/stuck is never taken for the
+// order with ID "stuck". A path that matches only under another method gets
+// 405 with an Allow header rather than 404.
+type router struct {
+	routes []route
+}
+
+type route struct {
+	method   string
+	segments []string
+	handler  http.HandlerFunc
+}
+
+func newRouter() *router {
+	return &router{}
+}
+
+func (rt *router) handle(method, pattern string, h http.HandlerFunc) {
+	rt.routes = append(rt.routes, route{method: method, segments: splitPath(pattern), handler: h})
+}
+
+func splitPath(p string) []string {
+	p = strings.Trim(p, "/")
+	if p == "" {
+		return nil
+	}
+	return strings.Split(p, "/")
+}
+
+// match reports whether path fits the route, returning the captured
+// parameters and how many segments matched literally.
+func (rt route) match(path []string) (map[string]string, int, bool) {
+	if len(path) != len(rt.segments) {
+		return nil, 0, false
+	}
+	params := map[string]string{}
+	literal := 0
+	for i, seg := range rt.segments {
+		if strings.HasPrefix(seg, "{") && strings.HasSuffix(seg, "}") {
+			if path[i] == "" {
+				return nil, 0, false
+			}
+			params[seg[1:len(seg)-1]] = path[i]
+			continue
+		}
+		if seg != path[i] {
+			return nil, 0, false
+		}
+		literal++
+	}
+	return params, literal, true
+}
+
+func (rt *router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := splitPath(r.URL.Path)
+	var best *route
+	var bestParams map[string]string
+	bestLiteral := -1
+	allowed := map[string]bool{}
+	for i := range rt.routes {
+		params, literal, ok := rt.routes[i].match(path)
+		if !ok {
+			continue
+		}
+		if rt.routes[i].method != r.Method {
+			allowed[rt.routes[i].method] = true
+			continue
+		}
+		if literal > bestLiteral {
+			best, bestParams, bestLiteral = &rt.routes[i], params, literal
+		}
+	}
+	if best == nil {
+		if len(allowed) == 0 {
+			notFound(w, r)
+			return
+		}
+		methods := make([]string, 0, len(allowed))
+		for m := range allowed {
+			methods = append(methods, m)
+		}
+		sort.Strings(methods)
+		w.Header().Set("Allow", strings.Join(methods, ", "))
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte("method not allowed"))
+		return
+	}
+	best.handler(w, r.WithContext(context.WithValue(r.Context(), pathParamsCtxKey, bestParams)))
+}
+
+// pathParam is the path segment the matched route captured as {name}, or ""
+// when there is none.
+func pathParam(r *http.Request, name string) string {
+	params, _ := r.Context().Value(pathParamsCtxKey).(map[string]string)
+	return params[name]
+}
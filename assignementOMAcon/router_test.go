@@ -0,0 +1,129 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// TestRouter checks dispatch on a router whose handlers write the route they
+// were registered under and the parameters they were given. Parameter routes
+// are added before the literal ones they overlap, so the literal routes must
+// win by being more specific rather than by coming first.
+func TestRouter(t *testing.T) {
+	rt := newRouter()
+	for _, p := range []struct{ method, pattern string }{
+		{http.MethodGet, "/orders/{id}"},
+		{http.MethodPut, "/orders/{id}"},
+		{http.MethodGet, "/orders/{id}/history"},
+		{http.MethodPost, "/orders/{id}/courses/{course}/fire"},
+		{http.MethodGet, "/orders"},
+		{http.MethodPost, "/orders"},
+		{http.MethodGet, "/orders/export"},
+		{http.MethodGet, "/order"},
+		{http.MethodPut, "/order/orders"},
+	} {
+		name := p.method + " " + p.pattern
+		rt.handle(p.method, p.pattern, func(w http.ResponseWriter, r *http.Request) {
+			var params []string
+			for _, k := range []string{"id", "course"} {
+				if v := pathParam(r, k); v != "" {
+					params = append(params, k+"="+v)
+				}
+			}
+			w.Write([]byte(strings.TrimSpace(name + " " + strings.Join(params, " "))))
+		})
+	}
+
+	for _, tc := range []struct {
+		method, path string
+		status       int
+		body         string
+		allow        string
+	}{
+		{method: "GET", path: "/orders", status: 200, body: "GET /orders"},
+		{method: "GET", path: "/orders/", status: 200, body: "GET /orders"},
+		{method: "POST", path: "/orders", status: 200, body: "POST /orders"},
+		{method: "GET", path: "/orders/5", status: 200, body: "GET /orders/{id} id=5"},
+		{method: "PUT", path: "/orders/5/", status: 200, body: "PUT /orders/{id} id=5"},
+		{method: "GET", path: "/orders/5/history", status: 200, body: "GET /orders/{id}/history id=5"},
+		{method: "POST", path: "/orders/5/courses/2/fire", status: 200, body: "POST /orders/{id}/courses/{course}/fire id=5 course=2"},
+		{method: "GET", path: "/orders/export", status: 200, body: "GET /orders/export"},
+		// No literal route takes PUT, so export is an order ID here.
+		{method: "PUT", path: "/orders/export", status: 200, body: "PUT /orders/{id} id=export"},
+		{method: "DELETE", path: "/orders", status: 405, allow: "GET, POST"},
+		{method: "POST", path: "/orders/5", status: 405, allow: "GET, PUT"},
+		{method: "DELETE", path: "/orders/5/history", status: 405, allow: "GET"},
+		{method: "GET", path: "/order", status: 200, body: "GET /order"},
+		{method: "GET", path: "/order/", status: 200, body: "GET /order"},
+		{method: "PUT", path: "/order/orders", status: 200, body: "PUT /order/orders"},
+		{method: "GET", path: "/order/orders", status: 405, allow: "PUT"},
+		{method: "GET", path: "/orders/5/nope", status: 404},
+		{method: "GET", path: "/orders/5/courses//fire", status: 404},
+		{method: "GET", path: "/", status: 404},
+	} {
+		w := httptest.NewRecorder()
+		rt.ServeHTTP(w, httptest.NewRequest(tc.method, tc.path, nil))
+		if w.Code != tc.status {
+			t.Errorf("%s %s: status %d, want %d", tc.method, tc.path, w.Code, tc.status)
+			continue
+		}
+		if tc.body != "" && w.Body.String() != tc.body {
+			t.Errorf("%s %s: routed to %q, want %q", tc.method, tc.path, w.Body, tc.body)
+		}
+		if got := w.Header().Get("Allow"); got != tc.allow {
+			t.Errorf("%s %s: Allow %q, want %q", tc.method, tc.path, got, tc.allow)
+		}
+	}
+}
+
+// TestOrderRoutes sends requests for each kind of order route through the
+// whole server, with the routes the order handler really registers.
+func TestOrderRoutes(t *testing.T) {
+	s := newTestServer(t)
+	for _, tc := range []struct {
+		method, path, body string
+		status             int
+		contains           string
+		allow              string
+	}{
+		{method: "GET", path: "/orders", status: 200, contains: `"id":"5"`},
+		{method: "GET", path: "/orders/3", status: 200, contains: `"id":"3"`},
+		{method: "GET", path: "/orders/99", status: 404},
+		{method: "GET", path: "/orders/search?q=rahul", status: 200, contains: `"id":"1"`},
+		{method: "GET", path: "/orders/2/history", status: 200},
+		{method: "PUT", path: "/orders/4", body: `{"name":"Sanajana","table_number":"1234","order_items":[{"name":"roti","quantity":3}]}`, status: 200, contains: `"quantity":3`},
+		{method: "PUT", path: "/orders/4", body: `{"id":"5","name":"x","order_items":[{"name":"roti","quantity":1}]}`, status: 400},
+		{method: "PATCH", path: "/orders", status: 405, allow: "GET, POST"},
+		{method: "POST", path: "/orders/3", status: 405, allow: "DELETE, GET, PATCH, PUT"},
+		{method: "PUT", path: "/orders/3/history", status: 405, allow: "GET"},
+		{method: "GET", path: "/order", status: 200, contains: `"id":"5"`},
+		{method: "PUT", path: "/order/orders", body: `{"id":"5","name":"rohit","table_number":"1","order_items":[{"name":"pulav","quantity":2}]}`, status: 200, contains: `"quantity":2`},
+		{method: "PUT", path: "/order/orders", body: `{"id":"99","name":"x","order_items":[{"name":"roti","quantity":1}]}`, status: 404},
+		{method: "GET", path: "/order/orders", status: 405, allow: "PUT"},
+		{method: "GET", path: "/order/3", status: 404},
+	} {
+		w := do(s, tc.method, tc.path, tc.body)
+		if w.Code != tc.status {
+			t.Errorf("%s %s: status %d, want %d: %s", tc.method, tc.path, w.Code, tc.status, w.Body)
+			continue
+		}
+		if !strings.Contains(w.Body.String(), tc.contains) {
+			t.Errorf("%s %s: body %s does not contain %s", tc.method, tc.path, w.Body, tc.contains)
+		}
+		if got := w.Header().Get("Allow"); got != tc.allow {
+			t.Errorf("%s %s: Allow %q, want %q", tc.method, tc.path, got, tc.allow)
+		}
+	}
+
+	// /orders/export is the export, not the order with ID "export".
+	w := do(s, "GET", "/orders/export", "")
+	if w.Code != http.StatusOK || !strings.HasPrefix(w.Header().Get("content-type"), "text/csv") {
+		t.Errorf("GET /orders/export: status %d, content-type %q, want a CSV export",
+			w.Code, w.Header().Get("content-type"))
+	}
+	if header := strings.SplitN(w.Body.String(), "\n", 2)[0]; header != strings.Join(orderExportColumns, ",") {
+		t.Errorf("GET /orders/export: header %q, want the export columns", header)
+	}
+}
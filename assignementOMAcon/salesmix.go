@@ -0,0 +1,147 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+var salesMixRe = regexp.MustCompile(`^/reports/sales-mix$`)
+
+// uncategorized collects lines for items without a category, including
+// items that are not on the menu.
+const uncategorized = "uncategorized"
+
+// itemSales is one item's sales within its category. RevenueMix is its share
+// of the category's revenue.
+type itemSales struct {
+	MenuItemID string  `json:"menu_item_id,omitempty"`
+	Name       string  `json:"name"`
+	Quantity   int     `json:"quantity"`
+	Revenue    int64   `json:"revenue"`
+	RevenueMix float64 `json:"revenue_mix"`
+}
+
+// categorySales is one category's share of everything sold, as percentages
+// of the items sold and of the revenue.
+type categorySales struct {
+	Category    string      `json:"category"`
+	Quantity    int         `json:"quantity"`
+	Revenue     int64       `json:"revenue"`
+	QuantityMix float64     `json:"quantity_mix"`
+	RevenueMix  float64     `json:"revenue_mix"`
+	Items       []itemSales `json:"items"`
+}
+
+// salesMixReport covers the paid orders placed between From and To. Revenue
+// is line price times quantity, before order discounts, service charges, tax
+// and tips, so that categories compare on what was ordered.
+type salesMixReport struct {
+	From       string          `json:"from"`
+	To         string          `json:"to"`
+	Orders     int             `json:"orders"`
+	Quantity   int             `json:"quantity"`
+	Revenue    int64           `json:"revenue"`
+	Categories []categorySales `json:"categories"`
+}
+
+// percent is part of whole as a percentage to two places.
+func percent(part, whole float64) float64 {
+	if whole == 0 {
+		return 0
+	}
+	return math.Round(part/whole*10000) / 100
+}
+
+// SalesMix reports what sold per menu category between ?from= and ?to=
+// (inclusive dates, default today), largest revenue first. Every item on the
+// menu is listed under its category, those that sold nothing with zeros, so
+// slow sellers show up alongside the rest.
+func (h *reportHandler) SalesMix(w http.ResponseWriter, r *http.Request) {
+	from, to, err := parseDateRange(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	rep := salesMixReport{From: from.Format(dateLayout), To: to.AddDate(0, 0, -1).Format(dateLayout)}
+	type itemKey struct{ category, item string }
+	byItem := map[itemKey]*itemSales{}
+	lineFor := func(category, key string, it itemSales) *itemSales {
+		k := itemKey{category, key}
+		if byItem[k] == nil {
+			byItem[k] = &it
+		}
+		return byItem[k]
+	}
+	for _, item := range h.menu.list() {
+		category := item.Category
+		if category == "" {
+			category = uncategorized
+		}
+		lineFor(category, item.ID, itemSales{MenuItemID: item.ID, Name: item.Name})
+	}
+
+	h.store.RLock()
+	for _, o := range h.store.m {
+		at := o.CreatedAt
+		if at == nil {
+			at = o.UpdatedAt
+		}
+		if !isPaid(o) || at == nil || at.Before(from) || !at.Before(to) {
+			continue
+		}
+		rep.Orders++
+		for _, it := range o.OrderItems {
+			category, key, line := uncategorized, strings.ToLower(it.Name), itemSales{Name: it.Name}
+			if item, ok := h.menu.resolve(it); ok {
+				key, line = item.ID, itemSales{MenuItemID: item.ID, Name: item.Name}
+				if item.Category != "" {
+					category = item.Category
+				}
+			}
+			s := lineFor(category, key, line)
+			s.Quantity += it.Quantity
+			s.Revenue += int64(it.Quantity) * it.UnitPrice
+		}
+	}
+	h.store.RUnlock()
+
+	byCategory := map[string]*categorySales{}
+	for k, s := range byItem {
+		c := byCategory[k.category]
+		if c == nil {
+			c = &categorySales{Category: k.category}
+			byCategory[k.category] = c
+		}
+		c.Quantity += s.Quantity
+		c.Revenue += s.Revenue
+		c.Items = append(c.Items, *s)
+		rep.Quantity += s.Quantity
+		rep.Revenue += s.Revenue
+	}
+	rep.Categories = make([]categorySales, 0, len(byCategory))
+	for _, c := range byCategory {
+		c.QuantityMix = percent(float64(c.Quantity), float64(rep.Quantity))
+		c.RevenueMix = percent(float64(c.Revenue), float64(rep.Revenue))
+		for i := range c.Items {
+			c.Items[i].RevenueMix = percent(float64(c.Items[i].Revenue), float64(c.Revenue))
+		}
+		sort.Slice(c.Items, func(i, j int) bool {
+			if c.Items[i].Revenue != c.Items[j].Revenue {
+				return c.Items[i].Revenue > c.Items[j].Revenue
+			}
+			return c.Items[i].Name < c.Items[j].Name
+		})
+		rep.Categories = append(rep.Categories, *c)
+	}
+	sort.Slice(rep.Categories, func(i, j int) bool {
+		if rep.Categories[i].Revenue != rep.Categories[j].Revenue {
+			return rep.Categories[i].Revenue > rep.Categories[j].Revenue
+		}
+		return rep.Categories[i].Category < rep.Categories[j].Category
+	})
+	writeJSON(w, r, http.StatusOK, rep)
+}
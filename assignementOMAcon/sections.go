@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	listAssignmentsRe = regexp.MustCompile(`^/sections/assignments/?$`)
+	assignmentRe      = regexp.MustCompile(`^/sections/assignments/([^/]+)$`)
+)
+
+// sectionAssignment puts a waiter in charge of floor plan sections for one
+// shift. It lapses when the waiter clocks out.
+type sectionAssignment struct {
+	StaffID    string    `json:"staff_id"`
+	LocationID string    `json:"location_id"`
+	Sections   []string  `json:"sections"`
+	ShiftStart time.Time `json:"shift_start"`
+	AssignedBy string    `json:"assigned_by"`
+	AssignedAt time.Time `json:"assigned_at"`
+}
+
+// forbiddenError rejects a change the caller is not allowed to make.
+type forbiddenError struct {
+	msg string
+}
+
+func (e *forbiddenError) Error() string {
+	return e.msg
+}
+
+type sectionStore struct {
+	m     map[string]sectionAssignment
+	plans *floorPlanStore
+	tips  *tipStore
+	*sync.RWMutex
+}
+
+func newSectionStore(plans *floorPlanStore, tips *tipStore) *sectionStore {
+	return &sectionStore{m: map[string]sectionAssignment{}, plans: plans, tips: tips, RWMutex: &sync.RWMutex{}}
+}
+
+// openShift returns the start of the staff member's current shift.
+func (s *sectionStore) openShift(staffID string) (time.Time, bool) {
+	s.tips.RLock()
+	defer s.tips.RUnlock()
+	for _, sh := range s.tips.shifts {
+		if sh.StaffID == staffID && sh.End == nil {
+			return sh.Start, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// current returns the staff member's assignment if it belongs to the shift
+// they are working now.
+func (s *sectionStore) current(staffID string) (sectionAssignment, bool) {
+	s.RLock()
+	a, ok := s.m[staffID]
+	s.RUnlock()
+	if !ok {
+		return sectionAssignment{}, false
+	}
+	start, open := s.openShift(staffID)
+	return a, open && start.Equal(a.ShiftStart)
+}
+
+// sectionOf finds the floor plan section a table is in.
+func (s *sectionStore) sectionOf(location, table string) (string, bool) {
+	for _, sec := range s.plans.get(location).Sections {
+		for _, t := range sec.Tables {
+			if t.Number == table {
+				return sec.ID, true
+			}
+		}
+	}
+	return "", false
+}
+
+// authorize lets waiters change an order only if its table, before and after
+// the change, is in a section they are assigned for this shift. Tables that
+// are not in any section are open to everyone, and other roles are not
+// restricted.
+func (s *sectionStore) authorize(r *http.Request, sessions *sessionStore, prev, next order) error {
+	sess, ok := sessions.fromRequest(r)
+	if !ok || sess.Role != roleWaiter {
+		return nil
+	}
+	a, assigned := s.current(sess.StaffID)
+	for _, o := range []order{prev, next} {
+		if o.ID == "" || o.TableNumber == "" {
+			continue
+		}
+		location := orderLocation(o)
+		sec, ok := s.sectionOf(location, o.TableNumber)
+		if !ok {
+			continue
+		}
+		allowed := false
+		if assigned && a.LocationID == location {
+			for _, id := range a.Sections {
+				allowed = allowed || id == sec
+			}
+		}
+		if !allowed {
+			return &forbiddenError{msg: "table " + o.TableNumber + " is in section " + sec + ", which is not assigned to you"}
+		}
+	}
+	return nil
+}
+
+type sectionHandler struct {
+	sections *sectionStore
+	sessions *sessionStore
+	audit    *auditLog
+}
+
+func (h *sectionHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("content-type", "application/json")
+	scope := "orders:read"
+	if r.Method != http.MethodGet {
+		scope = "orders:manage"
+	}
+	sess, ok := h.sessions.requireScope(w, r, scope)
+	if !ok {
+		return
+	}
+	switch {
+	case r.Method == http.MethodGet && listAssignmentsRe.MatchString(r.URL.Path):
+		h.List(w, r)
+		return
+	case r.Method == http.MethodPut && assignmentRe.MatchString(r.URL.Path):
+		h.Assign(w, r, sess)
+		return
+	case r.Method == http.MethodDelete && assignmentRe.MatchString(r.URL.Path):
+		h.Unassign(w, r, sess)
+		return
+	default:
+		notFound(w, r)
+		return
+	}
+}
+
+// List returns the assignments for shifts that are still open.
+func (h *sectionHandler) List(w http.ResponseWriter, r *http.Request) {
+	h.sections.RLock()
+	ids := make([]string, 0, len(h.sections.m))
+	for id := range h.sections.m {
+		ids = append(ids, id)
+	}
+	h.sections.RUnlock()
+	sort.Strings(ids)
+	out := []sectionAssignment{}
+	for _, id := range ids {
+		if a, ok := h.sections.current(id); ok {
+			out = append(out, a)
+		}
+	}
+	writeJSON(w, r, http.StatusOK, out)
+}
+
+// Assign sets a clocked-in waiter's sections (body {"location_id", "sections"})
+// for the rest of their shift.
+func (h *sectionHandler) Assign(w http.ResponseWriter, r *http.Request, sess session) {
+	staffID := assignmentRe.FindStringSubmatch(r.URL.Path)[1]
+	var a sectionAssignment
+	if err := json.NewDecoder(r.Body).Decode(&a); err != nil || len(a.Sections) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("sections are required"))
+		return
+	}
+	if a.LocationID == "" {
+		a.LocationID = defaultLocation
+	}
+	known := map[string]bool{}
+	for _, sec := range h.sections.plans.get(a.LocationID).Sections {
+		known[sec.ID] = true
+	}
+	for _, id := range a.Sections {
+		if !known[id] {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("unknown section " + id))
+			return
+		}
+	}
+	start, ok := h.sections.openShift(staffID)
+	if !ok {
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte("not clocked in"))
+		return
+	}
+	a.StaffID, a.ShiftStart, a.AssignedBy, a.AssignedAt = staffID, start, sess.StaffID, time.Now().UTC()
+	h.sections.Lock()
+	h.sections.m[staffID] = a
+	h.sections.Unlock()
+	h.audit.record(auditEntry{Action: "section.assign", Ref: staffID, StaffID: sess.StaffID})
+	writeJSON(w, r, http.StatusOK, a)
+}
+
+func (h *sectionHandler) Unassign(w http.ResponseWriter, r *http.Request, sess session) {
+	staffID := assignmentRe.FindStringSubmatch(r.URL.Path)[1]
+	h.sections.Lock()
+	_, ok := h.sections.m[staffID]
+	delete(h.sections.m, staffID)
+	h.sections.Unlock()
+	if !ok {
+		notFound(w, r)
+		return
+	}
+	h.audit.record(auditEntry{Action: "section.unassign", Ref: staffID, StaffID: sess.StaffID})
+	w.WriteHeader(http.StatusNoContent)
+}
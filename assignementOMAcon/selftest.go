@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"time"
+)
+
+// selftestTotal is what the synthetic order costs, in minor units.
+const selftestTotal = 100
+
+type selftestStep struct {
+	Name       string  `json:"name"`
+	OK         bool    `json:"ok"`
+	Status     int     `json:"status,omitempty"`
+	DurationMs float64 `json:"duration_ms"`
+	Error      string  `json:"error,omitempty"`
+}
+
+type selftestReport struct {
+	OK      bool           `json:"ok"`
+	OrderID string         `json:"order_id"`
+	Steps   []selftestStep `json:"steps"`
+}
+
+// selftestHandler runs a synthetic order through the real order handler and
+// store so a deploy can be checked end to end. The order has no items and no
+// table, so it never reaches the kitchen, printers or inventory.
+type selftestHandler struct {
+	orders   *orderHandler
+	sessions *sessionStore
+}
+
+func (h *selftestHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("content-type", "application/json")
+	if r.Method != http.MethodPost {
+		notFound(w, r)
+		return
+	}
+	if _, ok := h.sessions.requireScope(w, r, "admin"); !ok {
+		return
+	}
+	suffix, err := randomToken(8)
+	if err != nil {
+		internalServerError(w, r)
+		return
+	}
+	rep := h.run(r, "selftest-"+suffix)
+	status := http.StatusOK
+	if !rep.OK {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, r, status, rep)
+}
+
+// run creates, updates, pays and deletes the order, stopping at the first
+// failed step. The order is deleted even when an earlier step failed.
+func (h *selftestHandler) run(r *http.Request, id string) selftestReport {
+	rep := selftestReport{OK: true, OrderID: id, Steps: []selftestStep{}}
+	o := order{ID: id, Name: "self-test", Payment: paymentPending, Channel: channelWalkIn, Total: selftestTotal}
+	steps := []struct {
+		name string
+		fn   func() (int, error)
+	}{
+		{"create", func() (int, error) {
+			return h.call(r, http.MethodPost, "/orders/", o, &o)
+		}},
+		{"update", func() (int, error) {
+			o.Name = "self-test (updated)"
+			return h.call(r, http.MethodPut, "/orders/"+id, o, &o)
+		}},
+		{"pay", func() (int, error) {
+			var view paymentsView
+			status, err := h.call(r, http.MethodPost, "/orders/"+id+"/payments", paymentLeg{Method: tenderCash, Amount: selftestTotal}, &view)
+			if err == nil && view.BalanceDue != 0 {
+				err = fmt.Errorf("balance due is %d after paying in full", view.BalanceDue)
+			}
+			return status, err
+		}},
+		{"verify", func() (int, error) {
+			h.orders.store.RLock()
+			stored, ok := h.orders.store.m[id]
+			h.orders.store.RUnlock()
+			switch {
+			case !ok:
+				return 0, errOrderNotFound
+			case stored.Name != o.Name:
+				return 0, fmt.Errorf("stored name is %q, want %q", stored.Name, o.Name)
+			case !isPaid(stored):
+				return 0, fmt.Errorf("stored order is not paid")
+			case stored.ReceiptURL == "":
+				return 0, fmt.Errorf("paid order has no receipt")
+			}
+			return 0, nil
+		}},
+	}
+	created := false
+	for _, s := range steps {
+		ok := h.step(&rep, s.name, s.fn)
+		if s.name == "create" {
+			created = ok
+		}
+		if !ok {
+			break
+		}
+	}
+	if created {
+		h.step(&rep, "delete", func() (int, error) {
+			return 0, h.orders.remove(r, id)
+		})
+	}
+	return rep
+}
+
+func (h *selftestHandler) step(rep *selftestReport, name string, fn func() (int, error)) bool {
+	start := time.Now()
+	status, err := fn()
+	s := selftestStep{
+		Name:       name,
+		OK:         err == nil,
+		Status:     status,
+		DurationMs: float64(time.Since(start).Microseconds()) / 1000,
+	}
+	if err != nil {
+		s.Error = err.Error()
+		rep.OK = false
+	}
+	rep.Steps = append(rep.Steps, s)
+	return s.OK
+}
+
+// call sends body to the order handler as the caller, so the steps are
+// audited under their session, and decodes a successful response into out.
+func (h *selftestHandler) call(r *http.Request, method, path string, body, out interface{}) (int, error) {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return 0, err
+	}
+	req, err := http.NewRequestWithContext(r.Context(), method, path, bytes.NewReader(b))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Authorization", r.Header.Get("Authorization"))
+	req.Header.Set(deviceTokenHeader, r.Header.Get(deviceTokenHeader))
+	rec := httptest.NewRecorder()
+	h.orders.ServeHTTP(rec, req)
+	if rec.Code < 200 || rec.Code > 299 {
+		return rec.Code, fmt.Errorf("%s %s: %d %s", method, path, rec.Code, bytes.TrimSpace(rec.Body.Bytes()))
+	}
+	return rec.Code, json.Unmarshal(rec.Body.Bytes(), out)
+}
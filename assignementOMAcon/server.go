@@ -0,0 +1,467 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"log"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"google.golang.org/grpc"
+)
+
+// server is the API wired up from a config: its stores, handlers and
+// background workers, behind the middleware chain.
+type server struct {
+	handler http.Handler
+	orders  *orderHandler
+	// grpc serves the order service of proto/orders.proto.
+	grpc *grpc.Server
+	// db is the order database, if orders are not kept in memory.
+	db *sqlStore
+}
+
+// newServer builds the server cfg describes. Its background workers run
+// until ctx is done; Close releases the database once they have stopped.
+func newServer(ctx context.Context, cfg config, logger *slog.Logger) (*server, error) {
+	mux := http.NewServeMux()
+
+	contention := newContentionTracker(cfg.LockTrace)
+	store := &datastore{
+		m: map[string]order{
+			"1": {
+				ID:          "1",
+				Name:        "Rahul",
+				OrderItems:  orderItems{{Name: "veg pulav", Quantity: 1}, {Name: "biryani", Quantity: 1}},
+				TotalItems:  2,
+				Payment:     paymentPaid,
+				TableNumber: "11",
+			},
+			"2": {
+				ID:          "2",
+				Name:        "Mayur",
+				OrderItems:  orderItems{{Name: "Pav Bhaji", Quantity: 1}, {Name: "manchurian", Quantity: 1}},
+				TotalItems:  2,
+				Payment:     paymentPaid,
+				TableNumber: "123",
+			},
+			"3": {
+				ID:          "3",
+				Name:        "Nikhil",
+				OrderItems:  orderItems{{Name: "veg pulav", Quantity: 1}},
+				TotalItems:  1,
+				Payment:     paymentPaid,
+				TableNumber: "12",
+			},
+			"4": {
+				ID:          "4",
+				Name:        "Sanajana",
+				OrderItems:  orderItems{{Name: "chicken khima", Quantity: 1}, {Name: "roti", Quantity: 1}},
+				TotalItems:  2,
+				Payment:     paymentPending,
+				TableNumber: "1234",
+			},
+			"5": {
+				ID:          "5",
+				Name:        "rohit",
+				OrderItems:  orderItems{{Name: "pulav", Quantity: 1}},
+				TotalItems:  1,
+				Payment:     paymentPending,
+				TableNumber: "1",
+			},
+		},
+		history:       newOrderHistory(),
+		reports:       newReportStore(),
+		tracedRWMutex: newTracedRWMutex("orders", contention),
+	}
+	if !cfg.Seed {
+		store.m = map[string]order{}
+	}
+	// The sqlite and postgres drivers keep orders in the database at the
+	// store's DSN; the default, memory, loses them on restart.
+	s := &server{}
+	if cfg.Store.Driver != storeMemory {
+		db, err := openSQLStore(cfg.Store.Driver, cfg.Store.DSN)
+		if err != nil {
+			return nil, err
+		}
+		s.db = db
+		if err := store.persist(db); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+	health := newHealthMonitor(ctx, store)
+	healthH := &healthHandler{monitor: health}
+	mux.Handle("/healthz", healthH)
+	mux.Handle("/readyz", healthH)
+	receipts := newReceiptStore()
+	tracking := newReceiptStore()
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		s.Close()
+		return nil, err
+	}
+	staffStore := newStaffStore(secret)
+	if cfg.Seed {
+		staffStore.add(staff{ID: "w1", Name: "Rahul", Role: roleWaiter}, "1234")
+		staffStore.add(staff{ID: "k1", Name: "Nikhil", Role: roleKitchen}, "2345")
+		staffStore.add(staff{ID: "m1", Name: "Mayur", Role: roleManager}, "345678")
+	}
+	for _, m := range cfg.Auth.Staff {
+		staffStore.add(staff{ID: m.ID, Name: m.Name, Role: m.Role, LocationID: m.LocationID}, m.PIN)
+	}
+	sessions := newSessionStore()
+	sessions.auth = &cfg.Auth
+	devices := newDeviceStore()
+	audit := newAuditLog()
+	feed := newChangeFeed()
+	events := newEventBus()
+	hooks := newHookRegistry()
+	validators := newValidatorRegistry()
+	validators.Register("name", validateName)
+	validators.Register("table", validateTable(cfg.TableNumberMax))
+	floorPlans := newFloorPlanStore(feed)
+	validators.Register("table_exists", validateTableExists(floorPlans))
+	validators.Register("channel", validateChannel)
+	validators.Register("items", validateItems)
+	validators.Register("payment", validatePayment)
+	if cfg.ValidationRules != "" {
+		if err := registerConstraints(validators, cfg.ValidationRules); err != nil {
+			s.Close()
+			return nil, err
+		}
+	}
+	menu := newMenuStore(feed)
+	if cfg.MenuCheck {
+		validators.Register("menu", validateMenuItems(menu))
+	}
+	loadPlugins(&pluginHost{Hooks: hooks, Validators: validators})
+	if cfg.Seed {
+		for _, item := range []menuItem{
+			{ID: "biryani", Name: "biryani"},
+			{ID: "veg-pulav", Name: "veg pulav"},
+			{ID: "pulav", Name: "pulav"},
+			{ID: "pav-bhaji", Name: "pav bhaji", Station: "grill"},
+			{ID: "manchurian", Name: "manchurian", Station: "fryer"},
+			{ID: "chicken-khima", Name: "chicken khima", Station: "grill"},
+			{ID: "roti", Name: "roti", Station: "grill"},
+		} {
+			menu.set(item)
+		}
+	}
+	store.RLock()
+	for _, o := range store.m {
+		menu.countOrdered(context.Background(), o)
+	}
+	store.RUnlock()
+	hooks.OnAfterCreate(menu.countOrdered)
+	kitchen := newKitchenQueue(menu)
+	layouts := newLayoutStore()
+	printers := newPrinterStore(rawTCPTransport, layouts)
+	kitchen.onFire = printers.printTicket
+	giftCards := newGiftCardStore()
+	customers := newCustomerStore()
+
+	inventory := newInventoryStore(hooks)
+	if cfg.Seed {
+		for _, item := range []inventoryItem{
+			{SKU: "biryani", Name: "biryani", OnHand: 40, Threshold: 10},
+			{SKU: "veg-pulav", Name: "veg pulav", OnHand: 40, Threshold: 10},
+			{SKU: "pulav", Name: "pulav", OnHand: 30, Threshold: 8},
+			{SKU: "pav-bhaji", Name: "pav bhaji", OnHand: 25, Threshold: 5},
+			{SKU: "manchurian", Name: "manchurian", OnHand: 25, Threshold: 5},
+			{SKU: "chicken-khima", Name: "chicken khima", OnHand: 20, Threshold: 5},
+			{SKU: "roti", Name: "roti", OnHand: 100, Threshold: 20},
+		} {
+			inventory.set(item)
+		}
+	}
+	hooks.OnAfterCreate(func(ctx context.Context, o order) {
+		inventory.consume(orderItemNames(o))
+	})
+	hooks.OnAfterCreate(kitchen.fireFirstCourse)
+	delivery := newDeliveryStore()
+	if cfg.DeliveryWebhook.Secret != "" {
+		delivery.register(newWebhookAdapter("webhook", cfg.DeliveryWebhook.Secret, cfg.DeliveryWebhook.StatusURL))
+	}
+	hooks.OnAfterStatusChange(delivery.statusChanged)
+	waits := newWaitEstimator()
+	hooks.OnAfterCreate(waits.seated)
+	hooks.OnAfterStatusChange(waits.statusChanged)
+
+	numbers, err := newOrderNumbers(cfg.OrderNumbers.File, cfg.OrderNumbers.Reset == "daily")
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	numbers.resume(store.m, time.Now())
+	var ulids *ulidSource
+	if cfg.OrderIDs == orderIDsULID {
+		ulids = newULIDSource()
+	}
+	tips := newTipStore()
+	sections := newSectionStore(floorPlans, tips)
+	settingsStore := newSettingsStore()
+	voids := newVoidStore()
+	overrides := newOverrideStore()
+	waste := newWasteLog()
+	drawers := newDrawerStore()
+	promotions := newPromotionStore(menu)
+	quotas := newQuotaStore(cfg.Quotas)
+	hooks.OnBeforeCreate(afterHours(settingsStore))
+	go health.track("scheduled", func() { releaseScheduled(ctx, store, kitchen, time.Minute) })
+	api := &jsonAPI{store: store, customers: customers, menu: menu}
+	orderH := &orderHandler{
+		store:       store,
+		receipts:    receipts,
+		tracking:    tracking,
+		sessions:    sessions,
+		devices:     devices,
+		audit:       audit,
+		feed:        feed,
+		events:      events,
+		hooks:       hooks,
+		validators:  validators,
+		kitchen:     kitchen,
+		menu:        menu,
+		jsonAPI:     api,
+		numbers:     numbers,
+		ulids:       ulids,
+		sections:    sections,
+		deleteMode:  cfg.DeleteMode,
+		duplicates:  newDuplicateCheck(cfg.Duplicates),
+		idempotency: newIdempotencyStore(time.Duration(cfg.IdempotencyTTL)),
+		settings:    settingsStore,
+		paging:      cfg.Paging,
+		promotions:  promotions,
+		voids:       voids,
+		overrides:   overrides,
+		waste:       waste,
+		drawers:     drawers,
+		quotas:      quotas,
+		accounts: map[string]tenderAccount{
+			tenderGiftCard:     giftCards,
+			tenderStoreCredit:  storeCreditTender{customers: customers},
+			tenderHouseAccount: houseAccountTender{customers: customers},
+		},
+	}
+
+	stuck := newWatchdog(store, kitchen, hooks, cfg.Stuck)
+	go health.track("stuck", func() { stuck.run(ctx, time.Minute) })
+	mux.Handle("/orders/stuck", &stuckHandler{watchdog: stuck, sessions: sessions})
+
+	orderH.routes = orderH.routeOrders()
+	mux.Handle("/orders", orderH)
+	mux.Handle("/orders/", orderH)
+	mux.Handle("/order/", orderH)
+	feedback := newFeedbackStore()
+	receiptH := &receiptHandler{store: store, receipts: receipts, layouts: layouts, menu: menu, feedback: feedback, audit: audit}
+	mux.Handle("/r/", receiptH)
+	mux.Handle("/track/", &trackingHandler{store: store, tracking: tracking, kitchen: kitchen, feed: feed})
+	mux.Handle("/auth/", &authHandler{staff: staffStore, sessions: sessions})
+	mux.Handle("/devices", &deviceHandler{devices: devices, sessions: sessions, audit: audit})
+	mux.Handle("/devices/", &deviceHandler{devices: devices, sessions: sessions, audit: audit})
+	syncH := newSyncHandler(orderH, feed)
+	syncH.sources[kindMenu] = menu.syncSource()
+	syncH.sources[kindTables] = floorPlans.syncSource()
+	mux.Handle("/sync", syncH)
+	mux.Handle("/sync/", syncH)
+	inventoryH := &inventoryHandler{inventory: inventory, sessions: sessions}
+	mux.Handle("/inventory", inventoryH)
+	mux.Handle("/inventory/", inventoryH)
+	purchasing := newPurchasingStore()
+	purchasingH := &purchasingHandler{
+		purchasing: purchasing,
+		inventory:  inventory,
+		store:      store,
+		sessions:   sessions,
+		audit:      audit,
+	}
+	mux.Handle("/suppliers", purchasingH)
+	mux.Handle("/suppliers/", purchasingH)
+	mux.Handle("/purchase-orders", purchasingH)
+	mux.Handle("/purchase-orders/", purchasingH)
+	mux.Handle("/purchasing/", purchasingH)
+	wasteH := &wasteHandler{waste: waste, inventory: inventory, purchasing: purchasing, store: store, sessions: sessions, audit: audit}
+	mux.Handle("/waste", wasteH)
+	mux.Handle("/waste/", wasteH)
+	drawerH := &drawerHandler{drawers: drawers, sessions: sessions, audit: audit}
+	mux.Handle("/drawers", drawerH)
+	mux.Handle("/drawers/", drawerH)
+	tipH := &tipHandler{tips: tips, staff: staffStore, store: store, sessions: sessions}
+	mux.Handle("/shifts", tipH)
+	mux.Handle("/shifts/", tipH)
+	mux.Handle("/tips/", tipH)
+	reportH := &reportHandler{
+		store:     store,
+		sessions:  sessions,
+		audit:     audit,
+		feed:      feed,
+		events:    events,
+		voids:     voids,
+		waste:     waste,
+		overrides: overrides,
+		feedback:  feedback,
+		menu:      menu,
+	}
+	mux.Handle("/reports/", reportH)
+	mux.Handle("/voids", &voidHandler{voids: voids, sessions: sessions})
+	images, err := newImageStore(cfg.Images)
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	menuH := &menuHandler{menu: menu, sessions: sessions, jsonAPI: api, images: images}
+	mux.Handle("/menu", menuH)
+	mux.Handle("/menu/", menuH)
+	kitchenH := &kitchenHandler{queue: kitchen, store: store, sessions: sessions}
+	mux.Handle("/kitchen/", kitchenH)
+	mux.Handle("/metrics", &metricsHandler{store: store, kitchen: kitchenH, sessions: sessions})
+	giftCardH := &giftCardHandler{cards: giftCards, sessions: sessions, audit: audit}
+	mux.Handle("/giftcards", giftCardH)
+	mux.Handle("/giftcards/", giftCardH)
+	customerH := &customerHandler{customers: customers, sessions: sessions, audit: audit, jsonAPI: api}
+	mux.Handle("/customers", customerH)
+	mux.Handle("/customers/", customerH)
+	reservations := newReservationStore()
+	reservationH := &reservationHandler{reservations: reservations, sessions: sessions}
+	mux.Handle("/reservations", reservationH)
+	mux.Handle("/reservations/", reservationH)
+	mux.Handle("/calendar/", reservationH)
+	floorPlanH := &floorPlanHandler{plans: floorPlans, store: store, reservations: reservations, sessions: sessions}
+	mux.Handle("/floorplan", floorPlanH)
+	mux.Handle("/floorplan/", floorPlanH)
+	tableH := &tableHandler{plans: floorPlans, store: store, reservations: reservations, sessions: sessions}
+	mux.Handle("/tables", tableH)
+	mux.Handle("/tables/", tableH)
+	sectionH := &sectionHandler{sections: sections, sessions: sessions, audit: audit}
+	mux.Handle("/sections/", sectionH)
+	mux.Handle("/waitlist/", &waitlistHandler{
+		estimator:    waits,
+		plans:        floorPlans,
+		store:        store,
+		reservations: reservations,
+		kitchen:      kitchen,
+		sessions:     sessions,
+	})
+	mux.Handle("/integrations/", &deliveryHandler{delivery: delivery, orders: orderH})
+	mux.Handle("/admin/webhooks/", &webhookHandler{delivery: delivery, sessions: sessions, audit: audit})
+	courierH := &courierHandler{couriers: newCourierStore(), store: store, sessions: sessions, audit: audit}
+	mux.Handle("/couriers", courierH)
+	mux.Handle("/couriers/", courierH)
+	promotionH := &promotionHandler{promotions: promotions, sessions: sessions, audit: audit}
+	mux.Handle("/promotions", promotionH)
+	mux.Handle("/promotions/", promotionH)
+	printerH := &printerHandler{printers: printers, sessions: sessions}
+	for _, path := range []string{"/admin/printers", "/admin/printers/", "/admin/printer-groups", "/admin/printer-groups/", "/admin/print-routes", "/admin/print-routes/", "/admin/print-jobs"} {
+		mux.Handle(path, printerH)
+	}
+	layoutH := &layoutHandler{layouts: layouts, sessions: sessions}
+	mux.Handle("/admin/layouts/", layoutH)
+	mux.Handle("/staff/", &activityHandler{audit: audit, staff: staffStore, sessions: sessions})
+	settingsH := &settingsHandler{settings: settingsStore, sessions: sessions, audit: audit}
+	for _, path := range []string{"/admin/settings", "/admin/settings/", "/settings"} {
+		mux.Handle(path, settingsH)
+	}
+	auditH := &auditHandler{audit: audit, sessions: sessions, paging: cfg.Paging}
+	mux.Handle("/admin/audit", auditH)
+	mux.Handle("/admin/audit/", auditH)
+	quotaH := &quotaHandler{quotas: quotas, store: store, sessions: sessions, audit: audit}
+	mux.Handle("/admin/quotas", quotaH)
+	mux.Handle("/admin/quotas/", quotaH)
+	var exports *exporter
+	if cfg.Exports.Bucket != "" {
+		dest, err := newS3Store(cfg.Exports.objectStoreConfig)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		at, err := cfg.Exports.offset()
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		exports = newExporter(audit, feed, dest, cfg.Exports.Prefix)
+		go health.track("exports", func() { exports.run(ctx, at) })
+	}
+	exportH := &exportHandler{exporter: exports, sessions: sessions, audit: audit}
+	mux.Handle("/admin/exports", exportH)
+	mux.Handle("/admin/exports/", exportH)
+	mailCfg, err := newMailConfig(cfg.SMTP)
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	mailer := newReportMailer(newScheduledReports(reportH, tipH), mailCfg)
+	go health.track("report-mail", func() { mailer.run(ctx) })
+	reportScheduleH := &reportScheduleHandler{mailer: mailer, sessions: sessions, audit: audit}
+	mux.Handle("/admin/report-schedules", reportScheduleH)
+	mux.Handle("/admin/report-schedules/", reportScheduleH)
+	mux.Handle("/admin/import", &importHandler{orders: orderH, sessions: sessions})
+	signer, err := newLinkSigner(cfg.LinkSigningKey)
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	mux.Handle("/admin/links", &linkHandler{signer: signer, store: store, sessions: sessions, audit: audit})
+	mux.Handle("/files/", &fileHandler{signer: signer, receipts: receiptH, audit: audit, feed: feed})
+	mux.Handle("/ws/orders", &orderStreamHandler{events: events, sessions: sessions})
+	mux.Handle("/admin/contention", &contentionHandler{tracker: contention, sessions: sessions})
+	docsH, err := newDocsHandler(orderH.routes)
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	mux.Handle("/openapi.json", docsH)
+	mux.Handle("/docs", docsH)
+	mux.Handle("/docs/", docsH)
+	mux.Handle("/debug/selftest", &selftestHandler{orders: orderH, sessions: sessions})
+
+	available := map[string]middleware{
+		"requestid": requestIDMiddleware(),
+		"logging":   loggingMiddleware(logger),
+		"paths":     pathMiddleware(cfg.PathMode, mux),
+		"naming":    namingMiddleware(sessions, cfg.FieldNaming),
+		"envelope":  envelopeMiddleware(cfg.ResponseEnvelope, cfg.Paging, sessions),
+		"errors":    errorMiddleware(),
+		"recovery":  recoveryMiddleware(hooks),
+		"cors":      corsMiddleware(cfg.CORSOrigins),
+		"ratelimit": rateLimitMiddleware(cfg.RateLimit, sessions.auth),
+		"auth":      authMiddleware(sessions, sessions.auth),
+		"quota":     quotaMiddleware(quotas),
+	}
+	names := cfg.Middleware
+	if cfg.Chaos.enabled() {
+		available["chaos"] = chaosMiddleware(cfg.Chaos)
+		names = append(names[:len(names):len(names)], "chaos")
+		log.Printf("chaos mode: faults %v on %g%% of requests", cfg.Chaos.Faults, cfg.Chaos.Percent)
+	}
+	if cfg.LockTrace {
+		available["locktrace"] = lockTraceMiddleware(contention)
+		names = append(names[:len(names):len(names)], "locktrace")
+		log.Printf("lock tracing on: see /admin/contention")
+	}
+	handler, err := buildChain(mux, names, available)
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	s.handler, s.orders = handler, orderH
+	s.grpc = newGRPCServer(ctx, orderH, sessions, quotas, events)
+	return s, nil
+}
+
+func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.handler.ServeHTTP(w, r)
+}
+
+// Close closes the order database, if there is one.
+func (s *server) Close() error {
+	if s.db == nil {
+		return nil
+	}
+	return s.db.Close()
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+)
+
+const testAPIKey = "test-manager-key"
+
+// newTestServer builds a server from the default config, with the seed data,
+// a manager API key and any other keys given, keeping orders in memory.
+func newTestServer(t testing.TB, keys ...apiKey) *server {
+	t.Helper()
+	cfg := defaultConfig()
+	cfg.Seed = true
+	cfg.Auth.APIKeys = append([]apiKey{{Name: "test", Role: roleManager, Key: testAPIKey}}, keys...)
+	auth, err := loadAuthConfig(cfg.Auth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Auth = *auth
+	ctx, cancel := context.WithCancel(context.Background())
+	s, err := newServer(ctx, cfg, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		cancel()
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		cancel()
+		s.Close()
+	})
+	return s
+}
+
+// do sends a request with the manager key and returns the recorded response.
+func do(s *server, method, path, body string) *httptest.ResponseRecorder {
+	return doWithKey(s, testAPIKey, method, path, body)
+}
+
+// doWithKey sends a request with key and returns the recorded response.
+func doWithKey(s *server, key, method, path, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	r.Header.Set(apiKeyHeader, key)
+	if body != "" {
+		r.Header.Set("content-type", "application/json")
+	}
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	return w
+}
+
+// TestOrdersConcurrentAccess reads, creates and updates orders from many
+// goroutines at once. Run it with -race to check the store is locked
+// properly.
+func TestOrdersConcurrentAccess(t *testing.T) {
+	s := newTestServer(t)
+	const workers, rounds = 8, 20
+	var wg sync.WaitGroup
+	errs := make(chan error, workers*rounds*3)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < rounds; j++ {
+				if w := do(s, http.MethodGet, "/orders/1", ""); w.Code != http.StatusOK {
+					errs <- fmt.Errorf("GET /orders/1: %d %s", w.Code, w.Body)
+				}
+				id := fmt.Sprintf("t%d-%d", i, j)
+				body := fmt.Sprintf(`{"id":%q,"name":"guest %d","table_number":"%d","order_items":[{"name":"roti","quantity":1}]}`, id, j, i+1)
+				if w := do(s, http.MethodPost, "/orders", body); w.Code != http.StatusOK {
+					errs <- fmt.Errorf("POST %s: %d %s", id, w.Code, w.Body)
+					continue
+				}
+				body = fmt.Sprintf(`{"name":"guest %d","table_number":"%d","order_items":[{"name":"roti","quantity":2}]}`, j, i+1)
+				if w := do(s, http.MethodPut, "/orders/"+id, body); w.Code != http.StatusOK {
+					errs <- fmt.Errorf("PUT %s: %d %s", id, w.Code, w.Body)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	s.orders.store.RLock()
+	defer s.orders.store.RUnlock()
+	if n := len(s.orders.store.m); n != 5+workers*rounds {
+		t.Errorf("store has %d orders, want %d", n, 5+workers*rounds)
+	}
+	for i := 0; i < workers; i++ {
+		for j := 0; j < rounds; j++ {
+			id := fmt.Sprintf("t%d-%d", i, j)
+			if o := s.orders.store.m[id]; len(o.OrderItems) != 1 || o.OrderItems[0].Quantity != 2 {
+				t.Errorf("order %s was not updated: %+v", id, o.OrderItems)
+			}
+		}
+	}
+}
+
+// TestSoftDelete checks that a soft delete cancels the order's status and
+// leaves its payment status alone.
+func TestSoftDelete(t *testing.T) {
+	s := newTestServer(t)
+	s.orders.deleteMode = deleteSoft
+	if w := do(s, http.MethodDelete, "/orders/4", ""); w.Code != http.StatusNoContent {
+		t.Fatalf("DELETE /orders/4: %d %s", w.Code, w.Body)
+	}
+	s.orders.store.RLock()
+	o := s.orders.store.m["4"]
+	s.orders.store.RUnlock()
+	if o.Status != statusCancelled || o.Payment != paymentPending || !isVoided(o) {
+		t.Errorf("soft-deleted order has status %q and payment %q", o.Status, o.Payment)
+	}
+	if w := do(s, http.MethodDelete, "/orders/4", ""); w.Code != http.StatusConflict {
+		t.Errorf("second DELETE /orders/4: %d, want 409", w.Code)
+	}
+}
+
+// TestStaffFromConfig checks that staff listed in the auth config can log in
+// with their PIN and that the demo staff are only there with seed data.
+func TestStaffFromConfig(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Auth.Staff = []staffAccount{{ID: "s1", Name: "Asha", Role: roleWaiter, PIN: "4821"}}
+	auth, err := loadAuthConfig(cfg.Auth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Auth = *auth
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s, err := newServer(ctx, cfg, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	for _, tc := range []struct {
+		body   string
+		status int
+	}{
+		{`{"staff_id":"s1","pin":"4821"}`, http.StatusOK},
+		{`{"staff_id":"m1","pin":"345678"}`, http.StatusUnauthorized},
+	} {
+		w := do(s, http.MethodPost, "/auth/pin", tc.body)
+		if w.Code != tc.status {
+			t.Errorf("PIN login %s: %d, want %d", tc.body, w.Code, tc.status)
+		}
+	}
+
+	for _, bad := range [][]staffAccount{
+		{{ID: "s1", Role: roleWaiter, PIN: "12"}},
+		{{ID: "s1", Role: "chef", PIN: "1234"}},
+		{{ID: "s1", Role: roleWaiter, PIN: "1234"}, {ID: "s1", Role: roleKitchen, PIN: "2345"}},
+	} {
+		if _, err := loadAuthConfig(authConfig{Staff: bad}); err == nil {
+			t.Errorf("staff %+v were accepted", bad)
+		}
+	}
+}
+
+// TestConfigRequiresAuth checks that a middleware list leaving out auth, which
+// guards the order routes, is refused.
+func TestConfigRequiresAuth(t *testing.T) {
+	cfg := defaultConfig()
+	if err := cfg.validate(); err != nil {
+		t.Fatalf("default config: %v", err)
+	}
+	cfg.Middleware = []string{"requestid", "logging", "recovery"}
+	if err := cfg.validate(); err == nil {
+		t.Error("middleware without auth was accepted")
+	}
+}
+
+// TestOData checks that $filter rejects literals of the wrong type, and that
+// OData queries are paged like the list.
+func TestOData(t *testing.T) {
+	s := newTestServer(t)
+	for _, filter := range []string{"total eq 'abc'", "locked eq 1", "contains(total,'1')", "order_items eq 'roti'"} {
+		w := do(s, http.MethodGet, "/orders?$filter="+url.QueryEscape(filter), "")
+		if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), `"validation_failed"`) {
+			t.Errorf("$filter=%s: %d %s, want a validation error", filter, w.Code, w.Body)
+		}
+	}
+	if w := do(s, http.MethodGet, "/orders?$filter="+url.QueryEscape("table_number eq 4"), ""); w.Code != http.StatusOK {
+		t.Errorf("number for a string field: %d %s", w.Code, w.Body)
+	}
+	w := do(s, http.MethodGet, "/orders?$orderby=id&limit=2&offset=1", "")
+	var res struct {
+		Value []order `json:"value"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil || len(res.Value) != 2 || res.Value[0].ID != "2" {
+		t.Errorf("?limit= and ?offset= with OData: %d %s", w.Code, w.Body)
+	}
+}
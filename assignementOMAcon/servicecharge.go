@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// serviceChargeRule adds Percent of the bill to orders for parties of at
+// least MinPartySize (zero: every order).
+type serviceChargeRule struct {
+	Name         string  `json:"name"`
+	Percent      float64 `json:"percent"`
+	MinPartySize int     `json:"min_party_size,omitempty"`
+}
+
+// serviceCharge is the automatic charge on an order, a line of its own on
+// the bill. Amount is already included in the order's Total. A manager can
+// remove it; the rule stays recorded alongside who removed it and why.
+type serviceCharge struct {
+	Rule          string     `json:"rule"`
+	Percent       float64    `json:"percent"`
+	Amount        int64      `json:"amount"`
+	RemovedBy     string     `json:"removed_by,omitempty"`
+	RemovedReason string     `json:"removed_reason,omitempty"`
+	RemovedAt     *time.Time `json:"removed_at,omitempty"`
+}
+
+// serviceChargeRules are the rules a location charges by. The flat
+// service_charge_percent setting counts as a rule for every party size.
+func (e effectiveSettings) serviceChargeRules() []serviceChargeRule {
+	rules := e.ServiceChargeRules
+	if e.ServiceChargePercent > 0 {
+		rules = append([]serviceChargeRule{{Name: "service charge", Percent: e.ServiceChargePercent}}, rules...)
+	}
+	return rules
+}
+
+// matchServiceCharge picks the rule for a party: of those that apply, the
+// one charging most.
+func matchServiceCharge(rules []serviceChargeRule, partySize int) (serviceChargeRule, bool) {
+	var best serviceChargeRule
+	found := false
+	for _, rule := range rules {
+		if partySize < rule.MinPartySize {
+			continue
+		}
+		if !found || rule.Percent > best.Percent {
+			best, found = rule, true
+		}
+	}
+	return best, found
+}
+
+// applyServiceCharge works out next's service charge and adds it to Total.
+// Clients send totals without the charge; an order echoed back with its
+// service_charge has that amount taken off first so it is not charged twice.
+// Once a manager has removed the charge it stays removed, and settled orders
+// keep what they were charged.
+func applyServiceCharge(settings *settingsStore, prev order, next *order) {
+	if isFinal(prev) {
+		next.ServiceCharge = prev.ServiceCharge
+		return
+	}
+	base := next.Total
+	if next.ServiceCharge != nil {
+		base -= next.ServiceCharge.Amount
+	}
+	next.Total, next.ServiceCharge = base, nil
+	if prev.ServiceCharge != nil && prev.ServiceCharge.RemovedAt != nil {
+		removed := *prev.ServiceCharge
+		next.ServiceCharge = &removed
+		return
+	}
+	location := next.LocationID
+	if prev.LocationID != "" {
+		location = prev.LocationID
+	}
+	if location == "" {
+		location = defaultLocation
+	}
+	rule, ok := matchServiceCharge(settings.resolve(location).serviceChargeRules(), next.PartySize)
+	if !ok || base <= 0 {
+		return
+	}
+	amount := int64(math.Round(float64(base) * rule.Percent / 100))
+	next.ServiceCharge = &serviceCharge{Rule: rule.Name, Percent: rule.Percent, Amount: amount}
+	next.Total += amount
+}
+
+// RemoveServiceCharge takes the service charge off an order. Only managers
+// may, and they must say why.
+func (h *orderHandler) RemoveServiceCharge(w http.ResponseWriter, r *http.Request) {
+	sess, ok := h.sessions.requireScope(w, r, "orders:manage")
+	if !ok {
+		return
+	}
+	var req struct {
+		Reason string `json:"reason"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || strings.TrimSpace(req.Reason) == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("reason is required"))
+		return
+	}
+	o, err := h.mutate(r, pathParam(r, "id"), "order.service_charge.remove", func(o *order) error {
+		if isFinal(*o) {
+			return &badRequestError{msg: "settled orders cannot be changed"}
+		}
+		if o.ServiceCharge == nil || o.ServiceCharge.RemovedAt != nil {
+			return &badRequestError{msg: "order has no service charge"}
+		}
+		now := time.Now().UTC()
+		removed := *o.ServiceCharge
+		o.Total -= removed.Amount
+		removed.Amount = 0
+		removed.RemovedBy, removed.RemovedReason, removed.RemovedAt = sess.StaffID, strings.TrimSpace(req.Reason), &now
+		o.ServiceCharge = &removed
+		return nil
+	})
+	if err != nil {
+		mutateFailed(w, r, err)
+		return
+	}
+	writeJSON(w, r, http.StatusOK, o)
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	globalSettingsRe   = regexp.MustCompile(`^/admin/settings/?$`)
+	locationSettingsRe = regexp.MustCompile(`^/admin/settings/locations/([^/]+)$`)
+	listOverridesRe    = regexp.MustCompile(`^/admin/settings/locations/?$`)
+	effectiveSettingRe = regexp.MustCompile(`^/settings/?$`)
+	currencyRe         = regexp.MustCompile(`^[A-Z]{3}$`)
+	clockRe            = regexp.MustCompile(`^([01][0-9]|2[0-3]):[0-5][0-9]$`)
+)
+
+var weekdays = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// serviceWindow is one stretch of opening hours on a day, as HH:MM in the
+// location's time zone. A window that closes at or before it opens runs past
+// midnight.
+type serviceWindow struct {
+	Open  string `json:"open"`
+	Close string `json:"close"`
+}
+
+// openingHours lists each weekday's (sun, mon, ... sat) service windows. A
+// day missing from the map is closed; a nil map means always open.
+type openingHours map[string][]serviceWindow
+
+// settings holds configuration that can differ between locations. In an
+// override, fields left null fall back to the global value.
+type settings struct {
+	TaxPercent           *float64     `json:"tax_percent"`
+	Currency             *string      `json:"currency"`
+	ServiceChargePercent *float64     `json:"service_charge_percent"`
+	Timezone             *string      `json:"timezone"`
+	OpeningHours         openingHours `json:"opening_hours"`
+	// ServiceChargeRules add automatic charges by party size; null inherits
+	// the global rules and an empty list turns them off.
+	ServiceChargeRules []serviceChargeRule `json:"service_charge_rules"`
+	// AfterHours is what happens to guest orders placed while closed:
+	// reject, or schedule them for the next opening.
+	AfterHours *string `json:"after_hours"`
+	// OrderReference is the format new orders' references are given in,
+	// such as "T{table}-{seq}"; see referencePlaceholderRe.
+	OrderReference *string `json:"order_reference"`
+}
+
+func (s settings) validate() error {
+	if s.AfterHours != nil && *s.AfterHours != afterHoursReject && *s.AfterHours != afterHoursSchedule {
+		return fmt.Errorf("after_hours must be reject or schedule")
+	}
+	for _, p := range []*float64{s.TaxPercent, s.ServiceChargePercent} {
+		if p != nil && (*p < 0 || *p > 100) {
+			return fmt.Errorf("percentages must be between 0 and 100")
+		}
+	}
+	for _, rule := range s.ServiceChargeRules {
+		if strings.TrimSpace(rule.Name) == "" || rule.Percent < 0 || rule.Percent > 100 || rule.MinPartySize < 0 {
+			return fmt.Errorf("service charge rules need a name, a percent between 0 and 100 and a non-negative min_party_size")
+		}
+	}
+	if s.OrderReference != nil {
+		if err := validateReferenceFormat(*s.OrderReference); err != nil {
+			return err
+		}
+	}
+	if s.Currency != nil && !currencyRe.MatchString(*s.Currency) {
+		return fmt.Errorf("currency must be an ISO 4217 code such as INR")
+	}
+	if s.Timezone != nil {
+		if _, err := time.LoadLocation(*s.Timezone); err != nil {
+			return fmt.Errorf("unknown timezone %q", *s.Timezone)
+		}
+	}
+	known := map[string]bool{}
+	for _, d := range weekdays {
+		known[d] = true
+	}
+	for day, windows := range s.OpeningHours {
+		if !known[day] {
+			return fmt.Errorf("opening_hours days must be sun, mon, tue, wed, thu, fri or sat")
+		}
+		for _, win := range windows {
+			if !clockRe.MatchString(win.Open) || !clockRe.MatchString(win.Close) {
+				return fmt.Errorf("opening hours must be HH:MM")
+			}
+		}
+	}
+	return nil
+}
+
+// effectiveSettings is the configuration a location runs with, and where each
+// value came from.
+type effectiveSettings struct {
+	LocationID           string              `json:"location_id"`
+	TaxPercent           float64             `json:"tax_percent"`
+	Currency             string              `json:"currency"`
+	ServiceChargePercent float64             `json:"service_charge_percent"`
+	Timezone             string              `json:"timezone"`
+	OpeningHours         openingHours        `json:"opening_hours"`
+	ServiceChargeRules   []serviceChargeRule `json:"service_charge_rules"`
+	AfterHours           string              `json:"after_hours"`
+	OrderReference       string              `json:"order_reference"`
+	Sources              map[string]string   `json:"sources"`
+}
+
+func (e effectiveSettings) location() *time.Location {
+	loc, err := time.LoadLocation(e.Timezone)
+	if err != nil {
+		return time.UTC
+	}
+	return loc
+}
+
+func float64Ptr(v float64) *float64 { return &v }
+func stringPtr(v string) *string    { return &v }
+
+var defaultSettings = settings{
+	TaxPercent:           float64Ptr(0),
+	Currency:             stringPtr("INR"),
+	ServiceChargePercent: float64Ptr(0),
+	Timezone:             stringPtr("UTC"),
+	AfterHours:           stringPtr(afterHoursReject),
+	OrderReference:       stringPtr(defaultReferenceFormat),
+}
+
+// settingsStore layers per-location overrides over global settings.
+type settingsStore struct {
+	global    settings
+	locations map[string]settings
+	*sync.RWMutex
+}
+
+func newSettingsStore() *settingsStore {
+	return &settingsStore{global: defaultSettings, locations: map[string]settings{}, RWMutex: &sync.RWMutex{}}
+}
+
+// resolve works out a location's settings: its override where set, the global
+// setting otherwise.
+func (s *settingsStore) resolve(location string) effectiveSettings {
+	s.RLock()
+	g, o := s.global, s.locations[location]
+	s.RUnlock()
+	e := effectiveSettings{LocationID: location, Sources: map[string]string{}}
+	pickFloat := func(name string, dst *float64, over, global *float64) {
+		*dst, e.Sources[name] = *global, "global"
+		if over != nil {
+			*dst, e.Sources[name] = *over, "location"
+		}
+	}
+	pickString := func(name string, dst *string, over, global *string) {
+		*dst, e.Sources[name] = *global, "global"
+		if over != nil {
+			*dst, e.Sources[name] = *over, "location"
+		}
+	}
+	pickFloat("tax_percent", &e.TaxPercent, o.TaxPercent, g.TaxPercent)
+	pickString("currency", &e.Currency, o.Currency, g.Currency)
+	pickFloat("service_charge_percent", &e.ServiceChargePercent, o.ServiceChargePercent, g.ServiceChargePercent)
+	pickString("timezone", &e.Timezone, o.Timezone, g.Timezone)
+	pickString("after_hours", &e.AfterHours, o.AfterHours, g.AfterHours)
+	pickString("order_reference", &e.OrderReference, o.OrderReference, g.OrderReference)
+	e.OpeningHours, e.Sources["opening_hours"] = g.OpeningHours, "global"
+	if o.OpeningHours != nil {
+		e.OpeningHours, e.Sources["opening_hours"] = o.OpeningHours, "location"
+	}
+	e.ServiceChargeRules, e.Sources["service_charge_rules"] = g.ServiceChargeRules, "global"
+	if o.ServiceChargeRules != nil {
+		e.ServiceChargeRules, e.Sources["service_charge_rules"] = o.ServiceChargeRules, "location"
+	}
+	if e.ServiceChargeRules == nil {
+		e.ServiceChargeRules = []serviceChargeRule{}
+	}
+	return e
+}
+
+type settingsHandler struct {
+	settings *settingsStore
+	sessions *sessionStore
+	audit    *auditLog
+}
+
+func (h *settingsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("content-type", "application/json")
+	if effectiveSettingRe.MatchString(r.URL.Path) {
+		if _, ok := h.sessions.requireScope(w, r, "orders:read"); !ok {
+			return
+		}
+		if r.Method != http.MethodGet {
+			notFound(w, r)
+			return
+		}
+		location := r.URL.Query().Get("location")
+		if location == "" {
+			location = defaultLocation
+		}
+		writeJSON(w, r, http.StatusOK, h.settings.resolve(location))
+		return
+	}
+	sess, ok := h.sessions.requireScope(w, r, "orders:manage")
+	if !ok {
+		return
+	}
+	switch {
+	case r.Method == http.MethodGet && globalSettingsRe.MatchString(r.URL.Path):
+		h.settings.RLock()
+		g := h.settings.global
+		h.settings.RUnlock()
+		writeJSON(w, r, http.StatusOK, g)
+		return
+	case r.Method == http.MethodPut && globalSettingsRe.MatchString(r.URL.Path):
+		h.PutGlobal(w, r, sess)
+		return
+	case r.Method == http.MethodGet && listOverridesRe.MatchString(r.URL.Path):
+		h.ListOverrides(w, r)
+		return
+	case r.Method == http.MethodGet && locationSettingsRe.MatchString(r.URL.Path):
+		id := locationSettingsRe.FindStringSubmatch(r.URL.Path)[1]
+		h.settings.RLock()
+		o := h.settings.locations[id]
+		h.settings.RUnlock()
+		writeJSON(w, r, http.StatusOK, o)
+		return
+	case r.Method == http.MethodPut && locationSettingsRe.MatchString(r.URL.Path):
+		h.PutLocation(w, r, sess)
+		return
+	case r.Method == http.MethodDelete && locationSettingsRe.MatchString(r.URL.Path):
+		id := locationSettingsRe.FindStringSubmatch(r.URL.Path)[1]
+		h.settings.Lock()
+		delete(h.settings.locations, id)
+		h.settings.Unlock()
+		h.audit.record(auditEntry{Action: "settings.location.reset", Ref: id, StaffID: sess.StaffID})
+		w.WriteHeader(http.StatusNoContent)
+		return
+	default:
+		notFound(w, r)
+		return
+	}
+}
+
+// PutGlobal replaces the global settings. Fields left null keep the built-in
+// default, so every location always resolves to a value.
+func (h *settingsHandler) PutGlobal(w http.ResponseWriter, r *http.Request, sess session) {
+	var s settings
+	if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("invalid settings"))
+		return
+	}
+	if err := s.validate(); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if s.TaxPercent == nil {
+		s.TaxPercent = defaultSettings.TaxPercent
+	}
+	if s.Currency == nil {
+		s.Currency = defaultSettings.Currency
+	}
+	if s.ServiceChargePercent == nil {
+		s.ServiceChargePercent = defaultSettings.ServiceChargePercent
+	}
+	if s.Timezone == nil {
+		s.Timezone = defaultSettings.Timezone
+	}
+	if s.AfterHours == nil {
+		s.AfterHours = defaultSettings.AfterHours
+	}
+	if s.OrderReference == nil {
+		s.OrderReference = defaultSettings.OrderReference
+	}
+	h.settings.Lock()
+	h.settings.global = s
+	h.settings.Unlock()
+	h.audit.record(auditEntry{Action: "settings.global.update", StaffID: sess.StaffID})
+	writeJSON(w, r, http.StatusOK, s)
+}
+
+// PutLocation replaces a location's overrides. Null fields inherit the global
+// setting.
+func (h *settingsHandler) PutLocation(w http.ResponseWriter, r *http.Request, sess session) {
+	id := locationSettingsRe.FindStringSubmatch(r.URL.Path)[1]
+	var s settings
+	if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("invalid settings"))
+		return
+	}
+	if err := s.validate(); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	h.settings.Lock()
+	h.settings.locations[id] = s
+	h.settings.Unlock()
+	h.audit.record(auditEntry{Action: "settings.location.update", Ref: id, StaffID: sess.StaffID})
+	writeJSON(w, r, http.StatusOK, h.settings.resolve(id))
+}
+
+func (h *settingsHandler) ListOverrides(w http.ResponseWriter, r *http.Request) {
+	h.settings.RLock()
+	ids := make([]string, 0, len(h.settings.locations))
+	for id := range h.settings.locations {
+		ids = append(ids, id)
+	}
+	h.settings.RUnlock()
+	sort.Strings(ids)
+	out := make([]effectiveSettings, 0, len(ids))
+	for _, id := range ids {
+		out = append(out, h.settings.resolve(id))
+	}
+	writeJSON(w, r, http.StatusOK, out)
+}
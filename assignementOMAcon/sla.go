@@ -0,0 +1,145 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"time"
+)
+
+var slaReportRe = regexp.MustCompile(`^/reports/sla$`)
+
+// slaStages are the statuses an order waits in, in workflow order, and who
+// it is waiting on there: received and preparing orders wait on the kitchen,
+// ready ones on the servers.
+var slaStages = []struct {
+	status orderStatus
+	owner  string
+}{
+	{statusReceived, "kitchen"},
+	{statusPreparing, "kitchen"},
+	{statusReady, "servers"},
+}
+
+// stageTime is how long an order spent in one status. Open is set while the
+// order is still in it, Seconds then being how long it has waited so far.
+type stageTime struct {
+	Status  orderStatus
+	Seconds float64
+	Open    bool
+	// end is when the order left the status, or now while it is open.
+	end time.Time
+}
+
+// stageTimes works out from an order's status history how long it spent in
+// each status it has left, and how long it has been in the one it is in.
+// Served orders are done, so their last status takes no time.
+func stageTimes(o order, now time.Time) []stageTime {
+	var out []stageTime
+	for i, c := range o.StatusHistory {
+		if i+1 < len(o.StatusHistory) {
+			next := o.StatusHistory[i+1].At
+			out = append(out, stageTime{Status: c.Status, Seconds: next.Sub(c.At).Seconds(), end: next})
+		} else if c.Status != statusServed && !isVoided(o) {
+			out = append(out, stageTime{Status: c.Status, Seconds: now.Sub(c.At).Seconds(), Open: true, end: now})
+		}
+	}
+	return out
+}
+
+// stageStats summarises the time orders spent in one status, in seconds.
+type stageStats struct {
+	Status orderStatus `json:"status"`
+	Owner  string      `json:"owner"`
+	Count  int         `json:"count"`
+	Mean   float64     `json:"mean"`
+	P50    float64     `json:"p50"`
+	P90    float64     `json:"p90"`
+	P95    float64     `json:"p95"`
+	Max    float64     `json:"max"`
+	// InProgress counts orders in the status now, and Oldest is how long the
+	// longest of them has waited.
+	InProgress int     `json:"in_progress"`
+	Oldest     float64 `json:"oldest"`
+}
+
+type slaReport struct {
+	From   string       `json:"from"`
+	To     string       `json:"to"`
+	Stages []stageStats `json:"stages"`
+	// Bottleneck is the stage with the slowest p90, and Owner who it waits
+	// on; empty when no order has finished a stage.
+	Bottleneck orderStatus `json:"bottleneck,omitempty"`
+	Owner      string      `json:"owner,omitempty"`
+}
+
+// percentile is the nearest-rank percentile p of sorted values.
+func percentile(sorted []float64, p float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+// SLA reports how long orders spent in each status: percentiles over the
+// stages finished between ?from= and ?to= (inclusive dates, default today),
+// and the orders waiting in each status now, so managers can see whether the
+// kitchen or the servers are holding orders up.
+func (h *reportHandler) SLA(w http.ResponseWriter, r *http.Request) {
+	from, to, err := parseDateRange(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	now := time.Now().UTC()
+	finished := map[orderStatus][]float64{}
+	rep := slaReport{From: from.Format(dateLayout), To: to.AddDate(0, 0, -1).Format(dateLayout)}
+	byStatus := map[orderStatus]*stageStats{}
+	for _, s := range slaStages {
+		rep.Stages = append(rep.Stages, stageStats{Status: s.status, Owner: s.owner})
+	}
+	for i := range rep.Stages {
+		byStatus[rep.Stages[i].Status] = &rep.Stages[i]
+	}
+	h.store.RLock()
+	for _, o := range h.store.m {
+		for _, st := range stageTimes(o, now) {
+			stats, ok := byStatus[st.Status]
+			switch {
+			case !ok:
+			case st.Open:
+				stats.InProgress++
+				stats.Oldest = math.Max(stats.Oldest, st.Seconds)
+			case !st.end.Before(from) && st.end.Before(to):
+				finished[st.Status] = append(finished[st.Status], st.Seconds)
+			}
+		}
+	}
+	h.store.RUnlock()
+	var slowest float64
+	for i := range rep.Stages {
+		stats := &rep.Stages[i]
+		times := finished[stats.Status]
+		if len(times) == 0 {
+			continue
+		}
+		sort.Float64s(times)
+		var sum float64
+		for _, t := range times {
+			sum += t
+		}
+		stats.Count, stats.Mean = len(times), sum/float64(len(times))
+		stats.P50, stats.P90, stats.P95 = percentile(times, 50), percentile(times, 90), percentile(times, 95)
+		stats.Max = times[len(times)-1]
+		if stats.P90 > slowest {
+			slowest, rep.Bottleneck, rep.Owner = stats.P90, stats.Status, stats.Owner
+		}
+	}
+	writeJSON(w, r, http.StatusOK, rep)
+}
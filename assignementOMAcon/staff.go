@@ -0,0 +1,295 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	pinLoginRe = regexp.MustCompile(`^/auth/pin$`)
+	pinRe      = regexp.MustCompile(`^[0-9]{4,6}$`)
+)
+
+const (
+	sessionTTL       = 15 * time.Minute
+	pinMaxFailures   = 5
+	pinLockout       = 5 * time.Minute
+	pinRateWindow    = time.Minute
+	pinRateMaxPerWin = 10
+)
+
+const (
+	roleWaiter  = "waiter"
+	roleKitchen = "kitchen"
+	roleManager = "manager"
+	roleAdmin   = "admin"
+)
+
+var roleScopes = map[string][]string{
+	roleWaiter:  {"orders:read", "orders:write"},
+	roleKitchen: {"orders:read", "kitchen"},
+	roleManager: {"orders:read", "orders:write", "orders:manage", "kitchen"},
+	roleAdmin:   {"orders:read", "orders:write", "orders:manage", "kitchen", "admin"},
+}
+
+type staff struct {
+	ID         string `json:"id"`
+	Name       string `json:"name"`
+	Role       string `json:"role"`
+	LocationID string `json:"location_id,omitempty"`
+	pinHash    string
+}
+
+// pinState tracks login attempts for one staff member.
+type pinState struct {
+	failures    int
+	lockedUntil time.Time
+	attempts    []time.Time
+}
+
+type staffStore struct {
+	m      map[string]staff
+	pins   map[string]*pinState
+	secret []byte
+	*sync.RWMutex
+}
+
+func newStaffStore(secret []byte) *staffStore {
+	return &staffStore{
+		m:       map[string]staff{},
+		pins:    map[string]*pinState{},
+		secret:  secret,
+		RWMutex: &sync.RWMutex{},
+	}
+}
+
+func (s *staffStore) hashPIN(staffID, pin string) string {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte(staffID + ":" + pin))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (s *staffStore) add(member staff, pin string) {
+	s.Lock()
+	member.pinHash = s.hashPIN(member.ID, pin)
+	s.m[member.ID] = member
+	s.Unlock()
+}
+
+type pinError struct {
+	status     int
+	msg        string
+	retryAfter time.Duration
+}
+
+// verifyPIN checks a PIN against the staff member, applying the per-staff rate
+// limit and locking the account after repeated failures.
+func (s *staffStore) verifyPIN(staffID, pin string, now time.Time) (staff, *pinError) {
+	s.Lock()
+	defer s.Unlock()
+
+	member, ok := s.m[staffID]
+	if !ok {
+		return staff{}, &pinError{status: http.StatusUnauthorized, msg: "invalid credentials"}
+	}
+	st := s.pins[staffID]
+	if st == nil {
+		st = &pinState{}
+		s.pins[staffID] = st
+	}
+	if now.Before(st.lockedUntil) {
+		return staff{}, &pinError{status: http.StatusLocked, msg: "account locked", retryAfter: st.lockedUntil.Sub(now)}
+	}
+
+	recent := st.attempts[:0]
+	for _, t := range st.attempts {
+		if now.Sub(t) < pinRateWindow {
+			recent = append(recent, t)
+		}
+	}
+	st.attempts = recent
+	if len(st.attempts) >= pinRateMaxPerWin {
+		return staff{}, &pinError{status: http.StatusTooManyRequests, msg: "too many attempts", retryAfter: pinRateWindow - now.Sub(st.attempts[0])}
+	}
+	st.attempts = append(st.attempts, now)
+
+	if !hmac.Equal([]byte(member.pinHash), []byte(s.hashPIN(staffID, pin))) {
+		st.failures++
+		if st.failures >= pinMaxFailures {
+			st.failures = 0
+			st.lockedUntil = now.Add(pinLockout)
+			return staff{}, &pinError{status: http.StatusLocked, msg: "account locked", retryAfter: pinLockout}
+		}
+		return staff{}, &pinError{status: http.StatusUnauthorized, msg: "invalid credentials"}
+	}
+	st.failures = 0
+	return member, nil
+}
+
+type session struct {
+	Token     string    `json:"token"`
+	StaffID   string    `json:"staff_id"`
+	Role      string    `json:"role"`
+	Scopes    []string  `json:"scopes"`
+	ExpiresAt time.Time `json:"expires_at"`
+	// LocationID is the location the session acts for. Sessions without one
+	// act for any location.
+	LocationID string `json:"location_id,omitempty"`
+	// FieldNaming is the API key's field naming, if it has one.
+	FieldNaming string `json:"-"`
+	// PageLimits are the API key's page limits, if it has any.
+	PageLimits pageLimits `json:"-"`
+}
+
+func (s session) hasScope(scope string) bool {
+	for _, sc := range s.Scopes {
+		if sc == scope {
+			return true
+		}
+	}
+	return false
+}
+
+type sessionStore struct {
+	m map[string]session
+	// auth resolves credentials other than PIN sessions. It is set before
+	// the server starts.
+	auth *authConfig
+	*sync.RWMutex
+}
+
+func newSessionStore() *sessionStore {
+	return &sessionStore{m: map[string]session{}, RWMutex: &sync.RWMutex{}}
+}
+
+func (s *sessionStore) create(member staff, now time.Time) (session, error) {
+	token, err := randomToken(32)
+	if err != nil {
+		return session{}, err
+	}
+	sess := session{
+		Token:      token,
+		StaffID:    member.ID,
+		Role:       member.Role,
+		Scopes:     roleScopes[member.Role],
+		LocationID: member.LocationID,
+		ExpiresAt:  now.Add(sessionTTL),
+	}
+	s.Lock()
+	for k, v := range s.m {
+		if now.After(v.ExpiresAt) {
+			delete(s.m, k)
+		}
+	}
+	s.m[token] = sess
+	s.Unlock()
+	return sess, nil
+}
+
+func (s *sessionStore) lookup(token string, now time.Time) (session, bool) {
+	s.RLock()
+	sess, ok := s.m[token]
+	s.RUnlock()
+	if !ok || now.After(sess.ExpiresAt) {
+		return session{}, false
+	}
+	return sess, true
+}
+
+// fromRequest resolves the request's credentials to a live session: an API
+// key, or a bearer token that is a PIN session, an API key or a JWT.
+func (s *sessionStore) fromRequest(r *http.Request) (session, bool) {
+	if key := r.Header.Get(apiKeyHeader); key != "" && s.auth != nil {
+		return s.auth.apiKeySession(key)
+	}
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return session{}, false
+	}
+	token, now := strings.TrimPrefix(auth, "Bearer "), time.Now()
+	if sess, ok := s.lookup(token, now); ok || s.auth == nil {
+		return sess, ok
+	}
+	if sess, ok := s.auth.apiKeySession(token); ok {
+		return sess, true
+	}
+	return s.auth.jwtSession(token, now)
+}
+
+type authHandler struct {
+	staff    *staffStore
+	sessions *sessionStore
+}
+
+type pinLoginRequest struct {
+	StaffID string `json:"staff_id"`
+	PIN     string `json:"pin"`
+}
+
+func (h *authHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("content-type", "application/json")
+	switch {
+	case r.Method == http.MethodPost && pinLoginRe.MatchString(r.URL.Path):
+		h.PINLogin(w, r)
+		return
+	default:
+		notFound(w, r)
+		return
+	}
+}
+
+func (h *authHandler) PINLogin(w http.ResponseWriter, r *http.Request) {
+	var req pinLoginRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || !pinRe.MatchString(req.PIN) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("pin must be 4 to 6 digits"))
+		return
+	}
+	now := time.Now()
+	member, perr := h.staff.verifyPIN(req.StaffID, req.PIN, now)
+	if perr != nil {
+		if perr.retryAfter > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(perr.retryAfter.Seconds())+1))
+		}
+		w.WriteHeader(perr.status)
+		w.Write([]byte(perr.msg))
+		return
+	}
+	sess, err := h.sessions.create(member, now)
+	if err != nil {
+		internalServerError(w, r)
+		return
+	}
+	jsonBytes, err := json.Marshal(sess)
+	if err != nil {
+		internalServerError(w, r)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonBytes)
+}
+
+// requireScope writes 401/403 and returns false unless the request carries a
+// session holding scope.
+func (s *sessionStore) requireScope(w http.ResponseWriter, r *http.Request, scope string) (session, bool) {
+	sess, ok := s.fromRequest(r)
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("unauthorized"))
+		return session{}, false
+	}
+	if !sess.hasScope(scope) {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("forbidden"))
+		return session{}, false
+	}
+	return sess, true
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// orderStore is a database that keeps orders: sqlStore for SQLite and
+// Postgres. It sits behind datastore and is only reached through it.
+type orderStore interface {
+	Get(id string) (order, bool, error)
+	List() ([]order, error)
+	Create(o order) error
+	Update(o order) error
+	Delete(id string) error
+}
+
+const (
+	storeMemory   = "memory"
+	storeSQLite   = "sqlite"
+	storePostgres = "postgres"
+)
+
+// put stores o, creating or replacing it. The caller holds the write lock.
+// The in-memory copy only changes once the database has accepted it.
+func (s *datastore) put(o order) error {
+	if s.db != nil {
+		var err error
+		if _, exists := s.m[o.ID]; exists {
+			err = s.db.Update(o)
+		} else {
+			err = s.db.Create(o)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	s.m[o.ID] = o
+	return nil
+}
+
+// batchStore is an orderStore that can create several orders at once, all or
+// none.
+type batchStore interface {
+	CreateAll(orders []order) error
+}
+
+// createAll stores new orders together: if one cannot be stored, none are.
+// The caller holds the write lock. A database that cannot create them in one
+// go has the ones already written deleted again.
+func (s *datastore) createAll(orders []order) error {
+	if batch, ok := s.db.(batchStore); ok {
+		if err := batch.CreateAll(orders); err != nil {
+			return err
+		}
+	} else if s.db != nil {
+		for i, o := range orders {
+			if err := s.db.Create(o); err != nil {
+				for _, done := range orders[:i] {
+					s.db.Delete(done.ID)
+				}
+				return err
+			}
+		}
+	}
+	for _, o := range orders {
+		s.m[o.ID] = o
+	}
+	return nil
+}
+
+// drop deletes the order with id. The caller holds the write lock.
+func (s *datastore) drop(id string) error {
+	if s.db != nil {
+		if err := s.db.Delete(id); err != nil {
+			return err
+		}
+	}
+	delete(s.m, id)
+	return nil
+}
+
+// persist backs s with db. Orders already in db replace the in-memory ones;
+// an empty db is filled from memory so it starts with the same orders.
+func (s *datastore) persist(db orderStore) error {
+	saved, err := db.List()
+	if err != nil {
+		return err
+	}
+	s.Lock()
+	defer s.Unlock()
+	if len(saved) == 0 {
+		for _, o := range s.m {
+			if err := db.Create(o); err != nil {
+				return err
+			}
+		}
+	} else {
+		s.m = make(map[string]order, len(saved))
+		for _, o := range saved {
+			s.m[o.ID] = o
+		}
+	}
+	s.db = db
+	return nil
+}
+
+// migrations are applied in order, each once; schema_migrations records how
+// many have run. Append to the list, never edit an entry that has shipped.
+var migrations = []string{
+	`CREATE TABLE orders (
+		id         TEXT PRIMARY KEY,
+		doc        TEXT NOT NULL,
+		version    BIGINT NOT NULL DEFAULT 0,
+		updated_at TEXT
+	)`,
+	`CREATE TABLE order_history (
+		order_id  TEXT NOT NULL,
+		seq       INTEGER NOT NULL,
+		at        TEXT NOT NULL,
+		action    TEXT NOT NULL,
+		staff_id  TEXT NOT NULL DEFAULT '',
+		device_id TEXT NOT NULL DEFAULT '',
+		changes   TEXT NOT NULL,
+		PRIMARY KEY (order_id, seq)
+	)`,
+	`CREATE TABLE z_reports (
+		business_date TEXT PRIMARY KEY,
+		doc           TEXT NOT NULL
+	)`,
+}
+
+// sqlStore keeps orders in SQLite or PostgreSQL. Each order is stored as its
+// JSON document, so new order fields need no migration; id and version are
+// columns of their own.
+//
+// Queries use $n placeholders, which both drivers accept, but SQLite numbers
+// them by first appearance, so they must appear in order.
+type sqlStore struct {
+	db *sql.DB
+}
+
+// openSQLStore connects to driver (sqlite or postgres) at dsn and brings the
+// schema up to date.
+func openSQLStore(driver, dsn string) (*sqlStore, error) {
+	name := driver
+	if driver == storeSQLite {
+		name = "sqlite3"
+	}
+	db, err := sql.Open(name, dsn)
+	if err != nil {
+		return nil, err
+	}
+	if driver == storeSQLite {
+		// SQLite allows one writer at a time.
+		db.SetMaxOpenConns(1)
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	s := &sqlStore{db: db}
+	if err := s.migrate(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// Close closes the database once the server has stopped writing.
+func (s *sqlStore) Close() error {
+	return s.db.Close()
+}
+
+func (s *sqlStore) migrate() error {
+	if _, err := s.db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER NOT NULL)`); err != nil {
+		return err
+	}
+	var applied int
+	if err := s.db.QueryRow(`SELECT COUNT(*) FROM schema_migrations`).Scan(&applied); err != nil {
+		return err
+	}
+	for i := applied; i < len(migrations); i++ {
+		tx, err := s.db.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(migrations[i]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d: %w", i+1, err)
+		}
+		if _, err := tx.Exec(`INSERT INTO schema_migrations (version) VALUES ($1)`, i+1); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *sqlStore) Get(id string) (order, bool, error) {
+	var doc string
+	err := s.db.QueryRow(`SELECT doc FROM orders WHERE id = $1`, id).Scan(&doc)
+	if err == sql.ErrNoRows {
+		return order{}, false, nil
+	}
+	if err != nil {
+		return order{}, false, err
+	}
+	var o order
+	if err := json.Unmarshal([]byte(doc), &o); err != nil {
+		return order{}, false, err
+	}
+	return o, true, nil
+}
+
+func (s *sqlStore) List() ([]order, error) {
+	rows, err := s.db.Query(`SELECT doc FROM orders ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []order{}
+	for rows.Next() {
+		var doc string
+		if err := rows.Scan(&doc); err != nil {
+			return nil, err
+		}
+		var o order
+		if err := json.Unmarshal([]byte(doc), &o); err != nil {
+			return nil, err
+		}
+		out = append(out, o)
+	}
+	return out, rows.Err()
+}
+
+func (s *sqlStore) Create(o order) error {
+	doc, updated, err := orderRow(o)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(`INSERT INTO orders (id, doc, version, updated_at) VALUES ($1, $2, $3, $4)`,
+		o.ID, doc, o.Version, updated)
+	return err
+}
+
+// CreateAll inserts orders in one transaction.
+func (s *sqlStore) CreateAll(orders []order) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	for _, o := range orders {
+		doc, updated, err := orderRow(o)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		if _, err := tx.Exec(`INSERT INTO orders (id, doc, version, updated_at) VALUES ($1, $2, $3, $4)`,
+			o.ID, doc, o.Version, updated); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("order %s: %w", o.ID, err)
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *sqlStore) Update(o order) error {
+	doc, updated, err := orderRow(o)
+	if err != nil {
+		return err
+	}
+	res, err := s.db.Exec(`UPDATE orders SET doc = $1, version = $2, updated_at = $3 WHERE id = $4`,
+		doc, o.Version, updated, o.ID)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return errOrderNotFound
+	}
+	return nil
+}
+
+func (s *sqlStore) Delete(id string) error {
+	_, err := s.db.Exec(`DELETE FROM orders WHERE id = $1`, id)
+	return err
+}
+
+func orderRow(o order) (doc string, updated sql.NullString, err error) {
+	b, err := json.Marshal(o)
+	if err != nil {
+		return "", sql.NullString{}, err
+	}
+	if o.UpdatedAt != nil {
+		updated = sql.NullString{String: o.UpdatedAt.UTC().Format(time.RFC3339Nano), Valid: true}
+	}
+	return string(b), updated, nil
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	stuckPreparing       = "preparing"
+	stuckAwaitingPayment = "awaiting_payment"
+)
+
+// stuckThresholds is how long an order may stay in each status before it is
+// flagged.
+type stuckThresholds struct {
+	Preparing       duration `json:"preparing"`
+	AwaitingPayment duration `json:"awaiting_payment"`
+}
+
+func (t stuckThresholds) validate() error {
+	if t.Preparing <= 0 || t.AwaitingPayment <= 0 {
+		return fmt.Errorf("thresholds must be positive durations")
+	}
+	return nil
+}
+
+// stuckOrder is an order that has been in one status for too long. An order
+// is preparing while any fired ticket is unbumped, and awaiting payment once
+// the kitchen is done with it but it is still open.
+type stuckOrder struct {
+	OrderID     string    `json:"order_id"`
+	TableNumber string    `json:"table_number,omitempty"`
+	LocationID  string    `json:"location_id,omitempty"`
+	Status      string    `json:"status"`
+	Since       time.Time `json:"since"`
+	Minutes     int       `json:"minutes"`
+	Threshold   int       `json:"threshold_minutes"`
+	FlaggedAt   time.Time `json:"flagged_at"`
+}
+
+// watchdog periodically looks for stuck orders. Each is notified once, when
+// first flagged, and stays flagged until it moves on.
+type watchdog struct {
+	store      *datastore
+	kitchen    *kitchenQueue
+	hooks      *hookRegistry
+	thresholds stuckThresholds
+	flagged    map[string]stuckOrder
+	*sync.Mutex
+}
+
+func newWatchdog(store *datastore, kitchen *kitchenQueue, hooks *hookRegistry, thresholds stuckThresholds) *watchdog {
+	return &watchdog{
+		store:      store,
+		kitchen:    kitchen,
+		hooks:      hooks,
+		thresholds: thresholds,
+		flagged:    map[string]stuckOrder{},
+		Mutex:      &sync.Mutex{},
+	}
+}
+
+// run scans every interval until ctx is done.
+func (d *watchdog) run(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-t.C:
+			d.scan(now.UTC())
+		}
+	}
+}
+
+// status reports the status an open order is in and since when. Courses that
+// fire on their own once the previous one is bumped are preparing from that
+// bump.
+func (d *watchdog) status(o order, now time.Time) (string, time.Time) {
+	var preparing, lastBump *time.Time
+	for _, t := range d.kitchen.tickets(o) {
+		switch t.Status {
+		case ticketFired:
+			since := t.FiredAt
+			if since == nil {
+				since = lastBump
+			}
+			if since != nil && (preparing == nil || since.Before(*preparing)) {
+				preparing = since
+			}
+		case ticketBumped:
+			if t.BumpedAt != nil && (lastBump == nil || t.BumpedAt.After(*lastBump)) {
+				lastBump = t.BumpedAt
+			}
+		default:
+			// A held or waiting course: the order is between courses.
+			if preparing == nil {
+				return "", now
+			}
+		}
+	}
+	switch {
+	case preparing != nil:
+		return stuckPreparing, *preparing
+	case lastBump != nil:
+		return stuckAwaitingPayment, *lastBump
+	case o.UpdatedAt != nil && len(orderCourses(o)) == 0:
+		return stuckAwaitingPayment, *o.UpdatedAt
+	}
+	return "", now
+}
+
+// scan flags orders past their status's threshold and notifies the newly
+// flagged ones.
+func (d *watchdog) scan(now time.Time) []stuckOrder {
+	d.store.RLock()
+	open := make([]order, 0, len(d.store.m))
+	for _, o := range d.store.m {
+		if !o.Locked && !isFinal(o) {
+			open = append(open, o)
+		}
+	}
+	d.store.RUnlock()
+
+	current := map[string]stuckOrder{}
+	for _, o := range open {
+		status, since := d.status(o, now)
+		limit := time.Duration(d.thresholds.AwaitingPayment)
+		if status == stuckPreparing {
+			limit = time.Duration(d.thresholds.Preparing)
+		}
+		if status == "" || now.Sub(since) < limit {
+			continue
+		}
+		current[o.ID] = stuckOrder{
+			OrderID:     o.ID,
+			TableNumber: o.TableNumber,
+			LocationID:  o.LocationID,
+			Status:      status,
+			Since:       since,
+			Minutes:     int(now.Sub(since) / time.Minute),
+			Threshold:   int(limit / time.Minute),
+			FlaggedAt:   now,
+		}
+	}
+
+	var raised []stuckOrder
+	d.Lock()
+	for id, s := range current {
+		if prev, ok := d.flagged[id]; ok && prev.Status == s.Status {
+			s.FlaggedAt = prev.FlaggedAt
+		} else {
+			raised = append(raised, s)
+		}
+		current[id] = s
+	}
+	d.flagged = current
+	d.Unlock()
+
+	for _, s := range raised {
+		log.Printf("stuck order: %s %s for %d min (threshold %d min)", s.OrderID, s.Status, s.Minutes, s.Threshold)
+		d.hooks.runStuckOrder(context.Background(), s)
+	}
+	out := make([]stuckOrder, 0, len(current))
+	for _, s := range current {
+		out = append(out, s)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Since.Before(out[j].Since) })
+	return out
+}
+
+type stuckHandler struct {
+	watchdog *watchdog
+	sessions *sessionStore
+}
+
+// ServeHTTP lists stuck orders, longest stuck first. The list is refreshed
+// on each request rather than waiting for the next scan.
+func (h *stuckHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("content-type", "application/json")
+	if _, ok := h.sessions.requireScope(w, r, "orders:read"); !ok {
+		return
+	}
+	if r.Method != http.MethodGet {
+		notFound(w, r)
+		return
+	}
+	writeJSON(w, r, http.StatusOK, h.watchdog.scan(time.Now().UTC()))
+}
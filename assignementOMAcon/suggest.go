@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var menuSuggestRe = regexp.MustCompile(`^/menu/suggest$`)
+
+const (
+	defaultSuggestions = 10
+	maxSuggestions     = 50
+)
+
+// prefixEntry is one word of a menu item name. The index is kept sorted by
+// word so every item with a word starting with a prefix is found by binary
+// search.
+type prefixEntry struct {
+	word   string
+	itemID string
+}
+
+// reindex rebuilds the prefix index. The caller holds the write lock.
+func (s *menuStore) reindex() {
+	idx := make([]prefixEntry, 0, len(s.m)*2)
+	for id, item := range s.m {
+		for _, name := range item.searchText() {
+			for _, w := range fuzzyWords(name) {
+				idx = append(idx, prefixEntry{word: w, itemID: id})
+			}
+		}
+	}
+	sort.Slice(idx, func(i, j int) bool {
+		if idx[i].word != idx[j].word {
+			return idx[i].word < idx[j].word
+		}
+		return idx[i].itemID < idx[j].itemID
+	})
+	s.prefixes = idx
+}
+
+// withPrefix returns the IDs of items having a word that starts with p.
+func (s *menuStore) withPrefix(p string) map[string]bool {
+	ids := map[string]bool{}
+	i := sort.Search(len(s.prefixes), func(i int) bool { return s.prefixes[i].word >= p })
+	for ; i < len(s.prefixes) && strings.HasPrefix(s.prefixes[i].word, p); i++ {
+		ids[s.prefixes[i].itemID] = true
+	}
+	return ids
+}
+
+// countOrdered is installed as an after-create hook to track how often each
+// menu item is ordered.
+func (s *menuStore) countOrdered(ctx context.Context, o order) {
+	for _, name := range orderItemNames(o) {
+		if item, ok := s.byName(name); ok {
+			s.Lock()
+			s.popularity[item.ID]++
+			s.Unlock()
+		}
+	}
+}
+
+type suggestion struct {
+	menuItem
+	Orders int `json:"orders"`
+}
+
+// suggest completes q against the menu. Every word of q must start some word
+// of an item's name in some language. Items are ranked by how often they were
+// ordered, then by whether the name shown in langs starts with q, then by
+// that name.
+func (s *menuStore) suggest(q string, langs []string, limit int) []suggestion {
+	words := fuzzyWords(q)
+	out := []suggestion{}
+	if len(words) == 0 {
+		return out
+	}
+	s.RLock()
+	ids := s.withPrefix(words[0])
+	for _, w := range words[1:] {
+		next := s.withPrefix(w)
+		for id := range ids {
+			if !next[id] {
+				delete(ids, id)
+			}
+		}
+	}
+	for id := range ids {
+		out = append(out, suggestion{menuItem: s.m[id].localize(langs), Orders: s.popularity[id]})
+	}
+	s.RUnlock()
+
+	lq := strings.ToLower(q)
+	sort.Slice(out, func(i, j int) bool {
+		a, b := out[i], out[j]
+		if a.Orders != b.Orders {
+			return a.Orders > b.Orders
+		}
+		as, bs := strings.HasPrefix(strings.ToLower(a.Name), lq), strings.HasPrefix(strings.ToLower(b.Name), lq)
+		if as != bs {
+			return as
+		}
+		return a.Name < b.Name
+	})
+	if len(out) > limit {
+		out = out[:limit]
+	}
+	return out
+}
+
+// Suggest serves order-entry autocomplete: ?q= is what has been typed so far
+// and ?limit= caps the number of completions.
+func (h *menuHandler) Suggest(w http.ResponseWriter, r *http.Request) {
+	limit := defaultSuggestions
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxSuggestions {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("limit must be between 1 and " + strconv.Itoa(maxSuggestions)))
+			return
+		}
+		limit = n
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, r, http.StatusOK, h.menu.suggest(r.URL.Query().Get("q"), requestedLanguages(r), limit))
+}
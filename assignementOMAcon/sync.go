@@ -0,0 +1,363 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	uploadMutationsRe = regexp.MustCompile(`^/sync/mutations$`)
+	deltaSyncRe       = regexp.MustCompile(`^/sync/?$`)
+)
+
+const (
+	mutationCreate = "create"
+	mutationUpdate = "update"
+)
+
+const (
+	rejectAlreadyExists = "already_exists"
+	rejectNotFound      = "not_found"
+	rejectStale         = "stale"
+	rejectInvalid       = "invalid"
+	rejectRule          = "rejected_by_rule"
+	rejectLocked        = "locked"
+	rejectForbidden     = "forbidden"
+	rejectQuota         = "quota_exceeded"
+)
+
+// A mutation's outcome is remembered for syncSeenTTL, and at most
+// syncSeenMax outcomes are; the oldest go first.
+const (
+	syncSeenTTL = 24 * time.Hour
+	syncSeenMax = 100000
+)
+
+// mutation is a change a client queued while offline. BaseVersion is the order
+// version the client last saw; ClientTime is when the change was made locally.
+type mutation struct {
+	MutationID  string    `json:"mutation_id"`
+	Op          string    `json:"op"`
+	Order       order     `json:"order"`
+	BaseVersion int64     `json:"base_version"`
+	ClientTime  time.Time `json:"client_time"`
+}
+
+type syncUpload struct {
+	ClientID  string     `json:"client_id"`
+	Mutations []mutation `json:"mutations"`
+}
+
+type mutationResult struct {
+	MutationID string       `json:"mutation_id"`
+	Reason     string       `json:"reason,omitempty"`
+	Errors     []fieldError `json:"errors,omitempty"`
+	Order      *order       `json:"order,omitempty"`
+}
+
+type syncResponse struct {
+	Applied  []mutationResult `json:"applied"`
+	Rejected []mutationResult `json:"rejected"`
+}
+
+// syncSource exposes one kind of object to delta sync.
+type syncSource struct {
+	get func(id string) (interface{}, bool)
+	all func() []interface{}
+}
+
+type deltaResponse struct {
+	Seq     int64                    `json:"seq"`
+	Reset   bool                     `json:"reset,omitempty"`
+	Changed map[string][]interface{} `json:"changed"`
+	Deleted map[string][]string      `json:"deleted"`
+}
+
+// seenMutation is the outcome of a client mutation and when it was applied.
+type seenMutation struct {
+	key string
+	res mutationResult
+	at  time.Time
+}
+
+type syncHandler struct {
+	orders  *orderHandler
+	feed    *changeFeed
+	sources map[string]syncSource
+	// seen remembers the outcome of each client mutation so a re-upload after
+	// a dropped response is answered the same way instead of applied twice.
+	// seenOrder holds them oldest first, to forget them in that order.
+	seen      map[string]seenMutation
+	seenOrder []seenMutation
+	*sync.Mutex
+}
+
+func newSyncHandler(orders *orderHandler, feed *changeFeed) *syncHandler {
+	h := &syncHandler{
+		orders:  orders,
+		feed:    feed,
+		sources: map[string]syncSource{},
+		seen:    map[string]seenMutation{},
+		Mutex:   &sync.Mutex{},
+	}
+	h.sources[kindOrders] = syncSource{
+		get: func(id string) (interface{}, bool) {
+			orders.store.RLock()
+			defer orders.store.RUnlock()
+			o, ok := orders.store.m[id]
+			return o, ok
+		},
+		all: func() []interface{} {
+			orders.store.RLock()
+			defer orders.store.RUnlock()
+			out := make([]interface{}, 0, len(orders.store.m))
+			for _, o := range orders.store.m {
+				out = append(out, o)
+			}
+			return out
+		},
+	}
+	return h
+}
+
+func (h *syncHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("content-type", "application/json")
+	switch {
+	case r.Method == http.MethodGet && deltaSyncRe.MatchString(r.URL.Path):
+		h.Delta(w, r)
+		return
+	case r.Method == http.MethodPost && uploadMutationsRe.MatchString(r.URL.Path):
+		h.Upload(w, r)
+		return
+	default:
+		notFound(w, r)
+		return
+	}
+}
+
+// Delta returns the objects changed or deleted after the client's ?since=
+// cursor. A missing cursor, or one ahead of the server (e.g. after a restart),
+// yields a full snapshot with reset set so the client discards local state.
+func (h *syncHandler) Delta(w http.ResponseWriter, r *http.Request) {
+	var since int64
+	if v := r.URL.Query().Get("since"); v != "" {
+		var err error
+		if since, err = strconv.ParseInt(v, 10, 64); err != nil || since < 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("since must be a non-negative sequence number"))
+			return
+		}
+	}
+	resp := deltaResponse{Changed: map[string][]interface{}{}, Deleted: map[string][]string{}}
+	for kind := range h.sources {
+		resp.Changed[kind] = []interface{}{}
+		resp.Deleted[kind] = []string{}
+	}
+
+	changes, head := h.feed.since(since)
+	resp.Seq = head
+	if since == 0 || since > head {
+		resp.Reset = since > head
+		for kind, src := range h.sources {
+			resp.Changed[kind] = src.all()
+		}
+		writeJSON(w, r, http.StatusOK, resp)
+		return
+	}
+	for _, c := range changes {
+		src, ok := h.sources[c.Kind]
+		if !ok {
+			continue
+		}
+		if v, found := src.get(c.ID); found && !c.Deleted {
+			resp.Changed[c.Kind] = append(resp.Changed[c.Kind], v)
+		} else {
+			resp.Deleted[c.Kind] = append(resp.Deleted[c.Kind], c.ID)
+		}
+	}
+	writeJSON(w, r, http.StatusOK, resp)
+}
+
+// Upload applies a batch of offline mutations. Mutations are replayed in client
+// time order (ties broken by mutation ID) so the outcome does not depend on
+// upload order. An update whose base version is stale wins only if it was made
+// after the server's copy was last modified; otherwise it is rejected and the
+// current server copy is returned so the client can rebase.
+func (h *syncHandler) Upload(w http.ResponseWriter, r *http.Request) {
+	var req syncUpload
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ClientID == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("client_id and mutations are required"))
+		return
+	}
+	sort.SliceStable(req.Mutations, func(i, j int) bool {
+		a, b := req.Mutations[i], req.Mutations[j]
+		if !a.ClientTime.Equal(b.ClientTime) {
+			return a.ClientTime.Before(b.ClientTime)
+		}
+		return a.MutationID < b.MutationID
+	})
+
+	resp := syncResponse{Applied: []mutationResult{}, Rejected: []mutationResult{}}
+	h.Lock()
+	defer h.Unlock()
+	for _, m := range req.Mutations {
+		key, now := req.ClientID+"/"+m.MutationID, time.Now()
+		seen, ok := h.seen[key]
+		res := seen.res
+		if !ok || now.Sub(seen.at) >= syncSeenTTL {
+			var err error
+			res, err = h.apply(r, m)
+			if err != nil {
+				internalServerError(w, r)
+				return
+			}
+			h.remember(seenMutation{key: key, res: res, at: now})
+		}
+		if res.Reason != "" {
+			resp.Rejected = append(resp.Rejected, res)
+		} else {
+			resp.Applied = append(resp.Applied, res)
+		}
+	}
+	writeJSON(w, r, http.StatusOK, resp)
+}
+
+// remember records a mutation's outcome, first forgetting those past
+// syncSeenTTL and, when there are syncSeenMax, the oldest. The caller holds
+// the lock.
+func (h *syncHandler) remember(s seenMutation) {
+	for len(h.seenOrder) > 0 {
+		oldest := h.seenOrder[0]
+		if len(h.seenOrder) < syncSeenMax && s.at.Sub(oldest.at) < syncSeenTTL {
+			break
+		}
+		// A mutation remembered again after it expired is only forgotten
+		// with its newest outcome.
+		if h.seen[oldest.key].at.Equal(oldest.at) {
+			delete(h.seen, oldest.key)
+		}
+		h.seenOrder[0] = seenMutation{}
+		h.seenOrder = h.seenOrder[1:]
+	}
+	h.seen[s.key] = s
+	h.seenOrder = append(h.seenOrder, s)
+}
+
+// apply applies one mutation. Payments, tax, tip and the order's links are
+// the server's: they are kept as stored whatever the mutation says.
+func (h *syncHandler) apply(r *http.Request, m mutation) (mutationResult, error) {
+	res := mutationResult{MutationID: m.MutationID}
+	u := m.Order
+	if m.MutationID == "" || u.ID == "" || (m.Op != mutationCreate && m.Op != mutationUpdate) {
+		res.Reason = rejectInvalid
+		return res, nil
+	}
+	if m.Op == mutationCreate {
+		defaultChannel(&u)
+		if err := placeOrder(r, h.orders.sessions, &u); err != nil {
+			res.Reason = rejectForbidden
+			return res, nil
+		}
+	}
+	store := h.orders.store
+	store.RLock()
+	prev := store.m[u.ID]
+	store.RUnlock()
+	keepPayments(prev, &u)
+	defaultPayment(&u)
+	unavailable := h.orders.menu.price(prev, &u)
+	tallyItems(&u)
+	if errs := append(unavailable, h.orders.validators.validate(u)...); len(errs) > 0 {
+		res.Reason = rejectInvalid
+		res.Errors = errs
+		return res, nil
+	}
+	if err := h.orders.sections.authorize(r, h.orders.sessions, prev, u); err != nil {
+		res.Reason = rejectForbidden
+		return res, nil
+	}
+	applyPromotions(h.orders.promotions, prev, &u, time.Now())
+	applyServiceCharge(h.orders.settings, prev, &u)
+	keepTotalOverride(prev, &u)
+	if err := h.runHooks(r, m, prev, &u); err != nil {
+		var closed *closedError
+		if _, ok := err.(*ruleError); !ok && !errors.As(err, &closed) {
+			return res, err
+		}
+		res.Reason = rejectRule
+		return res, nil
+	}
+
+	store.Lock()
+	current, exists := store.m[u.ID]
+	switch {
+	case m.Op == mutationCreate && exists:
+		res.Reason = rejectAlreadyExists
+	case m.Op == mutationUpdate && !exists:
+		res.Reason = rejectNotFound
+	case current.Locked:
+		res.Reason = rejectLocked
+	case m.Op == mutationUpdate && m.BaseVersion != current.Version &&
+		(current.UpdatedAt == nil || !m.ClientTime.After(*current.UpdatedAt)):
+		res.Reason = rejectStale
+	case m.Op == mutationCreate && h.orders.quotas.admit(store.m, u)[0] != nil:
+		res.Reason = rejectQuota
+	}
+	if res.Reason != "" {
+		store.Unlock()
+		if exists {
+			res.Order = &current
+		}
+		return res, nil
+	}
+	u.Locked = false
+	// Payments taken since the mutation was prepared are kept.
+	keepPayments(current, &u)
+	defaultPayment(&u)
+	u.ReceiptURL, u.TrackingURL = current.ReceiptURL, current.TrackingURL
+	if exists {
+		u.Channel, u.LocationID, u.Number, u.Reference = current.Channel, current.LocationID, current.Number, current.Reference
+		keepStatus(current, &u)
+	} else {
+		if err := h.orders.numbers.number(&u, func(id string) bool { _, ok := store.m[id]; return ok }); err != nil {
+			store.Unlock()
+			return res, err
+		}
+		h.orders.reference(&u, time.Now())
+		startStatus(current, &u, identifyActor(r, h.orders.sessions, h.orders.devices).StaffID, time.Now())
+	}
+	touch(&u, current, time.Now())
+	if err := store.put(u); err != nil {
+		store.Unlock()
+		return res, err
+	}
+	store.Unlock()
+
+	h.orders.recordChange(r, "order.sync."+m.Op, current, u)
+	h.feed.publish(kindOrders, u.ID, false)
+	if exists {
+		h.orders.events.updated(u)
+		h.orders.hooks.runAfterStatusChange(r.Context(), current, u)
+	} else {
+		h.orders.events.created(u)
+		h.orders.hooks.runAfterCreate(r.Context(), u)
+	}
+	res.Order = &u
+	return res, nil
+}
+
+func (h *syncHandler) runHooks(r *http.Request, m mutation, prev order, u *order) error {
+	if m.Op == mutationCreate {
+		if err := h.orders.hooks.runBeforeCreate(r.Context(), u); err != nil {
+			return err
+		}
+	}
+	return h.orders.hooks.runBeforePayment(r.Context(), prev, u)
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"time"
+)
+
+var (
+	listTablesRe = regexp.MustCompile(`^/tables/?$`)
+	tableRe      = regexp.MustCompile(`^/tables/([0-9]+)$`)
+)
+
+// defaultSectionID is the section tables go in when they are added without
+// one to a plan that has no sections yet.
+const defaultSectionID = "main"
+
+// tableInput is a table added or changed through /tables. Only Seats, the
+// table's capacity, is required for a new table; the rest places it on the
+// floor plan and defaults to a unit square at the origin in the plan's first
+// section.
+type tableInput struct {
+	SectionID string  `json:"section_id"`
+	Shape     string  `json:"shape"`
+	X         float64 `json:"x"`
+	Y         float64 `json:"y"`
+	Width     float64 `json:"width"`
+	Height    float64 `json:"height"`
+	Rotation  float64 `json:"rotation"`
+	Seats     int     `json:"seats"`
+}
+
+// table finds a table on a location's plan and the section it is in.
+func (p floorPlan) table(number string) (floorTable, string, bool) {
+	for _, s := range p.Sections {
+		for _, t := range s.Tables {
+			if t.Number == number {
+				return t, s.ID, true
+			}
+		}
+	}
+	return floorTable{}, "", false
+}
+
+func (p floorPlan) hasTables() bool {
+	for _, s := range p.Sections {
+		if len(s.Tables) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// putTable adds or replaces a table on a location's plan, moving it to
+// sectionID.
+func (s *floorPlanStore) putTable(location, sectionID string, t floorTable) (floorPlan, error) {
+	s.Lock()
+	defer s.Unlock()
+	p, ok := s.m[location]
+	if !ok {
+		p = floorPlan{LocationID: location, Sections: []section{}}
+	}
+	sections := make([]section, 0, len(p.Sections)+1)
+	placed := false
+	for _, sec := range p.Sections {
+		tables := make([]floorTable, 0, len(sec.Tables)+1)
+		for _, existing := range sec.Tables {
+			switch {
+			case existing.Number != t.Number:
+				tables = append(tables, existing)
+			case sec.ID == sectionID:
+				tables = append(tables, t)
+				placed = true
+			}
+		}
+		sec.Tables = tables
+		sections = append(sections, sec)
+	}
+	if !placed {
+		for i := range sections {
+			if sections[i].ID == sectionID {
+				sections[i].Tables = append(sections[i].Tables, t)
+				placed = true
+			}
+		}
+	}
+	if !placed {
+		sections = append(sections, section{ID: sectionID, Name: sectionID, Tables: []floorTable{t}})
+	}
+	p.Sections = sections
+	if err := p.validate(); err != nil {
+		return floorPlan{}, err
+	}
+	now := time.Now().UTC()
+	p.UpdatedAt = &now
+	before := s.m[location]
+	s.m[location] = p
+	s.publish(before, p)
+	return p, nil
+}
+
+// deleteTable takes a table off a location's plan.
+func (s *floorPlanStore) deleteTable(location, number string) bool {
+	s.Lock()
+	defer s.Unlock()
+	p, ok := s.m[location]
+	if !ok {
+		return false
+	}
+	found := false
+	sections := make([]section, 0, len(p.Sections))
+	for _, sec := range p.Sections {
+		tables := make([]floorTable, 0, len(sec.Tables))
+		for _, t := range sec.Tables {
+			if t.Number == number {
+				found = true
+				continue
+			}
+			tables = append(tables, t)
+		}
+		sec.Tables = tables
+		sections = append(sections, sec)
+	}
+	if !found {
+		return false
+	}
+	now := time.Now().UTC()
+	before := s.m[location]
+	p.Sections, p.UpdatedAt = sections, &now
+	s.m[location] = p
+	s.publish(before, p)
+	return true
+}
+
+// validateTableExists requires an order's table to be on its location's floor
+// plan. Locations without tables on their plan take any table number.
+func validateTableExists(plans *floorPlanStore) validationRule {
+	return func(o order) []fieldError {
+		if o.TableNumber == "" {
+			return nil
+		}
+		location := o.LocationID
+		if location == "" {
+			location = defaultLocation
+		}
+		p := plans.get(location)
+		if _, _, ok := p.table(o.TableNumber); !ok && p.hasTables() {
+			return []fieldError{{Field: "table_number", Message: "is not a table at " + location}}
+		}
+		return nil
+	}
+}
+
+// tableHandler serves the tables on a location's floor plan (?location=,
+// default main) with their live status: occupied while an open order is at
+// the table, reserved when a reservation starts within the hour, free
+// otherwise.
+type tableHandler struct {
+	plans        *floorPlanStore
+	store        *datastore
+	reservations *reservationStore
+	sessions     *sessionStore
+}
+
+func (h *tableHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("content-type", "application/json")
+	scope := "orders:read"
+	if r.Method != http.MethodGet {
+		scope = "orders:manage"
+	}
+	if _, ok := h.sessions.requireScope(w, r, scope); !ok {
+		return
+	}
+	location := r.URL.Query().Get("location")
+	if location == "" {
+		location = defaultLocation
+	}
+	switch {
+	case r.Method == http.MethodGet && listTablesRe.MatchString(r.URL.Path):
+		writeJSON(w, r, http.StatusOK, liveTables(h.plans.get(location), h.store, h.reservations, time.Now().UTC()))
+		return
+	case r.Method == http.MethodGet && tableRe.MatchString(r.URL.Path):
+		h.Get(w, r, location)
+		return
+	case r.Method == http.MethodPut && tableRe.MatchString(r.URL.Path):
+		h.Put(w, r, location)
+		return
+	case r.Method == http.MethodDelete && tableRe.MatchString(r.URL.Path):
+		h.Delete(w, r, location)
+		return
+	default:
+		notFound(w, r)
+		return
+	}
+}
+
+func (h *tableHandler) Get(w http.ResponseWriter, r *http.Request, location string) {
+	number := tableRe.FindStringSubmatch(r.URL.Path)[1]
+	for _, t := range liveTables(h.plans.get(location), h.store, h.reservations, time.Now().UTC()) {
+		if t.Number == number {
+			writeJSON(w, r, http.StatusOK, t)
+			return
+		}
+	}
+	notFound(w, r)
+}
+
+// Put adds a table to the floor plan or changes it. Fields left out of a
+// change keep their current values.
+func (h *tableHandler) Put(w http.ResponseWriter, r *http.Request, location string) {
+	number := tableRe.FindStringSubmatch(r.URL.Path)[1]
+	plan := h.plans.get(location)
+	in := tableInput{Shape: "square", Width: 1, Height: 1, SectionID: defaultSectionID}
+	if len(plan.Sections) > 0 {
+		in.SectionID = plan.Sections[0].ID
+	}
+	if t, sectionID, ok := plan.table(number); ok {
+		in = tableInput{SectionID: sectionID, Shape: t.Shape, X: t.X, Y: t.Y, Width: t.Width, Height: t.Height, Rotation: t.Rotation, Seats: t.Seats}
+	}
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("invalid table"))
+		return
+	}
+	t := floorTable{Number: number, Shape: in.Shape, X: in.X, Y: in.Y, Width: in.Width, Height: in.Height, Rotation: in.Rotation, Seats: in.Seats}
+	if _, err := h.plans.putTable(location, in.SectionID, t); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	h.Get(w, r, location)
+}
+
+// Delete takes a table off the floor plan. Tables with open orders stay.
+func (h *tableHandler) Delete(w http.ResponseWriter, r *http.Request, location string) {
+	number := tableRe.FindStringSubmatch(r.URL.Path)[1]
+	for _, t := range liveTables(h.plans.get(location), h.store, h.reservations, time.Now().UTC()) {
+		if t.Number == number && len(t.OpenOrders) > 0 {
+			w.WriteHeader(http.StatusConflict)
+			w.Write([]byte(fmt.Sprintf("table %s has open orders", number)))
+			return
+		}
+	}
+	if !h.plans.deleteTable(location, number) {
+		notFound(w, r)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
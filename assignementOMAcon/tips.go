@@ -0,0 +1,293 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	clockInRe     = regexp.MustCompile(`^/shifts/clock-in$`)
+	clockOutRe    = regexp.MustCompile(`^/shifts/clock-out$`)
+	listShiftsRe  = regexp.MustCompile(`^/shifts/?$`)
+	getTipRulesRe = regexp.MustCompile(`^/tips/rules$`)
+	putTipRulesRe = regexp.MustCompile(`^/tips/rules$`)
+	tipPayoutRe   = regexp.MustCompile(`^/tips/payout$`)
+)
+
+const (
+	poolByHours         = "hours"
+	poolByRoleWeights   = "role_weights"
+	poolByWeightedHours = "weighted_hours"
+)
+
+// tipPoolRules decides how the tips taken during a period are shared. With
+// "hours" everyone earns in proportion to hours worked; with "role_weights"
+// each person earns their role's weight regardless of hours; with
+// "weighted_hours" hours are multiplied by the role weight.
+type tipPoolRules struct {
+	Method      string             `json:"method"`
+	RoleWeights map[string]float64 `json:"role_weights,omitempty"`
+}
+
+func (r tipPoolRules) weight(role string) float64 {
+	if w, ok := r.RoleWeights[role]; ok {
+		return w
+	}
+	return 1
+}
+
+type shift struct {
+	StaffID string     `json:"staff_id"`
+	Start   time.Time  `json:"start"`
+	End     *time.Time `json:"end,omitempty"`
+}
+
+// hoursWithin returns how long the shift overlapped [from, to). Open shifts
+// run until now.
+func (s shift) hoursWithin(from, to, now time.Time) float64 {
+	end := now
+	if s.End != nil {
+		end = *s.End
+	}
+	if s.Start.After(from) {
+		from = s.Start
+	}
+	if end.Before(to) {
+		to = end
+	}
+	if !to.After(from) {
+		return 0
+	}
+	return to.Sub(from).Hours()
+}
+
+type tipStore struct {
+	rules  tipPoolRules
+	shifts []shift
+	*sync.RWMutex
+}
+
+func newTipStore() *tipStore {
+	return &tipStore{
+		rules:   tipPoolRules{Method: poolByHours},
+		RWMutex: &sync.RWMutex{},
+	}
+}
+
+type tipPayout struct {
+	StaffID string  `json:"staff_id"`
+	Name    string  `json:"name"`
+	Role    string  `json:"role"`
+	Hours   float64 `json:"hours"`
+	Weight  float64 `json:"weight"`
+	Payout  int64   `json:"payout"`
+}
+
+type tipPayoutReport struct {
+	From    time.Time    `json:"from"`
+	To      time.Time    `json:"to"`
+	Pool    int64        `json:"pool"`
+	Payouts []tipPayout  `json:"payouts"`
+	Rules   tipPoolRules `json:"rules"`
+}
+
+type tipHandler struct {
+	tips     *tipStore
+	staff    *staffStore
+	store    *datastore
+	sessions *sessionStore
+}
+
+func (h *tipHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("content-type", "application/json")
+	sess, ok := h.sessions.fromRequest(r)
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("unauthorized"))
+		return
+	}
+	switch {
+	case r.Method == http.MethodPost && clockInRe.MatchString(r.URL.Path):
+		h.ClockIn(w, r, sess)
+		return
+	case r.Method == http.MethodPost && clockOutRe.MatchString(r.URL.Path):
+		h.ClockOut(w, r, sess)
+		return
+	}
+	if _, ok := h.sessions.requireScope(w, r, "orders:manage"); !ok {
+		return
+	}
+	switch {
+	case r.Method == http.MethodGet && listShiftsRe.MatchString(r.URL.Path):
+		h.tips.RLock()
+		out := append([]shift{}, h.tips.shifts...)
+		h.tips.RUnlock()
+		writeJSON(w, r, http.StatusOK, out)
+		return
+	case r.Method == http.MethodGet && getTipRulesRe.MatchString(r.URL.Path):
+		h.tips.RLock()
+		rules := h.tips.rules
+		h.tips.RUnlock()
+		writeJSON(w, r, http.StatusOK, rules)
+		return
+	case r.Method == http.MethodPut && putTipRulesRe.MatchString(r.URL.Path):
+		h.PutRules(w, r)
+		return
+	case r.Method == http.MethodGet && tipPayoutRe.MatchString(r.URL.Path):
+		h.Payout(w, r)
+		return
+	default:
+		notFound(w, r)
+		return
+	}
+}
+
+func (h *tipHandler) ClockIn(w http.ResponseWriter, r *http.Request, sess session) {
+	h.tips.Lock()
+	defer h.tips.Unlock()
+	for _, s := range h.tips.shifts {
+		if s.StaffID == sess.StaffID && s.End == nil {
+			w.WriteHeader(http.StatusConflict)
+			w.Write([]byte("already clocked in"))
+			return
+		}
+	}
+	s := shift{StaffID: sess.StaffID, Start: time.Now().UTC()}
+	h.tips.shifts = append(h.tips.shifts, s)
+	writeJSON(w, r, http.StatusCreated, s)
+}
+
+func (h *tipHandler) ClockOut(w http.ResponseWriter, r *http.Request, sess session) {
+	h.tips.Lock()
+	defer h.tips.Unlock()
+	for i, s := range h.tips.shifts {
+		if s.StaffID == sess.StaffID && s.End == nil {
+			now := time.Now().UTC()
+			h.tips.shifts[i].End = &now
+			writeJSON(w, r, http.StatusOK, h.tips.shifts[i])
+			return
+		}
+	}
+	w.WriteHeader(http.StatusConflict)
+	w.Write([]byte("not clocked in"))
+}
+
+func (h *tipHandler) PutRules(w http.ResponseWriter, r *http.Request) {
+	var rules tipPoolRules
+	if err := json.NewDecoder(r.Body).Decode(&rules); err != nil ||
+		(rules.Method != poolByHours && rules.Method != poolByRoleWeights && rules.Method != poolByWeightedHours) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("method must be hours, role_weights or weighted_hours"))
+		return
+	}
+	for _, wt := range rules.RoleWeights {
+		if wt < 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("role weights must not be negative"))
+			return
+		}
+	}
+	h.tips.Lock()
+	h.tips.rules = rules
+	h.tips.Unlock()
+	writeJSON(w, r, http.StatusOK, rules)
+}
+
+// Payout shares the tips on orders paid in the window between the staff who
+// worked during it. The window defaults to the last 12 hours, which covers an
+// ordinary shift; pass RFC 3339 ?from= and ?to= to override.
+func (h *tipHandler) Payout(w http.ResponseWriter, r *http.Request) {
+	now := time.Now().UTC()
+	from, to := now.Add(-12*time.Hour), now
+	var err error
+	if v := r.URL.Query().Get("from"); v != "" {
+		if from, err = time.Parse(time.RFC3339, v); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("from must be RFC 3339"))
+			return
+		}
+	}
+	if v := r.URL.Query().Get("to"); v != "" {
+		if to, err = time.Parse(time.RFC3339, v); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("to must be RFC 3339"))
+			return
+		}
+	}
+
+	var pool int64
+	h.store.RLock()
+	for _, o := range h.store.m {
+		if o.Tip > 0 && isPaid(o) && o.UpdatedAt != nil && !o.UpdatedAt.Before(from) && o.UpdatedAt.Before(to) {
+			pool += o.Tip
+		}
+	}
+	h.store.RUnlock()
+
+	h.tips.RLock()
+	rules := h.tips.rules
+	hours := map[string]float64{}
+	for _, s := range h.tips.shifts {
+		if hrs := s.hoursWithin(from, to, now); hrs > 0 {
+			hours[s.StaffID] += hrs
+		}
+	}
+	h.tips.RUnlock()
+
+	payouts := make([]tipPayout, 0, len(hours))
+	h.staff.RLock()
+	for id, hrs := range hours {
+		member := h.staff.m[id]
+		p := tipPayout{StaffID: id, Name: member.Name, Role: member.Role, Hours: math.Round(hrs*100) / 100}
+		switch rules.Method {
+		case poolByHours:
+			p.Weight = hrs
+		case poolByRoleWeights:
+			p.Weight = rules.weight(member.Role)
+		case poolByWeightedHours:
+			p.Weight = hrs * rules.weight(member.Role)
+		}
+		payouts = append(payouts, p)
+	}
+	h.staff.RUnlock()
+	sort.Slice(payouts, func(i, j int) bool { return payouts[i].StaffID < payouts[j].StaffID })
+	distribute(pool, payouts)
+
+	writeJSON(w, r, http.StatusOK, tipPayoutReport{
+		From: from, To: to, Pool: pool, Payouts: payouts, Rules: rules,
+	})
+}
+
+// distribute splits pool in proportion to each payout's weight. Whole units
+// are handed out by largest remainder so the payouts always sum to the pool.
+func distribute(pool int64, payouts []tipPayout) {
+	var total float64
+	for _, p := range payouts {
+		total += p.Weight
+	}
+	if total <= 0 || pool <= 0 {
+		return
+	}
+	type rem struct {
+		idx  int
+		frac float64
+	}
+	rems := make([]rem, len(payouts))
+	var given int64
+	for i := range payouts {
+		exact := float64(pool) * payouts[i].Weight / total
+		payouts[i].Payout = int64(math.Floor(exact))
+		given += payouts[i].Payout
+		rems[i] = rem{idx: i, frac: exact - math.Floor(exact)}
+	}
+	sort.SliceStable(rems, func(i, j int) bool { return rems[i].frac > rems[j].frac })
+	for i := 0; given < pool && i < len(rems); i++ {
+		payouts[rems[i].idx].Payout++
+		given++
+	}
+}
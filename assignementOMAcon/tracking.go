@@ -0,0 +1,218 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"regexp"
+	"time"
+)
+
+var (
+	trackPageRe   = regexp.MustCompile(`^/track/([0-9A-Za-z]+)$`)
+	trackEventsRe = regexp.MustCompile(`^/track/([0-9A-Za-z]+)/events$`)
+)
+
+const (
+	trackReceived  = "received"
+	trackPreparing = "preparing"
+	trackReady     = "ready"
+	trackCancelled = "cancelled"
+)
+
+// trackKeepAlive is how often an idle status stream sends a comment so
+// proxies do not close it.
+const trackKeepAlive = 15 * time.Second
+
+func trackingPath(token string) string {
+	return "/track/" + token
+}
+
+// attachTracking gives a new order the link guests follow to watch it.
+func (h *orderHandler) attachTracking(u *order) error {
+	token, err := h.tracking.issue(u.ID)
+	if err != nil {
+		return err
+	}
+	u.TrackingURL = trackingPath(token)
+	return nil
+}
+
+// trackingView is what a guest sees of their order: no prices, names or
+// table, only what they ordered and how far along it is.
+type trackingView struct {
+	Number    int64          `json:"number,omitempty"`
+	Status    string         `json:"status"`
+	Items     []trackingItem `json:"items"`
+	UpdatedAt time.Time      `json:"updated_at"`
+}
+
+type trackingItem struct {
+	Name     string `json:"name"`
+	Quantity int    `json:"quantity"`
+}
+
+// trackingStatus follows an order through the kitchen: received until a
+// course is fired, preparing while any station still has a ticket, and ready
+// once every ticket is bumped. An order moved further along its status
+// workflow by hand shows as far as it has got.
+func trackingStatus(o order, tickets []ticket) string {
+	if isVoided(o) {
+		return trackCancelled
+	}
+	started, done := false, len(tickets) > 0
+	for _, t := range tickets {
+		started = started || t.FiredAt != nil || t.BumpedAt != nil
+		done = done && t.Status == ticketBumped
+	}
+	switch {
+	case done || o.Status == statusReady || o.Status == statusServed:
+		return trackReady
+	case started || o.Status == statusPreparing:
+		return trackPreparing
+	}
+	return trackReceived
+}
+
+type trackingHandler struct {
+	store    *datastore
+	tracking *receiptStore
+	kitchen  *kitchenQueue
+	feed     *changeFeed
+}
+
+// ServeHTTP serves the public status page and its event stream. The token
+// in the path is all the authentication there is, like a receipt link.
+func (h *trackingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		notFound(w, r)
+		return
+	}
+	switch {
+	case trackPageRe.MatchString(r.URL.Path):
+		h.Page(w, r, trackPageRe.FindStringSubmatch(r.URL.Path)[1])
+	case trackEventsRe.MatchString(r.URL.Path):
+		h.Events(w, r, trackEventsRe.FindStringSubmatch(r.URL.Path)[1])
+	default:
+		notFound(w, r)
+	}
+}
+
+// view looks up the order behind token. ok is false for unknown tokens and
+// for orders that have since been deleted.
+func (h *trackingHandler) view(token string) (trackingView, bool) {
+	orderID, ok := h.tracking.lookup(token)
+	if !ok {
+		return trackingView{}, false
+	}
+	h.store.RLock()
+	o, ok := h.store.m[orderID]
+	h.store.RUnlock()
+	if !ok {
+		return trackingView{}, false
+	}
+	v := trackingView{Number: o.Number, Status: trackingStatus(o, h.kitchen.tickets(o)), Items: []trackingItem{}}
+	for _, it := range o.OrderItems {
+		v.Items = append(v.Items, trackingItem{Name: it.Name, Quantity: it.Quantity})
+	}
+	if o.UpdatedAt != nil {
+		v.UpdatedAt = *o.UpdatedAt
+	}
+	return v, true
+}
+
+// Page renders the status page, or the status itself for clients asking for
+// JSON.
+func (h *trackingHandler) Page(w http.ResponseWriter, r *http.Request, token string) {
+	v, ok := h.view(token)
+	if !ok {
+		notFound(w, r)
+		return
+	}
+	if r.Header.Get("Accept") == "application/json" {
+		w.Header().Set("content-type", "application/json")
+		writeJSON(w, r, http.StatusOK, v)
+		return
+	}
+	w.Header().Set("content-type", "text/html; charset=utf-8")
+	page := struct {
+		View   trackingView
+		Events string
+	}{v, trackingPath(token) + "/events"}
+	if err := trackingTmpl.Execute(w, page); err != nil {
+		internalServerError(w, r)
+		return
+	}
+}
+
+// Events streams the order's status as server-sent events: the current
+// status straight away, then each change until the client goes away. The
+// stream ends once the order is ready, cancelled or gone.
+func (h *trackingHandler) Events(w http.ResponseWriter, r *http.Request, token string) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		internalServerError(w, r)
+		return
+	}
+	if _, ok := h.view(token); !ok {
+		notFound(w, r)
+		return
+	}
+	w.Header().Set("content-type", eventStreamMediaType)
+	w.Header().Set("cache-control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	keepAlive := time.NewTicker(trackKeepAlive)
+	defer keepAlive.Stop()
+	last := ""
+	for {
+		// Take the channels before looking so no change is missed.
+		orderChanged, kitchenChanged := h.feed.changed.wait(), h.kitchen.changed.wait()
+		v, ok := h.view(token)
+		if !ok {
+			return
+		}
+		if v.Status != last {
+			b, err := json.Marshal(v)
+			if err != nil {
+				return
+			}
+			fmt.Fprintf(w, "event: status\ndata: %s\n\n", b)
+			flusher.Flush()
+			last = v.Status
+		}
+		if v.Status == trackReady || v.Status == trackCancelled {
+			return
+		}
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+			flusher.Flush()
+		case <-orderChanged:
+		case <-kitchenChanged:
+		}
+	}
+}
+
+var trackingTmpl = template.Must(template.New("tracking").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><meta name="viewport" content="width=device-width, initial-scale=1"><title>Order {{with .View.Number}}#{{.}}{{end}}</title></head>
+<body>
+<h1>Order {{with .View.Number}}#{{.}}{{end}}</h1>
+<p>Status: <strong id="status">{{.View.Status}}</strong></p>
+<ul>{{range .View.Items}}<li>{{.Quantity}} &times; {{.Name}}</li>{{end}}</ul>
+<script>
+var events = new EventSource({{.Events}});
+events.addEventListener("status", function (e) {
+	var status = JSON.parse(e.data).status;
+	document.getElementById("status").textContent = status;
+	if (status === "ready" || status === "cancelled") {
+		events.close();
+	}
+});
+</script>
+</body>
+</html>
+`))
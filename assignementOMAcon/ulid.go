@@ -0,0 +1,88 @@
+package main
+
+import (
+	"crypto/rand"
+	"sync"
+	"time"
+)
+
+// Orders created without an ID are given their order number or a ULID as
+// their ID, as config.OrderIDs says.
+const (
+	orderIDsNumber = "number"
+	orderIDsULID   = "ulid"
+)
+
+// crockford is the base32 alphabet ULIDs are written in: no I, L, O or U, so
+// IDs read aloud or typed by hand are hard to get wrong.
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// ulidSource generates ULIDs: 26 characters, a 48-bit millisecond timestamp
+// followed by 80 random bits. They sort by creation time as plain strings.
+// IDs made in the same millisecond increment the random part so they still
+// sort in the order they were made.
+type ulidSource struct {
+	lastMs   uint64
+	lastRand [10]byte
+	*sync.Mutex
+}
+
+func newULIDSource() *ulidSource {
+	return &ulidSource{Mutex: &sync.Mutex{}}
+}
+
+func (s *ulidSource) next(now time.Time) (string, error) {
+	ms := uint64(now.UnixNano() / int64(time.Millisecond))
+	s.Lock()
+	defer s.Unlock()
+	if ms <= s.lastMs && incrementBytes(s.lastRand[:]) {
+		ms = s.lastMs
+	} else {
+		if _, err := rand.Read(s.lastRand[:]); err != nil {
+			return "", err
+		}
+		if ms < s.lastMs {
+			// The clock went back; stay on the last timestamp so IDs keep
+			// increasing.
+			ms = s.lastMs
+		}
+	}
+	s.lastMs = ms
+	return encodeULID(ms, s.lastRand), nil
+}
+
+// incrementBytes adds one to b as a big-endian number, reporting false if it
+// overflowed.
+func incrementBytes(b []byte) bool {
+	for i := len(b) - 1; i >= 0; i-- {
+		b[i]++
+		if b[i] != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func encodeULID(ms uint64, entropy [10]byte) string {
+	var id [16]byte
+	for i := 0; i < 6; i++ {
+		id[i] = byte(ms >> (8 * (5 - i)))
+	}
+	copy(id[6:], entropy[:])
+	// 128 bits in 26 five-bit characters: the first character holds only the
+	// top three bits.
+	out := make([]byte, 26)
+	var acc uint32
+	bits := 2
+	j := 0
+	for _, b := range id {
+		acc = acc<<8 | uint32(b)
+		bits += 8
+		for bits >= 5 {
+			bits -= 5
+			out[j] = crockford[(acc>>uint(bits))&31]
+			j++
+		}
+	}
+	return string(out)
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// fieldError describes why one field of a request is invalid.
+type fieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// validationRule inspects an order and reports every field it rejects.
+type validationRule func(o order) []fieldError
+
+type namedRule struct {
+	name string
+	rule validationRule
+}
+
+// validatorRegistry holds the domain rules every stored order must satisfy.
+type validatorRegistry struct {
+	rules []namedRule
+	*sync.RWMutex
+}
+
+func newValidatorRegistry() *validatorRegistry {
+	return &validatorRegistry{RWMutex: &sync.RWMutex{}}
+}
+
+func (v *validatorRegistry) Register(name string, rule validationRule) {
+	v.Lock()
+	v.rules = append(v.rules, namedRule{name: name, rule: rule})
+	v.Unlock()
+}
+
+func (v *validatorRegistry) validate(o order) []fieldError {
+	v.RLock()
+	rules := v.rules
+	v.RUnlock()
+	var errs []fieldError
+	for _, r := range rules {
+		errs = append(errs, r.rule(o)...)
+	}
+	return errs
+}
+
+// validationFailed reports the fields of a request that were rejected, in
+// the error's details.
+func validationFailed(w http.ResponseWriter, r *http.Request, errs []fieldError) {
+	writeError(w, r, http.StatusBadRequest, "validation_failed", "the request has invalid fields", errs)
+}
+
+// decodeFailed reports a request body that could not be read as an order,
+// naming the field when the decoder knows it.
+func decodeFailed(w http.ResponseWriter, r *http.Request, err error) {
+	var typeErr *json.UnmarshalTypeError
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.As(err, &tooLarge):
+		bodyReadFailed(w, r, err)
+	case errors.As(err, &typeErr) && typeErr.Field != "":
+		writeError(w, r, http.StatusBadRequest, "invalid_body", "the request body could not be read",
+			[]fieldError{{Field: typeErr.Field, Message: "must be " + jsonKind(typeErr.Type.Kind())}})
+	default:
+		writeError(w, r, http.StatusBadRequest, "invalid_body", "the request body could not be read",
+			[]fieldError{{Field: "body", Message: "must be a JSON order: " + err.Error()}})
+	}
+}
+
+func jsonKind(k reflect.Kind) string {
+	switch k {
+	case reflect.String:
+		return "a string"
+	case reflect.Bool:
+		return "true or false"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "a whole number"
+	case reflect.Float32, reflect.Float64:
+		return "a number"
+	case reflect.Slice, reflect.Array:
+		return "a list"
+	}
+	return "an object"
+}
+
+func validateName(o order) []fieldError {
+	if strings.TrimSpace(o.Name) == "" {
+		return []fieldError{{Field: "name", Message: "is required"}}
+	}
+	return nil
+}
+
+// validateTable accepts orders without a table, such as takeaways, and
+// otherwise table numbers from 1 to max.
+func validateTable(max int) validationRule {
+	return func(o order) []fieldError {
+		if o.TableNumber == "" {
+			return nil
+		}
+		if n, err := strconv.Atoi(o.TableNumber); err != nil || n < 1 || n > max {
+			return []fieldError{{Field: "table_number", Message: "must be a number from 1 to " + strconv.Itoa(max)}}
+		}
+		return nil
+	}
+}
+
+// constraint is a rule declared in the VALIDATION_RULES config file, e.g.
+//
+//	[{"field": "total_items", "max": 20},
+//	 {"field": "table_number", "one_of": ["1", "11", "12"]}]
+//
+// Field names are the order's JSON keys.
+type constraint struct {
+	Field    string   `json:"field"`
+	Required bool     `json:"required,omitempty"`
+	Min      *float64 `json:"min,omitempty"`
+	Max      *float64 `json:"max,omitempty"`
+	Pattern  string   `json:"pattern,omitempty"`
+	OneOf    []string `json:"one_of,omitempty"`
+	Message  string   `json:"message,omitempty"`
+}
+
+func loadConstraints(path string) ([]constraint, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cs []constraint
+	if err := json.Unmarshal(b, &cs); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	return cs, nil
+}
+
+// compile turns a declared constraint into a validation rule.
+func (c constraint) compile() (validationRule, error) {
+	if c.Field == "" {
+		return nil, fmt.Errorf("constraint without field")
+	}
+	var re *regexp.Regexp
+	if c.Pattern != "" {
+		var err error
+		if re, err = regexp.Compile(c.Pattern); err != nil {
+			return nil, fmt.Errorf("constraint on %s: %w", c.Field, err)
+		}
+	}
+	fail := func(def string) []fieldError {
+		msg := c.Message
+		if msg == "" {
+			msg = def
+		}
+		return []fieldError{{Field: c.Field, Message: msg}}
+	}
+	return func(o order) []fieldError {
+		value, present := orderField(o, c.Field)
+		if !present {
+			if c.Required {
+				return fail("is required")
+			}
+			return nil
+		}
+		if c.Min != nil || c.Max != nil {
+			n, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return fail("must be a number")
+			}
+			if c.Min != nil && n < *c.Min {
+				return fail(fmt.Sprintf("must be at least %g", *c.Min))
+			}
+			if c.Max != nil && n > *c.Max {
+				return fail(fmt.Sprintf("must be at most %g", *c.Max))
+			}
+		}
+		if re != nil && !re.MatchString(value) {
+			return fail("has an invalid format")
+		}
+		if len(c.OneOf) > 0 {
+			for _, allowed := range c.OneOf {
+				if value == allowed {
+					return nil
+				}
+			}
+			return fail("is not an allowed value")
+		}
+		return nil
+	}, nil
+}
+
+// orderField returns the value of the order's JSON field as a string.
+func orderField(o order, field string) (string, bool) {
+	b, err := json.Marshal(o)
+	if err != nil {
+		return "", false
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal(b, &fields); err != nil {
+		return "", false
+	}
+	v, ok := fields[field]
+	if !ok {
+		return "", false
+	}
+	switch v := v.(type) {
+	case string:
+		return v, v != ""
+	default:
+		return fmt.Sprint(v), true
+	}
+}
+
+// registerConstraints compiles the constraints in the file at path into
+// validators.
+func registerConstraints(v *validatorRegistry, path string) error {
+	cs, err := loadConstraints(path)
+	if err != nil {
+		return err
+	}
+	for i, c := range cs {
+		rule, err := c.compile()
+		if err != nil {
+			return err
+		}
+		v.Register(fmt.Sprintf("config[%d]:%s", i, c.Field), rule)
+	}
+	return nil
+}
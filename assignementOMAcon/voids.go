@@ -0,0 +1,275 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var listVoidsRe = regexp.MustCompile(`^/voids/?$`)
+
+const (
+	voidPending  = "pending"
+	voidApproved = "approved"
+	voidRejected = "rejected"
+)
+
+// itemVoid takes units of one item off an order. Staff request it and it only
+// changes the order once a manager approves it. Approved voids come off the
+// bill but still count as waste, since the food was made.
+type itemVoid struct {
+	ID          string     `json:"id"`
+	OrderID     string     `json:"order_id"`
+	Item        string     `json:"item"`
+	Quantity    int        `json:"quantity"`
+	UnitPrice   int64      `json:"unit_price"`
+	Amount      int64      `json:"amount"`
+	Reason      string     `json:"reason"`
+	Status      string     `json:"status"`
+	RequestedBy string     `json:"requested_by,omitempty"`
+	RequestedAt time.Time  `json:"requested_at"`
+	DecidedBy   string     `json:"decided_by,omitempty"`
+	DecidedAt   *time.Time `json:"decided_at,omitempty"`
+}
+
+type voidStore struct {
+	voids []itemVoid
+	*sync.RWMutex
+}
+
+func newVoidStore() *voidStore {
+	return &voidStore{RWMutex: &sync.RWMutex{}}
+}
+
+func (s *voidStore) add(v itemVoid) itemVoid {
+	s.Lock()
+	defer s.Unlock()
+	v.ID = strconv.Itoa(len(s.voids) + 1)
+	s.voids = append(s.voids, v)
+	return v
+}
+
+func (s *voidStore) get(id string) (itemVoid, bool) {
+	n, err := strconv.Atoi(id)
+	s.RLock()
+	defer s.RUnlock()
+	if err != nil || n < 1 || n > len(s.voids) {
+		return itemVoid{}, false
+	}
+	return s.voids[n-1], true
+}
+
+// list returns the voids keep accepts, oldest first.
+func (s *voidStore) list(keep func(itemVoid) bool) []itemVoid {
+	s.RLock()
+	defer s.RUnlock()
+	out := []itemVoid{}
+	for _, v := range s.voids {
+		if keep(v) {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// pendingUnits is how many units of item on an order already await approval.
+func (s *voidStore) pendingUnits(orderID, item string) int {
+	n := 0
+	for _, v := range s.list(func(v itemVoid) bool {
+		return v.OrderID == orderID && v.Status == voidPending && strings.EqualFold(v.Item, item)
+	}) {
+		n += v.Quantity
+	}
+	return n
+}
+
+// decide moves a pending void to status. It fails if someone else decided it
+// first.
+func (s *voidStore) decide(id, status, staffID string, now time.Time) (itemVoid, error) {
+	n, _ := strconv.Atoi(id)
+	s.Lock()
+	defer s.Unlock()
+	if n < 1 || n > len(s.voids) {
+		return itemVoid{}, errOrderNotFound
+	}
+	v := &s.voids[n-1]
+	if v.Status != voidPending {
+		return itemVoid{}, &badRequestError{msg: "void is already " + v.Status}
+	}
+	v.Status, v.DecidedBy, v.DecidedAt = status, staffID, &now
+	return *v, nil
+}
+
+// reopen puts a void back to pending after its approval could not be applied.
+func (s *voidStore) reopen(id string) {
+	n, _ := strconv.Atoi(id)
+	s.Lock()
+	defer s.Unlock()
+	if n >= 1 && n <= len(s.voids) {
+		s.voids[n-1].Status, s.voids[n-1].DecidedBy, s.voids[n-1].DecidedAt = voidPending, "", nil
+	}
+}
+
+// findLine is the index of the order line for item, or -1.
+func findLine(o order, item string) int {
+	for i, it := range o.OrderItems {
+		if strings.EqualFold(it.Name, item) {
+			return i
+		}
+	}
+	return -1
+}
+
+// RequestVoid asks for units of an item to come off an order. Nothing changes
+// until a manager approves.
+func (h *orderHandler) RequestVoid(w http.ResponseWriter, r *http.Request) {
+	sess, ok := h.sessions.requireScope(w, r, "orders:write")
+	if !ok {
+		return
+	}
+	var req struct {
+		Item     string `json:"item"`
+		Quantity int    `json:"quantity"`
+		Reason   string `json:"reason"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Item == "" || strings.TrimSpace(req.Reason) == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("item and reason are required"))
+		return
+	}
+	if req.Quantity == 0 {
+		req.Quantity = 1
+	}
+	id := pathParam(r, "id")
+	h.store.RLock()
+	o, ok := h.store.m[id]
+	h.store.RUnlock()
+	if !ok {
+		notFound(w, r)
+		return
+	}
+	if o.Locked || isFinal(o) {
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte("settled orders must be refunded, not voided"))
+		return
+	}
+	line := findLine(o, req.Item)
+	if line < 0 || req.Quantity < 1 ||
+		req.Quantity+h.voids.pendingUnits(id, req.Item) > o.OrderItems[line].Quantity {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("quantity must be at least 1 and no more than the order has left to void"))
+		return
+	}
+	it := o.OrderItems[line]
+	v := h.voids.add(itemVoid{
+		OrderID:     id,
+		Item:        it.Name,
+		Quantity:    req.Quantity,
+		UnitPrice:   it.UnitPrice,
+		Amount:      int64(req.Quantity) * it.UnitPrice,
+		Reason:      strings.TrimSpace(req.Reason),
+		Status:      voidPending,
+		RequestedBy: sess.StaffID,
+		RequestedAt: time.Now().UTC(),
+	})
+	a := identifyActor(r, h.sessions, h.devices)
+	h.audit.record(auditEntry{Action: "order.item_void.request", OrderID: id, Ref: v.ID, StaffID: a.StaffID, DeviceID: a.DeviceID})
+	writeJSON(w, r, http.StatusCreated, v)
+}
+
+func (h *orderHandler) ListVoids(w http.ResponseWriter, r *http.Request) {
+	if _, ok := h.sessions.requireScope(w, r, "orders:read"); !ok {
+		return
+	}
+	id := pathParam(r, "id")
+	writeJSON(w, r, http.StatusOK, h.voids.list(func(v itemVoid) bool { return v.OrderID == id }))
+}
+
+// ApproveVoid takes the voided units off the order and its bill.
+func (h *orderHandler) ApproveVoid(w http.ResponseWriter, r *http.Request) {
+	sess, ok := h.sessions.requireScope(w, r, "orders:manage")
+	if !ok {
+		return
+	}
+	v, ok := h.voids.get(pathParam(r, "void"))
+	if !ok || v.OrderID != pathParam(r, "id") {
+		notFound(w, r)
+		return
+	}
+	v, err := h.voids.decide(v.ID, voidApproved, sess.StaffID, time.Now().UTC())
+	if err != nil {
+		mutateFailed(w, r, err)
+		return
+	}
+	_, err = h.mutate(r, v.OrderID, "order.item_void.approve", func(o *order) error {
+		if isFinal(*o) {
+			return &badRequestError{msg: "settled orders must be refunded, not voided"}
+		}
+		line := findLine(*o, v.Item)
+		if line < 0 || o.OrderItems[line].Quantity < v.Quantity {
+			return &badRequestError{msg: "the order no longer has the items to void"}
+		}
+		before := *o
+		items := append(orderItems{}, o.OrderItems...)
+		items[line].Quantity -= v.Quantity
+		if items[line].Quantity == 0 {
+			items = append(items[:line], items[line+1:]...)
+		}
+		o.OrderItems = items
+		tallyItems(o)
+		applyPromotions(h.promotions, before, o, time.Now())
+		applyServiceCharge(h.settings, before, o)
+		keepTotalOverride(before, o)
+		return nil
+	})
+	if err != nil {
+		h.voids.reopen(v.ID)
+		mutateFailed(w, r, err)
+		return
+	}
+	writeJSON(w, r, http.StatusOK, v)
+}
+
+// RejectVoid declines a void; the order is left as it is.
+func (h *orderHandler) RejectVoid(w http.ResponseWriter, r *http.Request) {
+	sess, ok := h.sessions.requireScope(w, r, "orders:manage")
+	if !ok {
+		return
+	}
+	v, ok := h.voids.get(pathParam(r, "void"))
+	if !ok || v.OrderID != pathParam(r, "id") {
+		notFound(w, r)
+		return
+	}
+	v, err := h.voids.decide(v.ID, voidRejected, sess.StaffID, time.Now().UTC())
+	if err != nil {
+		mutateFailed(w, r, err)
+		return
+	}
+	h.audit.record(auditEntry{Action: "order.item_void.reject", OrderID: v.OrderID, Ref: v.ID, StaffID: sess.StaffID})
+	writeJSON(w, r, http.StatusOK, v)
+}
+
+// voidHandler lists voids across orders, e.g. ?status=pending for the ones
+// waiting on a manager.
+type voidHandler struct {
+	voids    *voidStore
+	sessions *sessionStore
+}
+
+func (h *voidHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("content-type", "application/json")
+	if _, ok := h.sessions.requireScope(w, r, "orders:manage"); !ok {
+		return
+	}
+	if r.Method != http.MethodGet || !listVoidsRe.MatchString(r.URL.Path) {
+		notFound(w, r)
+		return
+	}
+	status := r.URL.Query().Get("status")
+	writeJSON(w, r, http.StatusOK, h.voids.list(func(v itemVoid) bool { return status == "" || v.Status == status }))
+}
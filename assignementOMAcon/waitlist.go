@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var waitEstimateRe = regexp.MustCompile(`^/waitlist/estimate$`)
+
+const (
+	// defaultTurnTime is assumed until enough tables have turned to learn from.
+	defaultTurnTime = time.Hour
+	// minTurnRemaining is the least time an occupied table is expected to need,
+	// however long it has been seated.
+	minTurnRemaining = 5 * time.Minute
+	// defaultTicketPace is the time per ticket assumed when nothing was bumped
+	// in the last hour.
+	defaultTicketPace = 10 * time.Minute
+	turnoverSamples   = 50
+	minTurnoverSample = 3
+)
+
+// waitEstimator learns how long tables stay seated. An order with a table
+// number counts as seated from creation until it is paid, voided or refunded.
+type waitEstimator struct {
+	seatedAt map[string]time.Time
+	turns    []time.Duration
+	*sync.RWMutex
+}
+
+func newWaitEstimator() *waitEstimator {
+	return &waitEstimator{seatedAt: map[string]time.Time{}, RWMutex: &sync.RWMutex{}}
+}
+
+// seated is installed as an after-create hook.
+func (e *waitEstimator) seated(ctx context.Context, o order) {
+	if o.TableNumber == "" || isFinal(o) {
+		return
+	}
+	e.Lock()
+	if _, ok := e.seatedAt[o.ID]; !ok {
+		e.seatedAt[o.ID] = time.Now().UTC()
+	}
+	e.Unlock()
+}
+
+// statusChanged is installed as an after-status-change hook and records a turn
+// when a seated order is settled.
+func (e *waitEstimator) statusChanged(ctx context.Context, prev, next order) {
+	if isFinal(prev) || !isFinal(next) {
+		return
+	}
+	e.Lock()
+	defer e.Unlock()
+	start, ok := e.seatedAt[next.ID]
+	if !ok {
+		return
+	}
+	delete(e.seatedAt, next.ID)
+	e.turns = append(e.turns, time.Since(start))
+	if len(e.turns) > turnoverSamples {
+		e.turns = e.turns[len(e.turns)-turnoverSamples:]
+	}
+}
+
+// turnTime is the mean of recent turns, or the default while there are too
+// few of them.
+func (e *waitEstimator) turnTime() (time.Duration, int) {
+	e.RLock()
+	defer e.RUnlock()
+	if len(e.turns) < minTurnoverSample {
+		return defaultTurnTime, len(e.turns)
+	}
+	var sum time.Duration
+	for _, d := range e.turns {
+		sum += d
+	}
+	return sum / time.Duration(len(e.turns)), len(e.turns)
+}
+
+func (e *waitEstimator) seatedSince(o order) time.Time {
+	e.RLock()
+	defer e.RUnlock()
+	if t, ok := e.seatedAt[o.ID]; ok {
+		return t
+	}
+	if o.UpdatedAt != nil {
+		return *o.UpdatedAt
+	}
+	return time.Now().UTC()
+}
+
+type waitEstimate struct {
+	PartySize        int     `json:"party_size"`
+	LocationID       string  `json:"location_id"`
+	EstimateMinutes  int     `json:"estimate_minutes"`
+	FreeTables       int     `json:"free_tables"`
+	SuitableTables   int     `json:"suitable_tables"`
+	OpenOrders       int     `json:"open_orders"`
+	KitchenBacklog   int     `json:"kitchen_backlog"`
+	TicketsPerHour   int     `json:"tickets_per_hour"`
+	AvgTurnMinutes   float64 `json:"avg_turn_minutes"`
+	TurnoverSamples  int     `json:"turnover_samples"`
+	NextTableNumber  string  `json:"next_table_number,omitempty"`
+	NextTableSection string  `json:"next_table_section,omitempty"`
+}
+
+type waitlistHandler struct {
+	estimator    *waitEstimator
+	plans        *floorPlanStore
+	store        *datastore
+	reservations *reservationStore
+	kitchen      *kitchenQueue
+	sessions     *sessionStore
+}
+
+func (h *waitlistHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("content-type", "application/json")
+	if _, ok := h.sessions.requireScope(w, r, "orders:read"); !ok {
+		return
+	}
+	switch {
+	case r.Method == http.MethodGet && waitEstimateRe.MatchString(r.URL.Path):
+		h.Estimate(w, r)
+		return
+	default:
+		notFound(w, r)
+		return
+	}
+}
+
+// Estimate predicts how long a walk-in party waits for a table that seats it.
+// A free table means no wait. Otherwise each occupied table is expected to
+// turn after the average turn time since it was seated; tables still waiting
+// on the kitchen cannot turn before the kitchen has worked through its
+// backlog at its current pace. Tables reserved within the hour are skipped.
+func (h *waitlistHandler) Estimate(w http.ResponseWriter, r *http.Request) {
+	size, err := strconv.Atoi(r.URL.Query().Get("party_size"))
+	if err != nil || size < 1 {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("party_size must be a positive number"))
+		return
+	}
+	location := r.URL.Query().Get("location")
+	if location == "" {
+		location = defaultLocation
+	}
+	now := time.Now().UTC()
+	est := waitEstimate{PartySize: size, LocationID: location}
+
+	turn, samples := h.estimator.turnTime()
+	est.AvgTurnMinutes = math.Round(turn.Minutes()*10) / 10
+	est.TurnoverSamples = samples
+	est.TicketsPerHour = h.kitchen.bumpedSince(now.Add(-time.Hour))
+	pace := defaultTicketPace
+	if est.TicketsPerHour > 0 {
+		pace = time.Hour / time.Duration(est.TicketsPerHour)
+	}
+
+	orders := map[string]order{}
+	pending := map[string]bool{}
+	h.store.RLock()
+	for _, o := range h.store.m {
+		if o.Locked || isFinal(o) {
+			continue
+		}
+		orders[o.ID] = o
+		est.OpenOrders++
+		for _, t := range h.kitchen.tickets(o) {
+			if t.Status != ticketBumped {
+				est.KitchenBacklog++
+				pending[o.ID] = true
+			}
+		}
+	}
+	h.store.RUnlock()
+	kitchenWait := time.Duration(est.KitchenBacklog) * pace
+
+	best := time.Duration(-1)
+	for _, t := range liveTables(h.plans.get(location), h.store, h.reservations, now) {
+		if t.Seats < size || t.Status == tableReserved {
+			continue
+		}
+		est.SuitableTables++
+		var wait time.Duration
+		if t.Status == tableOccupied {
+			wait = minTurnRemaining
+			for _, id := range t.OpenOrders {
+				o := orders[id]
+				if left := turn - now.Sub(h.estimator.seatedSince(o)); left > wait {
+					wait = left
+				}
+				if pending[id] && kitchenWait+minTurnRemaining > wait {
+					wait = kitchenWait + minTurnRemaining
+				}
+			}
+		} else {
+			est.FreeTables++
+		}
+		if best < 0 || wait < best {
+			best = wait
+			est.NextTableNumber, est.NextTableSection = t.Number, t.SectionID
+		}
+	}
+	if best < 0 {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		w.Write([]byte("no available table at this location seats the party"))
+		return
+	}
+	est.EstimateMinutes = int(math.Ceil(best.Minutes()))
+	writeJSON(w, r, http.StatusOK, est)
+}
@@ -0,0 +1,384 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	wasteReportRe = regexp.MustCompile(`^/reports/waste$`)
+	wasteLogRe    = regexp.MustCompile(`^/waste/?$`)
+)
+
+const (
+	wasteKindVoid  = "void"
+	wasteKindComp  = "comp"
+	wasteKindWaste = "waste"
+)
+
+// compReasons and wasteReasons are the reason codes comps and kitchen waste
+// are recorded under, so the report can total them.
+var (
+	compReasons = map[string]bool{
+		"guest_complaint": true,
+		"long_wait":       true,
+		"goodwill":        true,
+		"promotion":       true,
+		"staff_meal":      true,
+	}
+	wasteReasons = map[string]bool{
+		"spoiled":        true,
+		"expired":        true,
+		"dropped":        true,
+		"overcooked":     true,
+		"wrong_order":    true,
+		"overproduction": true,
+	}
+)
+
+// wasteEntry records a comp (an item given away on an order) or kitchen
+// waste (stock thrown out). Cost is the impact in minor currency units: the
+// sale value of a comp, the purchase cost of waste.
+type wasteEntry struct {
+	ID       string    `json:"id"`
+	Kind     string    `json:"kind"`
+	OrderID  string    `json:"order_id,omitempty"`
+	SKU      string    `json:"sku,omitempty"`
+	Item     string    `json:"item"`
+	Quantity int       `json:"quantity"`
+	Cost     int64     `json:"cost"`
+	Reason   string    `json:"reason"`
+	Note     string    `json:"note,omitempty"`
+	StaffID  string    `json:"staff_id,omitempty"`
+	At       time.Time `json:"at"`
+}
+
+type wasteLog struct {
+	entries []wasteEntry
+	*sync.RWMutex
+}
+
+func newWasteLog() *wasteLog {
+	return &wasteLog{RWMutex: &sync.RWMutex{}}
+}
+
+func (l *wasteLog) record(e wasteEntry) wasteEntry {
+	l.Lock()
+	defer l.Unlock()
+	e.ID = strconv.Itoa(len(l.entries) + 1)
+	if e.At.IsZero() {
+		e.At = time.Now().UTC()
+	}
+	l.entries = append(l.entries, e)
+	return e
+}
+
+// between returns the entries recorded in [from, to).
+func (l *wasteLog) between(from, to time.Time) []wasteEntry {
+	l.RLock()
+	defer l.RUnlock()
+	out := []wasteEntry{}
+	for _, e := range l.entries {
+		if !e.At.Before(from) && e.At.Before(to) {
+			out = append(out, e)
+		}
+	}
+	return out
+}
+
+// lastUnitCost is what the most recent purchase order paid for one unit of
+// sku, or zero if it was never ordered.
+func (s *purchasingStore) lastUnitCost(sku string) int64 {
+	s.RLock()
+	defer s.RUnlock()
+	var latest time.Time
+	var cost int64
+	for _, po := range s.orders {
+		for _, l := range po.Lines {
+			if l.SKU == sku && !po.CreatedAt.Before(latest) {
+				latest, cost = po.CreatedAt, l.UnitCost
+			}
+		}
+	}
+	return cost
+}
+
+// byName finds the inventory item an item name refers to, as consume does.
+func (s *inventoryStore) byName(name string) (inventoryItem, bool) {
+	s.RLock()
+	defer s.RUnlock()
+	for _, item := range s.m {
+		if strings.EqualFold(item.Name, name) {
+			return item, true
+		}
+	}
+	return inventoryItem{}, false
+}
+
+type wasteHandler struct {
+	waste      *wasteLog
+	inventory  *inventoryStore
+	purchasing *purchasingStore
+	store      *datastore
+	sessions   *sessionStore
+	audit      *auditLog
+}
+
+func (h *wasteHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("content-type", "application/json")
+	scope := "orders:write"
+	if r.Method == http.MethodGet {
+		scope = "orders:manage"
+	}
+	sess, ok := h.sessions.requireScope(w, r, scope)
+	if !ok {
+		return
+	}
+	switch {
+	case r.Method == http.MethodGet && wasteLogRe.MatchString(r.URL.Path):
+		from, to, err := parseDateRange(r)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		writeJSON(w, r, http.StatusOK, h.waste.between(from, to))
+		return
+	case r.Method == http.MethodPost && wasteLogRe.MatchString(r.URL.Path):
+		h.Record(w, r, sess)
+		return
+	default:
+		notFound(w, r)
+		return
+	}
+}
+
+// Record logs kitchen waste. The stock comes from sku, or from the inventory
+// item named item; it is taken off hand and costed at the last purchase
+// price. Waste that matches no inventory item is still logged, at no cost.
+func (h *wasteHandler) Record(w http.ResponseWriter, r *http.Request, sess session) {
+	var req struct {
+		SKU      string `json:"sku"`
+		Item     string `json:"item"`
+		OrderID  string `json:"order_id"`
+		Quantity int    `json:"quantity"`
+		Reason   string `json:"reason"`
+		Note     string `json:"note"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || (req.SKU == "" && req.Item == "") ||
+		req.Quantity < 1 || !wasteReasons[req.Reason] {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("sku or item, a positive quantity and a known reason code are required"))
+		return
+	}
+	if req.OrderID != "" {
+		h.store.RLock()
+		_, ok := h.store.m[req.OrderID]
+		h.store.RUnlock()
+		if !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("unknown order"))
+			return
+		}
+	}
+	e := wasteEntry{Kind: wasteKindWaste, OrderID: req.OrderID, SKU: req.SKU, Item: req.Item,
+		Quantity: req.Quantity, Reason: req.Reason, Note: req.Note, StaffID: sess.StaffID}
+	if e.SKU == "" {
+		if item, ok := h.inventory.byName(req.Item); ok {
+			e.SKU = item.SKU
+		}
+	}
+	if e.SKU != "" {
+		item, ok := h.inventory.adjust(e.SKU, -req.Quantity)
+		if !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("unknown sku"))
+			return
+		}
+		if e.Item == "" {
+			e.Item = item.Name
+		}
+		e.Cost = int64(req.Quantity) * h.purchasing.lastUnitCost(e.SKU)
+	}
+	e = h.waste.record(e)
+	h.audit.record(auditEntry{Action: "waste.record", OrderID: e.OrderID, Ref: e.ID, StaffID: sess.StaffID})
+	writeJSON(w, r, http.StatusCreated, e)
+}
+
+// Comp gives units of an item on an order away: they move to a line of their
+// own at no charge, so the kitchen and stock still see them.
+func (h *orderHandler) Comp(w http.ResponseWriter, r *http.Request) {
+	sess, ok := h.sessions.requireScope(w, r, "orders:manage")
+	if !ok {
+		return
+	}
+	var req struct {
+		Item     string `json:"item"`
+		Quantity int    `json:"quantity"`
+		Reason   string `json:"reason"`
+		Note     string `json:"note"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Item == "" || !compReasons[req.Reason] {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("item and a known reason code are required"))
+		return
+	}
+	if req.Quantity == 0 {
+		req.Quantity = 1
+	}
+	var comped orderItem
+	o, err := h.mutate(r, pathParam(r, "id"), "order.comp", func(o *order) error {
+		if isFinal(*o) {
+			return &badRequestError{msg: "settled orders must be refunded, not comped"}
+		}
+		line := -1
+		for i, it := range o.OrderItems {
+			if strings.EqualFold(it.Name, req.Item) && it.UnitPrice > 0 {
+				line = i
+				break
+			}
+		}
+		if line < 0 || req.Quantity < 1 || o.OrderItems[line].Quantity < req.Quantity {
+			return &badRequestError{msg: "the order has no such charged item to comp"}
+		}
+		before := *o
+		items := append(orderItems{}, o.OrderItems...)
+		comped = items[line]
+		items[line].Quantity -= req.Quantity
+		if items[line].Quantity == 0 {
+			items = append(items[:line], items[line+1:]...)
+		}
+		items = append(items, orderItem{Name: comped.Name, Quantity: req.Quantity, Notes: "comp: " + req.Reason})
+		o.OrderItems = items
+		tallyItems(o)
+		applyPromotions(h.promotions, before, o, time.Now())
+		applyServiceCharge(h.settings, before, o)
+		keepTotalOverride(before, o)
+		return nil
+	})
+	if err != nil {
+		mutateFailed(w, r, err)
+		return
+	}
+	h.waste.record(wasteEntry{Kind: wasteKindComp, OrderID: o.ID, Item: comped.Name, Quantity: req.Quantity,
+		Cost: int64(req.Quantity) * comped.UnitPrice, Reason: req.Reason, Note: req.Note, StaffID: sess.StaffID})
+	writeJSON(w, r, http.StatusOK, o)
+}
+
+// wasteTotal is what was lost under one heading: how many units and the cost
+// impact in minor currency units.
+type wasteTotal struct {
+	Key    string `json:"key"`
+	Units  int    `json:"units"`
+	Amount int64  `json:"amount"`
+}
+
+type wasteDay struct {
+	Date  string `json:"date"`
+	Voids int64  `json:"voids"`
+	Comps int64  `json:"comps"`
+	Waste int64  `json:"waste"`
+	Total int64  `json:"total"`
+}
+
+// wasteReport covers items made but not sold between From and To: approved
+// item voids and comps at their sale value, kitchen waste at cost. Voided
+// and comped items are off the bill, so revenue reports no longer see them.
+type wasteReport struct {
+	From     string       `json:"from"`
+	To       string       `json:"to"`
+	Voids    wasteTotal   `json:"voids"`
+	Comps    wasteTotal   `json:"comps"`
+	Waste    wasteTotal   `json:"waste"`
+	Total    int64        `json:"total"`
+	ByDay    []wasteDay   `json:"by_day"`
+	ByItem   []wasteTotal `json:"by_item"`
+	ByReason []wasteTotal `json:"by_reason"`
+}
+
+// Waste reports what was voided, comped and thrown away between ?from= and
+// ?to= (inclusive dates, default today), per day and per reason.
+func (h *reportHandler) Waste(w http.ResponseWriter, r *http.Request) {
+	from, to, err := parseDateRange(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	rep := wasteReport{
+		From:  from.Format(dateLayout),
+		To:    to.AddDate(0, 0, -1).Format(dateLayout),
+		Voids: wasteTotal{Key: wasteKindVoid},
+		Comps: wasteTotal{Key: wasteKindComp},
+		Waste: wasteTotal{Key: wasteKindWaste},
+	}
+	events := h.waste.between(from, to)
+	for _, v := range h.voids.list(func(v itemVoid) bool {
+		return v.Status == voidApproved && !v.DecidedAt.Before(from) && v.DecidedAt.Before(to)
+	}) {
+		events = append(events, wasteEntry{Kind: wasteKindVoid, Item: v.Item, Quantity: v.Quantity, Cost: v.Amount, Reason: v.Reason, At: *v.DecidedAt})
+	}
+	byDay := map[string]*wasteDay{}
+	byItem, byReason := map[string]*wasteTotal{}, map[string]*wasteTotal{}
+	add := func(t *wasteTotal, e wasteEntry) {
+		t.Units += e.Quantity
+		t.Amount += e.Cost
+	}
+	addTo := func(m map[string]*wasteTotal, key string, e wasteEntry) {
+		if m[key] == nil {
+			m[key] = &wasteTotal{Key: key}
+		}
+		add(m[key], e)
+	}
+	for _, e := range events {
+		date := e.At.UTC().Format(dateLayout)
+		d := byDay[date]
+		if d == nil {
+			d = &wasteDay{Date: date}
+			byDay[date] = d
+		}
+		switch e.Kind {
+		case wasteKindVoid:
+			add(&rep.Voids, e)
+			d.Voids += e.Cost
+		case wasteKindComp:
+			add(&rep.Comps, e)
+			d.Comps += e.Cost
+		case wasteKindWaste:
+			add(&rep.Waste, e)
+			d.Waste += e.Cost
+		}
+		d.Total += e.Cost
+		rep.Total += e.Cost
+		addTo(byItem, strings.ToLower(e.Item), e)
+		addTo(byReason, e.Reason, e)
+	}
+	rep.ByDay = make([]wasteDay, 0, len(byDay))
+	for _, d := range byDay {
+		rep.ByDay = append(rep.ByDay, *d)
+	}
+	sort.Slice(rep.ByDay, func(i, j int) bool { return rep.ByDay[i].Date < rep.ByDay[j].Date })
+	rep.ByItem, rep.ByReason = sortedWaste(byItem), sortedWaste(byReason)
+	writeJSON(w, r, http.StatusOK, rep)
+}
+
+// sortedWaste lists totals largest amount first.
+func sortedWaste(m map[string]*wasteTotal) []wasteTotal {
+	out := make([]wasteTotal, 0, len(m))
+	for _, t := range m {
+		out = append(out, *t)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Amount != out[j].Amount {
+			return out[i].Amount > out[j].Amount
+		}
+		return out[i].Key < out[j].Key
+	})
+	return out
+}
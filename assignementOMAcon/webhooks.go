@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	webhookDeliveriesRe = regexp.MustCompile(`^/admin/webhooks/deliveries/?$`)
+	webhookDeliveryRe   = regexp.MustCompile(`^/admin/webhooks/deliveries/([0-9]+)$`)
+	webhookRedeliverRe  = regexp.MustCompile(`^/admin/webhooks/deliveries/([0-9]+)/redeliver$`)
+)
+
+const (
+	webhookPending   = "pending"
+	webhookDelivered = "delivered"
+	webhookFailed    = "failed"
+)
+
+// webhookRetryDelays are the waits before each automatic retry of a failed
+// delivery. Once they are used up the delivery is failed and only goes out
+// again when redelivered by hand.
+var webhookRetryDelays = []time.Duration{5 * time.Second, 30 * time.Second, 2 * time.Minute}
+
+// webhookAttempt is one try at sending a delivery. ResponseCode is zero when
+// no response came back.
+type webhookAttempt struct {
+	At           time.Time `json:"at"`
+	ResponseCode int       `json:"response_code,omitempty"`
+	Error        string    `json:"error,omitempty"`
+	Manual       bool      `json:"manual,omitempty"`
+}
+
+// webhookDelivery is a status update owed to a delivery platform, with every
+// attempt made to send it.
+type webhookDelivery struct {
+	ID         string           `json:"id"`
+	Platform   string           `json:"platform"`
+	OrderID    string           `json:"order_id"`
+	ExternalID string           `json:"external_id"`
+	Event      string           `json:"event"`
+	Status     string           `json:"status"`
+	Attempts   []webhookAttempt `json:"attempts"`
+	CreatedAt  time.Time        `json:"created_at"`
+}
+
+// webhookLog keeps every outgoing delivery.
+type webhookLog struct {
+	deliveries []webhookDelivery
+	*sync.RWMutex
+}
+
+func newWebhookLog() *webhookLog {
+	return &webhookLog{RWMutex: &sync.RWMutex{}}
+}
+
+func (l *webhookLog) add(d webhookDelivery) webhookDelivery {
+	l.Lock()
+	defer l.Unlock()
+	d.ID = strconv.Itoa(len(l.deliveries) + 1)
+	if d.CreatedAt.IsZero() {
+		d.CreatedAt = time.Now().UTC()
+	}
+	d.Status = webhookPending
+	d.Attempts = []webhookAttempt{}
+	l.deliveries = append(l.deliveries, d)
+	return d
+}
+
+func (l *webhookLog) get(id string) (webhookDelivery, bool) {
+	n, err := strconv.Atoi(id)
+	l.RLock()
+	defer l.RUnlock()
+	if err != nil || n < 1 || n > len(l.deliveries) {
+		return webhookDelivery{}, false
+	}
+	return l.deliveries[n-1], true
+}
+
+// record adds an attempt to a delivery and sets its status: delivered on
+// success, failed when final, and pending while retries remain.
+func (l *webhookLog) record(id string, a webhookAttempt, final bool) webhookDelivery {
+	n, _ := strconv.Atoi(id)
+	l.Lock()
+	defer l.Unlock()
+	d := &l.deliveries[n-1]
+	d.Attempts = append(append([]webhookAttempt(nil), d.Attempts...), a)
+	switch {
+	case a.Error == "":
+		d.Status = webhookDelivered
+	case final:
+		d.Status = webhookFailed
+	default:
+		d.Status = webhookPending
+	}
+	return *d
+}
+
+// claim marks a failed delivery pending again so only one redelivery of it
+// runs at a time.
+func (l *webhookLog) claim(id string) (webhookDelivery, bool) {
+	n, _ := strconv.Atoi(id)
+	l.Lock()
+	defer l.Unlock()
+	d := &l.deliveries[n-1]
+	if d.Status != webhookFailed {
+		return *d, false
+	}
+	d.Status = webhookPending
+	return *d, true
+}
+
+// list returns deliveries newest first, optionally only those with a status,
+// for a platform or for an order.
+func (l *webhookLog) list(status, platform, orderID string) []webhookDelivery {
+	l.RLock()
+	out := make([]webhookDelivery, 0)
+	for _, d := range l.deliveries {
+		if (status == "" || d.Status == status) && (platform == "" || d.Platform == platform) &&
+			(orderID == "" || d.OrderID == orderID) {
+			out = append(out, d)
+		}
+	}
+	l.RUnlock()
+	sort.SliceStable(out, func(i, j int) bool { return out[i].CreatedAt.After(out[j].CreatedAt) })
+	return out
+}
+
+// attemptWebhook sends a delivery once through its platform's adapter, and
+// reports whether anything was sent.
+func attemptWebhook(a deliveryAdapter, d webhookDelivery, manual bool) (webhookAttempt, bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	at := webhookAttempt{At: time.Now().UTC(), Manual: manual}
+	code, err := a.pushStatus(ctx, d.ExternalID, d.Event)
+	at.ResponseCode = code
+	if err != nil {
+		at.Error = err.Error()
+	}
+	return at, code != 0 || err != nil
+}
+
+// deliver sends a new delivery, retrying on failure with webhookRetryDelays.
+// Deliveries are logged from their first attempt; nothing is logged for
+// platforms that take no status updates.
+func (l *webhookLog) deliver(a deliveryAdapter, d webhookDelivery) {
+	at, sent := attemptWebhook(a, d, false)
+	if !sent {
+		return
+	}
+	d.CreatedAt = at.At
+	d = l.add(d)
+	for i := 0; ; i++ {
+		d = l.record(d.ID, at, i == len(webhookRetryDelays))
+		if d.Status != webhookPending {
+			if d.Status == webhookFailed {
+				log.Printf("delivery: pushing %s for %s/%s failed after %d attempts: %s",
+					d.Event, d.Platform, d.ExternalID, len(d.Attempts), at.Error)
+			}
+			return
+		}
+		time.Sleep(webhookRetryDelays[i])
+		at, _ = attemptWebhook(a, d, false)
+	}
+}
+
+type webhookHandler struct {
+	delivery *deliveryStore
+	sessions *sessionStore
+	audit    *auditLog
+}
+
+func (h *webhookHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("content-type", "application/json")
+	sess, ok := h.sessions.requireScope(w, r, "orders:manage")
+	if !ok {
+		return
+	}
+	switch {
+	case r.Method == http.MethodGet && webhookDeliveriesRe.MatchString(r.URL.Path):
+		q := r.URL.Query()
+		writeJSON(w, r, http.StatusOK, h.delivery.webhooks.list(q.Get("status"), q.Get("platform"), q.Get("order_id")))
+		return
+	case r.Method == http.MethodGet && webhookDeliveryRe.MatchString(r.URL.Path):
+		d, ok := h.delivery.webhooks.get(webhookDeliveryRe.FindStringSubmatch(r.URL.Path)[1])
+		if !ok {
+			notFound(w, r)
+			return
+		}
+		writeJSON(w, r, http.StatusOK, d)
+		return
+	case r.Method == http.MethodPost && webhookRedeliverRe.MatchString(r.URL.Path):
+		h.Redeliver(w, r, sess)
+		return
+	default:
+		notFound(w, r)
+		return
+	}
+}
+
+// Redeliver sends a failed delivery again, once, and returns it with the new
+// attempt.
+func (h *webhookHandler) Redeliver(w http.ResponseWriter, r *http.Request, sess session) {
+	id := webhookRedeliverRe.FindStringSubmatch(r.URL.Path)[1]
+	d, ok := h.delivery.webhooks.get(id)
+	if !ok {
+		notFound(w, r)
+		return
+	}
+	a, ok := h.delivery.adapter(d.Platform)
+	if !ok {
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte("platform " + d.Platform + " is no longer connected"))
+		return
+	}
+	if d, ok = h.delivery.webhooks.claim(id); !ok {
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte("only failed deliveries can be redelivered; this one is " + d.Status))
+		return
+	}
+	at, _ := attemptWebhook(a, d, true)
+	d = h.delivery.webhooks.record(id, at, true)
+	h.audit.record(auditEntry{Action: "webhook.redeliver", OrderID: d.OrderID, Ref: d.ID, StaffID: sess.StaffID})
+	writeJSON(w, r, http.StatusOK, d)
+}
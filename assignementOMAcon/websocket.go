@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// wsGUID is mixed into the handshake key, as RFC 6455 specifies.
+const wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+const (
+	wsText  = 0x1
+	wsClose = 0x8
+	wsPing  = 0x9
+	wsPong  = 0xA
+)
+
+// Close codes sent to clients.
+const (
+	wsCloseNormal    = 1000
+	wsCloseProtocol  = 1002
+	wsCloseTooBig    = 1009
+	wsCloseTryLater  = 1013
+	wsMaxClientFrame = 1 << 16
+)
+
+var errWSClosed = errors.New("websocket closed")
+
+// isWebSocketUpgrade reports whether r asks to switch to the WebSocket
+// protocol.
+func isWebSocketUpgrade(r *http.Request) bool {
+	return strings.EqualFold(r.Header.Get("Upgrade"), "websocket") &&
+		headerHasToken(r.Header.Get("Connection"), "upgrade")
+}
+
+func headerHasToken(v, token string) bool {
+	for _, t := range strings.Split(v, ",") {
+		if strings.EqualFold(strings.TrimSpace(t), token) {
+			return true
+		}
+	}
+	return false
+}
+
+// wsConn is the server end of a WebSocket. It only sends text messages;
+// messages from the client are read and discarded, apart from pings and
+// closes. Writes may come from several goroutines.
+type wsConn struct {
+	conn net.Conn
+	rw   *bufio.ReadWriter
+	*sync.Mutex
+}
+
+// upgradeWebSocket completes the opening handshake and takes over the
+// connection. On failure it has already answered the request.
+func upgradeWebSocket(w http.ResponseWriter, r *http.Request) (*wsConn, bool) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if r.Method != http.MethodGet || !isWebSocketUpgrade(r) || key == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("websocket upgrade required"))
+		return nil, false
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		w.WriteHeader(http.StatusUpgradeRequired)
+		w.Write([]byte("websocket version 13 required"))
+		return nil, false
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		internalServerError(w, r)
+		return nil, false
+	}
+	conn, rw, err := hj.Hijack()
+	if err != nil {
+		internalServerError(w, r)
+		return nil, false
+	}
+	sum := sha1.Sum([]byte(key + wsGUID))
+	rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n")
+	rw.WriteString("Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(sum[:]) + "\r\n\r\n")
+	if err := rw.Flush(); err != nil {
+		conn.Close()
+		return nil, false
+	}
+	return &wsConn{conn: conn, rw: rw, Mutex: &sync.Mutex{}}, true
+}
+
+func (c *wsConn) writeFrame(opcode byte, payload []byte) error {
+	c.Lock()
+	defer c.Unlock()
+	header := []byte{0x80 | opcode}
+	switch n := len(payload); {
+	case n < 126:
+		header = append(header, byte(n))
+	case n <= 0xFFFF:
+		header = append(header, 126, 0, 0)
+		binary.BigEndian.PutUint16(header[2:], uint16(n))
+	default:
+		header = append(header, 127, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(header[2:], uint64(n))
+	}
+	c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	c.rw.Write(header)
+	c.rw.Write(payload)
+	return c.rw.Flush()
+}
+
+func (c *wsConn) writeText(b []byte) error {
+	return c.writeFrame(wsText, b)
+}
+
+// close sends a close frame with code and drops the connection.
+func (c *wsConn) close(code int) {
+	payload := make([]byte, 2)
+	binary.BigEndian.PutUint16(payload, uint16(code))
+	c.writeFrame(wsClose, payload)
+	c.conn.Close()
+}
+
+// readLoop reads client frames until the client closes the connection or it
+// fails, answering pings along the way.
+func (c *wsConn) readLoop() error {
+	for {
+		opcode, payload, err := c.readFrame()
+		if err != nil {
+			return err
+		}
+		switch opcode {
+		case wsClose:
+			c.close(wsCloseNormal)
+			return errWSClosed
+		case wsPing:
+			if err := c.writeFrame(wsPong, payload); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (c *wsConn) readFrame() (byte, []byte, error) {
+	var head [2]byte
+	if _, err := io.ReadFull(c.rw, head[:]); err != nil {
+		return 0, nil, err
+	}
+	opcode, masked, n := head[0]&0x0F, head[1]&0x80 != 0, uint64(head[1]&0x7F)
+	switch n {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(c.rw, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		n = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(c.rw, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		n = binary.BigEndian.Uint64(ext[:])
+	}
+	if !masked {
+		c.close(wsCloseProtocol)
+		return 0, nil, errWSClosed
+	}
+	if n > wsMaxClientFrame {
+		c.close(wsCloseTooBig)
+		return 0, nil, errWSClosed
+	}
+	var mask [4]byte
+	if _, err := io.ReadFull(c.rw, mask[:]); err != nil {
+		return 0, nil, err
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(c.rw, payload); err != nil {
+		return 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return opcode, payload, nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"encoding/xml"
+	"io"
+	"strconv"
+)
+
+const xlsxMediaType = "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"
+
+// The parts of a workbook with a single sheet, apart from the sheet itself.
+var xlsxParts = []struct{ name, body string }{
+	{"[Content_Types].xml", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types"><Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/><Default Extension="xml" ContentType="application/xml"/><Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/><Override PartName="/xl/worksheets/sheet1.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/></Types>`},
+	{"_rels/.rels", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships"><Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/></Relationships>`},
+	{"xl/_rels/workbook.xml.rels", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships"><Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet1.xml"/></Relationships>`},
+}
+
+// xlsxWriter streams a one-sheet Excel workbook. Cells are written as they
+// come, with strings inline rather than in a shared table, so rows need not
+// be held in memory.
+type xlsxWriter struct {
+	zw  *zip.Writer
+	buf *bufio.Writer
+	row int
+}
+
+func newXLSXWriter(w io.Writer, sheet string) (*xlsxWriter, error) {
+	zw := zip.NewWriter(w)
+	for _, p := range xlsxParts {
+		f, err := zw.Create(p.name)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := io.WriteString(f, p.body); err != nil {
+			return nil, err
+		}
+	}
+	f, err := zw.Create("xl/workbook.xml")
+	if err != nil {
+		return nil, err
+	}
+	io.WriteString(f, `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships"><sheets><sheet name="`)
+	xml.EscapeText(f, []byte(sheet))
+	if _, err := io.WriteString(f, `" sheetId="1" r:id="rId1"/></sheets></workbook>`); err != nil {
+		return nil, err
+	}
+	f, err = zw.Create("xl/worksheets/sheet1.xml")
+	if err != nil {
+		return nil, err
+	}
+	x := &xlsxWriter{zw: zw, buf: bufio.NewWriter(f)}
+	x.buf.WriteString(`<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData>`)
+	return x, nil
+}
+
+// xlsxColumn is the letter name of the zero-based column i: A, B, ... AA.
+func xlsxColumn(i int) string {
+	name := ""
+	for i++; i > 0; i = (i - 1) / 26 {
+		name = string(rune('A'+(i-1)%26)) + name
+	}
+	return name
+}
+
+// writeRow adds a row. Integers and floats become numbers and strings text;
+// empty strings and other values leave the cell blank.
+func (x *xlsxWriter) writeRow(cells ...interface{}) error {
+	x.row++
+	n := strconv.Itoa(x.row)
+	x.buf.WriteString(`<row r="` + n + `">`)
+	for i, c := range cells {
+		ref := xlsxColumn(i) + n
+		var num string
+		switch v := c.(type) {
+		case int:
+			num = strconv.Itoa(v)
+		case int64:
+			num = strconv.FormatInt(v, 10)
+		case float64:
+			num = strconv.FormatFloat(v, 'f', -1, 64)
+		case string:
+			if v == "" {
+				continue
+			}
+			x.buf.WriteString(`<c r="` + ref + `" t="inlineStr"><is><t xml:space="preserve">`)
+			xml.EscapeText(x.buf, []byte(v))
+			x.buf.WriteString(`</t></is></c>`)
+			continue
+		default:
+			continue
+		}
+		x.buf.WriteString(`<c r="` + ref + `"><v>` + num + `</v></c>`)
+	}
+	_, err := x.buf.WriteString(`</row>`)
+	return err
+}
+
+// Close finishes the sheet and the workbook.
+func (x *xlsxWriter) Close() error {
+	x.buf.WriteString(`</sheetData></worksheet>`)
+	if err := x.buf.Flush(); err != nil {
+		return err
+	}
+	return x.zw.Close()
+}
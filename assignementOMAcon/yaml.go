@@ -0,0 +1,278 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// yamlLine is a line of a YAML document with its comment and indentation
+// removed. n is its line number, for errors.
+type yamlLine struct {
+	n      int
+	indent int
+	text   string
+}
+
+// yamlToJSON converts a YAML config file to JSON, so that it is decoded and
+// checked exactly as a JSON one is. It handles the subset of YAML config
+// files need: block mappings and sequences nested by indentation, flow
+// sequences of scalars such as [a, b], comments, and plain, single- and
+// double-quoted scalars. Anchors, tags, multi-line scalars and multiple
+// documents are not supported.
+func yamlToJSON(b []byte) ([]byte, error) {
+	var lines []yamlLine
+	for i, raw := range strings.Split(string(b), "\n") {
+		raw = strings.TrimRight(raw, " \r")
+		text := strings.TrimLeft(raw, " ")
+		if strings.HasPrefix(text, "\t") {
+			return nil, fmt.Errorf("line %d: indent with spaces, not tabs", i+1)
+		}
+		text = strings.TrimRight(stripYAMLComment(text), " ")
+		if text == "" || (i == 0 || len(lines) == 0) && text == "---" {
+			continue
+		}
+		lines = append(lines, yamlLine{n: i + 1, indent: len(raw) - len(strings.TrimLeft(raw, " ")), text: text})
+	}
+	if len(lines) == 0 {
+		return []byte("{}"), nil
+	}
+	p := &yamlParser{lines: lines}
+	v, err := p.block(lines[0].indent)
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.lines) {
+		return nil, fmt.Errorf("line %d: unexpected indentation", p.lines[p.pos].n)
+	}
+	return json.Marshal(v)
+}
+
+// stripYAMLComment drops a # comment, which starts a line or follows a
+// space, outside quotes.
+func stripYAMLComment(s string) string {
+	var quote byte
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#' && (i == 0 || s[i-1] == ' '):
+			return s[:i]
+		}
+	}
+	return s
+}
+
+type yamlParser struct {
+	lines []yamlLine
+	pos   int
+}
+
+// block parses the mapping or sequence whose lines are indented by indent.
+func (p *yamlParser) block(indent int) (interface{}, error) {
+	if l := p.lines[p.pos]; l.text == "-" || strings.HasPrefix(l.text, "- ") {
+		return p.sequence(indent)
+	}
+	return p.mapping(indent)
+}
+
+func (p *yamlParser) sequence(indent int) (interface{}, error) {
+	out := []interface{}{}
+	for p.pos < len(p.lines) {
+		l := p.lines[p.pos]
+		if l.indent < indent {
+			break
+		}
+		if l.indent > indent {
+			return nil, fmt.Errorf("line %d: unexpected indentation", l.n)
+		}
+		if l.text != "-" && !strings.HasPrefix(l.text, "- ") {
+			return nil, fmt.Errorf("line %d: expected a sequence item", l.n)
+		}
+		rest := strings.TrimLeft(strings.TrimPrefix(l.text, "-"), " ")
+		if rest == "" {
+			p.pos++
+			v, err := p.nested(indent, l.n)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, v)
+			continue
+		}
+		if _, _, ok := splitYAMLKey(rest); ok {
+			// "- key: value" starts a mapping indented to its first key.
+			p.lines[p.pos] = yamlLine{n: l.n, indent: l.indent + len(l.text) - len(rest), text: rest}
+			v, err := p.mapping(p.lines[p.pos].indent)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, v)
+			continue
+		}
+		v, err := yamlScalar(rest, l.n)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, v)
+		p.pos++
+	}
+	return out, nil
+}
+
+func (p *yamlParser) mapping(indent int) (interface{}, error) {
+	out := map[string]interface{}{}
+	for p.pos < len(p.lines) {
+		l := p.lines[p.pos]
+		if l.indent < indent {
+			break
+		}
+		if l.indent > indent {
+			return nil, fmt.Errorf("line %d: unexpected indentation", l.n)
+		}
+		key, value, ok := splitYAMLKey(l.text)
+		if !ok {
+			return nil, fmt.Errorf("line %d: expected key: value", l.n)
+		}
+		if _, dup := out[key]; dup {
+			return nil, fmt.Errorf("line %d: duplicate key %q", l.n, key)
+		}
+		p.pos++
+		if value != "" {
+			v, err := yamlScalar(value, l.n)
+			if err != nil {
+				return nil, err
+			}
+			out[key] = v
+			continue
+		}
+		// A sequence may be indented as far as its key.
+		if p.pos < len(p.lines) && p.lines[p.pos].indent == indent && strings.HasPrefix(p.lines[p.pos].text+" ", "- ") {
+			v, err := p.sequence(indent)
+			if err != nil {
+				return nil, err
+			}
+			out[key] = v
+			continue
+		}
+		v, err := p.nested(indent, l.n)
+		if err != nil {
+			return nil, err
+		}
+		out[key] = v
+	}
+	return out, nil
+}
+
+// nested parses the block indented further than indent that follows line
+// n, or returns null when there is none.
+func (p *yamlParser) nested(indent, n int) (interface{}, error) {
+	if p.pos >= len(p.lines) || p.lines[p.pos].indent <= indent {
+		return nil, nil
+	}
+	return p.block(p.lines[p.pos].indent)
+}
+
+// splitYAMLKey splits "key: value" or "key:". Keys may be quoted.
+func splitYAMLKey(s string) (string, string, bool) {
+	if strings.HasPrefix(s, `"`) || strings.HasPrefix(s, "'") {
+		end := strings.IndexByte(s[1:], s[0])
+		if end < 0 {
+			return "", "", false
+		}
+		key, rest := s[1:end+1], s[end+2:]
+		if rest != ":" && !strings.HasPrefix(rest, ": ") {
+			return "", "", false
+		}
+		return key, strings.TrimSpace(rest[1:]), true
+	}
+	i := strings.Index(s+" ", ": ")
+	if i <= 0 {
+		return "", "", false
+	}
+	return s[:i], strings.TrimSpace(s[i+1:]), true
+}
+
+// yamlScalar reads a value: a quoted string, a flow sequence, null, a
+// boolean, a number, or otherwise a plain string.
+func yamlScalar(s string, n int) (interface{}, error) {
+	switch {
+	case strings.HasPrefix(s, `"`):
+		v, err := strconv.Unquote(s)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: bad double-quoted string %s", n, s)
+		}
+		return v, nil
+	case strings.HasPrefix(s, "'"):
+		if len(s) < 2 || !strings.HasSuffix(s, "'") {
+			return nil, fmt.Errorf("line %d: bad single-quoted string %s", n, s)
+		}
+		return strings.ReplaceAll(s[1:len(s)-1], "''", "'"), nil
+	case strings.HasPrefix(s, "["):
+		if !strings.HasSuffix(s, "]") {
+			return nil, fmt.Errorf("line %d: flow sequences must be on one line", n)
+		}
+		out := []interface{}{}
+		for _, item := range splitYAMLFlow(s[1 : len(s)-1]) {
+			if item = strings.TrimSpace(item); item == "" {
+				continue
+			}
+			v, err := yamlScalar(item, n)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, v)
+		}
+		return out, nil
+	case s == "{}":
+		return map[string]interface{}{}, nil
+	case strings.HasPrefix(s, "{"), strings.HasPrefix(s, "|"), strings.HasPrefix(s, ">"),
+		strings.HasPrefix(s, "&"), strings.HasPrefix(s, "*"), strings.HasPrefix(s, "!"):
+		return nil, fmt.Errorf("line %d: %s is not supported in config files", n, s)
+	}
+	switch s {
+	case "~", "null", "Null", "NULL":
+		return nil, nil
+	case "true", "True", "TRUE":
+		return true, nil
+	case "false", "False", "FALSE":
+		return false, nil
+	}
+	if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return i, nil
+	}
+	if f, err := strconv.ParseFloat(s, 64); err == nil && strings.Trim(s, "0123456789.eE+-") == "" {
+		return f, nil
+	}
+	return s, nil
+}
+
+// splitYAMLFlow splits the items of a flow sequence at commas outside
+// quotes.
+func splitYAMLFlow(s string) []string {
+	var items []string
+	var quote byte
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == ',':
+			items = append(items, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(items, s[start:])
+}